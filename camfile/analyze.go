@@ -0,0 +1,211 @@
+package camfile
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+How much a set of roots gains from deduplication.
+
+Logical bytes are what reading every root in full would return, with
+shared data counted each time it is read; physical bytes are what the
+distinct blocks take in the store.  A block's reference count is the
+number of times it is named, once per root given and once per entry in
+each distinct parent block, so a block a parent lists twice counts
+twice; it measures sharing, not how many parents GC would find.
+Padding is the fill after the payload that legacy writers stored in
+every block; blocks written now are cut to their payload.
+*/
+type Analysis struct {
+	Roots int `json:"roots"`
+	LogicalBytes int64 `json:"logical_bytes"`
+	PhysicalBytes int64 `json:"physical_bytes"`
+	Blocks int `json:"blocks"`
+	DataBlocks int `json:"data_blocks"`
+	IndirectBlocks int `json:"indirect_blocks"`
+	HeaderBytes int64 `json:"header_bytes"`
+	PaddingBytes int64 `json:"padding_bytes"`
+	// number of blocks with each reference count
+	RefCounts map[int]int `json:"ref_counts"`
+	// the most referenced blocks, most first
+	Top []BlockShare `json:"top"`
+}
+
+type BlockShare struct {
+	Id string `json:"id"`
+	Type string `json:"type"`
+	Refs int `json:"refs"`
+	Stored int `json:"stored"`
+}
+
+/*
+A distinct block met on the walk.
+*/
+type anode struct {
+	tag string
+	cnt, stored int
+	children []string
+	logical int64
+	sized bool
+}
+
+/*
+Logical over physical bytes; 1 with no sharing.
+*/
+func (an *Analysis) DedupRatio() (ratio float64) {
+
+	if an.PhysicalBytes == 0 {
+		return 0
+	}
+
+	return float64(an.LogicalBytes) / float64(an.PhysicalBytes)
+}
+
+/*
+The share of physical bytes that is padding.
+*/
+func (an *Analysis) PaddingFraction() (frac float64) {
+
+	if an.PhysicalBytes == 0 {
+		return 0
+	}
+
+	return float64(an.PaddingBytes) / float64(an.PhysicalBytes)
+}
+
+/*
+Walk roots, ids or capabilities of files or trees, and report on the
+blocks below them, keeping the top most referenced.  With no roots, the
+pinned roots are used.  No keys are needed; only the clear headers and
+ids are read.
+*/
+func (cs *Server) Analyze(roots []string, top int) (an *Analysis, err error) {
+	return cs.AnalyzeContext(context.Background(), roots, top)
+}
+
+func (cs *Server) AnalyzeContext(ctx context.Context, roots []string, top int) (an *Analysis, err error) {
+	var (
+		pins map[string]string
+		nodes map[string]*anode
+		refs map[string]int
+	)
+
+	if len(roots) == 0 {
+		if pins, err = cs.PinsContext(ctx); err != nil {
+			return
+		}
+		for _, id := range pins {
+			roots = append(roots, id)
+		}
+	}
+
+	an = &Analysis{ Roots: len(roots), RefCounts: make(map[int]int) }
+	nodes = make(map[string]*anode)
+	refs = make(map[string]int)
+	for _, root := range roots {
+		root, _, _ = strings.Cut(root, ":")
+		if !isBlockId(root) {
+			return nil, fmt.Errorf("not a block id: %s", root)
+		}
+		refs[root]++
+		if err = cs.analyzeBlock(ctx, root, nodes, refs); err != nil {
+			return nil, err
+		}
+	}
+	for _, root := range roots {
+		root, _, _ = strings.Cut(root, ":")
+		an.LogicalBytes += logicalBytes(nodes, root)
+	}
+
+	for id, node := range nodes {
+		an.Blocks++
+		an.PhysicalBytes += int64(node.stored)
+		an.HeaderBytes += cam_header_size
+		switch node.tag {
+		case "DATA":
+			an.DataBlocks++
+		case "INDB":
+			an.IndirectBlocks++
+		}
+		if node.cnt >= 0 {
+			an.PaddingBytes += int64(node.stored - cam_header_size - node.cnt)
+		}
+		an.RefCounts[refs[id]]++
+		an.Top = append(an.Top, BlockShare{ Id: id, Type: node.tag, Refs: refs[id], Stored: node.stored })
+	}
+
+	sort.Slice(an.Top, func(ii, jj int) bool {
+		if an.Top[ii].Refs != an.Top[jj].Refs {
+			return an.Top[ii].Refs > an.Top[jj].Refs
+		}
+		return an.Top[ii].Id < an.Top[jj].Id
+	})
+	if top < len(an.Top) {
+		an.Top = an.Top[:max(top, 0)]
+	}
+
+	return
+}
+
+func (cs *Server) analyzeBlock(ctx context.Context, id string, nodes map[string]*anode, refs map[string]int) (err error) {
+	var (
+		block []byte
+		node *anode
+		hd header
+	)
+
+	if _, ok := nodes[id]; ok {
+		return
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if block, err = cs.getBlock(ctx, id); err != nil {
+		return
+	}
+
+	if hd, err = decodeHeader(block); err != nil {
+		return fmt.Errorf("%s: %s", id, err.Error())
+	}
+	node = &anode{ tag: hd.tag, cnt: hd.cnt, stored: len(block) }
+	// padding is only seen in the clear, and compressed blocks have none
+	if hd.crypt || hd.codec != CodecNone {
+		node.cnt = -1
+	}
+	if node.children, err = blockChildren(block); err != nil {
+		return fmt.Errorf("%s: %s", id, err.Error())
+	}
+	if node.tag == "DATA" {
+		node.logical, node.sized = int64(hd.cnt), true
+	}
+	nodes[id] = node
+
+	for _, child := range node.children {
+		refs[child]++
+		if err = cs.analyzeBlock(ctx, child, nodes, refs); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+/*
+Content bytes below id, counting shared subtrees each time.
+*/
+func logicalBytes(nodes map[string]*anode, id string) (size int64) {
+	var node *anode
+
+	if node = nodes[id]; node.sized {
+		return node.logical
+	}
+	for _, child := range node.children {
+		node.logical += logicalBytes(nodes, child)
+	}
+	node.sized = true
+
+	return node.logical
+}
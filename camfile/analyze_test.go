@@ -0,0 +1,111 @@
+package camfile
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	t.Run("dedup", analyzeDedup)
+	t.Run("padding", analyzePadding)
+	t.Run("pins", analyzePins)
+}
+
+func analyzeDedup(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		an *Analysis
+	)
+
+	cs = memServer(t)
+
+	// every full DATA block the same
+	zeros := diffWrite(t, cs, make([]byte, 100*(cam_block_size-cam_header_size)))
+	other, _ := tierWrite(t, cs, 42, 5000)
+	capa := cryptWrite(t, cs, cryptSecret, cryptContent())
+
+	if an, err = cs.Analyze([]string{ zeros, other, capa, other }, 3); err != nil {
+		t.Fatal("analyze failed, ", err.Error())
+	}
+	if an.Roots != 4 || an.Blocks != tierCount(t, cs.store) {
+		t.Fatal("wrong block count", an.Roots, an.Blocks)
+	}
+	want := int64(100*(cam_block_size-cam_header_size) + 2*5000 + len(cryptContent()))
+	if an.LogicalBytes != want || an.DedupRatio() <= 1 {
+		t.Fatal("wrong logical bytes", an.LogicalBytes, want)
+	}
+	if len(an.Top) != 3 || an.Top[0].Type != "DATA" || an.Top[0].Refs < 20 {
+		t.Fatal("zero block not the most shared", an.Top)
+	}
+	if an.RefCounts[2] == 0 || an.PaddingBytes != 0 {
+		t.Fatal("wrong ref counts or padding", an.RefCounts, an.PaddingBytes)
+	}
+}
+
+/*
+Legacy blocks stored their fill.
+*/
+func analyzePadding(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		an *Analysis
+		ids []string
+		id string
+	)
+
+	cs = memServer(t)
+
+	for ii := 0; ii < 3; ii++ {
+		chunk := strings.Repeat(fmt.Sprintf("%d", ii), 100)
+		head := []byte(fmt.Sprintf("%04xDATA%04x--------------------", 0, len(chunk)))
+		data := []byte(chunk + strings.Repeat("-", cam_block_size-cam_header_size-len(chunk)))
+		if id, err = cs.putBlock(head, data); err != nil {
+			t.Fatal("failed to put block, ", err.Error())
+		}
+		ids = append(ids, id)
+	}
+	head := []byte(fmt.Sprintf("%04xINDB%04x--------------------", 0, len(ids)*32))
+	if id, err = cs.putBlock(head, []byte(strings.Join(ids, ""))); err != nil {
+		t.Fatal("failed to put block, ", err.Error())
+	}
+
+	if an, err = cs.Analyze([]string{ id }, 10); err != nil {
+		t.Fatal("analyze failed, ", err.Error())
+	}
+	if an.LogicalBytes != 300 || an.PaddingBytes != 3*(cam_block_size-cam_header_size-100) {
+		t.Fatal("wrong padding", an.LogicalBytes, an.PaddingBytes)
+	}
+	if an.PaddingFraction() < 0.8 {
+		t.Fatal("padding fraction too low", an.PaddingFraction())
+	}
+}
+
+func analyzePins(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		an *Analysis
+		tree string
+	)
+
+	cs = memServer(t)
+	if tree, err = cs.PutTree(treeSetup(t)); err != nil {
+		t.Fatal("failed to put tree, ", err.Error())
+	}
+	if err = cs.Pin("tree", tree); err != nil {
+		t.Fatal("failed to pin, ", err.Error())
+	}
+
+	if an, err = cs.Analyze(nil, 0); err != nil {
+		t.Fatal("analyze failed, ", err.Error())
+	}
+	if an.Roots != 1 || an.Blocks != tierCount(t, cs.store) || len(an.Top) != 0 {
+		t.Fatal("pinned tree not analyzed", an)
+	}
+	if an.LogicalBytes == 0 || len(an.RefCounts) == 0 {
+		t.Fatal("no content in pinned tree", an)
+	}
+}
@@ -0,0 +1,378 @@
+package camfile
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Tar and zip archives in and out of directory trees.
+
+An import reads members straight into blocks, never to disk, and builds
+the same FILE and DIRB blocks PutTree would for the same files, so
+identical members, in one archive or across many, are stored once.  The
+members go in a directory of the given name; a "./" member, as tar -C dir
+. writes, gives it its mode and time, and otherwise it, like any
+directory the archive implies without listing, is 0755 with the newest
+time below it.  A member named twice is the later one, as tar extracts.
+Only regular files and directories are supported.
+
+An export writes the entries of a directory under their paths below it,
+or a file as a single member.  Tar exports start with "./" and keep
+times to the nanosecond, so importing one under the directory's name
+gives back the same id; zip keeps times to the second.
+*/
+
+type archiveNode struct {
+	mode fs.FileMode
+	mtime time.Time
+	// a member named it, rather than a path below it
+	listed bool
+	root string
+	size int64
+	kids map[string]*archiveNode
+}
+
+/*
+Import the tar stream r as a directory called name.
+Returns the id of its DIRB block.
+*/
+func (cs *Server) ImportTar(r io.Reader, name string) (id string, err error) {
+	return cs.ImportTarContext(context.Background(), r, name)
+}
+
+/*
+As ImportTar.  If ctx is done first no id is returned, whatever was stored.
+*/
+func (cs *Server) ImportTarContext(ctx context.Context, r io.Reader, name string) (id string, err error) {
+	var (
+		held []string
+		top *archiveNode
+		tr *tar.Reader
+		hdr *tar.Header
+	)
+
+	if cs.state != state_open {
+		return "", fmt.Errorf("not opened: server %s", stateString(cs.state))
+	}
+	defer func() { cs.release(held) }()
+
+	top = newArchiveDir()
+	tr = tar.NewReader(r)
+	for {
+		if hdr, err = tr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		if err = cs.importMember(ctx, top, hdr.Name, hdr.FileInfo().Mode(), hdr.ModTime, tr, &held); err != nil {
+			return
+		}
+	}
+
+	id, _, err = cs.putArchiveNode(ctx, top, name, &held)
+
+	return
+}
+
+/*
+Import the zip archive r, of size bytes, as a directory called name.
+A zip keeps its index at the end, so it must be read at random rather
+than streamed.  Returns the id of its DIRB block.
+*/
+func (cs *Server) ImportZip(r io.ReaderAt, size int64, name string) (id string, err error) {
+	return cs.ImportZipContext(context.Background(), r, size, name)
+}
+
+/*
+As ImportZip.  If ctx is done first no id is returned, whatever was stored.
+*/
+func (cs *Server) ImportZipContext(ctx context.Context, r io.ReaderAt, size int64, name string) (id string, err error) {
+	var (
+		held []string
+		top *archiveNode
+		zr *zip.Reader
+		rc io.ReadCloser
+	)
+
+	if cs.state != state_open {
+		return "", fmt.Errorf("not opened: server %s", stateString(cs.state))
+	}
+	defer func() { cs.release(held) }()
+
+	if zr, err = zip.NewReader(r, size); err != nil {
+		return
+	}
+
+	top = newArchiveDir()
+	for _, zf := range zr.File {
+		if rc, err = zf.Open(); err != nil {
+			return
+		}
+		err = cs.importMember(ctx, top, zf.Name, zf.Mode(), zf.Modified, rc, &held)
+		rc.Close()
+		if err != nil {
+			return
+		}
+	}
+
+	id, _, err = cs.putArchiveNode(ctx, top, name, &held)
+
+	return
+}
+
+func newArchiveDir() (nd *archiveNode) {
+	return &archiveNode{ mode: fs.ModeDir | 0755, kids: make(map[string]*archiveNode) }
+}
+
+/*
+Place one member in the tree below top, storing its content if it is a
+file.
+*/
+func (cs *Server) importMember(ctx context.Context, top *archiveNode, name string, mode fs.FileMode, mtime time.Time, src io.Reader, held *[]string) (err error) {
+	var (
+		elems []string
+		dir, nd *archiveNode
+		ok bool
+	)
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if !mode.IsDir() && !mode.IsRegular() {
+		return fmt.Errorf("unsupported member type: %s, %s", name, mode.Type())
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == "" || elem == "." {
+			continue
+		}
+		if !isEntryName(elem) {
+			return fmt.Errorf("bad member name: %q", name)
+		}
+		elems = append(elems, elem)
+	}
+	if len(elems) == 0 && !mode.IsDir() {
+		return fmt.Errorf("bad member name: %q", name)
+	}
+
+	dir = top
+	for ii, elem := range elems {
+		if nd, ok = dir.kids[elem]; ok && nd.kids == nil && ii < len(elems)-1 {
+			return fmt.Errorf("member below a file: %s", name)
+		}
+		if !ok || (mode.IsDir() && nd.kids == nil) || (!mode.IsDir() && ii == len(elems)-1) {
+			nd = newArchiveDir()
+			dir.kids[elem] = nd
+		}
+		dir = nd
+	}
+
+	dir.mode, dir.mtime, dir.listed = mode, mtime, true
+	if mode.IsDir() {
+		return
+	}
+	dir.kids = nil
+	dir.root, dir.size, err = cs.putReader(ctx, src, held)
+
+	return
+}
+
+/*
+Store nd and everything below it as FILE and DIRB blocks, as putTree
+does.  Returns the id and the time it was given.
+*/
+func (cs *Server) putArchiveNode(ctx context.Context, nd *archiveNode, name string, held *[]string) (id string, mtime time.Time, err error) {
+	var (
+		names []string
+		refs []camref
+		root, sub string
+		subtime time.Time
+		ref camref
+	)
+
+	if nd.kids == nil {
+		id, err = cs.putEntry(ctx, "FILE", nd.root, nd.size, nd.mode, nd.mtime, name, held)
+		return id, nd.mtime, err
+	}
+
+	for elem := range nd.kids {
+		names = append(names, elem)
+	}
+	sort.Strings(names)
+
+	mtime = time.Unix(0, 0)
+	for _, elem := range names {
+		if sub, subtime, err = cs.putArchiveNode(ctx, nd.kids[elem], elem, held); err != nil {
+			return
+		}
+		refs = append(refs, camref{ id: sub, size: 1 })
+		if subtime.After(mtime) {
+			mtime = subtime
+		}
+	}
+	if nd.listed {
+		mtime = nd.mtime
+	}
+	if len(refs) > 0 {
+		if ref, err = cs.putIndirect(ctx, refs, nil, CodecNone, held); err != nil {
+			return
+		}
+		root = ref.id
+	}
+	id, err = cs.putEntry(ctx, "DIRB", root, int64(len(refs)), nd.mode, mtime, name, held)
+
+	return
+}
+
+/*
+Write the tree id to w as a tar stream.
+*/
+func (cs *Server) ExportTar(id string, w io.Writer) (err error) {
+	return cs.ExportTarContext(context.Background(), id, w)
+}
+
+/*
+As ExportTar.  If ctx is done first the stream stops, unfinished.
+*/
+func (cs *Server) ExportTarContext(ctx context.Context, id string, w io.Writer) (err error) {
+	var (
+		ent *Entry
+		tw *tar.Writer
+	)
+
+	if ent, err = cs.LookupContext(ctx, id); err != nil {
+		return
+	}
+
+	tw = tar.NewWriter(w)
+	name := ent.Name
+	if ent.IsDir() {
+		name = "."
+	}
+	if err = cs.exportMember(ctx, ent, name, func(ent *Entry, name string) (dst io.Writer, err error) {
+		var hdr *tar.Header
+
+		if hdr, err = tar.FileInfoHeader(fsInfo{ ent: ent, name: ent.Name }, ""); err != nil {
+			return
+		}
+		hdr.Name, hdr.Format = name, tar.FormatPAX
+		if ent.IsDir() {
+			hdr.Name += "/"
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return
+		}
+
+		return tw, nil
+	}); err != nil {
+		return
+	}
+
+	return tw.Close()
+}
+
+/*
+Write the tree id to w as a zip archive, its files deflated.
+*/
+func (cs *Server) ExportZip(id string, w io.Writer) (err error) {
+	return cs.ExportZipContext(context.Background(), id, w)
+}
+
+/*
+As ExportZip.  If ctx is done first the archive stops, unfinished.
+*/
+func (cs *Server) ExportZipContext(ctx context.Context, id string, w io.Writer) (err error) {
+	var (
+		ent *Entry
+		zw *zip.Writer
+	)
+
+	if ent, err = cs.LookupContext(ctx, id); err != nil {
+		return
+	}
+
+	zw = zip.NewWriter(w)
+	name := ent.Name
+	if ent.IsDir() {
+		name = "."
+	}
+	if err = cs.exportMember(ctx, ent, name, func(ent *Entry, name string) (dst io.Writer, err error) {
+		var hdr *zip.FileHeader
+
+		// zip has no member for the top directory
+		if name == "." {
+			return io.Discard, nil
+		}
+		if hdr, err = zip.FileInfoHeader(fsInfo{ ent: ent, name: ent.Name }); err != nil {
+			return
+		}
+		hdr.Name = name
+		if ent.IsDir() {
+			hdr.Name += "/"
+		} else {
+			hdr.Method = zip.Deflate
+		}
+
+		return zw.CreateHeader(hdr)
+	}); err != nil {
+		return
+	}
+
+	return zw.Close()
+}
+
+/*
+Call create for ent and then, below it, for each of its entries in name
+order, copying file content to what create returns.
+*/
+func (cs *Server) exportMember(ctx context.Context, ent *Entry, name string, create func(ent *Entry, name string) (io.Writer, error)) (err error) {
+	var (
+		dst io.Writer
+		ents []*Entry
+		cr *Reader
+	)
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if dst, err = create(ent, name); err != nil {
+		return
+	}
+
+	if !ent.IsDir() {
+		if ent.Root == "" {
+			return
+		}
+		if cr, err = cs.OpenContext(ctx, ent.Root); err != nil {
+			return
+		}
+		defer cr.Close()
+		_, err = cr.Copy(dst)
+		return
+	}
+
+	if ents, err = cs.ReadDirContext(ctx, ent.Id); err != nil {
+		return
+	}
+	for _, sub := range ents {
+		if !isEntryName(sub.Name) {
+			return fmt.Errorf("bad name in %s: %q", ent.Id, sub.Name)
+		}
+		if err = cs.exportMember(ctx, sub, path.Join(name, sub.Name), create); err != nil {
+			return
+		}
+	}
+
+	return
+}
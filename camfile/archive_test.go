@@ -0,0 +1,266 @@
+package camfile
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchive(t *testing.T) {
+	t.Run("tar", archiveTar)
+	t.Run("zip", archiveZip)
+	t.Run("dedup", archiveDedup)
+	t.Run("members", archiveMembers)
+	t.Run("refuse", archiveRefuse)
+}
+
+type archiveMember struct {
+	name string
+	mode fs.FileMode
+	body string
+	link string
+}
+
+var archiveTime = time.Date(2021, 3, 4, 5, 6, 7, 890, time.UTC)
+
+func archiveWrite(t *testing.T, members []archiveMember) (buff *bytes.Buffer) {
+	buff = new(bytes.Buffer)
+	tw := tar.NewWriter(buff)
+
+	for _, mm := range members {
+		hdr := &tar.Header{ Name: mm.name, Mode: int64(mm.mode.Perm()), Size: int64(len(mm.body)), ModTime: archiveTime, Typeflag: tar.TypeReg, Format: tar.FormatPAX }
+		switch {
+		case mm.mode.IsDir():
+			hdr.Typeflag = tar.TypeDir
+		case mm.link != "":
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, mm.link
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal("failed to write header, ", err.Error())
+		}
+		if _, err := tw.Write([]byte(mm.body)); err != nil {
+			t.Fatal("failed to write member, ", err.Error())
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal("failed to close tar, ", err.Error())
+	}
+
+	return
+}
+
+/*
+A tree through a tar and back has the id it had.
+*/
+func archiveTar(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		src, dst, id, got string
+		buff bytes.Buffer
+	)
+
+	src = treeSetup(t)
+	cs = memServer(t)
+
+	if id, err = cs.PutTree(src); err != nil {
+		t.Fatal("failed to put tree, ", err.Error())
+	}
+	if err = cs.ExportTar(id, &buff); err != nil {
+		t.Fatal("failed to export, ", err.Error())
+	}
+	if got, err = cs.ImportTar(&buff, filepath.Base(src)); err != nil {
+		t.Fatal("failed to import, ", err.Error())
+	}
+	if got != id {
+		t.Fatal("tar round trip changed the tree", id, got)
+	}
+
+	// and into a store that never saw it
+	other := memServer(t)
+	buff.Reset()
+	cs.ExportTar(id, &buff)
+	if got, err = other.ImportTar(&buff, filepath.Base(src)); err != nil || got != id {
+		t.Fatal("tar import elsewhere differs", id, got, err)
+	}
+	dst = filepath.Join(t.TempDir(), "restored")
+	if err = other.GetTree(got, dst); err != nil {
+		t.Fatal("failed to get tree, ", err.Error())
+	}
+	treeCompare(t, src, dst)
+}
+
+/*
+Zip keeps content, modes and times to the second.
+*/
+func archiveZip(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		src, dst, id, got string
+		buff bytes.Buffer
+	)
+
+	src = treeSetup(t)
+	cs = memServer(t)
+
+	if id, err = cs.PutTree(src); err != nil {
+		t.Fatal("failed to put tree, ", err.Error())
+	}
+	if err = cs.ExportZip(id, &buff); err != nil {
+		t.Fatal("failed to export, ", err.Error())
+	}
+	if got, err = cs.ImportZip(bytes.NewReader(buff.Bytes()), int64(buff.Len()), "zipped"); err != nil {
+		t.Fatal("failed to import, ", err.Error())
+	}
+
+	dst = filepath.Join(t.TempDir(), "restored")
+	if err = cs.GetTree(got, dst); err != nil {
+		t.Fatal("failed to get tree, ", err.Error())
+	}
+	err = filepath.Walk(src, func(path string, wi os.FileInfo, err error) error {
+		if err != nil || wi.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		gi, err := os.Stat(filepath.Join(dst, rel))
+		if err != nil {
+			return err
+		}
+		wd, _ := os.ReadFile(path)
+		gd, _ := os.ReadFile(filepath.Join(dst, rel))
+		if gi.Mode() != wi.Mode() || !gi.ModTime().Equal(wi.ModTime().Truncate(time.Second)) || !bytes.Equal(wd, gd) {
+			t.Error(rel, "differs", gi.Mode(), wi.Mode(), gi.ModTime(), wi.ModTime())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("trees differ, ", err.Error())
+	}
+}
+
+/*
+Identical members share their blocks, so a second copy adds only its
+FILE block.
+*/
+func archiveDedup(t *testing.T) {
+	var (
+		err error
+		one, two int
+		ents []*Entry
+		id string
+	)
+
+	content := make([]byte, 20000)
+	rand.New(rand.NewSource(49)).Read(content)
+	count := func(members []archiveMember) (blocks int) {
+		store := NewMemStore()
+		cs := NewServerStore(store)
+		defer cs.Close()
+		if id, err = cs.ImportTar(archiveWrite(t, members), "dedup"); err != nil {
+			t.Fatal("failed to import, ", err.Error())
+		}
+		if ents, err = cs.ReadDir(id); err != nil {
+			t.Fatal("failed to read dir, ", err.Error())
+		}
+		store.Walk(context.Background(), func(string, time.Time) error {
+			blocks++
+			return nil
+		})
+		return
+	}
+
+	one = count([]archiveMember{ { "a.dat", 0644, string(content), "" } })
+	two = count([]archiveMember{ { "a.dat", 0644, string(content), "" }, { "b.dat", 0644, string(content), "" } })
+	if len(ents) != 2 || ents[0].Root != ents[1].Root {
+		t.Fatal("copies do not share a root", ents)
+	}
+	// one FILE block, and an indirect block for the two entries
+	if two != one+2 {
+		t.Fatal("second copy took", two-one, "blocks")
+	}
+}
+
+/*
+Directories the archive implies exist, and a later member replaces an
+earlier one of the same name.
+*/
+func archiveMembers(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		id string
+		ents []*Entry
+		top *Entry
+		buff bytes.Buffer
+	)
+
+	cs = memServer(t)
+
+	members := []archiveMember{
+		{ "./a/b/c.txt", 0600, "first", "" },
+		{ "a/b/c.txt", 0640, "second", "" },
+		{ "/d/", fs.ModeDir | 0700, "", "" },
+		{ "d/e", 0644, "", "" },
+	}
+	if id, err = cs.ImportTar(archiveWrite(t, members), "top"); err != nil {
+		t.Fatal("failed to import, ", err.Error())
+	}
+	if top, err = cs.Lookup(id); err != nil || top.Name != "top" || top.Mode != fs.ModeDir|0755 || !top.ModTime.Equal(archiveTime) {
+		t.Fatal("unexpected top", top, err)
+	}
+	if ents, err = cs.ReadDir(id); err != nil || len(ents) != 2 || ents[0].Name != "a" || ents[1].Mode != fs.ModeDir|0700 {
+		t.Fatal("unexpected entries", ents, err)
+	}
+	if ents, err = cs.ReadDir(ents[0].Id); err != nil || len(ents) != 1 || ents[0].Name != "b" {
+		t.Fatal("unexpected implied directory", ents, err)
+	}
+	if ents, err = cs.ReadDir(ents[0].Id); err != nil || len(ents) != 1 || ents[0].Mode != 0640 || ents[0].Size != 6 {
+		t.Fatal("earlier member kept", ents, err)
+	}
+
+	if err = cs.ExportTar(ents[0].Id, &buff); err != nil {
+		t.Fatal("failed to export, ", err.Error())
+	}
+	tr := tar.NewReader(&buff)
+	if hdr, err := tr.Next(); err != nil || hdr.Name != "c.txt" || hdr.Size != 6 {
+		t.Fatal("file exported as", hdr, err)
+	}
+	if _, err = tr.Next(); err == nil {
+		t.Fatal("more than one member for a file")
+	}
+}
+
+func archiveRefuse(t *testing.T) {
+	var (
+		cs *Server
+		err error
+	)
+
+	cs = memServer(t)
+
+	for _, members := range [][]archiveMember{
+		{ { "../escape", 0644, "x", "" } },
+		{ { "a/../../escape", 0644, "x", "" } },
+		{ { "link", 0777, "", "target" } },
+		{ { "f", 0644, "x", "" }, { "f/g", 0644, "y", "" } },
+		{ { ".", 0644, "x", "" } },
+	} {
+		if _, err = cs.ImportTar(archiveWrite(t, members), "bad"); err == nil {
+			t.Error("imported", members[len(members)-1].name)
+		}
+	}
+	if _, err = cs.ImportTar(strings.NewReader("not a tar at all, not even close to one"), "bad"); err == nil {
+		t.Error("imported garbage")
+	}
+	if _, err = cs.ImportZip(strings.NewReader("PK garbage"), 10, "bad"); err == nil {
+		t.Error("imported a bad zip")
+	}
+}
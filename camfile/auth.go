@@ -0,0 +1,508 @@
+package camfile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KimN100/random-examples/jwt"
+)
+
+/*
+An authenticated block server for use beyond localhost.
+
+Every request carries "Authorization: Bearer token", a token from the jwt
+package signed with the server's key, whose payload names a tenant, the
+scopes granted and an expiry:
+
+	{"sub":"acme","scope":"read write","exp":1700000000}
+
+read allows fetching blocks and pins, write storing blocks, asking which
+blocks the store lacks, which refreshes them as a put would, and setting
+and removing pins, and admin everything, including listing and removing
+blocks as GC does and reading metrics, see instrument.go.  Every token
+must expire, and no later than MaxLifetime from when it is used.
+
+Blocks are shared by all tenants, so identical data is stored once, but
+pins are not: a tenant sees and changes only its own, kept in the store
+under "tenant.name".  An admin token works on the store as it is and so
+sees every tenant's pins, which keeps a GC run through it from sweeping
+any tenant's roots.
+
+A tenant's quota is charged for the bytes of each block it adds that the
+store did not already have.  Usage is kept in the store, as a DATA block
+holding the count in decimal under the pin "quota.tenant", read when the
+tenant is first charged and written after each request that charged it.
+Handlers sharing a store each count their own requests over what they
+read, and a request under way when the server stops is not counted, so
+the quota is a limit on what a tenant stores over time, not to the byte.
+Removing a tenant's blocks, or its pins and then running GC, refunds
+nothing.
+
+Requests are rate limited per token, so one client running hot slows
+only itself, and optionally per tenant too, so that minting more tokens
+gets a tenant no further than TenantRate.
+*/
+type AuthOptions struct {
+	// key the tokens are signed with
+	Key string
+	// bytes each tenant may add, 0 for no limit
+	Quota int64
+	// requests per second per token, and the burst allowed above
+	// that, 0 for no limit
+	Rate float64
+	Burst int
+	// the same over all of a tenant's tokens together
+	TenantRate float64
+	TenantBurst int
+	// the longest a token may have left to run, 0 for
+	// cam_token_life_max
+	MaxLifetime time.Duration
+}
+
+const (
+	ScopeRead = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+const (
+	cam_quota_pin = "quota."
+	cam_token_life_max = 30 * 24 * time.Hour
+)
+
+var (
+	// returned, wrapped, when a put would take a tenant over its quota
+	ErrQuota = errors.New("quota exceeded")
+)
+
+/*
+The claims a token carries.
+*/
+type claims struct {
+	Sub string `json:"sub"`
+	Scope string `json:"scope"`
+	Exp int64 `json:"exp"`
+}
+
+/*
+A token bucket.
+*/
+type bucket struct {
+	tokens float64
+	last time.Time
+}
+
+/*
+Token buckets by key, all filling at rate up to burst above it.
+*/
+type limiter struct {
+	rate float64
+	burst int
+	buckets map[string]*bucket
+	pruned time.Time
+}
+
+type authHandler struct {
+	cs *Server
+	store BlockStore
+	opts AuthOptions
+	// /metrics, or nil
+	metrics http.Handler
+
+	mu sync.Mutex
+	// by tenant, once read from the store
+	usage map[string]int64
+	// by token and by tenant
+	perToken, perTenant limiter
+	// one write of a tenant's usage at a time
+	saveMu sync.Mutex
+}
+
+/*
+Make a token for tenant with the space separated scopes, signed with key,
+expiring at exp.
+*/
+func NewToken(key, tenant, scope string, exp time.Time) (token string, err error) {
+	var (
+		head, payl string
+		pairs map[string]interface{}
+	)
+
+	if !isTenantName(tenant) {
+		return "", fmt.Errorf("bad tenant name: %q", tenant)
+	}
+	for _, sc := range strings.Fields(scope) {
+		if sc != ScopeRead && sc != ScopeWrite && sc != ScopeAdmin {
+			return "", fmt.Errorf("unknown scope: %q", sc)
+		}
+	}
+	if exp.IsZero() {
+		return "", fmt.Errorf("token without an expiry")
+	}
+
+	pairs = map[string]interface{}{ "alg": "HS256", "typ": "JWT" }
+	if head, err = jwt.EncodeToJson(&pairs); err != nil {
+		return
+	}
+	pairs = map[string]interface{}{ "sub": tenant, "scope": scope, "exp": exp.Unix() }
+	if payl, err = jwt.EncodeToJson(&pairs); err != nil {
+		return
+	}
+
+	return jwt.EncodeToJwt(key, head, payl)
+}
+
+/*
+Serve the Server's store with the protocol of http.go to holders of
+tokens signed with opts.Key.
+*/
+func (cs *Server) AuthHandler(opts AuthOptions) (hh http.Handler) {
+	if opts.MaxLifetime <= 0 {
+		opts.MaxLifetime = cam_token_life_max
+	}
+
+	return &authHandler{
+		cs: cs,
+		store: cs.metered().store(cs.store),
+		opts: opts,
+		metrics: cs.metricsHandler(),
+		usage: make(map[string]int64),
+		perToken: limiter{ rate: opts.Rate, burst: opts.Burst, buckets: make(map[string]*bucket) },
+		perTenant: limiter{ rate: opts.TenantRate, burst: opts.TenantBurst, buckets: make(map[string]*bucket) },
+	}
+}
+
+func (ah *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		token, need string
+		cl *claims
+		err error
+		store BlockStore
+		ts *tenantStore
+	)
+
+	token, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if cl, err = ah.verify(token); err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !ah.allow(token, cl.Sub) {
+		http.Error(w, "rate limited", http.StatusTooManyRequests)
+		return
+	}
+
+	need = ScopeRead
+	switch {
+	case r.Method == http.MethodPut, r.URL.Path == "/batch/put", r.URL.Path == "/batch/has":
+		need = ScopeWrite
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/pin/"):
+		need = ScopeWrite
+	case r.Method == http.MethodDelete, r.URL.Path == "/block/", r.URL.Path == "/metrics":
+		need = ScopeAdmin
+	}
+	if !hasScope(cl.Scope, need) && !hasScope(cl.Scope, ScopeAdmin) {
+		http.Error(w, "token lacks scope " + need, http.StatusForbidden)
+		return
+	}
+
+	store = ah.store
+	if !hasScope(cl.Scope, ScopeAdmin) {
+		ts = &tenantStore{ BlockStore: ah.store, tenant: cl.Sub, auth: ah }
+		store = ts
+	}
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/block/"):
+		serveBlock(store, w, r)
+	case strings.HasPrefix(r.URL.Path, "/pin/"):
+		servePin(store, w, r)
+	case strings.HasPrefix(r.URL.Path, "/batch/"):
+		serveBatch(store, w, r)
+	case r.URL.Path == "/metrics" && ah.metrics != nil:
+		ah.metrics.ServeHTTP(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+
+	if ts != nil && ts.charged.Load() {
+		ah.saveUsage(r.Context(), cl.Sub)
+	}
+}
+
+func (ah *authHandler) verify(token string) (cl *claims, err error) {
+	var payl string
+
+	if token == "" {
+		return nil, fmt.Errorf("missing bearer token")
+	}
+	if _, payl, err = jwt.VerifyJwt(ah.opts.Key, token); err != nil {
+		return nil, fmt.Errorf("bad token: %s", err.Error())
+	}
+
+	cl = &claims{}
+	if err = json.Unmarshal([]byte(payl), cl); err != nil {
+		return nil, fmt.Errorf("bad token claims: %s", err.Error())
+	}
+	if !isTenantName(cl.Sub) {
+		return nil, fmt.Errorf("bad token tenant: %q", cl.Sub)
+	}
+	switch now := time.Now(); {
+	case cl.Exp == 0:
+		return nil, fmt.Errorf("token without an expiry")
+	case now.Unix() >= cl.Exp:
+		return nil, fmt.Errorf("token expired")
+	case time.Unix(cl.Exp, 0).Sub(now) > ah.opts.MaxLifetime:
+		return nil, fmt.Errorf("token lives longer than %s", ah.opts.MaxLifetime)
+	}
+
+	return
+}
+
+/*
+Take one request from the token's bucket and the tenant's, unless either
+is empty.
+*/
+func (ah *authHandler) allow(token, tenant string) (ok bool) {
+	var (
+		tk, tn *bucket
+		now time.Time
+	)
+
+	if ah.opts.Rate <= 0 && ah.opts.TenantRate <= 0 {
+		return true
+	}
+
+	ah.mu.Lock()
+	defer ah.mu.Unlock()
+
+	now = time.Now()
+	tk, tn = ah.perToken.fill(token, now), ah.perTenant.fill(tenant, now)
+	if (tk != nil && tk.tokens < 1) || (tn != nil && tn.tokens < 1) {
+		return false
+	}
+	if tk != nil {
+		tk.tokens--
+	}
+	if tn != nil {
+		tn.tokens--
+	}
+
+	return true
+}
+
+/*
+The bucket for key, topped up to now, or nil without a limit.  A bucket
+idle long enough to have filled is the same as a new one, so those are
+dropped as they go.
+*/
+func (lm *limiter) fill(key string, now time.Time) (bk *bucket) {
+	var ok bool
+
+	if lm.rate <= 0 {
+		return nil
+	}
+
+	full := float64(lm.burst) + 1
+	if fill := time.Duration(full / lm.rate * float64(time.Second)); now.Sub(lm.pruned) > fill {
+		for name, bk := range lm.buckets {
+			if now.Sub(bk.last) > fill {
+				delete(lm.buckets, name)
+			}
+		}
+		lm.pruned = now
+	}
+	if bk, ok = lm.buckets[key]; !ok {
+		bk = &bucket{ tokens: full, last: now }
+		lm.buckets[key] = bk
+	}
+	bk.tokens = min(bk.tokens + now.Sub(bk.last).Seconds()*lm.rate, full)
+	bk.last = now
+
+	return
+}
+
+/*
+Charge tenant for size bytes, or fail if that would exceed its quota.
+*/
+func (ah *authHandler) charge(ctx context.Context, tenant string, size int64) (err error) {
+
+	if err = ah.loadUsage(ctx, tenant); err != nil {
+		return
+	}
+
+	ah.mu.Lock()
+	defer ah.mu.Unlock()
+
+	if ah.opts.Quota > 0 && ah.usage[tenant]+size > ah.opts.Quota {
+		return fmt.Errorf("%w: %s has %d of %d bytes", ErrQuota, tenant, ah.usage[tenant], ah.opts.Quota)
+	}
+	ah.usage[tenant] += size
+
+	return
+}
+
+func (ah *authHandler) refund(tenant string, size int64) {
+
+	ah.mu.Lock()
+	ah.usage[tenant] -= size
+	ah.mu.Unlock()
+}
+
+/*
+Read tenant's usage from the store, unless it already has been.  No
+usage pin is no usage.
+*/
+func (ah *authHandler) loadUsage(ctx context.Context, tenant string) (err error) {
+	var (
+		id, tag string
+		block []byte
+		cnt int
+		used int64
+	)
+
+	ah.mu.Lock()
+	_, ok := ah.usage[tenant]
+	ah.mu.Unlock()
+	if ok {
+		return
+	}
+
+	if id, err = ah.store.GetPin(ctx, cam_quota_pin + tenant); errors.Is(err, os.ErrNotExist) {
+		err = nil
+	} else if err != nil {
+		return
+	} else {
+		if block, err = ah.cs.getBlock(ctx, id); err != nil {
+			return
+		}
+		if tag, cnt, err = parseHeader(block); err != nil {
+			return
+		}
+		if tag != "DATA" || cam_header_size+cnt > len(block) {
+			return fmt.Errorf("bad usage for %s: %s is %s", tenant, id, tag)
+		}
+		if used, err = strconv.ParseInt(string(block[cam_header_size:cam_header_size+cnt]), 10, 64); err != nil {
+			return fmt.Errorf("bad usage for %s: %s", tenant, err.Error())
+		}
+	}
+
+	ah.mu.Lock()
+	if _, ok = ah.usage[tenant]; !ok {
+		ah.usage[tenant] = used
+	}
+	ah.mu.Unlock()
+
+	return
+}
+
+/*
+Write tenant's usage to the store.  The response has gone by now, so a
+failure goes unreported; the count stays in memory, and is written after
+the next request that charges the tenant.
+*/
+func (ah *authHandler) saveUsage(ctx context.Context, tenant string) {
+	var (
+		held []string
+		id string
+		err error
+	)
+
+	ah.saveMu.Lock()
+	defer ah.saveMu.Unlock()
+
+	ah.mu.Lock()
+	data := []byte(strconv.FormatInt(ah.usage[tenant], 10))
+	ah.mu.Unlock()
+
+	defer func() { ah.cs.release(held) }()
+	hd := newHeader("DATA", len(data))
+	if id, err = ah.cs.putHeld(ctx, hd.encode(), data, &held); err == nil {
+		ah.store.PutPin(ctx, cam_quota_pin + tenant, id)
+	}
+}
+
+func hasScope(scope, want string) (ok bool) {
+
+	for _, sc := range strings.Fields(scope) {
+		if sc == want {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+Tenant names are pin names without dots, which separate them from the
+tenant's pin names in the store, other than those the store's own pins
+start with.
+*/
+func isTenantName(name string) (ok bool) {
+	return isPinName(name) && !strings.Contains(name, ".") && name + "." != cam_ref_pin && name + "." != cam_quota_pin
+}
+
+/*
+The store as a tenant sees it: its own pins only, and puts charged to
+its quota.
+*/
+type tenantStore struct {
+	BlockStore
+	tenant string
+	auth *authHandler
+	// a put was charged, so usage must be saved
+	charged atomic.Bool
+}
+
+func (ts *tenantStore) Put(ctx context.Context, id string, block []byte) (err error) {
+	var ok bool
+
+	if ok, err = ts.BlockStore.Has(ctx, id); err != nil {
+		return
+	}
+	if !ok {
+		if err = ts.auth.charge(ctx, ts.tenant, int64(len(block))); err != nil {
+			return
+		}
+		ts.charged.Store(true)
+	}
+	if err = ts.BlockStore.Put(ctx, id, block); err != nil && !ok {
+		ts.auth.refund(ts.tenant, int64(len(block)))
+	}
+
+	return
+}
+
+func (ts *tenantStore) pin(name string) (full string) {
+	return ts.tenant + "." + name
+}
+
+func (ts *tenantStore) PutPin(ctx context.Context, name, id string) (err error) {
+	return ts.BlockStore.PutPin(ctx, ts.pin(name), id)
+}
+
+func (ts *tenantStore) GetPin(ctx context.Context, name string) (id string, err error) {
+	return ts.BlockStore.GetPin(ctx, ts.pin(name))
+}
+
+func (ts *tenantStore) RemovePin(ctx context.Context, name string) (err error) {
+	return ts.BlockStore.RemovePin(ctx, ts.pin(name))
+}
+
+func (ts *tenantStore) WalkPins(ctx context.Context, fn func(name, id string) error) (err error) {
+	return ts.BlockStore.WalkPins(ctx, func(name, id string) error {
+		if rest, ok := strings.CutPrefix(name, ts.tenant + "."); ok {
+			return fn(rest, id)
+		}
+		return nil
+	})
+}
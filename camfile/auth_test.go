@@ -0,0 +1,282 @@
+package camfile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KimN100/random-examples/jwt"
+)
+
+func TestAuth(t *testing.T) {
+	t.Run("scopes", authScopes)
+	t.Run("tenants", authTenants)
+	t.Run("quota", authQuota)
+	t.Run("rate", authRate)
+	t.Run("tokens", authTokens)
+}
+
+const authKey = "not a very good key"
+
+/*
+An authenticated block server, and a Server talking to it per token.
+*/
+func authSetup(t *testing.T, opts AuthOptions) (remote *Server, client func(tenant, scope string) *Server) {
+	remote = memServer(t)
+	opts.Key = authKey
+	ts := httptest.NewServer(remote.AuthHandler(opts))
+	t.Cleanup(ts.Close)
+
+	client = func(tenant, scope string) *Server {
+		token, err := NewToken(authKey, tenant, scope, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal("failed to make token, ", err.Error())
+		}
+		return NewServerStore(NewHTTPStore(ts.URL, token))
+	}
+
+	return
+}
+
+func authWrite(cs *Server, content []byte) (id string, err error) {
+	var cw *Writer
+
+	if cw, err = cs.Create(); err != nil {
+		return
+	}
+	defer cw.Close()
+	id, _, err = cw.Copy(bytes.NewReader(content))
+
+	return
+}
+
+func authScopes(t *testing.T) {
+	var (
+		err error
+		id string
+		report *GCReport
+	)
+
+	_, client := authSetup(t, AuthOptions{})
+	reader, writer, admin := client("acme", "read"), client("acme", "write read"), client("ops", "admin")
+
+	if _, err = authWrite(reader, []byte("read only")); err == nil {
+		t.Fatal("read token stored a block")
+	}
+	if id, err = authWrite(writer, []byte("read and write")); err != nil {
+		t.Fatal("write token refused, ", err.Error())
+	}
+	tierRead(t, reader, id, []byte("read and write"))
+	if err = reader.Pin("keep", id); err == nil {
+		t.Fatal("read token set a pin")
+	}
+	if err = writer.Pin("keep", id); err != nil {
+		t.Fatal("write token refused a pin, ", err.Error())
+	}
+
+	// listing and removing blocks is for admins
+	if _, err = writer.GC(GCOptions{}); err == nil {
+		t.Fatal("write token ran gc")
+	}
+	if report, err = admin.GC(GCOptions{}); err != nil {
+		t.Fatal("admin gc failed, ", err.Error())
+	}
+	if len(report.Removed) != 0 {
+		t.Fatal("admin gc swept a tenant's pinned blocks", report.Removed)
+	}
+}
+
+func authTenants(t *testing.T) {
+	var (
+		err error
+		id string
+		pins map[string]string
+	)
+
+	remote, client := authSetup(t, AuthOptions{})
+	acme, other, admin := client("acme", "read write"), client("other", "read write"), client("ops", "admin")
+
+	if id, err = authWrite(acme, []byte("shared content")); err != nil {
+		t.Fatal("failed to write, ", err.Error())
+	}
+	if again, err := authWrite(other, []byte("shared content")); err != nil || again != id {
+		t.Fatal("tenants do not share blocks", again, err)
+	}
+	if err = acme.Pin("keep", id); err != nil {
+		t.Fatal("failed to pin, ", err.Error())
+	}
+
+	if pins, err = other.Pins(); err != nil || len(pins) != 0 {
+		t.Fatal("pins leaked between tenants", pins, err)
+	}
+	if err = other.Unpin("keep"); err == nil {
+		t.Fatal("removed another tenant's pin")
+	}
+	if pins, err = acme.Pins(); err != nil || pins["keep"] != id {
+		t.Fatal("tenant lost its pin", pins, err)
+	}
+	if pins, err = admin.Pins(); err != nil || pins["acme.keep"] != id {
+		t.Fatal("admin does not see tenant pins", pins, err)
+	}
+	if pins, err = remote.Pins(); err != nil || pins["acme.keep"] != id {
+		t.Fatal("tenant pin not namespaced in the store", pins, err)
+	}
+}
+
+func authQuota(t *testing.T) {
+	var (
+		err error
+		used int
+	)
+
+	remote, client := authSetup(t, AuthOptions{ Quota: 20 * cam_block_size })
+	acme, other := client("acme", "read write"), client("other", "read write")
+
+	content := []byte(strings.Repeat("x", 10*(cam_block_size-cam_header_size)))
+	if _, err = authWrite(acme, content); err != nil {
+		t.Fatal("failed to write, ", err.Error())
+	}
+	used = tierBytes(t, remote.store)
+
+	// blocks the store has cost nothing
+	if _, err = authWrite(other, content); err != nil {
+		t.Fatal("shared blocks charged, ", err.Error())
+	}
+
+	big := make([]byte, 30*cam_block_size)
+	for ii := range big {
+		big[ii] = byte(ii / 7)
+	}
+	if _, err = authWrite(acme, big); err == nil || !strings.Contains(err.Error(), "quota") {
+		t.Fatal("quota not enforced", err)
+	}
+	if nn := tierBytes(t, remote.store) - used; nn > 20*cam_block_size {
+		t.Fatal("tenant stored past its quota", nn)
+	}
+	// other's quota is its own
+	if _, err = authWrite(other, big[:15*cam_block_size]); err != nil {
+		t.Fatal("quota shared between tenants, ", err.Error())
+	}
+
+	// and outlives the handler: acme is at its quota, and stays there
+	ts := httptest.NewServer(remote.AuthHandler(AuthOptions{ Key: authKey, Quota: 20 * cam_block_size }))
+	defer ts.Close()
+	token, _ := NewToken(authKey, "acme", "read write", time.Now().Add(time.Hour))
+	fresh := make([]byte, 5*(cam_block_size-cam_header_size))
+	rand.New(rand.NewSource(44)).Read(fresh)
+	if _, err = authWrite(NewServerStore(NewHTTPStore(ts.URL, token)), fresh); err == nil || !strings.Contains(err.Error(), "quota") {
+		t.Fatal("usage forgotten by a new handler", err)
+	}
+}
+
+func authRate(t *testing.T) {
+	var (
+		err error
+		limited int
+	)
+
+	_, client := authSetup(t, AuthOptions{ Rate: 1, Burst: 4 })
+	acme := client("acme", "read")
+
+	for ii := 0; ii < 10; ii++ {
+		if _, err = acme.store.Has(context.Background(), EmptyId); err != nil {
+			limited++
+		}
+	}
+	if limited < 4 || limited > 6 {
+		t.Fatal("wrong number of requests limited", limited)
+	}
+	if _, err = client("other", "read").store.Has(context.Background(), EmptyId); err != nil {
+		t.Fatal("rate limit shared between tenants, ", err.Error())
+	}
+	// each token has its own bucket
+	if _, err = client("acme", "read write").store.Has(context.Background(), EmptyId); err != nil {
+		t.Fatal("rate limit shared between tokens, ", err.Error())
+	}
+
+	// unless the tenant is capped too
+	_, client = authSetup(t, AuthOptions{ Rate: 100, Burst: 100, TenantRate: 1, TenantBurst: 4 })
+	limited = 0
+	for ii := 0; ii < 10; ii++ {
+		scope := "read"
+		if ii%2 == 1 {
+			scope = "read write"
+		}
+		if _, err = client("acme", scope).store.Has(context.Background(), EmptyId); err != nil {
+			limited++
+		}
+	}
+	if limited < 4 || limited > 6 {
+		t.Fatal("wrong number of requests limited across tokens", limited)
+	}
+
+	// buckets that have filled up are dropped
+	lm := &limiter{ rate: 1000, burst: 1, buckets: make(map[string]*bucket) }
+	lm.fill("acme", time.Now())
+	time.Sleep(10 * time.Millisecond)
+	if lm.fill("other", time.Now()); len(lm.buckets) != 1 {
+		t.Fatal("idle buckets kept", len(lm.buckets))
+	}
+}
+
+func authTokens(t *testing.T) {
+	var (
+		err error
+		token string
+	)
+
+	remote, _ := authSetup(t, AuthOptions{})
+	ts := httptest.NewServer(remote.AuthHandler(AuthOptions{ Key: authKey }))
+	defer ts.Close()
+
+	try := func(token string) error {
+		_, err := NewHTTPStore(ts.URL, token).Get(context.Background(), EmptyId)
+		return err
+	}
+
+	if err = try(""); err == nil || errors.Is(err, os.ErrNotExist) {
+		t.Fatal("no token accepted", err)
+	}
+	hour := time.Now().Add(time.Hour)
+	token, _ = NewToken("another key", "acme", "read", hour)
+	if err = try(token); err == nil || errors.Is(err, os.ErrNotExist) {
+		t.Fatal("token with the wrong key accepted", err)
+	}
+	token, _ = NewToken(authKey, "acme", "read", time.Now().Add(-time.Minute))
+	if err = try(token); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Fatal("expired token accepted", err)
+	}
+	token, _ = NewToken(authKey, "acme", "read", hour)
+	if err = try(token); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("good token refused", err)
+	}
+	token, _ = NewToken(authKey, "acme", "read", time.Now().Add(cam_token_life_max + time.Hour))
+	if err = try(token); err == nil || !strings.Contains(err.Error(), "longer") {
+		t.Fatal("token past the longest lifetime accepted", err)
+	}
+	if token, err = jwt.EncodeToJwt(authKey, `{"alg":"HS256","typ":"JWT"}`, `{"sub":"acme","scope":"read"}`); err != nil {
+		t.Fatal("failed to make token, ", err.Error())
+	}
+	if err = try(token); err == nil || !strings.Contains(err.Error(), "expiry") {
+		t.Fatal("token without an expiry accepted", err)
+	}
+
+	if _, err = NewToken(authKey, "a.b", "read", hour); err == nil {
+		t.Fatal("made a token for a bad tenant")
+	}
+	if _, err = NewToken(authKey, "quota", "read", hour); err == nil {
+		t.Fatal("made a token for a reserved tenant")
+	}
+	if _, err = NewToken(authKey, "acme", "root", hour); err == nil {
+		t.Fatal("made a token with an unknown scope")
+	}
+	if _, err = NewToken(authKey, "acme", "read", time.Time{}); err == nil {
+		t.Fatal("made a token that never expires")
+	}
+}
@@ -0,0 +1,433 @@
+package camfile
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Batched block transfer.
+
+A tree of a large file has a block per kilobyte, too many to move one
+request at a time over a network.  A store that can also move blocks in
+batches implements BatchStore; the HTTP store does, with three more
+requests:
+
+	POST /batch/has   ids, one per line; answers the missing ids
+	POST /batch/put   frames, stored in order
+	POST /batch/get   ids, one per line; answers a frame per id
+
+A frame is the 32 char id, the length as 4 hex digits and the block.  A
+block the server lacks comes back with length 0000.
+
+A Writer on a BatchStore queues its blocks and sends them in batches of
+up to cam_batch_max, asking first which ones the store lacks and sending
+only those.  Batches go in the order the blocks were queued, children
+before parents, so a store never holds a block whose subtree it lacks.
+*/
+type BatchStore interface {
+	BlockStore
+	// The ids the store lacks.  Those it has have their modification
+	// time refreshed, as Put would, so GC's grace period covers them.
+	HasMany(ctx context.Context, ids []string) (missing []string, err error)
+	// Put blocks[ii] under ids[ii], in order.
+	PutMany(ctx context.Context, ids []string, blocks [][]byte) (err error)
+	// Call fn for every id in order, with a nil block if it is missing.
+	GetMany(ctx context.Context, ids []string, fn func(id string, block []byte) error) (err error)
+}
+
+const (
+	cam_batch_max = 256
+	// ids a server takes in one has or get request
+	cam_batch_ids_max = 65536
+)
+
+/*
+Blocks a Writer has put but not yet sent.  Reached through the Writer's
+context, so every put made for the Writer is queued, however deep.
+*/
+type batcher struct {
+	store BatchStore
+	mt *meter
+	mu sync.Mutex
+	ids []string
+	blocks [][]byte
+	// one flush at a time, so batches go in order
+	flushMu sync.Mutex
+}
+
+type batchKey struct{}
+
+func batchFrom(ctx context.Context) (bb *batcher) {
+	bb, _ = ctx.Value(batchKey{}).(*batcher)
+	return
+}
+
+func (bb *batcher) put(ctx context.Context, id string, block []byte) (err error) {
+	var full bool
+
+	bb.mu.Lock()
+	bb.ids = append(bb.ids, id)
+	bb.blocks = append(bb.blocks, block)
+	full = len(bb.ids) >= cam_batch_max
+	bb.mu.Unlock()
+
+	if full {
+		err = bb.send(ctx, false)
+	}
+
+	return
+}
+
+/*
+Send everything queued.
+*/
+func (bb *batcher) flush(ctx context.Context) (err error) {
+	return bb.send(ctx, true)
+}
+
+/*
+Send the full batches queued, or with all everything.  Puts racing to
+fill a batch leave the few queued after it for the next one.  On error
+the blocks not yet sent go back to the front of the queue.
+*/
+func (bb *batcher) send(ctx context.Context, all bool) (err error) {
+	var (
+		ids, missing []string
+		blocks, send [][]byte
+		want map[string]bool
+		cnt int
+		start time.Time
+		size, sent int64
+	)
+
+	bb.flushMu.Lock()
+	defer bb.flushMu.Unlock()
+
+	bb.mu.Lock()
+	if cnt = len(bb.ids); !all {
+		cnt -= cnt % cam_batch_max
+	}
+	ids, blocks = bb.ids[:cnt], bb.blocks[:cnt]
+	bb.ids, bb.blocks = append([]string(nil), bb.ids[cnt:]...), append([][]byte(nil), bb.blocks[cnt:]...)
+	bb.mu.Unlock()
+
+	defer func() {
+		if err != nil && len(ids) > 0 {
+			bb.mu.Lock()
+			bb.ids = append(append([]string(nil), ids...), bb.ids...)
+			bb.blocks = append(append([][]byte(nil), blocks...), bb.blocks...)
+			bb.mu.Unlock()
+		}
+	}()
+
+	for len(ids) > 0 {
+		cnt = min(len(ids), cam_batch_max)
+		start = bb.mt.now()
+		missing, err = bb.store.HasMany(ctx, ids[:cnt])
+		bb.mt.op("has-many", cnt, 0, start, err)
+		if err != nil {
+			return
+		}
+		want = make(map[string]bool)
+		for _, id := range missing {
+			want[id] = true
+		}
+		missing, send, size, sent = missing[:0], nil, 0, 0
+		for ii := 0; ii < cnt; ii++ {
+			size += int64(len(blocks[ii]))
+			if want[ids[ii]] {
+				delete(want, ids[ii])
+				missing = append(missing, ids[ii])
+				send = append(send, blocks[ii])
+				sent += int64(len(blocks[ii]))
+			}
+		}
+		bb.mt.deduped(cnt-len(missing), size-sent)
+		if len(missing) > 0 {
+			start = bb.mt.now()
+			err = bb.store.PutMany(ctx, missing, send)
+			bb.mt.op("put-many", len(missing), sent, start, err)
+			if err != nil {
+				return
+			}
+		}
+		ids, blocks = ids[cnt:], blocks[cnt:]
+	}
+
+	return
+}
+
+func writeFrame(w io.Writer, id string, block []byte) (err error) {
+
+	if len(id) != 32 || len(block) > cam_block_size {
+		return fmt.Errorf("bad frame: %s, %d bytes", id, len(block))
+	}
+	if _, err = fmt.Fprintf(w, "%s%04x", id, len(block)); err == nil {
+		_, err = w.Write(block)
+	}
+
+	return
+}
+
+/*
+Read one frame.  io.EOF, unwrapped, only at a frame boundary.
+*/
+func readFrame(rd io.Reader) (id string, block []byte, err error) {
+	var (
+		head [36]byte
+		nn int64
+	)
+
+	if _, err = io.ReadFull(rd, head[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = fmt.Errorf("short frame: %w", err)
+		}
+		return
+	}
+	id = string(head[:32])
+	if !isBlockId(id) {
+		return "", nil, fmt.Errorf("bad frame id: %q", head[:32])
+	}
+	if nn, err = strconv.ParseInt(string(head[32:]), 16, 32); err != nil || nn > cam_block_size {
+		return "", nil, fmt.Errorf("bad frame length: %q", head[32:])
+	}
+	block = make([]byte, nn)
+	if _, err = io.ReadFull(rd, block); err != nil {
+		return "", nil, fmt.Errorf("short frame: %s: %w", id, err)
+	}
+
+	return
+}
+
+func readIds(rd io.Reader) (ids []string, err error) {
+
+	scan := bufio.NewScanner(rd)
+	for scan.Scan() {
+		if !isBlockId(scan.Text()) {
+			return nil, fmt.Errorf("not a block id: %q", scan.Text())
+		}
+		if ids = append(ids, scan.Text()); len(ids) > cam_batch_ids_max {
+			return nil, fmt.Errorf("more than %d ids", cam_batch_ids_max)
+		}
+	}
+
+	return ids, scan.Err()
+}
+
+/*
+Refresh a block's modification time, cheaply if the store knows how.
+*/
+func touchBlock(ctx context.Context, store BlockStore, id string) (err error) {
+	var block []byte
+
+	if tt, ok := store.(interface{ Touch(context.Context, string) error }); ok {
+		return tt.Touch(ctx, id)
+	}
+	if block, err = store.Get(ctx, id); err != nil {
+		return
+	}
+
+	return store.Put(ctx, id, block)
+}
+
+func (hs *httpStore) HasMany(ctx context.Context, ids []string) (missing []string, err error) {
+	var data []byte
+
+	if data, err = hs.do(ctx, http.MethodPost, "/batch/has", []byte(strings.Join(ids, "\n"))); err != nil {
+		return
+	}
+
+	return readIds(bytes.NewReader(data))
+}
+
+/*
+Frames are written to the request as it goes out, not built up first.
+*/
+func (hs *httpStore) PutMany(ctx context.Context, ids []string, blocks [][]byte) (err error) {
+	var (
+		pr *io.PipeReader
+		pw *io.PipeWriter
+		req *http.Request
+		resp *http.Response
+		data []byte
+	)
+
+	if len(ids) != len(blocks) {
+		return fmt.Errorf("%d ids for %d blocks", len(ids), len(blocks))
+	}
+
+	pr, pw = io.Pipe()
+	go func() {
+		var err error
+
+		for ii := range ids {
+			if err = writeFrame(pw, ids[ii], blocks[ii]); err != nil {
+				break
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, hs.base + "/batch/put", pr); err != nil {
+		return
+	}
+	if hs.token != "" {
+		req.Header.Set("Authorization", "Bearer " + hs.token)
+	}
+	if resp, err = hs.client.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		data, _ = io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("POST /batch/put: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	return
+}
+
+func (hs *httpStore) GetMany(ctx context.Context, ids []string, fn func(id string, block []byte) error) (err error) {
+	var (
+		req *http.Request
+		resp *http.Response
+		id string
+		block, data []byte
+		rd *bufio.Reader
+	)
+
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, hs.base + "/batch/get", strings.NewReader(strings.Join(ids, "\n"))); err != nil {
+		return
+	}
+	if hs.token != "" {
+		req.Header.Set("Authorization", "Bearer " + hs.token)
+	}
+	if resp, err = hs.client.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		data, _ = io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("POST /batch/get: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	rd = bufio.NewReader(resp.Body)
+	for _, want := range ids {
+		if id, block, err = readFrame(rd); err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("batch get: %w", io.ErrUnexpectedEOF)
+			}
+			return
+		}
+		if id != want {
+			return fmt.Errorf("batch get: asked for %s, got %s", want, id)
+		}
+		if len(block) == 0 {
+			block = nil
+		}
+		if err = fn(id, block); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+/*
+The batch requests, for any store.  Puts are checked against their ids
+and made one at a time, in order.
+*/
+func serveBatch(store BlockStore, w http.ResponseWriter, r *http.Request) {
+	var (
+		ids, missing []string
+		id string
+		block []byte
+		ok bool
+		err error
+	)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/batch/has":
+		if ids, err = readIds(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, id = range ids {
+			if ok, err = store.Has(r.Context(), id); err != nil {
+				break
+			}
+			if !ok {
+				missing = append(missing, id)
+			} else if err = touchBlock(r.Context(), store, id); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			w.Write([]byte(strings.Join(missing, "\n")))
+		}
+	case "/batch/put":
+		rd := bufio.NewReader(r.Body)
+		for {
+			if id, block, err = readFrame(rd); err == io.EOF {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			} else if err == nil {
+				err = verifyBlock(id, block)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err = store.Put(r.Context(), id, block); err != nil {
+				break
+			}
+		}
+	case "/batch/get":
+		if ids, err = readIds(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bw := bufio.NewWriter(w)
+		for _, id = range ids {
+			if block, err = store.Get(r.Context(), id); errors.Is(err, os.ErrNotExist) {
+				block, err = nil, nil
+			}
+			if err != nil {
+				break
+			}
+			if err = writeFrame(bw, id, block); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = bw.Flush()
+		}
+		// a failure part way through shows as a short response
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		httpError(w, err)
+	}
+}
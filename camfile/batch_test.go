@@ -0,0 +1,296 @@
+package camfile
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	t.Run("requests", batchRequests)
+	t.Run("only-missing", batchOnlyMissing)
+	t.Run("get-many", batchGetMany)
+	t.Run("corrupt-frame", batchCorruptFrame)
+	t.Run("scopes", batchScopes)
+	t.Run("failed-put", batchFailedPut)
+}
+
+/*
+Counts the requests a block server answers, by method and path prefix.
+*/
+type batchCounter struct {
+	mu sync.Mutex
+	counts map[string]int
+}
+
+func (bc *batchCounter) wrap(hh http.Handler) http.Handler {
+
+	bc.counts = make(map[string]int)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Method + " " + r.URL.Path
+		if strings.HasPrefix(r.URL.Path, "/block/") {
+			key = r.Method + " /block/"
+		}
+		bc.mu.Lock()
+		bc.counts[key]++
+		bc.mu.Unlock()
+		hh.ServeHTTP(w, r)
+	})
+}
+
+func (bc *batchCounter) get(key string) (cnt int) {
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	return bc.counts[key]
+}
+
+func (bc *batchCounter) total() (cnt int) {
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	for _, nn := range bc.counts {
+		cnt += nn
+	}
+
+	return
+}
+
+func batchRequests(t *testing.T) {
+	var (
+		remote, cs *Server
+		bc batchCounter
+		err error
+		id string
+		stat *FileStat
+	)
+
+	remote, cs = httpSetup(t, bc.wrap)
+	defer remote.Close()
+	defer cs.Close()
+
+	content := make([]byte, 600*992)
+	rand.New(rand.NewSource(45)).Read(content)
+	if id, err = authWrite(cs, content); err != nil {
+		t.Fatal("failed to copy to cam, ", err.Error())
+	}
+	tierRead(t, remote, id, content)
+
+	if stat, err = remote.Stat(id); err != nil {
+		t.Fatal("failed to stat, ", err.Error())
+	}
+	if bc.get("PUT /block/") != 0 {
+		t.Fatal("writer put blocks one at a time", bc.get("PUT /block/"))
+	}
+	// a has and a put per batch
+	if limit := 2*(stat.Blocks/cam_batch_max + 1); bc.total() > limit {
+		t.Fatal("too many requests for", stat.Blocks, "blocks:", bc.total(), "more than", limit)
+	}
+}
+
+/*
+Writing content the server already has sends no blocks.
+*/
+func batchOnlyMissing(t *testing.T) {
+	var (
+		remote, cs *Server
+		bc batchCounter
+		err error
+		id, id2 string
+	)
+
+	remote, cs = httpSetup(t, bc.wrap)
+	defer remote.Close()
+	defer cs.Close()
+
+	content := make([]byte, 100*992)
+	rand.New(rand.NewSource(46)).Read(content)
+	if id, err = authWrite(remote, content); err != nil {
+		t.Fatal("failed to copy to cam, ", err.Error())
+	}
+
+	if id2, err = authWrite(cs, content); err != nil {
+		t.Fatal("failed to copy to cam, ", err.Error())
+	}
+	if id2 != id {
+		t.Fatal("same content, different roots", id, id2)
+	}
+	if bc.get("POST /batch/put") != 0 {
+		t.Fatal("sent blocks the server had", bc.get("POST /batch/put"))
+	}
+	if bc.get("POST /batch/has") == 0 {
+		t.Fatal("never asked the server")
+	}
+
+	// half new, half old
+	copy(content[50*992:], bytes.Repeat([]byte("new"), 20000))
+	if id2, err = authWrite(cs, content); err != nil {
+		t.Fatal("failed to copy to cam, ", err.Error())
+	}
+	tierRead(t, remote, id2, content)
+	if bc.get("POST /batch/put") == 0 {
+		t.Fatal("sent none of the new blocks")
+	}
+}
+
+func batchGetMany(t *testing.T) {
+	var (
+		remote, cs *Server
+		err error
+		id string
+		ids, got []string
+		nils int
+	)
+
+	remote, cs = httpSetup(t, nil)
+	defer remote.Close()
+	defer cs.Close()
+
+	if id, err = authWrite(remote, []byte("batch get many")); err != nil {
+		t.Fatal("failed to copy to cam, ", err.Error())
+	}
+	absent := "0123456789abcdef0123456789abcdef"
+	ids = []string{ id, absent, id }
+
+	bs := cs.store.(BatchStore)
+	if err = bs.GetMany(context.Background(), ids, func(id string, block []byte) error {
+		got = append(got, id)
+		if block == nil {
+			nils++
+		} else if err := verifyBlock(id, block); err != nil {
+			t.Fatal("bad block, ", err.Error())
+		}
+		return nil
+	}); err != nil {
+		t.Fatal("get many failed, ", err.Error())
+	}
+	if !equalStrings(got, ids) || nils != 1 {
+		t.Fatal("get many returned", got, nils, "missing")
+	}
+
+	if got, err = bs.HasMany(context.Background(), ids); err != nil {
+		t.Fatal("has many failed, ", err.Error())
+	}
+	if !equalStrings(got, []string{ absent }) {
+		t.Fatal("has many returned", got)
+	}
+}
+
+/*
+A frame whose block does not match its id, or that is cut short, is
+refused and nothing after it is stored.
+*/
+func batchCorruptFrame(t *testing.T) {
+	var (
+		remote *Server
+		err error
+		buff bytes.Buffer
+		resp *http.Response
+		ok bool
+	)
+
+	remote = memServer(t)
+	ts := httptest.NewServer(remote.Handler())
+	defer ts.Close()
+
+	block := []byte(cam_empty_head)
+	bad := "0123456789abcdef0123456789abcdef"
+	writeFrame(&buff, bad, block)
+	writeFrame(&buff, EmptyId, block)
+	if resp, err = http.Post(ts.URL + "/batch/put", "", &buff); err != nil {
+		t.Fatal("post failed, ", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("expected bad request, got", resp.Status)
+	}
+	if ok, _ = remote.store.Has(context.Background(), EmptyId); ok {
+		t.Fatal("stored a block after a corrupt frame")
+	}
+
+	buff.Reset()
+	writeFrame(&buff, EmptyId, block)
+	if resp, err = http.Post(ts.URL + "/batch/put", "", bytes.NewReader(buff.Bytes()[:buff.Len()-1])); err != nil {
+		t.Fatal("post failed, ", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("expected bad request for a short frame, got", resp.Status)
+	}
+}
+
+func batchScopes(t *testing.T) {
+	var (
+		err error
+		id string
+	)
+
+	_, client := authSetup(t, AuthOptions{})
+	reader, writer := client("acme", "read"), client("acme", "read write")
+
+	if id, err = authWrite(writer, []byte("batched with a token")); err != nil {
+		t.Fatal("write token refused, ", err.Error())
+	}
+	if _, err = writer.store.(BatchStore).HasMany(context.Background(), []string{ id }); err != nil {
+		t.Fatal("write token refused has many, ", err.Error())
+	}
+	// has many refreshes what it finds, which is a write
+	if _, err = reader.store.(BatchStore).HasMany(context.Background(), []string{ id }); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatal("read token asked has many", err)
+	}
+	err = reader.store.(BatchStore).PutMany(context.Background(), []string{ EmptyId }, [][]byte{ []byte(cam_empty_head) })
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatal("read token put many", err)
+	}
+}
+
+
+/*
+A batch the server refuses fails the Writer: nothing written or closed
+afterwards publishes a root over the blocks it never stored.
+*/
+func batchFailedPut(t *testing.T) {
+	var (
+		remote, cs *Server
+		cw *Writer
+		err error
+		failed atomic.Bool
+	)
+
+	remote, cs = httpSetup(t, func(hh http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/batch/put" && failed.CompareAndSwap(false, true) {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			hh.ServeHTTP(w, r)
+		})
+	})
+	defer cs.Close()
+
+	content := make([]byte, 20*992)
+	rand.New(rand.NewSource(47)).Read(content)
+	if cw, err = cs.Create(); err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+	if _, _, err = cw.Copy(bytes.NewReader(content)); err == nil {
+		t.Fatal("copy survived the failed batch")
+	}
+	if _, err = cw.Write([]byte("more")); err == nil {
+		t.Fatal("wrote to a failed writer")
+	}
+	if err = cw.Close(); err == nil || cw.Id() != "" {
+		t.Fatal("published a root after a failed batch", cw.Id(), err)
+	}
+	if report, err := remote.Fsck(nil, ""); err != nil || !report.Ok() {
+		t.Fatal("server store is damaged, ", report, err)
+	}
+}
@@ -9,14 +9,16 @@ See for example:
 package camfile
 
 import (
+	"context"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
-	"net/http"
-	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -32,9 +34,31 @@ BUGS:
 	cam_block_size = 1024
 	cam_header_size = 32
 	cam_indirect_cnt = (cam_block_size - cam_header_size) / 32
+
+/*
+Indirect blocks written with subtree sizes are marked sized in the header,
+which keeps the total subtree size, see header.go, and store each child as
+a 32 char id followed by a 16 char hex byte count.  Legacy indirect blocks
+that are not sized store bare ids.
+*/
+	cam_sized_entry = 32 + 16
+	cam_sized_indirect_cnt = (cam_block_size - cam_header_size) / cam_sized_entry
+)
+
+/*
+The root of empty content, a DATA block with no payload.  Every Writer
+given nothing returns it, encrypted or not, and stores the block so it
+reads back like any other root.
+*/
+const (
+	EmptyId = "48365ab072df2a5711e0f98e61b1f63f"
+	cam_empty_head = "\x89CAM\x01\x01-\x00" + "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00" + "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
 )
 
 var (
+	// returned, wrapped, when a block does not match its id
+	ErrCorrupt = errors.New("corrupt block")
+
 	state_name []string = []string{
 		"state_none",
 		"state_open",
@@ -56,54 +80,114 @@ func stateString(state int) (str string) {
 }
 
 type Server struct {
-	client *http.Client
-	fsroot string
+	store BlockStore
 	state int
+
+	// ids written by open Writers, kept safe from GC, see gc.go
+	mu sync.Mutex
+	live map[string]int
+	// blocks in flight per transfer, see pipeline.go
+	workers int
+	// signs refs, see refs.go
+	refKey []byte
+	// nil unless instrumented, see instrument.go
+	meter atomic.Pointer[meter]
 }
 
 type Reader struct {
 	server *Server
 	state int
-	ids []string
+	refs []camref
+	// for calls without their own context
+	ctx context.Context
+
+	// random access, see readat.go
+	mu sync.Mutex
+	root camref
+	off int64
+	sizes map[string]int64
+	inner map[string][]byte
+	leafid string
+	leaf []byte
 }
 
 type Writer struct {
 	server *Server
 	state int
-	ids []string
+	refs []camref
+	// convergent encryption, see crypt.go
+	secret []byte
+	// compression, see compress.go
+	codec Codec
+	// every id put so far, released on Close
+	held []string
+	// cancelled with a cause by the caller's context or by Close
+	ctx context.Context
+	cancel context.CancelCauseFunc
+	// DATA blocks being put, see pipeline.go; mu guards refs meanwhile
+	pipe *pipe
+	mu sync.Mutex
+	// blocks queued for a BatchStore, see batch.go
+	batch *batcher
+
+	// bytes not yet filling a DATA block
+	buff []byte
+	// root, set once the tree is built
+	root camref
+	done bool
+}
+
+/*
+A reference to a subtree: the id of its top block and the number of
+content bytes below it.  size is -1 when read from a legacy indirect block.
+key is the hex key of an encrypted block, otherwise empty.
+*/
+type camref struct {
+	id string
+	size int64
+	key string
 }
 
 /*
 conn specifies the root of a file system on localhost,
+the same prefixed with "pack:" for a pack store, see pack.go,
 or the URL of a networked Cam block server.
 */
 func NewServer(conn string) (cs *Server, err error) {
+	var store BlockStore
+
+	if store, err = OpenStore(conn); err == nil {
+		cs = NewServerStore(store)
+	}
+
+	return
+}
+
+/*
+A Server over any BlockStore, for example one built from others with the
+composite stores in tier.go.
+*/
+func NewServerStore(store BlockStore) (cs *Server) {
+	return &Server{ store: store, state: state_open }
+}
+
+/*
+The BlockStore NewServer would use for conn.
+*/
+func OpenStore(conn string) (store BlockStore, err error) {
 
-	var (
-		hroot *http.Client
-		fi os.FileInfo
-		fsroot string
-	)
 	if conn == "" {
 		err = fmt.Errorf("missing connection string")
 		goto out
 	}
-	if strings.HasPrefix(conn, "http") {
-		hroot = &http.Client{}
+	if strings.HasPrefix(conn, "pack:") {
+		store, err = OpenPackStore(strings.TrimPrefix(conn, "pack:"))
+	} else if strings.HasPrefix(conn, "http") {
+		store = NewHTTPStore(conn, "")
 	} else {
-		if fi, err = os.Stat(conn); err != nil {
-			err = fmt.Errorf("bad root: %s, %s", conn, err.Error())
-			goto out
-		} else if !fi.IsDir() {
-			err = fmt.Errorf("bad root: %s, %s", conn, err.Error())
-			goto out
-		} else {
-			fsroot = conn
-		}
+		store, err = OpenFileStore(conn)
 	}
 
-	cs = &Server{ client: hroot, fsroot: fsroot, state: state_open }
-
 out:
 	return 
 }
@@ -112,15 +196,26 @@ out:
 Create a resource for managing the copy from a Server to the local writer.
 The local writer must be a type that supports Write, for example an *os.File 
 or a *bytes.Buffer.  The writer must be created separately.
+id is a root block id, or for an encrypted file the capability "id:key"
+returned by the Writer.
 */
 func (cs *Server) Open(id string) (cr *Reader, err error) {
+	return cs.OpenContext(context.Background(), id)
+}
 
-	if len(id) != 32 {
-		return nil, fmt.Errorf("not a block id: " + id)
+/*
+As Open.  ctx applies to every call on the Reader that does not take its
+own, such as Read and ReadAt.
+*/
+func (cs *Server) OpenContext(ctx context.Context, id string) (cr *Reader, err error) {
+	var root camref
+
+	if root, err = parseCap(id); err != nil {
+		return nil, err
 	}
 
-	cr = &Reader{ server: cs, state: state_open }
-	cr.ids = append(cr.ids, id)
+	cr = &Reader{ server: cs, state: state_open, root: root, ctx: ctx }
+	cr.refs = append(cr.refs, root)
 
 	return
 }
@@ -129,9 +224,29 @@ func (cs *Server) Open(id string) (cr *Reader, err error) {
 Create a resource for managing the copy from the local reader to a Server.
 The local reader must be a type that supports Read, for example an *os.File 
 or a *bytes.Buffer.  The reader must be created separately.
+Alternatively the Writer may be written to directly, for example by
+io.Copy or an encoder; Close then builds the tree and Id returns the root.
 */
 func (cs *Server) Create() (cr *Writer, err error) {
-	return &Writer{ server: cs, state: state_open }, nil
+	return cs.CreateContext(context.Background())
+}
+
+/*
+As Create.  Once ctx is done the Writer fails every further call with
+its error and never produces a root, so no partly stored tree is ever
+handed out.
+*/
+func (cs *Server) CreateContext(ctx context.Context) (cw *Writer, err error) {
+
+	cw = &Writer{ server: cs, state: state_open }
+	cw.ctx, cw.cancel = context.WithCancelCause(ctx)
+	if bs, ok := cs.store.(BatchStore); ok {
+		// every put made for the Writer is queued, see batch.go
+		cw.batch = &batcher{ store: bs, mt: cs.metered() }
+		cw.ctx = context.WithValue(cw.ctx, batchKey{}, cw.batch)
+	}
+
+	return
 }
 
 /*
@@ -142,7 +257,10 @@ func (cs *Server) Close() (err error) {
 	if cs.state != state_open {
 		panic("unexpected state")
 	}
-	cs.client = nil
+	if cl, ok := cs.store.(io.Closer); ok {
+		err = cl.Close()
+	}
+	cs.store = nil
 	cs.state = state_closed
 	return
 }
@@ -151,11 +269,15 @@ func (cs *Server) Close() (err error) {
 The Reader is initialized with the root block in Open().
 */
 func (cr *Reader) Copy(dst io.Writer) (nn int, err error) {
+	return cr.CopyContext(cr.ctx, dst)
+}
+
+func (cr *Reader) CopyContext(ctx context.Context, dst io.Writer) (nn int, err error) {
 
 	if cr.server.state != state_open || cr.state != state_open {
 		err = fmt.Errorf("not opened: server %s, reader %s", stateString(cr.server.state), stateString(cr.state))
 	} else {
-		nn, err = cr.copyToDst(dst)
+		nn, err = cr.copyToDst(ctx, dst)
 	}
 
 	return
@@ -167,67 +289,267 @@ func (cr *Reader) Close() (err error) {
 	}
 	cr.server = nil
 	cr.state = state_closed
-	cr.ids = nil
+	cr.refs = nil
+	cr.sizes = nil
+	cr.inner = nil
+	cr.leafid, cr.leaf = "", nil
 	return
 }
 
+/*
+Copy all of src to the Server and build the tree.  Returns the root id.
+No further writes are accepted afterwards, but Close must still be called.
+If building the tree fails the Writer stays failed: Close returns the
+error and Id stays empty.
+*/
 func (cw *Writer) Copy(src io.Reader) (id string, nn int, err error) {
+	return cw.CopyContext(cw.ctx, src)
+}
+
+/*
+As Copy.  If ctx is done before the tree is built the Writer is cancelled
+for good and the error is ctx's.
+*/
+func (cw *Writer) CopyContext(ctx context.Context, src io.Reader) (id string, nn int, err error) {
+	var cnt int64
 
 	if cw.server.state != state_open || cw.state != state_open {
 		err = fmt.Errorf("not opened: server %s, reader %s", stateString(cw.server.state), stateString(cw.state))
 	} else {
-		nn, err = cw.copySrc(src)
-		if len(cw.ids) > 1 {
-			id, err = cw.copyIds(src)
-		} else if len(cw.ids) == 1 {
-			id = cw.ids[0]
-		} else {
-			panic("no ids")
+		defer cw.bind(ctx)()
+		cnt, err = io.Copy(cw, src)
+		nn = int(cnt)
+		if err == nil {
+			id, err = cw.finish()
+		}
+		if cause := context.Cause(cw.ctx); err != nil && cause != nil {
+			err = cause
 		}
 	}
 
 	return
 }
 
+/*
+Cancel the Writer, with ctx's error as the cause, if ctx is done before
+the returned func is called.
+*/
+func (cw *Writer) bind(ctx context.Context) (stop func() bool) {
+	if ctx == cw.ctx {
+		return func() bool { return true }
+	}
+	return context.AfterFunc(ctx, func() { cw.cancel(ctx.Err()) })
+}
+
+/*
+Implement io.Writer.  Data is buffered and cut into DATA blocks of exactly
+cam_block_size - cam_header_size bytes, so the tree depends only on the
+content and not on how it was split across calls to Write.
+*/
+func (cw *Writer) Write(p []byte) (nn int, err error) {
+	const payload = cam_block_size - cam_header_size
+
+	if cw.server == nil || cw.server.state != state_open || cw.state != state_open {
+		err = fmt.Errorf("not opened: writer %s", stateString(cw.state))
+		return
+	}
+	if cw.done {
+		err = fmt.Errorf("write after finish")
+		return
+	}
+	if err = context.Cause(cw.ctx); err != nil {
+		return
+	}
+
+	for len(p) > 0 {
+		if len(cw.buff) == 0 && len(p) >= payload {
+			// whole block straight from the caller
+			if err = cw.putData(p[:payload]); err != nil {
+				return
+			}
+			nn += payload
+			p = p[payload:]
+			continue
+		}
+		cnt := payload - len(cw.buff)
+		if cnt > len(p) {
+			cnt = len(p)
+		}
+		cw.buff = append(cw.buff, p[:cnt]...)
+		nn += cnt
+		p = p[cnt:]
+		if len(cw.buff) == payload {
+			if err = cw.putData(cw.buff); err != nil {
+				return
+			}
+			cw.buff = cw.buff[:0]
+		}
+	}
+
+	return
+}
+
+/*
+Flush any buffered data, build the tree and release the Writer.
+Implements io.Closer; the root id is then available from Id.
+*/
 func (cw *Writer) Close() (err error) {
+	return cw.CloseContext(cw.ctx)
+}
+
+/*
+As Close.  If ctx is done first the tree is not finished and Id stays
+empty; the blocks already stored are left for GC.
+*/
+func (cw *Writer) CloseContext(ctx context.Context) (err error) {
 	if cw.state != state_open {
 		panic("unexpected state")
 	}
+	defer cw.bind(ctx)()
+	if !cw.done && cw.server != nil && cw.server.state == state_open {
+		_, err = cw.finish()
+	}
+	if cw.pipe != nil {
+		// nothing may still be holding ids when they are released
+		cw.pipe.wait()
+		cw.pipe = nil
+	}
+	if cw.server != nil {
+		cw.server.release(cw.held)
+	}
+	cw.cancel(context.Canceled)
+	cw.held = nil
 	cw.server = nil
 	cw.state = state_closed
-	cw.ids = nil
+	cw.refs = nil
+	cw.buff = nil
+	return
+}
+
+/*
+The root id of everything written, once Copy or Close has built the tree.
+For an encrypted Writer this is the capability "id:key", which is all a
+Reader needs.  EmptyId if nothing was written, and "" until the tree is
+built.
+*/
+func (cw *Writer) Id() (id string) {
+	return cw.root.cap()
+}
+
+/*
+Write out the final short block and the indirect blocks above the data.
+Returns Id.
+*/
+func (cw *Writer) finish() (id string, err error) {
+	var root camref
+
+	if cw.done {
+		return cw.Id(), nil
+	}
+	defer func() {
+		if err != nil {
+			// blocks below the root may be lost, so the Writer is
+			// failed for good and a later Close publishes nothing
+			cw.cancel(err)
+		}
+	}()
+	if len(cw.buff) > 0 {
+		if err = cw.putData(cw.buff); err != nil {
+			return
+		}
+		cw.buff = cw.buff[:0]
+	}
+	if cw.pipe != nil {
+		if err = cw.pipe.wait(); err != nil {
+			return
+		}
+	}
+
+	depth := treeDepth(len(cw.refs), cam_sized_indirect_cnt)
+	if cw.secret != nil {
+		depth = treeDepth(len(cw.refs), cam_keyed_indirect_cnt)
+	}
+	if len(cw.refs) > 1 {
+		root, err = cw.server.putIndirect(cw.ctx, cw.refs, cw.secret, cw.codec, &cw.held)
+	} else if len(cw.refs) == 1 {
+		root = cw.refs[0]
+	} else {
+		root.id, err = cw.server.putHeld(cw.ctx, []byte(cam_empty_head), nil, &cw.held)
+	}
+	if err == nil && cw.batch != nil {
+		err = cw.batch.flush(cw.ctx)
+	}
+	if err == nil {
+		// nothing is published unless every put below it finished in time
+		err = context.Cause(cw.ctx)
+	}
+	if err == nil {
+		cw.root, cw.refs = root, nil
+		cw.done = true
+		id = cw.Id()
+		cw.server.metered().depth(depth)
+	}
+
 	return
 }
 
-func (cr *Reader) copyToDst(dst io.Writer) (nn int, err error) {
+/*
+Walk the tree breadth first, writing DATA blocks out in order while up to
+the Server's concurrency blocks further along the queue are fetched ahead,
+see pipeline.go.
+*/
+func (cr *Reader) copyToDst(ctx context.Context, dst io.Writer) (nn int, err error) {
 	var (
-		id, tag string
-		cnt, ii int
-		buff [cam_block_size]byte
+		tag string
+		cnt, workers int
+		ff *fetch
+		ahead []*fetch
+		refs []camref
+		cancel context.CancelFunc
 	)
 
+	ctx, cancel = context.WithCancel(ctx)
+	defer func() {
+		// stop and wait for whatever was fetched ahead
+		cancel()
+		for _, ff := range ahead {
+			<-ff.done
+		}
+	}()
+	workers = cr.server.concurrency()
+
 loop:
-	for len(cr.ids) > 0 {
-		id, cr.ids = cr.ids[0], cr.ids[1:]
-		if err = cr.server.getBlock(id, buff[:]); err != nil {
+	for {
+		for len(ahead) < workers && len(cr.refs) > 0 {
+			ahead = append(ahead, cr.server.prefetch(ctx, cr.refs[0]))
+			cr.refs = cr.refs[1:]
+		}
+		if len(ahead) == 0 {
+			break loop
+		}
+		ff, ahead = ahead[0], ahead[1:]
+		<-ff.done
+
+		if err = ff.err; err != nil {
 			if err == io.EOF {
 				err = nil
 			}
 			break loop
 		}
-		if tag, cnt, err = cr.parseHeader(buff[:]); err != nil {
+		if tag, cnt, err = parseHeader(ff.block[:]); err != nil {
 			break loop
 		}
 		switch tag {
 		case "DATA":
-			if cnt, err = dst.Write(buff[cam_header_size:cam_header_size+cnt]); err != nil {
+			if cnt, err = dst.Write(ff.block[cam_header_size:cam_header_size+cnt]); err != nil {
 				break loop
 			}
 			nn += int(cnt)
 		case "INDB":
-			for ii = cam_header_size; ii < cam_header_size+cnt; ii += 32 {
-				cr.ids = append(cr.ids, string(buff[ii:ii+32]))
+			if refs, err = parseIndirect(ff.block[:], cnt); err != nil {
+				break loop
 			}
+			cr.refs = append(cr.refs, refs...)
 		default:
 			err = fmt.Errorf("unimplemented block type: %s", tag)
 			break loop
@@ -238,182 +560,303 @@ loop:
 }
 
 /*
-The first 32 bytes describe the block.
+The first 32 bytes describe the block, see header.go.  blocksize is the
+length of the decoded payload.
 */
-func (cr *Reader) parseHeader(data []byte) (blocktype string, blocksize int, err error) {
+func parseHeader(data []byte) (blocktype string, blocksize int, err error) {
+	var hd header
 
-	var nn int64
-
-	if len(data) != cam_block_size {
-		err = fmt.Errorf("BUG: parseHeader: incorrect block size: %d\n", len(data))
+	if hd, err = decodeHeader(data); err != nil {
 		return
 	}
 
-	blocktype = string(data[4:8])
-	
-	if nn, err = strconv.ParseInt(string(data[8:12]), 16, 16); err != nil {
-		err = fmt.Errorf("ERROR: parseHeader: failed to convert blocksize: %s, %s\n", data[8:12], err.Error())
+	return hd.tag, hd.cnt, nil
+}
+
+/*
+The ids a block refers to.  DATA blocks have none.
+*/
+func blockChildren(block []byte) (ids []string, err error) {
+	var (
+		hd header
+		refs []camref
+		ent *Entry
+	)
+
+	if hd, err = decodeHeader(block); err != nil {
 		return
 	}
-
-	blocksize = int(nn)
+	if !hd.crypt && hd.codec != CodecNone {
+		if block, err = decodeBlock(camref{}, block); err != nil {
+			return
+		}
+	}
+	switch hd.tag {
+	case "DATA":
+	case "FILE", "DIRB":
+		if ent, err = parseEntry("", block); err != nil {
+			return
+		}
+		if ent.Root != "" {
+			ids = append(ids, ent.Root)
+		}
+	case "INDB":
+		if hd.crypt {
+			// only the ids are in the clear
+			if cam_header_size + hd.cnt/cam_keyed_entry*32 > len(block) {
+				err = fmt.Errorf("bad indirect block: short")
+				return
+			}
+			ids = clearIds(block, hd.cnt)
+			break
+		}
+		if refs, err = parseIndirect(block, hd.cnt); err != nil {
+			return
+		}
+		for _, ref := range refs {
+			ids = append(ids, ref.id)
+		}
+	case "REFB":
+		if cam_header_size+hd.cnt > len(block) {
+			err = fmt.Errorf("bad ref block: short")
+			return
+		}
+		ids, err = refChildren(block[cam_header_size:cam_header_size+hd.cnt])
+	default:
+		err = fmt.Errorf("unimplemented block type: %s", hd.tag)
+	}
 
 	return
 }
 
-func (cw *Writer) copySrc(src io.Reader) (nn int, err error) {
+/*
+Return the children of an indirect block.  cnt is the payload length from
+the header.  Legacy blocks carry no sizes, so every ref has size -1.
+An encrypted block must already be decrypted.
+*/
+func parseIndirect(data []byte, cnt int) (refs []camref, err error) {
 	var (
-		buff [cam_block_size - cam_header_size]byte
-		head, data []byte
-		id string
-		cnt, salt int
+		ii, width int
+		size int64
+		hd header
 	)
 
-loop:
-	for {
-		if cnt, err = src.Read(buff[:]); err != nil {
-			if err == io.EOF {
-				err = nil
+	if hd, err = decodeHeader(data); err != nil {
+		return
+	}
+	if hd.sized && hd.crypt {
+		return parseKeyed(data, cnt)
+	}
+
+	width = 32
+	if hd.sized {
+		width = cam_sized_entry
+	}
+	if cnt%width != 0 || cam_header_size+cnt > len(data) {
+		err = fmt.Errorf("bad indirect block: %d bytes of %d byte entries", cnt, width)
+		return
+	}
+
+	for ii = cam_header_size; ii < cam_header_size+cnt; ii += width {
+		size = -1
+		if width == cam_sized_entry {
+			if size, err = strconv.ParseInt(string(data[ii+32:ii+width]), 16, 64); err != nil {
+				err = fmt.Errorf("bad indirect block size: %s, %s", data[ii+32:ii+width], err.Error())
+				return
 			}
-			break loop
 		}
-		salt = 0
-		head = []byte(fmt.Sprintf("%04xDATA%04x--------------------", salt, cnt))
-		data = buff[:cnt]
-		data = append(data, []byte(strings.Repeat("-", cam_block_size - cam_header_size - cnt))...)
+		refs = append(refs, camref{ id: string(data[ii:ii+32]), size: size })
+	}
 
-		if id, err = cw.server.putBlock(head, data); err != nil {
-			break loop
-		}
+	return
+}
 
-		cw.ids = append(cw.ids, id)
-		nn += cnt
+/*
+Queue one DATA block on the Writer's pipe.  Its ref is filled in when the
+put completes; an error is that of the first put to fail.
+*/
+func (cw *Writer) putData(buff []byte) (err error) {
+	var (
+		head, data []byte
+		cnt, idx int
+		hd header
+	)
+
+	cnt = len(buff)
+	hd = newHeader("DATA", cnt)
+	head = hd.encode()
+	data = append([]byte(nil), buff...)
+
+	if cw.pipe == nil {
+		cw.pipe = newPipe(cw.ctx, cw.server.concurrency())
 	}
 
-	return
+	cw.mu.Lock()
+	idx = len(cw.refs)
+	cw.refs = append(cw.refs, camref{ size: int64(cnt) })
+	cw.mu.Unlock()
+
+	return cw.pipe.run(func(ctx context.Context) (err error) {
+		var ref camref
+
+		if ref, err = cw.server.putSealed(ctx, head, data, cw.secret, cw.codec, &cw.held); err != nil {
+			return
+		}
+		cw.mu.Lock()
+		cw.refs[idx].id, cw.refs[idx].key = ref.id, ref.key
+		cw.mu.Unlock()
+
+		return
+	})
 }
 
-func (cw *Writer) copyIds(src io.Reader) (id string, err error) {
+/*
+Build the indirect blocks over refs bottom up until a single root remains.
+Each indirect block records the size of every child, and with a secret
+their keys, see crypt.go.  A single ref is its own root.  The blocks of
+each level are put in parallel, see pipeline.go.
+*/
+func (cs *Server) putIndirect(ctx context.Context, refs []camref, secret []byte, codec Codec, held *[]string) (root camref, err error) {
 	var (
-		data [cam_block_size - cam_header_size]byte
-		head []byte
-		cnt, ii, salt int
-		newids []string
+		data []byte
+		heads, datas [][]byte
+		cnt, ii, fanout, width int
+		total int64
+		ref camref
+		newrefs []camref
+		hd header
 	)
 
-loop:
-	for len(cw.ids) > 0 {
-		newids = nil
-		for len(cw.ids) > 0 {
-			cnt = len(cw.ids)
-			if cnt > cam_indirect_cnt {
-				cnt = cam_indirect_cnt
-			}
-			for ii = 0; ii < cnt; ii++ {
-				id, cw.ids = cw.ids[0], cw.ids[1:]
-				copy(data[ii*32:ii*32+32], id)
-			}
-			for ; ii < cam_indirect_cnt; ii++ {
-				copy(data[ii*32:ii*32+32], "--------------------------------")
+	if len(refs) == 1 {
+		return refs[0], nil
+	}
+
+	fanout, width = cam_sized_indirect_cnt, cam_sized_entry
+	if secret != nil {
+		fanout, width = cam_keyed_indirect_cnt, cam_keyed_entry
+	}
+
+	for len(refs) > 0 {
+		newrefs, heads, datas = nil, nil, nil
+		for len(refs) > 0 {
+			cnt = len(refs)
+			if cnt > fanout {
+				cnt = fanout
 			}
-			salt = 0
-			head = []byte(fmt.Sprintf("%04xINDB%04x--------------------", salt, cnt*32))
-			if id, err = cw.server.putBlock(head, data[:]); err != nil {
-				break loop
+			data = make([]byte, cnt*width)
+			if secret != nil {
+				total = putKeyed(data, refs[:cnt])
+				refs = refs[cnt:]
+			} else {
+				total = 0
+				for ii = 0; ii < cnt; ii++ {
+					ref, refs = refs[0], refs[1:]
+					copy(data[ii*cam_sized_entry:], fmt.Sprintf("%s%016x", ref.id, ref.size))
+					total += ref.size
+				}
 			}
+			hd = newHeader("INDB", cnt*width)
+			hd.sized, hd.total = true, total
+			heads = append(heads, hd.encode())
+			datas = append(datas, data)
+			newrefs = append(newrefs, camref{ size: total })
+		}
+		// assert len(refs) == 0
 
-			newids = append(newids, id)
+		if err = cs.parallel(ctx, len(newrefs), func(ctx context.Context, ii int) (err error) {
+			var ref camref
+
+			if ref, err = cs.putSealed(ctx, heads[ii], datas[ii], secret, codec, held); err == nil {
+				newrefs[ii].id, newrefs[ii].key = ref.id, ref.key
+			}
+			return
+		}); err != nil {
+			return
 		}
-		// assert len(cw.ids) == 0
 
-		if len(newids) > 1 {
-			cw.ids = newids
-		} else if len(newids) == 1 {
-			id = newids[0]
+		if len(newrefs) > 1 {
+			refs = newrefs
+		} else if len(newrefs) == 1 {
+			root = newrefs[0]
 		}
 	}
 
-	return}
+	return
+}
 
 /*
-BUGS:
-1.  This should probably be implemented by a Server interface and concrete 
-    types that support http and file system cams.
+Put a block to the Server's store.  Return the block id.
 */
 func (cs *Server) putBlock(head, data []byte) (id string, err error) {
-/*
-Put a block to either the local file system or an http block server.
-Return the block id.
-
-*/
-
-	if cs.client != nil {
-		panic("unimplemented")
-	} else if cs.fsroot != "" {
-		id, err = cs.putBlockFile(head, data)
-	} else {
-		panic("bad Server root")
-	}
-
-	return
+	return cs.putHeld(context.Background(), head, data, nil)
 }
 
-func (cs *Server) putBlockFile(head, data []byte) (id string, err error) {
+/*
+As putBlock, but when held is not nil the id is appended to it and kept
+safe from a concurrent GC until released.
+*/
+func (cs *Server) putHeld(ctx context.Context, head, data []byte, held *[]string) (id string, err error) {
 	var (
 		hh hash.Hash
-		fh *os.File
-		fn string
+		block []byte
 	)
 
+	block = make([]byte, 0, len(head)+len(data))
+	block = append(block, head...)
+	block = append(block, data...)
+
 	hh = md5.New()
-	hh.Write(head)
-	hh.Write(data)
+	hh.Write(block)
 	id = fmt.Sprintf("%x", hh.Sum(nil))
-	fn = cs.fsroot + "/" + id
-	if _, err = os.Stat(fn); err != nil {
-		if fh, err = os.Create(fn); err == nil {
-			fh.Write(head)
-			fh.Write(data)
-			fh.Close()
-		}
+
+	if held != nil {
+		cs.holdInto(held, id)
+	}
+
+	if bb := batchFrom(ctx); bb != nil {
+		err = bb.put(ctx, id, block)
+	} else {
+		err = cs.metered().put(ctx, cs.store, id, block)
 	}
 
 	return
 }
 
-func (cs *Server) getBlock(id string, data []byte) (err error) {
 /*
-Get a block from either a local file system or an http block server.
+Get a block from the Server's store, as stored.  What comes back is
+checked against the id, so a truncated or damaged block is an error
+wrapping ErrCorrupt, never data.  See readBlock for the decoded block.
 */
-	if cs.client != nil {
-		panic("unimplemented")
-	} else if cs.fsroot != "" {
-		err = cs.getBlockFile(id, data)
-	} else {
-		panic("bad server root")
+func (cs *Server) getBlock(ctx context.Context, id string) (block []byte, err error) {
+
+	if block, err = cs.metered().get(ctx, cs.store, id); err != nil {
+		return
+	}
+	if err = verifyBlock(id, block); err != nil {
+		block = nil
 	}
 
 	return
 }
 
-func (cs *Server) getBlockFile(id string, data []byte) (err error) {
+/*
+Check a block read from a store against its id.
+*/
+func verifyBlock(id string, block []byte) (err error) {
 	var (
-		fh *os.File
-		fn string
-		nn int
+		hh hash.Hash
+		sum string
 	)
 
-	fn = cs.fsroot + "/" + id
-	if fh, err = os.Open(fn); err != nil {
-		goto out
+	if len(block) < cam_header_size || len(block) > cam_block_size {
+		return fmt.Errorf("%w: %s: %d bytes", ErrCorrupt, id, len(block))
 	}
-	defer fh.Close()
-	if nn, err = io.ReadFull(fh, data); err != nil {
-		goto out
+
+	hh = md5.New()
+	hh.Write(block)
+	if sum = fmt.Sprintf("%x", hh.Sum(nil)); sum != id {
+		return fmt.Errorf("%w: %s: content hashes to %s", ErrCorrupt, id, sum)
 	}
-	// TODO: check nn
-	nn = nn
 
-out:
 	return
 }
@@ -1,17 +1,18 @@
 package camfile
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/md5"
 	"fmt"
 	"hash"
 	"io"
-	"os"
+	"math/rand"
+	"path/filepath"
 	"testing"
-)
-
-const (
-	cam_root_local = "/home/mike/Dev/SecureServer/cam"
-	cam_root_http = "http://localhost:8080"
+	"testing/iotest"
+	"time"
 )
 
 func TestNewServer(t *testing.T) {
@@ -23,209 +24,437 @@ func TestNewServer(t *testing.T) {
 
 func TestOpen(t *testing.T) {
 	t.Run("local", openLocal)
-//	t.Run("http", openHttp)
+	t.Run("http", openHttp)
 }
 
 func TestCreate(t *testing.T) {
 	t.Run("local", createLocal)
-//	t.Run("http", createHttp)
+	t.Run("http", createHttp)
 }
 
 func TestWriteToCam(t *testing.T) {
+	t.Run("write-local-zero", writeToCamZero)
 	t.Run("write-local-oneblock", writeToCamOne)
 	t.Run("write-local-twoblock", writeToCamTwo)
 }
 
+func TestWriteStream(t *testing.T) {
+	t.Run("chunking", writeStreamChunking)
+	t.Run("short-reads", writeStreamShortReads)
+	t.Run("encoder", writeStreamEncoder)
+}
+
 func TestReadFromCam(t *testing.T) {
 	t.Run("read-local-oneblock", readFromCamOne)
-//	t.Run("read-local-twoblock", readFromCamTwo)
 }
 
 /*
-TODO: should we allow empty files?
+Empty content has a root like any other, the same for every Writer.
 */
 func writeToCamZero(t *testing.T) {
-	t.Fatal("unimplemented")
+	var (
+		cs *Server
+		cw *Writer
+		cr *Reader
+		err error
+		id string
+		nn int
+		buff bytes.Buffer
+	)
+
+	cs = memServer(t)
+
+	if cw, err = cs.Create(); err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+	if id, nn, err = cw.Copy(bytes.NewReader(nil)); err != nil {
+		t.Fatal("failed to copy to cam, ", err.Error())
+	}
+	cw.Close()
+	if id != EmptyId || nn != 0 {
+		t.Fatal("unexpected empty root", id, nn)
+	}
+
+	// nothing written at all, and encrypted
+	if cw, err = cs.Create(); err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+	if err = cw.Close(); err != nil || cw.Id() != EmptyId {
+		t.Fatal("unexpected empty root on close", cw.Id(), err)
+	}
+	if cw, err = cs.CreateEncrypted(cryptSecret); err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+	if err = cw.Close(); err != nil || cw.Id() != EmptyId {
+		t.Fatal("unexpected encrypted empty root", cw.Id(), err)
+	}
+
+	if cr, err = cs.Open(id); err != nil {
+		t.Fatal("failed to create reader, ", err.Error())
+	}
+	defer cr.Close()
+	if nn, err = cr.Copy(&buff); err != nil || nn != 0 || buff.Len() != 0 {
+		t.Fatal("empty root read back content", nn, err)
+	}
+	if nn, err = cr.Read(make([]byte, 10)); nn != 0 || err != io.EOF {
+		t.Fatal("expected EOF", nn, err)
+	}
+}
+
+/*
+Sizes around block and fan-out boundaries read back the same from every
+backend, under the same root.
+*/
+func TestBoundaries(t *testing.T) {
+	const payload = cam_block_size - cam_header_size
+
+	var (
+		backends = []struct {
+			name string
+			open func(t *testing.T) *Server
+		}{
+			{ "mem", func(t *testing.T) *Server { return memServer(t) } },
+			{ "dir", func(t *testing.T) *Server { return connServer(t, t.TempDir()) } },
+			{ "fanout", func(t *testing.T) *Server {
+				store, err := NewFileStore(t.TempDir(), 2)
+				if err != nil {
+					t.Fatal("failed to create store, ", err.Error())
+				}
+				return NewServerStore(store)
+			} },
+			{ "pack", func(t *testing.T) *Server { return connServer(t, "pack:" + t.TempDir()) } },
+			{ "http", func(t *testing.T) *Server {
+				remote, cs := httpSetup(t, nil)
+				t.Cleanup(func() { remote.Close() })
+				return cs
+			} },
+		}
+		sizes = []int{
+			0, 1, payload - 1, payload, payload + 1,
+			cam_sized_indirect_cnt * payload, cam_sized_indirect_cnt*payload + 1,
+			cam_sized_indirect_cnt * cam_sized_indirect_cnt * payload,
+			cam_sized_indirect_cnt*cam_sized_indirect_cnt*payload + 1,
+		}
+		roots = make(map[int]string)
+	)
+
+	for _, be := range backends {
+		t.Run(be.name, func(t *testing.T) {
+			cs := be.open(t)
+			defer cs.Close()
+			for _, size := range sizes {
+				id := boundaryCheck(t, cs, size)
+				if want, ok := roots[size]; ok && id != want {
+					t.Fatal("root differs between backends", be.name, size, id, want)
+				}
+				roots[size] = id
+			}
+		})
+	}
+}
+
+func boundaryCheck(t *testing.T, cs *Server, size int) (id string) {
+	var (
+		cw *Writer
+		cr *Reader
+		err error
+		nn int
+		total int64
+		content, tail []byte
+		buff bytes.Buffer
+		report *FsckReport
+	)
+
+	content = make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(content)
+
+	if cw, err = cs.Create(); err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+	if id, nn, err = cw.Copy(bytes.NewReader(content)); err != nil || nn != size {
+		t.Fatal("failed to copy to cam, ", size, nn, err)
+	}
+	cw.Close()
+	if (size == 0) != (id == EmptyId) {
+		t.Fatal("unexpected root", size, id)
+	}
+
+	if cr, err = cs.Open(id); err != nil {
+		t.Fatal("failed to create reader, ", err.Error())
+	}
+	defer cr.Close()
+	if nn, err = cr.Copy(&buff); err != nil || nn != size || !bytes.Equal(buff.Bytes(), content) {
+		t.Fatal("content mismatch", size, nn, err)
+	}
+	if total, err = cr.Size(); err != nil || total != int64(size) {
+		t.Fatal("wrong size", size, total, err)
+	}
+	tail = make([]byte, 2)
+	if nn, err = cr.ReadAt(tail, int64(size)); nn != 0 || err != io.EOF {
+		t.Fatal("expected EOF at the end", size, nn, err)
+	}
+	if size > 0 {
+		if nn, err = cr.ReadAt(tail, int64(size-1)); nn != 1 || err != io.EOF || tail[0] != content[size-1] {
+			t.Fatal("wrong last byte", size, nn, err)
+		}
+	}
+	if report, err = cs.Fsck(nil, ""); err != nil || !report.Ok() {
+		t.Fatal("fsck failed", size, report, err)
+	}
+
+	return
 }
 
 /*
-Read a file that should have been uploaded in a previous test.
+Write two blocks' worth of content and read it back, checking the count
+of bytes and the md5 of what came out against what went in.
 */
 func readFromCamOne(t *testing.T) {
 
 	var (
 		cs *Server
+		cw *Writer
 		cr *Reader
 		err error
-		fh *os.File
 		id string
 		nn int
 		hh hash.Hash
-		data [32 * 1024]byte 	// large enough to be too large
+		content []byte
+		buff bytes.Buffer
 	)
-	if cs, err = NewServer(cam_root_local); err != nil {
-		t.Fatal("failed to create server", err.Error())
+	cs = memServer(t)
+
+	content = make([]byte, 993)
+	rand.New(rand.NewSource(993)).Read(content)
+
+	if cw, err = cs.Create(); err != nil {
+		t.Fatal("failed to create writer", err.Error())
 	}
-	defer cs.Close()
+	if id, _, err = cw.Copy(bytes.NewReader(content)); err != nil {
+		t.Fatal("failed to copy to cam", err.Error())
+	}
+	cw.Close()
 
-	if cr, err = cs.Open("f4b946cdd69b35a8a66fd2b1e56245e9"); err != nil {
+	if cr, err = cs.Open(id); err != nil {
 		t.Fatal("failed to create reader", err.Error())
 	}
 	defer cr.Close()
 
-	if fh, err = os.Create("/tmp/camfile-test.dat"); err != nil {
-		t.Fatal("failed to create tmp file", err.Error())
-	}
-
-	if nn, err = cr.Copy(fh); err != nil {
+	if nn, err = cr.Copy(&buff); err != nil {
 		t.Fatal("failed to read cam", err.Error())
 	}
-	
-	fh.Close()
 
 	if nn != 993 {
 		t.Fatal("unexpected copy size", nn)
 	}
 
-	if fh, err = os.Open("/tmp/camfile-test.dat"); err != nil {
-		t.Fatal("failed to reopen tmp file", err.Error())
-	}
-
-	if nn, err = io.ReadFull(fh, data[:]); err != nil {
-		if err != io.ErrUnexpectedEOF {
-			t.Fatal("failed to reread tmp file", err.Error())
-		}
-	}
-	fh.Close()
-
 	hh = md5.New()
-	hh.Write(data[:nn])
+	hh.Write(buff.Bytes())
 	id = fmt.Sprintf("%x", hh.Sum(nil))
 
-	if id != "60a3f7763758c3b52320d683b89e489f" {
-		t.Fatal("unexpected hash", id)
+	if want := fmt.Sprintf("%x", md5.Sum(content)); id != want {
+		t.Fatal("unexpected hash", id, want)
 	}
 
 }
 
 func writeToCamOne(t *testing.T) {
+	writeToCamBlocks(t, 992, 1)
+}
+
+/*
+One byte over a block is two data blocks under an indirect root.
+*/
+func writeToCamTwo(t *testing.T) {
+	writeToCamBlocks(t, 993, 3)
+}
+
+/*
+Write size bytes to a fresh store and check the count and the number of
+blocks it took.  The root is the md5 of its block, so it must be stored
+under that id.
+*/
+func writeToCamBlocks(t *testing.T, size, blocks int) {
 	var (
 		cs *Server
 		cw *Writer
 		err error
-		fh *os.File
 		id string
-		nn int
+		nn, cnt int
+		block, content []byte
 	)
 
-	nn = nn
-
-	if cs, err = NewServer(cam_root_local); err != nil {
-		t.Fatal("failed to create server, ", err.Error())
-	}
+	store := NewMemStore()
+	cs = NewServerStore(store)
 	defer cs.Close()
 
+	content = make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(content)
+
 	if cw, err = cs.Create(); err != nil {
 		t.Fatal("failed to create writer, ", err.Error())
 	}
 	defer cw.Close()
 
-	if fh, err = os.Open("testdata/camfile-test-one-block.dat"); err != nil {
-		t.Fatal("failed to open test data, ", err.Error())
+	if id, nn, err = cw.Copy(bytes.NewReader(content)); err != nil {
+		t.Fatal("failed to copy to cam, ", err.Error())
 	}
-	defer fh.Close()
 
-	if id, nn, err = cw.Copy(fh); err != nil {
-		t.Fatal("failed to copy to cam, ", err.Error())
+	if nn != size {
+		t.Fatal("unexpected upload size", nn)
+	}
+	if block, err = store.Get(context.Background(), id); err != nil {
+		t.Fatal("root block not stored, ", err.Error())
+	}
+	if sum := fmt.Sprintf("%x", md5.Sum(block)); sum != id {
+		t.Fatal("unexpected root block", id, sum)
+	}
+	store.Walk(context.Background(), func(string, time.Time) error {
+		cnt++
+		return nil
+	})
+	if cnt != blocks {
+		t.Fatal("unexpected block count", cnt, blocks)
 	}
+}
 
-	if id != "ae0fab12f558c802558726d04cb5aed6" {
-		t.Fatal("unexpected root block", id)
+/*
+Write content in chunks of the given size and return the root id.
+*/
+func writeStreamChunks(t *testing.T, cs *Server, content []byte, chunk int) (id string) {
+	var (
+		cw *Writer
+		err error
+		nn, off int
+	)
+
+	if cw, err = cs.Create(); err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
 	}
-	if nn != 992 {
-		t.Fatal("unexpected upload size", nn)
+	for off = 0; off < len(content); off += nn {
+		end := off + chunk
+		if end > len(content) {
+			end = len(content)
+		}
+		if nn, err = cw.Write(content[off:end]); err != nil {
+			t.Fatal("failed to write, ", err.Error())
+		}
+	}
+	if err = cw.Close(); err != nil {
+		t.Fatal("failed to close writer, ", err.Error())
 	}
+
+	return cw.Id()
 }
 
-func writeToCamTwo(t *testing.T) {
+/*
+The root must not depend on how the content was split across writes.
+*/
+func writeStreamChunking(t *testing.T) {
+	var (
+		cs *Server
+		content []byte
+		id, want string
+	)
+
+	cs = memServer(t)
+
+	content = make([]byte, 50*1024+3)
+	rand.New(rand.NewSource(2)).Read(content)
+
+	want = writeStreamChunks(t, cs, content, len(content))
+	for _, chunk := range []int{1, 7, 991, 992, 993, 4096} {
+		if id = writeStreamChunks(t, cs, content, chunk); id != want {
+			t.Fatal("root depends on write size", chunk, id, want)
+		}
+	}
+}
+
+/*
+Copy from a reader that returns one byte at a time.
+*/
+func writeStreamShortReads(t *testing.T) {
 	var (
 		cs *Server
 		cw *Writer
 		err error
-		fh *os.File
-		id string
+		content []byte
+		id, want string
 		nn int
 	)
 
-	nn = nn
+	cs = memServer(t)
 
-	if cs, err = NewServer(cam_root_local); err != nil {
-		t.Fatal("failed to create server, ", err.Error())
-	}
-	defer cs.Close()
+	content = make([]byte, 3000)
+	rand.New(rand.NewSource(3)).Read(content)
+	want = writeStreamChunks(t, cs, content, len(content))
 
 	if cw, err = cs.Create(); err != nil {
 		t.Fatal("failed to create writer, ", err.Error())
 	}
 	defer cw.Close()
 
-	if fh, err = os.Open("testdata/camfile-test-two-block.dat"); err != nil {
-		t.Fatal("failed to open test data, ", err.Error())
-	}
-	defer fh.Close()
-
-	if id, nn, err = cw.Copy(fh); err != nil {
+	if id, nn, err = cw.Copy(iotest.OneByteReader(bytes.NewReader(content))); err != nil {
 		t.Fatal("failed to copy to cam, ", err.Error())
 	}
-
-	if id != "f4b946cdd69b35a8a66fd2b1e56245e9" {
-		t.Fatal("unexpected root block", id)
+	if id != want {
+		t.Fatal("unexpected root block", id, want)
 	}
-	if nn != 993 {
+	if nn != len(content) {
 		t.Fatal("unexpected upload size", nn)
 	}
+	if _, err = cw.Write([]byte("x")); err == nil {
+		t.Fatal("expected error writing after Copy")
+	}
 }
 
 /*
-Read a known file from the Cam.
-Ensure the expected number of bytes is reported.
-Ensure the file matches a known md5.
+Use the Writer as the destination of a gzip.Writer and read it back.
 */
-/*
-func TestReadFromCam(t *testing.T) {
+func writeStreamEncoder(t *testing.T) {
 	var (
 		cs *Server
+		cw *Writer
 		cr *Reader
+		zw *gzip.Writer
+		zr *gzip.Reader
 		err error
-		fh *os.File
-		nn int
+		content, got []byte
 	)
 
-	nn = nn
-	
-	if cs, err = NewServer(cam_root_local); err != nil {
-		t.Fatal("failed to create server, ", err.Error())
+	cs = memServer(t)
+
+	content = bytes.Repeat([]byte("all work and no play makes jack a dull boy\n"), 1000)
+
+	if cw, err = cs.Create(); err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+	zw = gzip.NewWriter(cw)
+	if _, err = zw.Write(content); err != nil {
+		t.Fatal("failed to write, ", err.Error())
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal("failed to close gzip, ", err.Error())
+	}
+	if err = cw.Close(); err != nil {
+		t.Fatal("failed to close writer, ", err.Error())
 	}
-	defer cs.Close()
 
-	if cr, err = cs.Open(); err != nil {
+	if cr, err = cs.Open(cw.Id()); err != nil {
 		t.Fatal("failed to create reader, ", err.Error())
 	}
 	defer cr.Close()
-
-	if fh, err = os.Create("/tmp/camfile-test.dat"); err != nil {
-		t.Fatal("failed to create tmp file, ", err.Error())
+	if zr, err = gzip.NewReader(cr); err != nil {
+		t.Fatal("failed to open gzip, ", err.Error())
 	}
-	defer fh.Close()
-
-	if nn, err = cr.Copy(fh); err != nil {
-		t.Fatal("failed to copy from cam, ", err.Error())
+	if got, err = io.ReadAll(zr); err != nil {
+		t.Fatal("failed to read, ", err.Error())
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("content mismatch")
 	}
-
-	t.Fatal("unimplemented copy count test")
-	t.Fatal("unimplemented md5 test")
 }
-*/
+
 // Must have a connection string
 func newServerNoConnection(t *testing.T) {
 	var (
@@ -282,17 +511,17 @@ func newServerLocalBadPath(t *testing.T) {
 	)
 
 	// file system strings must refer to valid directories
-	cs, err = NewServer("/tmp/bad/path")
+	bad := filepath.Join(t.TempDir(), "bad", "path")
+	cs, err = NewServer(bad)
 	if cs != nil {
 		t.Error("unexpected server: ", cs)
 	}
 	if err == nil {
 		t.Error("expected error")
 	}
-	if err != nil && err.Error() != "bad root: /tmp/bad/path, stat /tmp/bad/path: no such file or directory" {
+	if err != nil && err.Error() != "bad root: " + bad + ", stat " + bad + ": no such file or directory" {
 		t.Error("expected error message: ", err.Error())
 	}
-	cs = nil
 }
 
 func newServerLocalGoodPath(t *testing.T) {
@@ -301,7 +530,7 @@ func newServerLocalGoodPath(t *testing.T) {
 		err error
 	)
 
-	cs, err = NewServer(cam_root_local)
+	cs, err = NewServer(t.TempDir())
 	if cs == nil {
 		t.Fatal("expected server")
 	}
@@ -309,8 +538,6 @@ func newServerLocalGoodPath(t *testing.T) {
 		t.Error("unexpected error: ", err.Error())
 	}
 	cs.Close()
-
-	cs = nil
 }
 
 func openLocal(t *testing.T) {
@@ -320,9 +547,7 @@ func openLocal(t *testing.T) {
 		err error
 	)
 
-	if cs, err = NewServer(cam_root_local); err != nil {
-		t.Fatal("failed to create server: ", err.Error())
-	}
+	cs = memServer(t)
 
 	if cr, err = cs.Open("bogus 32 char md5-ish string ---"); err != nil {
 		t.Fatal("failed to create reader: ", err.Error())
@@ -354,14 +579,12 @@ func openLocal(t *testing.T) {
 
 func openHttp(t *testing.T) {
 	var (
-		cs *Server
 		cr *Reader
 		err error
 	)
 
-	if cs, err = NewServer(cam_root_http); err != nil {
-		t.Fatal("failed to create server: ", err.Error())
-	}
+	remote, cs := httpSetup(t, nil)
+	defer remote.Close()
 
 	if cr, err = cs.Open("bogus 32 char md5-ish string ---"); err != nil {
 		t.Fatal("failed to create reader: ", err.Error())
@@ -398,9 +621,7 @@ func createLocal(t *testing.T) {
 		err error
 	)
 
-	if cs, err = NewServer(cam_root_local); err != nil {
-		t.Fatal("failed to create server")
-	}
+	cs = memServer(t)
 	if cw, err = cs.Create(); err != nil {
 		t.Fatal("failed to create writer")
 	}
@@ -431,15 +652,64 @@ func createLocal(t *testing.T) {
 
 func createHttp(t *testing.T) {
 	var (
-		cs *Server
 		cw *Writer
 		err error
 	)
 
-	t.Fatal("unimplemented")
+	remote, cs := httpSetup(t, nil)
+	defer remote.Close()
+	defer cs.Close()
 
-	cs = cs
-	cw = cw
-	err = err
+	if cw, err = cs.Create(); err != nil {
+		t.Fatal("failed to create writer")
+	}
+	if cw.server != cs {
+		t.Fatal("failed to initialize cw.server")
+	}
+	if _, err = cw.Write([]byte("over the wire")); err != nil {
+		t.Fatal("failed to write, ", err.Error())
+	}
+	if err = cw.Close(); err != nil {
+		t.Fatal("failed to close writer, ", err.Error())
+	}
+	if cw.state != state_closed {
+		t.Fatal("failed to close cw.state")
+	}
+	if _, err = remote.Open(cw.Id()); err != nil {
+		t.Fatal("root not on the block server, ", err.Error())
+	}
+}
+
+/*
+A Server on a new in-memory store, closed when the test ends unless the
+test closed it; camtest.MemServer for the tests in this package, which
+cannot import camtest.
+*/
+func memServer(t testing.TB) (cs *Server) {
+
+	cs = NewServerStore(NewMemStore())
+	t.Cleanup(func() { serverClose(cs) })
+
+	return
+}
+
+/*
+A Server for conn, as NewServer takes it, closed as memServer's is.  For
+tests of a particular backend.
+*/
+func connServer(t testing.TB, conn string) (cs *Server) {
+	var err error
+
+	if cs, err = NewServer(conn); err != nil {
+		t.Fatal("failed to create server, ", err.Error())
+	}
+	t.Cleanup(func() { serverClose(cs) })
+
+	return
 }
 
+func serverClose(cs *Server) {
+	if cs.state == state_open {
+		cs.Close()
+	}
+}
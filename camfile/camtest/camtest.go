@@ -0,0 +1,227 @@
+/*
+Helpers for testing code that uses camfile.
+
+Every Server here lives only as long as the test that made it, in memory
+or under t.TempDir, so tests need no fixtures on disk and no state from
+earlier runs.  Content is generated from a seed, so a failure repeats.
+
+	func TestMine(t *testing.T) {
+		for _, be := range camtest.Backends {
+			cs := be.Open(t)
+			id := camtest.RoundTrip(t, cs, camtest.Content(1, 5000), camtest.Options{})
+			...
+		}
+	}
+*/
+package camtest
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/KimN100/random-examples/camfile"
+)
+
+type Backend struct {
+	Name string
+	Open func(t testing.TB) *camfile.Server
+}
+
+/*
+The stores a round trip should hold on.
+*/
+var Backends = []Backend{
+	{ "mem", MemServer },
+	{ "dir", DirServer },
+	{ "fanout", func(t testing.TB) *camfile.Server {
+		store, err := camfile.NewFileStore(t.TempDir(), 2)
+		if err != nil {
+			t.Fatal("failed to create store, ", err.Error())
+		}
+		return serve(t, store)
+	} },
+	{ "pack", func(t testing.TB) *camfile.Server {
+		cs, err := camfile.NewServer("pack:" + t.TempDir())
+		if err != nil {
+			t.Fatal("failed to create server, ", err.Error())
+		}
+		t.Cleanup(func() { cs.Close() })
+		return cs
+	} },
+}
+
+/*
+How RoundTrip writes.
+*/
+type Options struct {
+	Codec camfile.Codec
+	// encrypt with this secret
+	Secret []byte
+	// bytes per Write, 0 for one Copy
+	Chunk int
+	// blocks in flight, 0 for the default
+	Workers int
+}
+
+/*
+Content bytes in a full DATA block.
+*/
+const Payload = 992
+
+/*
+Block parameters a root must not depend on: Writes short of, at and
+past the block payload, and blocks put one at a time or many at once.
+The block size itself is fixed by the format; see Options for the codec
+and secret, which do change the root.
+*/
+var Writes = []Options{
+	{},
+	{ Chunk: 1, Workers: 1 },
+	{ Chunk: Payload - 1, Workers: 2 },
+	{ Chunk: Payload, Workers: 16 },
+	{ Chunk: Payload + 1, Workers: 1 },
+	{ Chunk: 3*Payload + 7, Workers: 64 },
+}
+
+/*
+A Server on a new in-memory store, closed when the test ends.
+*/
+func MemServer(t testing.TB) (cs *camfile.Server) {
+	return serve(t, camfile.NewMemStore())
+}
+
+/*
+A Server on a new directory under t.TempDir, closed when the test ends.
+*/
+func DirServer(t testing.TB) (cs *camfile.Server) {
+	var err error
+
+	if cs, err = camfile.NewServer(t.TempDir()); err != nil {
+		t.Fatal("failed to create server, ", err.Error())
+	}
+	t.Cleanup(func() { cs.Close() })
+
+	return
+}
+
+func serve(t testing.TB, store camfile.BlockStore) (cs *camfile.Server) {
+
+	cs = camfile.NewServerStore(store)
+	t.Cleanup(func() { cs.Close() })
+
+	return
+}
+
+/*
+size random bytes, the same for the same seed.
+*/
+func Content(seed int64, size int) (content []byte) {
+
+	content = make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(content)
+
+	return
+}
+
+/*
+size bytes of a fixed pattern that does not depend on any library, for
+golden ids: a line of text, with every line numbered so no two blocks
+are alike.
+*/
+func Pattern(size int) (content []byte) {
+	var (
+		buff bytes.Buffer
+		line int
+	)
+
+	for buff.Len() < size {
+		line++
+		buff.WriteString("camfile golden line ")
+		for div := 100000; div > 0; div /= 10 {
+			buff.WriteByte(byte('0' + line/div%10))
+		}
+		buff.WriteByte('\n')
+	}
+
+	return buff.Bytes()[:size]
+}
+
+/*
+Write content to cs as opts says, read it back whole and at a few
+offsets, check it, fsck the store, and return the root, a capability if
+encrypted.
+*/
+func RoundTrip(t testing.TB, cs *camfile.Server, content []byte, opts Options) (id string) {
+	var (
+		cw *camfile.Writer
+		cr *camfile.Reader
+		err error
+		nn int
+		size int64
+		buff bytes.Buffer
+		report *camfile.FsckReport
+	)
+
+	t.Helper()
+
+	if opts.Workers > 0 {
+		cs.SetConcurrency(opts.Workers)
+	}
+	if opts.Secret != nil {
+		cw, err = cs.CreateEncrypted(opts.Secret)
+	} else {
+		cw, err = cs.Create()
+	}
+	if err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+	if opts.Codec != 0 {
+		if err = cw.SetCodec(opts.Codec); err != nil {
+			t.Fatal("failed to set codec, ", err.Error())
+		}
+	}
+	if opts.Chunk > 0 {
+		for off := 0; off < len(content); off += opts.Chunk {
+			if _, err = cw.Write(content[off:min(off+opts.Chunk, len(content))]); err != nil {
+				t.Fatal("failed to write, ", err.Error())
+			}
+		}
+	} else if _, nn, err = cw.Copy(bytes.NewReader(content)); err != nil || nn != len(content) {
+		t.Fatal("failed to copy to cam, ", nn, err)
+	}
+	if err = cw.Close(); err != nil {
+		t.Fatal("failed to close writer, ", err.Error())
+	}
+	id = cw.Id()
+
+	if cr, err = cs.Open(id); err != nil {
+		t.Fatal("failed to create reader, ", err.Error())
+	}
+	defer cr.Close()
+	if nn, err = cr.Copy(&buff); err != nil || !bytes.Equal(buff.Bytes(), content) {
+		t.Fatal("content read back differs, ", len(content), nn, err)
+	}
+	if size, err = cr.Size(); err != nil || size != int64(len(content)) {
+		t.Fatal("wrong size, ", len(content), size, err)
+	}
+	for _, off := range []int{ 0, len(content)/3, len(content) - 1 } {
+		if off < 0 {
+			continue
+		}
+		part := make([]byte, min(2000, len(content)-off))
+		if nn, err = cr.ReadAt(part, int64(off)); nn != len(part) || (err != nil && err != io.EOF) {
+			t.Fatal("failed to read at, ", off, nn, err)
+		}
+		if !bytes.Equal(part, content[off:off+len(part)]) {
+			t.Fatal("content read at differs, ", off)
+		}
+	}
+
+	if report, err = cs.Fsck(nil, ""); err != nil || !report.Ok() {
+		t.Fatal("fsck failed, ", report, err)
+	}
+
+	return
+}
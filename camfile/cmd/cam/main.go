@@ -0,0 +1,643 @@
+/*
+Store and fetch files in a camfile block store.
+
+	cam [-s store] put file|-
+	cam [-s store] get id [out]
+	cam [-s store] cat id ...
+	cam [-s store] stat id
+	cam [-s store] tree id
+	cam [-s store] pin [name id]
+	cam [-s store] unpin name
+	cam [-s store] [-json] [-top n] stats [root ...]
+	cam [-s store] [-key key] [-quota bytes] [-rate n] [-metrics] serve addr
+	cam [-key key] token tenant scope [duration]
+	cam [-s store] [-refkey key] [-type mime] [-by name] push name file|-
+	cam [-s store] [-refkey key] ref [name]
+	cam [-s store] [-refkey key] log name
+	cam [-s store] import archive|- [name]
+	cam [-s store] export id archive|-
+
+The store is a directory, "pack:" and a directory, or the URL of a block
+server, as camfile.NewServer takes them; it defaults to $CAM_STORE.  A
+server that wants a token gets the one from -t, or $CAM_TOKEN.
+put prints the root id of what it stored, and ids may be capabilities
+for encrypted files.  get, cat and stat also take the files and
+directories of a tree; get restores a directory to out.  pin with no
+arguments lists the pins.  stats reports how much the roots, or all
+pinned roots, gain from deduplication; with -json it prints the whole
+analysis for dashboards.
+
+serve runs an authenticated block server for the store, see
+camfile.AuthOptions, and token makes a token for it; scope is a quoted
+list of read, write and admin, and the token lasts for duration, a day
+if not given.  Both sign with -key, or $CAM_KEY.  With -metrics the
+server counts what it serves, for admin tokens to scrape from /metrics.
+
+push stores a file as the next version of the named ref, see
+camfile.Ref, ref shows a ref's current version, or with no name lists
+them, and log shows every version, newest first.  Refs are signed with
+-refkey, or $CAM_REF_KEY.
+
+import stores a tar or zip archive as a directory tree, named for the
+archive or name, and prints its id; export writes a tree back out.  An
+archive ending in .zip is a zip, anything else, and - for standard input
+or output, a tar.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/KimN100/random-examples/camfile"
+)
+
+var (
+	gStore string
+	gToken string
+	gKey string
+	gQuota int64
+	gRate float64
+	gJSON bool
+	gTop int
+	gRefKey string
+	gType string
+	gBy string
+	gMetrics bool
+	gCmd string
+	gArgs []string
+	gIn io.Reader = os.Stdin
+	gOut io.Writer = os.Stdout
+)
+
+/*
+Arguments each command takes, at least and at most.
+*/
+var gCmds = map[string][2]int{
+	"put": { 1, 1 },
+	"get": { 1, 2 },
+	"cat": { 1, -1 },
+	"stat": { 1, 1 },
+	"tree": { 1, 1 },
+	"pin": { 0, 2 },
+	"unpin": { 1, 1 },
+	"stats": { 0, -1 },
+	"serve": { 1, 1 },
+	"token": { 2, 3 },
+	"push": { 2, 2 },
+	"ref": { 0, 1 },
+	"log": { 1, 1 },
+	"import": { 1, 2 },
+	"export": { 2, 2 },
+}
+
+func Args() (ok bool) {
+	var (
+		nargs [2]int
+		found bool
+	)
+
+	flag.StringVar(&gStore, "s", os.Getenv("CAM_STORE"), "store directory or URL")
+	flag.StringVar(&gToken, "t", os.Getenv("CAM_TOKEN"), "bearer token for a block server")
+	flag.StringVar(&gKey, "key", os.Getenv("CAM_KEY"), "key tokens are signed with")
+	flag.Int64Var(&gQuota, "quota", 0, "bytes each tenant may add when serving")
+	flag.Float64Var(&gRate, "rate", 0, "requests per second per token when serving")
+	flag.BoolVar(&gJSON, "json", false, "stats as JSON")
+	flag.IntVar(&gTop, "top", 10, "number of most shared blocks in stats")
+	flag.StringVar(&gRefKey, "refkey", os.Getenv("CAM_REF_KEY"), "key refs are signed with")
+	flag.StringVar(&gType, "type", "application/octet-stream", "content type recorded by push")
+	flag.StringVar(&gBy, "by", os.Getenv("USER"), "creator recorded by push")
+	flag.BoolVar(&gMetrics, "metrics", false, "serve Prometheus metrics at /metrics")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: cam [-s store] put|get|cat|stat|tree|pin|unpin|stats|serve|token|push|ref|log|import|export args\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		goto out
+	}
+	gCmd = flag.Arg(0)
+	gArgs = flag.Args()[1:]
+	if (gStore == "" && gCmd != "token") || (gKey == "" && (gCmd == "serve" || gCmd == "token")) {
+		goto out
+	}
+
+	if nargs, found = gCmds[gCmd]; !found {
+		goto out
+	}
+	if len(gArgs) < nargs[0] || (nargs[1] >= 0 && len(gArgs) > nargs[1]) {
+		goto out
+	}
+	if gCmd == "pin" && len(gArgs) == 1 {
+		goto out
+	}
+	if gRefKey == "" && (gCmd == "push" || gCmd == "log" || (gCmd == "ref" && len(gArgs) == 1)) {
+		goto out
+	}
+
+	ok = true
+
+out:
+	return
+}
+
+func put(cs *camfile.Server, name string) (err error) {
+	var (
+		src io.Reader
+		fh *os.File
+		cw *camfile.Writer
+		id string
+	)
+
+	if name == "-" {
+		src = gIn
+	} else {
+		if fh, err = os.Open(name); err != nil {
+			return
+		}
+		defer fh.Close()
+		src = fh
+	}
+
+	if cw, err = cs.Create(); err != nil {
+		return
+	}
+	defer cw.Close()
+	if id, _, err = cw.Copy(src); err != nil {
+		return
+	}
+	fmt.Fprintln(gOut, id)
+
+	return
+}
+
+/*
+The FILE or DIRB entry id, or nil if id is the root of a file's content
+or a capability.
+*/
+func entry(cs *camfile.Server, id string) (ent *camfile.Entry, err error) {
+
+	if strings.Contains(id, ":") {
+		return
+	}
+	if ent, err = cs.Lookup(id); errors.Is(err, camfile.ErrNotEntry) {
+		ent, err = nil, nil
+	}
+
+	return
+}
+
+func cat(cs *camfile.Server, id string, dst io.Writer) (err error) {
+	var (
+		ent *camfile.Entry
+		cr *camfile.Reader
+	)
+
+	if ent, err = entry(cs, id); err != nil {
+		return
+	}
+	if ent != nil {
+		if ent.IsDir() {
+			return fmt.Errorf("is a directory: %s", id)
+		}
+		if id = ent.Root; id == "" {
+			return
+		}
+	}
+
+	if cr, err = cs.Open(id); err != nil {
+		return
+	}
+	defer cr.Close()
+	_, err = cr.Copy(dst)
+
+	return
+}
+
+/*
+Write to a temporary file beside out and rename it into place, so a
+failed get leaves nothing behind.  A directory is restored to out as
+GetTree does.
+*/
+func get(cs *camfile.Server, id, out string) (err error) {
+	var (
+		ent *camfile.Entry
+		fh *os.File
+	)
+
+	if ent, err = entry(cs, id); err != nil {
+		return
+	}
+	if ent != nil && ent.IsDir() {
+		if out == "" || out == "-" {
+			return fmt.Errorf("is a directory, give a path: %s", id)
+		}
+		return cs.GetTree(id, out)
+	}
+
+	if out == "" || out == "-" {
+		return cat(cs, id, gOut)
+	}
+
+	if fh, err = os.CreateTemp(filepath.Dir(out), ".cam-*"); err != nil {
+		return
+	}
+	if err = cat(cs, id, fh); err == nil {
+		err = fh.Close()
+	} else {
+		fh.Close()
+	}
+	if err == nil {
+		err = os.Rename(fh.Name(), out)
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+	}
+
+	return
+}
+
+/*
+Describe an entry, then the blocks of a file's content.
+*/
+func stat(cs *camfile.Server, id string) (err error) {
+	var (
+		ent *camfile.Entry
+		st *camfile.FileStat
+	)
+
+	if ent, err = entry(cs, id); err != nil {
+		return
+	}
+	if ent != nil {
+		fmt.Fprintf(gOut, "name %s\nmode %s\nmtime %s\n", ent.Name, ent.Mode, ent.ModTime.Format(time.RFC3339))
+		if ent.IsDir() {
+			fmt.Fprintf(gOut, "entries %d\n", ent.Size)
+			return
+		}
+		if id = ent.Root; id == "" {
+			fmt.Fprintf(gOut, "size %d\n", ent.Size)
+			return
+		}
+	}
+
+	if st, err = cs.Stat(id); err != nil {
+		return
+	}
+	fmt.Fprintf(gOut, "size %d\ndepth %d\nblocks %d\nstored %d\n", st.Size, st.Depth, st.Blocks, st.Stored)
+
+	return
+}
+
+func tree(cs *camfile.Server, id string) (err error) {
+
+	return cs.WalkBlocks(id, func(info camfile.BlockInfo) error {
+		indent := strings.Repeat("  ", info.Depth)
+		if info.Type == "INDB" {
+			fmt.Fprintf(gOut, "%s%s %s %d bytes, %d children\n", indent, info.Type, info.Id, info.Size, info.Children)
+		} else {
+			fmt.Fprintf(gOut, "%s%s %s %d bytes\n", indent, info.Type, info.Id, info.Size)
+		}
+		return nil
+	})
+}
+
+func pins(cs *camfile.Server) (err error) {
+	var (
+		pins map[string]string
+		names []string
+	)
+
+	if pins, err = cs.Pins(); err != nil {
+		return
+	}
+	for name := range pins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(gOut, "%s %s\n", name, pins[name])
+	}
+
+	return
+}
+
+func stats(cs *camfile.Server, roots []string) (err error) {
+	var (
+		an *camfile.Analysis
+		data []byte
+		counts []int
+	)
+
+	if an, err = cs.Analyze(roots, gTop); err != nil {
+		return
+	}
+	if gJSON {
+		if data, err = json.MarshalIndent(an, "", "  "); err == nil {
+			fmt.Fprintln(gOut, string(data))
+		}
+		return
+	}
+
+	fmt.Fprintf(gOut, "roots %d\nblocks %d, %d data, %d indirect\n", an.Roots, an.Blocks, an.DataBlocks, an.IndirectBlocks)
+	fmt.Fprintf(gOut, "logical %d bytes\nphysical %d bytes\ndedup %.2fx\n", an.LogicalBytes, an.PhysicalBytes, an.DedupRatio())
+	fmt.Fprintf(gOut, "headers %d bytes\npadding %d bytes, %.1f%%\n", an.HeaderBytes, an.PaddingBytes, 100*an.PaddingFraction())
+	for refs := range an.RefCounts {
+		counts = append(counts, refs)
+	}
+	sort.Ints(counts)
+	for _, refs := range counts {
+		fmt.Fprintf(gOut, "refs %d: %d blocks\n", refs, an.RefCounts[refs])
+	}
+	for _, share := range an.Top {
+		fmt.Fprintf(gOut, "top %s %s %d refs, %d bytes\n", share.Id, share.Type, share.Refs, share.Stored)
+	}
+
+	return
+}
+
+func serve(cs *camfile.Server, addr string) (err error) {
+	var opts camfile.AuthOptions
+
+	opts = camfile.AuthOptions{ Key: gKey, Quota: gQuota, Rate: gRate, Burst: int(gRate) }
+	if gMetrics {
+		cs.SetInstrument(camfile.NewMetrics())
+	}
+
+	return http.ListenAndServe(addr, cs.AuthHandler(opts))
+}
+
+func token(tenant, scope, life string) (err error) {
+	var (
+		exp time.Time
+		dur time.Duration
+		tok string
+	)
+
+	if life == "" {
+		life = "24h"
+	}
+	if dur, err = time.ParseDuration(life); err != nil {
+		return
+	}
+	exp = time.Now().Add(dur)
+	if tok, err = camfile.NewToken(gKey, tenant, scope, exp); err != nil {
+		return
+	}
+	fmt.Fprintln(gOut, tok)
+
+	return
+}
+
+/*
+Store the file as the next version of name, failing if someone else
+pushed in between.
+*/
+func push(cs *camfile.Server, name, file string) (err error) {
+	var (
+		src io.Reader
+		fh *os.File
+		ref *camfile.Ref
+		prev string
+	)
+
+	if ref, err = cs.GetRef(name); err == nil {
+		prev = ref.Id
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return
+	}
+
+	if file == "-" {
+		src = gIn
+	} else {
+		if fh, err = os.Open(file); err != nil {
+			return
+		}
+		defer fh.Close()
+		src = fh
+	}
+
+	if ref, err = cs.PutObject(name, src, camfile.RefMeta{ ContentType: gType, CreatedBy: gBy }, prev); err != nil {
+		return
+	}
+	printRef(ref)
+
+	return
+}
+
+func printRef(ref *camfile.Ref) {
+	fmt.Fprintf(gOut, "%s %s %s %d bytes, %s by %s at %s\n", ref.Id, ref.Name, ref.Root, ref.Meta.Size,
+		ref.Meta.ContentType, ref.Meta.CreatedBy, ref.Time.Format(time.RFC3339))
+}
+
+func refs(cs *camfile.Server, name string) (err error) {
+	var (
+		names []string
+		ref *camfile.Ref
+	)
+
+	if name != "" {
+		if ref, err = cs.GetRef(name); err == nil {
+			printRef(ref)
+		}
+		return
+	}
+
+	if names, err = cs.Refs(); err != nil {
+		return
+	}
+	for _, name = range names {
+		fmt.Fprintln(gOut, name)
+	}
+
+	return
+}
+
+/*
+Store a tar or zip archive as a tree named name, or for the archive.
+*/
+func importArchive(cs *camfile.Server, file, name string) (err error) {
+	var (
+		fh *os.File
+		fi os.FileInfo
+		id string
+	)
+
+	if name == "" {
+		name = strings.TrimSuffix(strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)), ".tar")
+	}
+	if file == "-" {
+		if name == "-" {
+			name = "stdin"
+		}
+		id, err = cs.ImportTar(gIn, name)
+	} else {
+		if fh, err = os.Open(file); err != nil {
+			return
+		}
+		defer fh.Close()
+		if strings.HasSuffix(file, ".zip") {
+			if fi, err = fh.Stat(); err != nil {
+				return
+			}
+			id, err = cs.ImportZip(fh, fi.Size(), name)
+		} else {
+			id, err = cs.ImportTar(fh, name)
+		}
+	}
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(gOut, id)
+
+	return
+}
+
+/*
+Write the tree id to an archive, as get writes a file: through a
+temporary file renamed into place.
+*/
+func exportArchive(cs *camfile.Server, id, out string) (err error) {
+	var fh *os.File
+
+	if out == "-" {
+		return cs.ExportTar(id, gOut)
+	}
+
+	if fh, err = os.CreateTemp(filepath.Dir(out), ".cam-*"); err != nil {
+		return
+	}
+	if strings.HasSuffix(out, ".zip") {
+		err = cs.ExportZip(id, fh)
+	} else {
+		err = cs.ExportTar(id, fh)
+	}
+	if err == nil {
+		err = fh.Close()
+	} else {
+		fh.Close()
+	}
+	if err == nil {
+		err = os.Rename(fh.Name(), out)
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+	}
+
+	return
+}
+
+/*
+The Server for gStore, with the token for a block server.
+*/
+func open() (cs *camfile.Server, err error) {
+
+	if gToken != "" && strings.HasPrefix(gStore, "http") {
+		cs = camfile.NewServerStore(camfile.NewHTTPStore(gStore, gToken))
+	} else if cs, err = camfile.NewServer(gStore); err != nil {
+		return
+	}
+	cs.SetRefKey([]byte(gRefKey))
+
+	return
+}
+
+/*
+Run gCmd with gArgs on cs; every command but token.
+*/
+func run(cs *camfile.Server) (err error) {
+
+	switch gCmd {
+	case "put":
+		err = put(cs, gArgs[0])
+	case "get":
+		gArgs = append(gArgs, "")
+		err = get(cs, gArgs[0], gArgs[1])
+	case "cat":
+		for _, id := range gArgs {
+			if err = cat(cs, id, gOut); err != nil {
+				break
+			}
+		}
+	case "stat":
+		err = stat(cs, gArgs[0])
+	case "tree":
+		err = tree(cs, gArgs[0])
+	case "pin":
+		if len(gArgs) == 0 {
+			err = pins(cs)
+		} else {
+			err = cs.Pin(gArgs[0], gArgs[1])
+		}
+	case "unpin":
+		err = cs.Unpin(gArgs[0])
+	case "stats":
+		err = stats(cs, gArgs)
+	case "serve":
+		err = serve(cs, gArgs[0])
+	case "push":
+		err = push(cs, gArgs[0], gArgs[1])
+	case "ref":
+		gArgs = append(gArgs, "")
+		err = refs(cs, gArgs[0])
+	case "log":
+		err = cs.RefHistory(gArgs[0], func(ref *camfile.Ref) error {
+			printRef(ref)
+			return nil
+		})
+	case "import":
+		gArgs = append(gArgs, "")
+		err = importArchive(cs, gArgs[0], gArgs[1])
+	case "export":
+		err = exportArchive(cs, gArgs[0], gArgs[1])
+	}
+
+	return
+}
+
+func main() {
+	var (
+		cs *camfile.Server
+		err error
+	)
+
+	if !Args() {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if gCmd == "token" {
+		gArgs = append(gArgs, "")
+		if err = token(gArgs[0], gArgs[1], gArgs[2]); err != nil {
+			fmt.Fprintf(os.Stderr, "cam token: %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cs, err = open(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open store: %s\n", err.Error())
+		os.Exit(2)
+	}
+
+	err = run(cs)
+
+	if cerr := cs.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cam %s: %s\n", gCmd, err.Error())
+		os.Exit(1)
+	}
+}
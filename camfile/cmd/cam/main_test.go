@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/KimN100/random-examples/camfile"
+	"github.com/KimN100/random-examples/camfile/camtest"
+)
+
+/*
+Run the command on cs as main would, with standard input in and what it
+prints returned.
+*/
+func runCmd(cs *camfile.Server, in []byte, cmd string, args ...string) (out string, err error) {
+	var buff bytes.Buffer
+
+	gCmd, gArgs = cmd, args
+	gIn, gOut = bytes.NewReader(in), &buff
+	defer func() { gIn, gOut = os.Stdin, os.Stdout }()
+	err = run(cs)
+
+	return buff.String(), err
+}
+
+/*
+Every command that reads a root takes the root of a file's content, a
+FILE and a DIRB alike, or refuses the ones it cannot show.
+*/
+func TestCommands(t *testing.T) {
+	var (
+		cs *camfile.Server
+		err error
+		src, dst, content, file, dir, empty, out string
+	)
+
+	cs = camtest.MemServer(t)
+	src, dst = t.TempDir(), t.TempDir()
+	body := camtest.Content(1, 100000)
+	os.MkdirAll(filepath.Join(src, "d", "e"), 0o755)
+	os.WriteFile(filepath.Join(src, "d", "a.txt"), body, 0o644)
+	os.WriteFile(filepath.Join(src, "d", "e", "b.txt"), []byte("b"), 0o644)
+	os.WriteFile(filepath.Join(src, "empty"), nil, 0o644)
+
+	if content, err = runCmd(cs, body, "put", "-"); err != nil {
+		t.Fatal("failed to put, ", err.Error())
+	}
+	content = strings.TrimSpace(content)
+	if file, err = cs.PutTree(filepath.Join(src, "d", "a.txt")); err != nil {
+		t.Fatal("failed to put file, ", err.Error())
+	}
+	if dir, err = cs.PutTree(filepath.Join(src, "d")); err != nil {
+		t.Fatal("failed to put tree, ", err.Error())
+	}
+	if empty, err = cs.PutTree(filepath.Join(src, "empty")); err != nil {
+		t.Fatal("failed to put empty file, ", err.Error())
+	}
+
+	tests := []struct {
+		cmd string
+		args []string
+		// printed, or contained in what is printed if part
+		want string
+		part bool
+		fail bool
+		// and written to dst/path
+		path string
+		written string
+	}{
+		{ cmd: "put", args: []string{ filepath.Join(src, "d", "a.txt") }, want: content + "\n" },
+		{ cmd: "cat", args: []string{ content }, want: string(body) },
+		{ cmd: "cat", args: []string{ file }, want: string(body) },
+		{ cmd: "cat", args: []string{ file, content }, want: string(body) + string(body) },
+		{ cmd: "cat", args: []string{ empty }, want: "" },
+		{ cmd: "cat", args: []string{ dir }, fail: true },
+		{ cmd: "get", args: []string{ content }, want: string(body) },
+		{ cmd: "get", args: []string{ file, filepath.Join(dst, "file") }, path: "file", written: string(body) },
+		{ cmd: "get", args: []string{ dir, filepath.Join(dst, "dir") }, path: "dir/e/b.txt", written: "b" },
+		{ cmd: "get", args: []string{ dir }, fail: true },
+		{ cmd: "stat", args: []string{ content }, want: "size 100000\ndepth 3\n", part: true },
+		{ cmd: "stat", args: []string{ file }, want: "name a.txt\nmode -rw-r--r--\n", part: true },
+		{ cmd: "stat", args: []string{ file }, want: "size 100000\ndepth 3\n", part: true },
+		{ cmd: "stat", args: []string{ empty }, want: "name empty\n", part: true },
+		{ cmd: "stat", args: []string{ dir }, want: "name d\nmode drwxr-xr-x\n", part: true },
+		{ cmd: "stat", args: []string{ dir }, want: "entries 2\n", part: true },
+		{ cmd: "tree", args: []string{ content }, want: "INDB " + content, part: true },
+		{ cmd: "pin", args: []string{ "keep", dir } },
+		{ cmd: "pin", want: "keep " + dir + "\n" },
+		{ cmd: "unpin", args: []string{ "keep" } },
+		{ cmd: "pin", want: "" },
+		{ cmd: "export", args: []string{ dir, filepath.Join(dst, "d.tar") } },
+		{ cmd: "import", args: []string{ filepath.Join(dst, "d.tar") }, want: dir + "\n" },
+		{ cmd: "cat", args: []string{ "0123456789abcdef0123456789abcdef" }, fail: true },
+	}
+
+	for _, test := range tests {
+		out, err = runCmd(cs, body, test.cmd, test.args...)
+		if test.fail {
+			if err == nil {
+				t.Error(test.cmd, test.args, "did not fail")
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(test.cmd, test.args, "failed, ", err.Error())
+			continue
+		}
+		if (test.part && !strings.Contains(out, test.want)) || (!test.part && out != test.want) {
+			t.Errorf("%s %v printed %.80q, want %.80q", test.cmd, test.args, out, test.want)
+		}
+		if test.path != "" {
+			if data, err := os.ReadFile(filepath.Join(dst, test.path)); err != nil || string(data) != test.written {
+				t.Error(test.cmd, test.args, "wrote the wrong", test.path, err)
+			}
+		}
+	}
+}
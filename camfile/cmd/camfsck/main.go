@@ -0,0 +1,97 @@
+/*
+Check a camfile block store.
+
+	camfsck [-q quarantine-dir] store [root ...]
+
+Every block is re-hashed against its id, and every indirect block is
+checked for children missing from the store.  With roots, blocks not
+reachable from any of them are listed.  With -q, corrupt blocks are moved
+to the quarantine directory.  Exits 1 if any problem was found.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/KimN100/random-examples/camfile"
+)
+
+var (
+	gQuarantine string
+	gStore string
+	gRoots []string
+)
+
+func Args() (ok bool) {
+
+	flag.StringVar(&gQuarantine, "q", "", "move corrupt blocks to this directory")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: camfsck [-q quarantine-dir] store [root ...]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		goto out
+	}
+	gStore = flag.Arg(0)
+	gRoots = flag.Args()[1:]
+
+	ok = true
+
+out:
+	return
+}
+
+func main() {
+	var (
+		cs *camfile.Server
+		report *camfile.FsckReport
+		err error
+		status int
+	)
+
+	if !Args() {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if cs, err = camfile.NewServer(gStore); err != nil {
+		fmt.Printf("failed to open store: %s\n", err.Error())
+		os.Exit(2)
+	}
+
+	if report, err = cs.Fsck(gRoots, gQuarantine); err != nil {
+		fmt.Printf("fsck failed: %s\n", err.Error())
+		os.Exit(2)
+	}
+
+	for _, id := range report.Corrupt {
+		fmt.Printf("corrupt %s\n", id)
+	}
+	for _, ref := range report.Dangling {
+		if ref.Parent == "" {
+			fmt.Printf("missing root %s\n", ref.Child)
+		} else {
+			fmt.Printf("dangling %s -> %s\n", ref.Parent, ref.Child)
+		}
+	}
+	for _, id := range report.Unreachable {
+		fmt.Printf("unreachable %s\n", id)
+	}
+	for _, id := range report.Quarantined {
+		fmt.Printf("quarantined %s\n", id)
+	}
+
+	fmt.Printf("%d blocks, %d corrupt, %d dangling, %d unreachable\n",
+		report.Blocks, len(report.Corrupt), len(report.Dangling), len(report.Unreachable))
+
+	if !report.Ok() {
+		status = 1
+	}
+	cs.Close()
+	os.Exit(status)
+}
@@ -0,0 +1,167 @@
+package camfile
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+/*
+Per-block compression.
+
+A Writer may compress the payload of each block it writes.  The codec is
+recorded in the header, '-' for none, and the payload length in
+the header is always the decoded length.  A block that does not get
+smaller is stored as is.  Blocks are stored without the trailing '-'
+padding older blocks carry; both kinds read back the same.
+
+Ids are hashes of the stored, compressed bytes, so content addressing is
+unchanged; compression is deterministic, so equal content written with
+the same codec still deduplicates.
+
+Compression comes before encryption, and like encryption skips the clear
+ids at the front of an encrypted indirect block.
+*/
+
+type Codec byte
+
+const (
+	CodecNone Codec = '-'
+	CodecFlate Codec = 'F'
+)
+
+/*
+Compress every block this Writer writes.  Must be called before the first
+Write.
+*/
+func (cw *Writer) SetCodec(codec Codec) (err error) {
+
+	if cw.state != state_open {
+		return fmt.Errorf("not opened: writer %s", stateString(cw.state))
+	}
+	if len(cw.refs) > 0 || len(cw.buff) > 0 || cw.done {
+		return fmt.Errorf("codec must be set before writing")
+	}
+	switch codec {
+	case CodecNone, CodecFlate:
+		cw.codec = codec
+	default:
+		err = fmt.Errorf("unknown codec: %c", codec)
+	}
+
+	return
+}
+
+/*
+Compress the payload after prefix, returning a new block with the codec
+recorded, or the block unchanged if compression fails or does not help.
+*/
+func compressBlock(block []byte, prefix int, codec Codec) (out []byte, err error) {
+	var (
+		buff bytes.Buffer
+		zw *flate.Writer
+	)
+
+	switch codec {
+	case 0, CodecNone:
+		return block, nil
+	case CodecFlate:
+	default:
+		return nil, fmt.Errorf("unknown codec: %c", codec)
+	}
+
+	// the block is sound as it is, so anything going wrong here stores
+	// it uncompressed
+	if zw, err = flate.NewWriter(&buff, flate.DefaultCompression); err != nil {
+		return block, nil
+	}
+	if _, err = zw.Write(block[cam_header_size+prefix:]); err != nil {
+		zw.Close()
+		return block, nil
+	}
+	if err = zw.Close(); err != nil || buff.Len() >= len(block) - cam_header_size - prefix {
+		return block, nil
+	}
+
+	out = make([]byte, 0, cam_header_size+prefix+buff.Len())
+	out = append(out, block[:cam_header_size+prefix]...)
+	out = append(out, buff.Bytes()...)
+	if err = editHeader(out, func(hd *header) { hd.codec = codec }); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+/*
+Turn a block as stored into header plus decoded payload: decrypt with the
+ref's key if needed, then decompress.  Returns a new slice.
+*/
+func decodeBlock(ref camref, raw []byte) (block []byte, err error) {
+	var (
+		cnt, prefix int
+		body []byte
+		hd header
+	)
+
+	if hd, err = decodeHeader(raw); err != nil {
+		return
+	}
+	cnt = hd.cnt
+	block = append([]byte(nil), raw...)
+
+	if hd.crypt {
+		if ref.key == "" {
+			return nil, fmt.Errorf("encrypted block, no key: %s", ref.id)
+		}
+		if prefix, err = clearPrefix(block); err != nil {
+			return nil, err
+		}
+		if cam_header_size+prefix > len(block) {
+			return nil, fmt.Errorf("%w: %s: short block", ErrCorrupt, ref.id)
+		}
+		if err = cryptPayload(ref.key, block[cam_header_size+prefix:]); err != nil {
+			return nil, err
+		}
+	}
+
+	switch hd.codec {
+	case CodecNone:
+	case CodecFlate:
+		if cam_header_size+prefix > len(block) {
+			return nil, fmt.Errorf("%w: %s: short block", ErrCorrupt, ref.id)
+		}
+		if body, err = inflate(block[cam_header_size+prefix:], cnt-prefix); err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", ErrCorrupt, ref.id, err.Error())
+		}
+		block = append(block[:cam_header_size+prefix], body...)
+	default:
+		return nil, fmt.Errorf("unknown codec: %s, %c", ref.id, hd.codec)
+	}
+
+	if len(block) < cam_header_size+cnt {
+		return nil, fmt.Errorf("%w: %s: short payload", ErrCorrupt, ref.id)
+	}
+
+	return
+}
+
+func inflate(body []byte, cnt int) (data []byte, err error) {
+	var zr io.ReadCloser
+
+	if cnt < 0 {
+		return nil, fmt.Errorf("bad length: %d", cnt)
+	}
+	zr = flate.NewReader(bytes.NewReader(body))
+	defer zr.Close()
+
+	if data, err = io.ReadAll(io.LimitReader(zr, int64(cnt)+1)); err != nil {
+		return
+	}
+	if len(data) != cnt {
+		err = fmt.Errorf("decompressed %d bytes, want %d", len(data), cnt)
+	}
+
+	return
+}
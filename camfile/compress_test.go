@@ -0,0 +1,132 @@
+package camfile
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	t.Run("text", compressText)
+	t.Run("random", compressRandom)
+	t.Run("encrypted", compressEncrypted)
+	t.Run("no-padding", compressNoPadding)
+}
+
+/*
+Write content with the codec, read it back, and return the bytes used
+by the store.
+*/
+func compressRoundTrip(t *testing.T, codec Codec, secret []byte, content []byte) (used int64) {
+	var (
+		cs *Server
+		cw *Writer
+		cr *Reader
+		err error
+		dir, id string
+		buff bytes.Buffer
+		ents []os.DirEntry
+		fi os.FileInfo
+	)
+
+	dir = t.TempDir()
+	cs = connServer(t, dir)
+
+	if secret != nil {
+		cw, err = cs.CreateEncrypted(secret)
+	} else {
+		cw, err = cs.Create()
+	}
+	if err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+	if err = cw.SetCodec(codec); err != nil {
+		t.Fatal("failed to set codec, ", err.Error())
+	}
+	if id, _, err = cw.Copy(bytes.NewReader(content)); err != nil {
+		t.Fatal("failed to copy to cam, ", err.Error())
+	}
+	cw.Close()
+
+	if cr, err = cs.Open(id); err != nil {
+		t.Fatal("failed to create reader, ", err.Error())
+	}
+	defer cr.Close()
+	if _, err = cr.Copy(&buff); err != nil {
+		t.Fatal("failed to copy from cam, ", err.Error())
+	}
+	if !bytes.Equal(buff.Bytes(), content) {
+		t.Fatal("content mismatch")
+	}
+
+	ents, _ = os.ReadDir(dir)
+	for _, ent := range ents {
+		fi, _ = os.Stat(filepath.Join(dir, ent.Name()))
+		used += fi.Size()
+	}
+
+	return
+}
+
+func compressText(t *testing.T) {
+	var (
+		content []byte
+		plain, packed int64
+	)
+
+	rr := rand.New(rand.NewSource(7))
+	words := strings.Fields("content addressable storage breaks files into blocks and names each block by its hash")
+	for len(content) < 100000 {
+		content = append(content, words[rr.Intn(len(words))]...)
+		content = append(content, ' ')
+	}
+
+	plain = compressRoundTrip(t, CodecNone, nil, content)
+	packed = compressRoundTrip(t, CodecFlate, nil, content)
+	if packed*2 > plain {
+		t.Fatal("text did not compress", packed, plain)
+	}
+}
+
+/*
+An incompressible block is stored as is.
+*/
+func compressRandom(t *testing.T) {
+	var (
+		content []byte
+		plain, packed int64
+	)
+
+	content = make([]byte, 900)
+	rand.New(rand.NewSource(8)).Read(content)
+
+	plain = compressRoundTrip(t, CodecNone, nil, content)
+	packed = compressRoundTrip(t, CodecFlate, nil, content)
+	if packed != plain {
+		t.Fatal("random data changed size", packed, plain)
+	}
+}
+
+func compressEncrypted(t *testing.T) {
+	var plain, packed int64
+
+	plain = compressRoundTrip(t, CodecNone, cryptSecret, cryptContent())
+	packed = compressRoundTrip(t, CodecFlate, cryptSecret, cryptContent())
+	if packed >= plain {
+		t.Fatal("encrypted text did not compress", packed, plain)
+	}
+}
+
+/*
+A short file takes its header plus its content on disk.
+*/
+func compressNoPadding(t *testing.T) {
+	var used int64
+
+	if used = compressRoundTrip(t, CodecNone, nil, []byte("short")); used != cam_header_size+5 {
+		t.Fatal("unexpected block size", used)
+	}
+}
@@ -0,0 +1,171 @@
+package camfile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestContext(t *testing.T) {
+	t.Run("cancel-copy", contextCancelCopy)
+	t.Run("cancel-close", contextCancelClose)
+	t.Run("cancel-tree", contextCancelTree)
+	t.Run("cancel-read", contextCancelRead)
+}
+
+/*
+A reader that calls cancel once n bytes have been read from it.
+*/
+type cancelReader struct {
+	src io.Reader
+	n int
+	cancel context.CancelFunc
+}
+
+func (cr *cancelReader) Read(p []byte) (nn int, err error) {
+	nn, err = cr.src.Read(p)
+	if cr.n -= nn; cr.n <= 0 {
+		cr.cancel()
+	}
+	return
+}
+
+func contextCancelCopy(t *testing.T) {
+	var (
+		cs *Server
+		cw *Writer
+		err error
+		id string
+		content []byte
+		ctx context.Context
+		cancel context.CancelFunc
+	)
+
+	cs = memServer(t)
+
+	content = make([]byte, 50000)
+	rand.New(rand.NewSource(35)).Read(content)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	if cw, err = cs.CreateContext(ctx); err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+
+	src := &cancelReader{ src: bytes.NewReader(content), n: 20000, cancel: cancel }
+	if id, _, err = cw.Copy(src); !errors.Is(err, context.Canceled) {
+		t.Fatal("expected cancellation", err)
+	}
+	if id != "" {
+		t.Fatal("cancelled copy returned a root", id)
+	}
+	if err = cw.Close(); err == nil {
+		t.Fatal("close of a cancelled writer succeeded")
+	}
+	if cw.Id() != "" {
+		t.Fatal("cancelled writer has a root", cw.Id())
+	}
+	if len(cs.live) != 0 {
+		t.Fatal("writer did not release its blocks", cs.live)
+	}
+}
+
+/*
+Everything is written, but the tree is not finished in time.
+*/
+func contextCancelClose(t *testing.T) {
+	var (
+		cs *Server
+		cw *Writer
+		err error
+		ctx context.Context
+		cancel context.CancelFunc
+	)
+
+	cs = memServer(t)
+
+	if cw, err = cs.Create(); err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+	if _, err = cw.Write(make([]byte, 30000)); err != nil {
+		t.Fatal("failed to write, ", err.Error())
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err = cw.CloseContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatal("expected cancellation", err)
+	}
+	if cw.Id() != "" {
+		t.Fatal("cancelled writer has a root", cw.Id())
+	}
+}
+
+func contextCancelTree(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		src, id string
+		ctx context.Context
+		cancel context.CancelFunc
+	)
+
+	cs = memServer(t)
+
+	src = treeSetup(t)
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if id, err = cs.PutTreeContext(ctx, src); !errors.Is(err, context.Canceled) || id != "" {
+		t.Fatal("expected cancellation and no root", id, err)
+	}
+
+	if id, err = cs.PutTree(src); err != nil {
+		t.Fatal("failed to put tree, ", err.Error())
+	}
+	if err = cs.GetTreeContext(ctx, id, t.TempDir()); !errors.Is(err, context.Canceled) {
+		t.Fatal("expected cancellation", err)
+	}
+}
+
+func contextCancelRead(t *testing.T) {
+	var (
+		cs *Server
+		cw *Writer
+		cr *Reader
+		err error
+		id string
+		buff bytes.Buffer
+		ctx context.Context
+		cancel context.CancelFunc
+	)
+
+	cs = memServer(t)
+
+	if cw, err = cs.Create(); err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+	if id, _, err = cw.Copy(bytes.NewReader(make([]byte, 30000))); err != nil {
+		t.Fatal("failed to copy to cam, ", err.Error())
+	}
+	cw.Close()
+
+	if cr, err = cs.Open(id); err != nil {
+		t.Fatal("failed to create reader, ", err.Error())
+	}
+	defer cr.Close()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err = cr.CopyContext(ctx, &buff); !errors.Is(err, context.Canceled) {
+		t.Fatal("expected cancellation", err)
+	}
+	if _, err = cr.ReadAtContext(ctx, make([]byte, 10), 0); !errors.Is(err, context.Canceled) {
+		t.Fatal("expected cancellation", err)
+	}
+	if _, err = cr.ReadAt(make([]byte, 10), 0); err != nil {
+		t.Fatal("reader unusable after a cancelled call, ", err.Error())
+	}
+}
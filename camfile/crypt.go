@@ -0,0 +1,265 @@
+package camfile
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+Convergent encryption.
+
+An encrypting Writer encrypts each block with a key derived from a hash of
+its plaintext and a per-store secret, so the same content under the same
+secret always produces the same ciphertext and still deduplicates, while
+the block server, which never sees the secret, cannot read it.  Ids are
+hashes of what is stored, so the server can still verify blocks.
+
+Payloads are AES-128 in CTR mode with a zero IV; the key is never reused
+for different plaintext.  Headers stay in the clear and flag encrypted
+blocks, see header.go.  So that GC and Fsck can still follow trees,
+the child ids of an encrypted indirect block stay in the clear ahead of
+the encrypted part:
+
+	[0:n*32]      child ids
+	[n*32:n*80]   per child, 16 hex size then 32 hex key, encrypted
+
+The key of each block lives in its parent, so the root id and key, the
+capability "id:key" returned by Writer.Id, is all a Reader needs.
+A wrong key is not detected; it reads as garbage.
+
+Only content is hidden.  The server, or anyone who can read the store,
+still learns the exact size of every file: CTR keeps each payload's
+length, the header counts it, and an INDB header carries the plaintext
+total of everything below it.  The clear child ids give away the shape
+of each tree, so which blocks make up which file, and equal blocks
+across files show up as shared ids, as convergent encryption intends.
+Pad content before writing it if its size matters.
+*/
+
+const (
+	cam_key_size = 16
+	cam_keyed_entry = 32 + 16 + 2*cam_key_size
+	cam_keyed_indirect_cnt = (cam_block_size - cam_header_size) / cam_keyed_entry
+)
+
+/*
+Create a Writer that encrypts every block.  secret should be a random
+value kept by the client for the life of the store; Writers sharing it
+deduplicate against each other.
+*/
+func (cs *Server) CreateEncrypted(secret []byte) (cw *Writer, err error) {
+	return cs.CreateEncryptedContext(context.Background(), secret)
+}
+
+func (cs *Server) CreateEncryptedContext(ctx context.Context, secret []byte) (cw *Writer, err error) {
+
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("missing secret")
+	}
+	if cw, err = cs.CreateContext(ctx); err == nil {
+		cw.secret = append([]byte(nil), secret...)
+	}
+
+	return
+}
+
+/*
+Split "id" or "id:key" into a ref.
+*/
+func parseCap(cap string) (ref camref, err error) {
+	var (
+		id, key string
+		ok bool
+	)
+
+	id, key, ok = strings.Cut(cap, ":")
+	if len(id) != 32 {
+		return ref, fmt.Errorf("not a block id: %s", cap)
+	}
+	if ok {
+		if _, err = hex.DecodeString(key); err != nil || len(key) != 2*cam_key_size {
+			return ref, fmt.Errorf("bad key: %s", cap)
+		}
+	}
+
+	return camref{ id: id, size: -1, key: key }, nil
+}
+
+func (ref camref) cap() (cap string) {
+	if ref.key == "" {
+		return ref.id
+	}
+	return ref.id + ":" + ref.key
+}
+
+func deriveKey(secret, block []byte) (key string) {
+	var sum [sha256.Size]byte
+
+	sum = sha256.Sum256(block)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(sum[:])
+
+	return hex.EncodeToString(mac.Sum(nil)[:cam_key_size])
+}
+
+/*
+Encrypt or decrypt data in place.
+*/
+func cryptPayload(key string, data []byte) (err error) {
+	var (
+		kk []byte
+		bc cipher.Block
+		iv [aes.BlockSize]byte
+	)
+
+	if kk, err = hex.DecodeString(key); err != nil {
+		return
+	}
+	if bc, err = aes.NewCipher(kk); err != nil {
+		return
+	}
+	cipher.NewCTR(bc, iv[:]).XORKeyStream(data, data)
+
+	return
+}
+
+/*
+Bytes at the start of the payload left in the clear.
+*/
+func clearPrefix(block []byte) (nn int, err error) {
+	var (
+		tag string
+		cnt int
+	)
+
+	if tag, cnt, err = parseHeader(block); err != nil {
+		return
+	}
+	switch tag {
+	case "DATA":
+	case "INDB":
+		nn = cnt / cam_keyed_entry * 32
+	default:
+		err = fmt.Errorf("cannot encrypt block type: %s", tag)
+	}
+
+	return
+}
+
+/*
+As putHeld, but first compress with codec when that saves space, and
+with a secret then encrypt.  Returns the id and, when encrypted, the key.
+*/
+func (cs *Server) putSealed(ctx context.Context, head, data, secret []byte, codec Codec, held *[]string) (ref camref, err error) {
+	var (
+		block []byte
+		prefix int
+	)
+
+	block = make([]byte, 0, len(head)+len(data))
+	block = append(block, head...)
+	block = append(block, data...)
+
+	if secret != nil {
+		ref.key = deriveKey(secret, block)
+		if prefix, err = clearPrefix(block); err != nil {
+			return
+		}
+	}
+	if block, err = compressBlock(block, prefix, codec); err != nil {
+		return
+	}
+	if secret != nil {
+		if err = editHeader(block, func(hd *header) { hd.crypt = true }); err != nil {
+			return
+		}
+		if err = cryptPayload(ref.key, block[cam_header_size+prefix:]); err != nil {
+			return
+		}
+	}
+
+	ref.id, err = cs.putHeld(ctx, block[:cam_header_size], block[cam_header_size:], held)
+
+	return
+}
+
+/*
+Get a block and decode it into data, which must be cam_block_size long:
+decrypt with the ref's key if the block is encrypted, then decompress.
+The decoded block keeps its flags so its layout is still known.
+*/
+func (cs *Server) readBlock(ctx context.Context, ref camref, data []byte) (err error) {
+	var block []byte
+
+	if block, err = cs.getBlock(ctx, ref.id); err != nil {
+		return
+	}
+	if block, err = decodeBlock(ref, block); err != nil {
+		return
+	}
+	copy(data, block)
+
+	return
+}
+
+/*
+Lay out an encrypted indirect block's payload.  Returns the total size.
+*/
+func putKeyed(data []byte, refs []camref) (total int64) {
+	var nn int
+
+	nn = len(refs)
+	for ii, ref := range refs {
+		copy(data[ii*32:], ref.id)
+		copy(data[nn*32+ii*(cam_keyed_entry-32):], fmt.Sprintf("%016x%s", ref.size, ref.key))
+		total += ref.size
+	}
+
+	return
+}
+
+/*
+Parse a decrypted encrypted indirect block.
+*/
+func parseKeyed(data []byte, cnt int) (refs []camref, err error) {
+	var (
+		nn, off int
+		size int64
+		ids []string
+	)
+
+	if cnt%cam_keyed_entry != 0 || cam_header_size+cnt > len(data) {
+		return nil, fmt.Errorf("bad indirect block: %d bytes of %d byte entries", cnt, cam_keyed_entry)
+	}
+
+	nn = cnt / cam_keyed_entry
+	ids = clearIds(data, cnt)
+	for ii := 0; ii < nn; ii++ {
+		off = cam_header_size + nn*32 + ii*(cam_keyed_entry-32)
+		if size, err = strconv.ParseInt(string(data[off:off+16]), 16, 64); err != nil {
+			return nil, fmt.Errorf("bad indirect block size: %s, %s", data[off:off+16], err.Error())
+		}
+		refs = append(refs, camref{ id: ids[ii], size: size, key: string(data[off+16:off+cam_keyed_entry-32]) })
+	}
+
+	return
+}
+
+/*
+The child ids of an encrypted indirect block, readable without the key.
+*/
+func clearIds(block []byte, cnt int) (ids []string) {
+
+	for ii := 0; ii < cnt/cam_keyed_entry; ii++ {
+		ids = append(ids, string(block[cam_header_size+ii*32:cam_header_size+ii*32+32]))
+	}
+
+	return
+}
@@ -0,0 +1,168 @@
+package camfile
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCrypt(t *testing.T) {
+	t.Run("round-trip", cryptRoundTrip)
+	t.Run("dedup", cryptDedup)
+	t.Run("opaque", cryptOpaque)
+	t.Run("gc", cryptGC)
+}
+
+var cryptSecret = []byte("not a very good secret")
+
+func cryptWrite(t *testing.T, cs *Server, secret []byte, content []byte) (capa string) {
+	var (
+		cw *Writer
+		err error
+	)
+
+	if cw, err = cs.CreateEncrypted(secret); err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+	defer cw.Close()
+
+	if capa, _, err = cw.Copy(bytes.NewReader(content)); err != nil {
+		t.Fatal("failed to copy to cam, ", err.Error())
+	}
+	if !strings.Contains(capa, ":") {
+		t.Fatal("expected a capability", capa)
+	}
+
+	return
+}
+
+/*
+Enough content for two levels of encrypted indirect blocks.
+*/
+func cryptContent() (content []byte) {
+	return []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 4000))
+}
+
+func cryptRoundTrip(t *testing.T) {
+	var (
+		cs *Server
+		cr *Reader
+		err error
+		capa string
+		content, got []byte
+		buff bytes.Buffer
+	)
+
+	cs = memServer(t)
+
+	content = cryptContent()
+	capa = cryptWrite(t, cs, cryptSecret, content)
+
+	if cr, err = cs.Open(capa); err != nil {
+		t.Fatal("failed to create reader, ", err.Error())
+	}
+	defer cr.Close()
+
+	if _, err = cr.Copy(&buff); err != nil {
+		t.Fatal("failed to copy from cam, ", err.Error())
+	}
+	if !bytes.Equal(buff.Bytes(), content) {
+		t.Fatal("content mismatch")
+	}
+
+	got = make([]byte, 100)
+	if _, err = cr.ReadAt(got, 150000); err != nil {
+		t.Fatal("failed to read, ", err.Error())
+	}
+	if !bytes.Equal(got, content[150000:150100]) {
+		t.Fatal("content mismatch at offset")
+	}
+
+	// the id alone is not enough
+	cr2, _ := cs.Open(capa[:32])
+	defer cr2.Close()
+	if _, err = io.ReadAll(cr2); err == nil {
+		t.Fatal("expected error reading without the key")
+	}
+}
+
+func cryptDedup(t *testing.T) {
+	var (
+		cs *Server
+		one, two, other string
+	)
+
+	cs = memServer(t)
+
+	one = cryptWrite(t, cs, cryptSecret, cryptContent())
+	two = cryptWrite(t, cs, cryptSecret, cryptContent())
+	other = cryptWrite(t, cs, []byte("another secret"), cryptContent())
+
+	if one != two {
+		t.Fatal("same content and secret, different capabilities", one, two)
+	}
+	if one[:32] == other[:32] {
+		t.Fatal("different secrets, same root")
+	}
+}
+
+/*
+No stored block contains the plaintext.
+*/
+func cryptOpaque(t *testing.T) {
+	var (
+		cs *Server
+		dir string
+		ents []os.DirEntry
+		data []byte
+	)
+
+	dir = t.TempDir()
+	cs = connServer(t, dir)
+
+	cryptWrite(t, cs, cryptSecret, cryptContent())
+
+	ents, _ = os.ReadDir(dir)
+	for _, ent := range ents {
+		data, _ = os.ReadFile(filepath.Join(dir, ent.Name()))
+		if bytes.Contains(data, []byte("quick brown")) {
+			t.Fatal("plaintext in block", ent.Name())
+		}
+	}
+}
+
+/*
+GC and Fsck follow encrypted trees without the key.
+*/
+func cryptGC(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		capa string
+		report *GCReport
+		fr *FsckReport
+		pins map[string]string
+	)
+
+	cs = memServer(t)
+
+	capa = cryptWrite(t, cs, cryptSecret, cryptContent())
+	if err = cs.Pin("secret", capa); err != nil {
+		t.Fatal("failed to pin, ", err.Error())
+	}
+	if pins, _ = cs.Pins(); pins["secret"] != capa[:32] {
+		t.Fatal("pin should hold only the id", pins)
+	}
+	if report, err = cs.GC(GCOptions{}); err != nil {
+		t.Fatal("gc failed, ", err.Error())
+	}
+	if len(report.Removed) != 0 || report.Reachable != report.Blocks {
+		t.Fatal("encrypted blocks swept", report)
+	}
+	if fr, err = cs.Fsck([]string{ capa[:32] }, ""); err != nil || !fr.Ok() {
+		t.Fatal("fsck failed", fr, err)
+	}
+}
@@ -0,0 +1,279 @@
+package camfile
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+/*
+Comparing trees.
+
+Files are cut into DATA blocks at fixed offsets, so two versions of a
+file that differ by edits in place share every block the edits did not
+touch, and every indirect block above only untouched data.  Diff walks
+the new tree from the top and stops at each subtree whose id it also
+finds at the same place in the old tree; what is left is the changed
+data and the blocks that hold it.  A file that grew a level taller is
+still matched, by looking down the old tree for subtrees of the right
+size.  Inserting or deleting bytes shifts everything after the edit and
+shows up as a change to the rest of the file.
+*/
+
+type Range struct {
+	Off, Len int64
+}
+
+type DiffReport struct {
+	OldSize, NewSize int64
+	// byte ranges of the new file that differ from the old, in order
+	Ranges []Range
+	// blocks of the new tree not matched in the old, children before
+	// parents so they can be copied in this order
+	Blocks []string
+}
+
+/*
+A subtree of the old file and where it sits.
+*/
+type span struct {
+	ref camref
+	off, size int64
+}
+
+type differ struct {
+	cs *Server
+	ctx context.Context
+	report *DiffReport
+	seen map[string]bool
+}
+
+/*
+Compare the file under newroot with the one under oldroot.  Both are ids,
+or capabilities for encrypted files.
+*/
+func (cs *Server) Diff(oldroot, newroot string) (report *DiffReport, err error) {
+	return cs.DiffContext(context.Background(), oldroot, newroot)
+}
+
+func (cs *Server) DiffContext(ctx context.Context, oldroot, newroot string) (report *DiffReport, err error) {
+	var (
+		oldref, newref camref
+		df *differ
+	)
+
+	if oldref, err = parseCap(oldroot); err != nil {
+		return
+	}
+	if newref, err = parseCap(newroot); err != nil {
+		return
+	}
+
+	report = &DiffReport{}
+	df = &differ{ cs: cs, ctx: ctx, report: report, seen: make(map[string]bool) }
+	if report.OldSize, err = proveSize(df.get, oldref); err != nil {
+		return nil, err
+	}
+	if report.NewSize, err = proveSize(df.get, newref); err != nil {
+		return nil, err
+	}
+	oldref.size, newref.size = report.OldSize, report.NewSize
+
+	if err = df.diff([]span{ { oldref, 0, report.OldSize } }, newref, 0); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+func (df *differ) get(at camref) (block []byte, err error) {
+
+	if err = df.ctx.Err(); err != nil {
+		return
+	}
+	if block, err = df.cs.getBlock(df.ctx, at.id); err != nil {
+		return
+	}
+
+	return decodeBlock(at, block)
+}
+
+/*
+The children of an indirect block with their sizes, or nil for a leaf.
+*/
+func (df *differ) children(at camref) (tag string, cnt int, refs []camref, err error) {
+	var block []byte
+
+	if block, err = df.get(at); err != nil {
+		return
+	}
+	if tag, cnt, err = parseHeader(block); err != nil {
+		return
+	}
+	switch tag {
+	case "DATA":
+	case "INDB":
+		if refs, err = parseIndirect(block, cnt); err != nil {
+			return
+		}
+		for ii := range refs {
+			if refs[ii].size < 0 {
+				if refs[ii].size, err = proveSize(df.get, refs[ii]); err != nil {
+					return
+				}
+			}
+		}
+	default:
+		err = fmt.Errorf("unimplemented block type: %s", tag)
+	}
+
+	return
+}
+
+/*
+Compare the new subtree at, off bytes into the file, with the parts of
+the old file that overlap it.
+*/
+func (df *differ) diff(olds []span, at camref, off int64) (err error) {
+	var (
+		tag string
+		cnt int
+		refs []camref
+		sub []span
+		pos int64
+	)
+
+	for _, old := range olds {
+		if old.ref.id == at.id && old.off == off && old.size == at.size {
+			return
+		}
+	}
+
+	if tag, cnt, refs, err = df.children(at); err != nil {
+		return
+	}
+	if tag == "DATA" {
+		df.changed(off, int64(cnt))
+	}
+
+	pos = off
+	for _, ref := range refs {
+		if sub, err = df.overlap(olds, pos, ref.size); err != nil {
+			return
+		}
+		if err = df.diff(sub, ref, pos); err != nil {
+			return
+		}
+		pos += ref.size
+	}
+
+	if !df.seen[at.id] {
+		df.seen[at.id] = true
+		df.report.Blocks = append(df.report.Blocks, at.id)
+	}
+
+	return
+}
+
+/*
+The old subtrees overlapping [off, off+size), opening any that are
+larger than that so a match of the same size can be found.
+*/
+func (df *differ) overlap(olds []span, off, size int64) (out []span, err error) {
+	var refs []camref
+
+	for len(olds) > 0 {
+		old := olds[0]
+		olds = olds[1:]
+		if old.off+old.size <= off || old.off >= off+size {
+			continue
+		}
+		if old.size <= size {
+			out = append(out, old)
+			continue
+		}
+		if _, _, refs, err = df.children(old.ref); err != nil {
+			return
+		}
+		pos := old.off
+		for _, ref := range refs {
+			olds = append(olds, span{ ref, pos, ref.size })
+			pos += ref.size
+		}
+	}
+
+	return
+}
+
+func (df *differ) changed(off, size int64) {
+	var last *Range
+
+	if size == 0 {
+		return
+	}
+	if nn := len(df.report.Ranges); nn > 0 {
+		if last = &df.report.Ranges[nn-1]; last.Off+last.Len == off {
+			last.Len += size
+			return
+		}
+	}
+	df.report.Ranges = append(df.report.Ranges, Range{ off, size })
+}
+
+/*
+The blocks reachable from roots that dst does not have, children before
+parents.  As with Sync, a block dst has is taken to have its subtree
+there too.  Copying the blocks in the order returned brings dst up to
+date; this is the list Sync would copy.
+*/
+func (cs *Server) Missing(dst BlockStore, roots ...string) (ids []string, err error) {
+	return cs.MissingContext(context.Background(), dst, roots...)
+}
+
+func (cs *Server) MissingContext(ctx context.Context, dst BlockStore, roots ...string) (ids []string, err error) {
+	var seen map[string]bool
+
+	seen = make(map[string]bool)
+	for _, root := range roots {
+		root, _, _ = strings.Cut(root, ":")
+		if !isBlockId(root) {
+			return nil, fmt.Errorf("not a block id: %s", root)
+		}
+		if err = cs.missing(ctx, dst, root, seen, &ids); err != nil {
+			return nil, err
+		}
+	}
+
+	return
+}
+
+func (cs *Server) missing(ctx context.Context, dst BlockStore, id string, seen map[string]bool, ids *[]string) (err error) {
+	var (
+		ok bool
+		block []byte
+		children []string
+	)
+
+	if seen[id] {
+		return
+	}
+	seen[id] = true
+
+	if ok, err = dst.Has(ctx, id); err != nil || ok {
+		return
+	}
+	if block, err = cs.getBlock(ctx, id); err != nil {
+		return
+	}
+	if children, err = blockChildren(block); err != nil {
+		return fmt.Errorf("%s: %s", id, err.Error())
+	}
+	for _, child := range children {
+		if err = cs.missing(ctx, dst, child, seen, ids); err != nil {
+			return
+		}
+	}
+	*ids = append(*ids, id)
+
+	return
+}
@@ -0,0 +1,184 @@
+package camfile
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	t.Run("edit", diffEdit)
+	t.Run("grow", diffGrow)
+	t.Run("same", diffSame)
+	t.Run("missing", diffMissing)
+}
+
+func diffWrite(t *testing.T, cs *Server, content []byte) (id string) {
+	var (
+		cw *Writer
+		err error
+	)
+
+	if cw, err = cs.Create(); err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+	defer cw.Close()
+	if id, _, err = cw.Copy(bytes.NewReader(content)); err != nil {
+		t.Fatal("failed to copy to cam, ", err.Error())
+	}
+
+	return
+}
+
+func diffSetup(t *testing.T) (cs *Server, old, new []byte) {
+	cs = memServer(t)
+	old = make([]byte, 100000)
+	rand.New(rand.NewSource(40)).Read(old)
+	new = append([]byte(nil), old...)
+
+	return
+}
+
+func diffEdit(t *testing.T) {
+	var (
+		cs *Server
+		old, new []byte
+		report *DiffReport
+		err error
+	)
+
+	cs, old, new = diffSetup(t)
+	copy(new[50000:], "an edit in place")
+	copy(new[80000:], "and another")
+
+	if report, err = cs.Diff(diffWrite(t, cs, old), diffWrite(t, cs, new)); err != nil {
+		t.Fatal("diff failed, ", err.Error())
+	}
+	if report.OldSize != 100000 || report.NewSize != 100000 || len(report.Ranges) != 2 {
+		t.Fatal("wrong diff", report)
+	}
+	for ii, off := range []int64{ 50000, 80000 } {
+		rr := report.Ranges[ii]
+		if rr.Off > off || rr.Off+rr.Len < off+16 || rr.Len > 2*cam_block_size {
+			t.Fatal("range does not cover the edit closely", rr)
+		}
+	}
+	// two leaves and their paths
+	if len(report.Blocks) > 8 {
+		t.Fatal("too many changed blocks", len(report.Blocks))
+	}
+}
+
+/*
+The new file is a level taller; the old part still matches.
+*/
+func diffGrow(t *testing.T) {
+	var (
+		cs *Server
+		old, new []byte
+		report *DiffReport
+		err error
+	)
+
+	cs, old, new = diffSetup(t)
+	old = old[:15000]
+
+	if report, err = cs.Diff(diffWrite(t, cs, old), diffWrite(t, cs, new)); err != nil {
+		t.Fatal("diff failed, ", err.Error())
+	}
+	if len(report.Ranges) != 1 || report.Ranges[0].Off < 14000 || report.Ranges[0].Off+report.Ranges[0].Len != 100000 {
+		t.Fatal("growth not found as a tail", report.Ranges)
+	}
+
+	// and the other way, a truncation
+	if report, err = cs.Diff(diffWrite(t, cs, new), diffWrite(t, cs, old)); err != nil {
+		t.Fatal("diff failed, ", err.Error())
+	}
+	if report.OldSize != 100000 || report.NewSize != 15000 || len(report.Ranges) > 1 {
+		t.Fatal("wrong diff of a truncation", report)
+	}
+}
+
+func diffSame(t *testing.T) {
+	var (
+		cs *Server
+		old []byte
+		report *DiffReport
+		err error
+	)
+
+	cs, old, _ = diffSetup(t)
+	id := diffWrite(t, cs, old)
+
+	if report, err = cs.Diff(id, id); err != nil {
+		t.Fatal("diff failed, ", err.Error())
+	}
+	if len(report.Ranges) != 0 || len(report.Blocks) != 0 {
+		t.Fatal("identical files differ", report)
+	}
+}
+
+/*
+Only the changed blocks go to a site that has the old version.
+*/
+func diffMissing(t *testing.T) {
+	var (
+		cs, site *Server
+		old, new []byte
+		report *DiffReport
+		ids []string
+		block []byte
+		err error
+	)
+
+	cs, old, new = diffSetup(t)
+	copy(new[30000:], "changed")
+	oldid, newid := diffWrite(t, cs, old), diffWrite(t, cs, new)
+
+	site = memServer(t)
+	if _, err = Sync(context.Background(), site.store, cs.store, oldid); err != nil {
+		t.Fatal("sync failed, ", err.Error())
+	}
+
+	if ids, err = cs.Missing(site.store, newid); err != nil {
+		t.Fatal("missing failed, ", err.Error())
+	}
+	if report, err = cs.Diff(oldid, newid); err != nil {
+		t.Fatal("diff failed, ", err.Error())
+	}
+	sorted := append([]string(nil), ids...)
+	sort.Strings(sorted)
+	sort.Strings(report.Blocks)
+	if len(ids) == 0 || len(ids) > 4 || !equalStrings(sorted, report.Blocks) {
+		t.Fatal("missing and diff disagree", ids, report.Blocks)
+	}
+
+	for _, id := range ids {
+		if block, err = cs.store.Get(context.Background(), id); err != nil {
+			t.Fatal(err)
+		}
+		if err = site.store.Put(context.Background(), id, block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tierRead(t, site, newid, new)
+	if ids, err = cs.Missing(site.store, newid); err != nil || len(ids) != 0 {
+		t.Fatal("still missing after copy", ids, err)
+	}
+}
+
+func equalStrings(aa, bb []string) (ok bool) {
+
+	if len(aa) != len(bb) {
+		return false
+	}
+	for ii := range aa {
+		if aa[ii] != bb[ii] {
+			return false
+		}
+	}
+
+	return true
+}
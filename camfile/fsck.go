@@ -0,0 +1,163 @@
+package camfile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+The result of checking a store.
+
+Corrupt blocks do not hash to their id, are the wrong size, or have a
+header that cannot be parsed.  A dangling reference is an indirect block
+naming a child that is not in the store; a root given to Fsck that is not
+in the store is reported with an empty Parent.  Unreachable blocks are
+only computed when roots are given.
+*/
+type FsckReport struct {
+	Blocks int
+	Corrupt []string
+	Dangling []FsckRef
+	Unreachable []string
+	Quarantined []string
+}
+
+type FsckRef struct {
+	Parent string
+	Child string
+}
+
+/*
+True if the store had no problems.
+*/
+func (fr *FsckReport) Ok() (ok bool) {
+	return len(fr.Corrupt) == 0 && len(fr.Dangling) == 0 && len(fr.Unreachable) == 0
+}
+
+/*
+Check every block in the store.
+
+If roots are given, blocks not reachable from any of them are reported.
+A root may be the capability of an encrypted file; only its id is used,
+as Pin does.
+If quarantine names a directory, corrupt blocks are copied there and
+removed from the store, so a later write of the same content repairs it.
+*/
+func (cs *Server) Fsck(roots []string, quarantine string) (report *FsckReport, err error) {
+	return cs.FsckContext(context.Background(), roots, quarantine)
+}
+
+func (cs *Server) FsckContext(ctx context.Context, roots []string, quarantine string) (report *FsckReport, err error) {
+	var (
+		all map[string]bool
+		good map[string][]string
+		seen map[string]bool
+		block []byte
+		ids, todo []string
+		id string
+	)
+
+	if cs.state != state_open {
+		err = fmt.Errorf("not opened: server %s", stateString(cs.state))
+		goto out
+	}
+
+	report = &FsckReport{}
+	all = make(map[string]bool)
+	good = make(map[string][]string)
+
+	if err = cs.store.Walk(ctx, func(id string, mtime time.Time) error {
+		all[id] = true
+		return nil
+	}); err != nil {
+		goto out
+	}
+	report.Blocks = len(all)
+
+	for id = range all {
+		if block, err = cs.store.Get(ctx, id); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				// removed while we were looking
+				err = nil
+				continue
+			}
+			goto out
+		}
+		if verifyBlock(id, block) != nil {
+			report.Corrupt = append(report.Corrupt, id)
+			continue
+		}
+		if ids, err = blockChildren(block); err != nil {
+			err = nil
+			report.Corrupt = append(report.Corrupt, id)
+			continue
+		}
+		good[id] = ids
+		for _, child := range ids {
+			if !all[child] {
+				report.Dangling = append(report.Dangling, FsckRef{ Parent: id, Child: child })
+			}
+		}
+	}
+
+	if len(roots) > 0 {
+		seen = make(map[string]bool)
+		for _, id = range roots {
+			id, _, _ = strings.Cut(id, ":")
+			if !all[id] {
+				report.Dangling = append(report.Dangling, FsckRef{ Child: id })
+			}
+			todo = append(todo, id)
+		}
+		for len(todo) > 0 {
+			id, todo = todo[0], todo[1:]
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			todo = append(todo, good[id]...)
+		}
+		for id = range all {
+			if !seen[id] {
+				report.Unreachable = append(report.Unreachable, id)
+			}
+		}
+	}
+
+	sort.Strings(report.Corrupt)
+	sort.Strings(report.Unreachable)
+
+	if quarantine != "" {
+		for _, id = range report.Corrupt {
+			if err = cs.quarantineBlock(ctx, id, quarantine); err != nil {
+				goto out
+			}
+			report.Quarantined = append(report.Quarantined, id)
+		}
+	}
+
+out:
+	return
+}
+
+/*
+Move a block out of the store into the quarantine directory.
+*/
+func (cs *Server) quarantineBlock(ctx context.Context, id, dir string) (err error) {
+	var block []byte
+
+	if block, err = cs.store.Get(ctx, id); err != nil {
+		return
+	}
+	if err = os.WriteFile(dir + "/" + id, block, 0644); err != nil {
+		return
+	}
+	err = cs.store.Remove(ctx, id)
+
+	return
+}
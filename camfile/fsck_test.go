@@ -0,0 +1,187 @@
+package camfile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+	t.Run("clean", fsckClean)
+	t.Run("damaged", fsckDamaged)
+	t.Run("verify-read", fsckVerifyRead)
+	t.Run("encrypted-root", fsckEncryptedRoot)
+}
+
+/*
+Write two files to a fresh store.  Returns the roots.
+*/
+func fsckSetup(t *testing.T) (cs *Server, dir string, roots []string) {
+	var (
+		err error
+		id string
+		content []byte
+	)
+
+	dir = t.TempDir()
+	cs = connServer(t, dir)
+
+	rr := rand.New(rand.NewSource(4))
+	for _, size := range []int{5000, 100} {
+		content = make([]byte, size)
+		rr.Read(content)
+		cw, _ := cs.Create()
+		if id, _, err = cw.Copy(bytes.NewReader(content)); err != nil {
+			t.Fatal("failed to copy to cam, ", err.Error())
+		}
+		cw.Close()
+		roots = append(roots, id)
+	}
+
+	return
+}
+
+func fsckClean(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		roots []string
+		report *FsckReport
+	)
+
+	cs, _, roots = fsckSetup(t)
+
+	if report, err = cs.Fsck(roots, ""); err != nil {
+		t.Fatal("fsck failed, ", err.Error())
+	}
+	if !report.Ok() {
+		t.Fatal("unexpected problems", report)
+	}
+	// six DATA blocks and an INDB, plus one single block file
+	if report.Blocks != 8 {
+		t.Fatal("unexpected block count", report.Blocks)
+	}
+}
+
+func fsckDamaged(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		dir string
+		roots, children []string
+		block []byte
+		report *FsckReport
+	)
+
+	cs, dir, roots = fsckSetup(t)
+
+	if block, err = cs.store.Get(context.Background(), roots[0]); err != nil {
+		t.Fatal("failed to get root, ", err.Error())
+	}
+	if children, err = blockChildren(block); err != nil || len(children) != 6 {
+		t.Fatal("unexpected children", children, err)
+	}
+
+	// truncate one child, lose another
+	if err = os.Truncate(dir + "/" + children[0], 100); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(dir + "/" + children[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	quarantine := t.TempDir()
+	// only the first root, so the second file is unreachable
+	if report, err = cs.Fsck(roots[:1], quarantine); err != nil {
+		t.Fatal("fsck failed, ", err.Error())
+	}
+	if len(report.Corrupt) != 1 || report.Corrupt[0] != children[0] {
+		t.Fatal("unexpected corrupt blocks", report.Corrupt)
+	}
+	if len(report.Dangling) != 1 || report.Dangling[0] != (FsckRef{ Parent: roots[0], Child: children[1] }) {
+		t.Fatal("unexpected dangling refs", report.Dangling)
+	}
+	if len(report.Unreachable) != 1 || report.Unreachable[0] != roots[1] {
+		t.Fatal("unexpected unreachable blocks", report.Unreachable)
+	}
+	if len(report.Quarantined) != 1 {
+		t.Fatal("unexpected quarantine", report.Quarantined)
+	}
+	if _, err = os.Stat(quarantine + "/" + children[0]); err != nil {
+		t.Fatal("missing quarantined block, ", err.Error())
+	}
+	if _, err = os.Stat(dir + "/" + children[0]); err == nil {
+		t.Fatal("quarantined block still in store")
+	}
+}
+
+/*
+A damaged block must be an error on read, not wrong data.
+*/
+func fsckVerifyRead(t *testing.T) {
+	var (
+		cs *Server
+		cr *Reader
+		err error
+		dir string
+		roots []string
+		block []byte
+	)
+
+	cs, dir, roots = fsckSetup(t)
+
+	block, _ = os.ReadFile(dir + "/" + roots[1])
+	block[cam_header_size] ^= 0xff
+	if err = os.WriteFile(dir + "/" + roots[1], block, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if cr, err = cs.Open(roots[1]); err != nil {
+		t.Fatal("failed to create reader, ", err.Error())
+	}
+	defer cr.Close()
+
+	if _, err = cr.Copy(&bytes.Buffer{}); !errors.Is(err, ErrCorrupt) {
+		t.Fatal("expected corrupt block error, got", err)
+	}
+}
+
+/*
+A capability names its tree as well as the bare id does.
+*/
+func fsckEncryptedRoot(t *testing.T) {
+	var (
+		cs *Server
+		cw *Writer
+		err error
+		roots []string
+		id string
+		report *FsckReport
+	)
+
+	cs, _, roots = fsckSetup(t)
+
+	content := make([]byte, 5000)
+	rand.New(rand.NewSource(5)).Read(content)
+	if cw, err = cs.CreateEncrypted([]byte("fsck secret")); err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+	if id, _, err = cw.Copy(bytes.NewReader(content)); err != nil {
+		t.Fatal("failed to copy to cam, ", err.Error())
+	}
+	cw.Close()
+	if !strings.Contains(id, ":") {
+		t.Fatal("not a capability", id)
+	}
+
+	if report, err = cs.Fsck(append(roots, id), ""); err != nil {
+		t.Fatal("fsck failed, ", err.Error())
+	}
+	if !report.Ok() {
+		t.Fatal("unexpected problems", report)
+	}
+}
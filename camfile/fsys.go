@@ -0,0 +1,288 @@
+package camfile
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+/*
+A read-only fs.FS over a snapshot made by PutTree.
+
+Paths are resolved by walking DIRB blocks from the root, so nothing is
+extracted to disk.  Files implement io.Seeker and io.ReaderAt on top of a
+Reader, which is what http.FileServer needs for range requests:
+
+	http.Handle("/", http.FileServer(http.FS(cs.FS(root))))
+
+The FS stays usable only while the Server is open.
+*/
+type FS struct {
+	server *Server
+	root string
+}
+
+func (cs *Server) FS(root string) (fsys *FS) {
+	return &FS{ server: cs, root: root }
+}
+
+/*
+The same view as an http.FileSystem.
+*/
+func (cs *Server) HTTPFileSystem(root string) (hfs http.FileSystem) {
+	return http.FS(cs.FS(root))
+}
+
+func (fsys *FS) Open(name string) (file fs.File, err error) {
+	var ent *Entry
+
+	if ent, err = fsys.lookup("open", name); err != nil {
+		return
+	}
+	if ent.IsDir() {
+		return &fsDir{ fsys: fsys, ent: ent, name: name }, nil
+	}
+
+	ff := &fsFile{ ent: ent, name: name }
+	if ent.Root != "" {
+		if ff.cr, err = fsys.server.Open(ent.Root); err != nil {
+			return nil, &fs.PathError{ Op: "open", Path: name, Err: err }
+		}
+	}
+
+	return ff, nil
+}
+
+/*
+Implement fs.StatFS.
+*/
+func (fsys *FS) Stat(name string) (fi fs.FileInfo, err error) {
+	var ent *Entry
+
+	if ent, err = fsys.lookup("stat", name); err != nil {
+		return
+	}
+
+	return fsInfo{ ent: ent, name: path.Base(name) }, nil
+}
+
+/*
+Implement fs.ReadDirFS.
+*/
+func (fsys *FS) ReadDir(name string) (des []fs.DirEntry, err error) {
+	var (
+		ent *Entry
+		ents []*Entry
+	)
+
+	if ent, err = fsys.lookup("readdir", name); err != nil {
+		return
+	}
+	if !ent.IsDir() {
+		return nil, &fs.PathError{ Op: "readdir", Path: name, Err: errors.New("not a directory") }
+	}
+	if ents, err = fsys.server.ReadDir(ent.Id); err != nil {
+		return nil, &fs.PathError{ Op: "readdir", Path: name, Err: err }
+	}
+
+	return dirEntries(ents), nil
+}
+
+/*
+Walk from the root to name, one directory at a time.
+*/
+func (fsys *FS) lookup(op, name string) (ent *Entry, err error) {
+
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{ Op: op, Path: name, Err: fs.ErrInvalid }
+	}
+	if ent, err = fsys.server.Lookup(fsys.root); err != nil {
+		return nil, &fs.PathError{ Op: op, Path: name, Err: err }
+	}
+	if name == "." {
+		return
+	}
+
+	for _, elem := range strings.Split(name, "/") {
+		if !ent.IsDir() {
+			return nil, &fs.PathError{ Op: op, Path: name, Err: fs.ErrNotExist }
+		}
+		if ent, err = fsys.server.lookupChild(context.Background(), ent, elem); errors.Is(err, fs.ErrNotExist) {
+			return nil, &fs.PathError{ Op: op, Path: name, Err: fs.ErrNotExist }
+		} else if err != nil {
+			return nil, &fs.PathError{ Op: op, Path: name, Err: err }
+		}
+	}
+
+	return
+}
+
+func dirEntries(ents []*Entry) (des []fs.DirEntry) {
+
+	des = make([]fs.DirEntry, len(ents))
+	for ii, ent := range ents {
+		des[ii] = fsInfo{ ent: ent, name: ent.Name }
+	}
+
+	return
+}
+
+/*
+Both fs.FileInfo and fs.DirEntry for an Entry.  The root keeps the name
+it was opened by rather than the name it was stored under.
+*/
+type fsInfo struct {
+	ent *Entry
+	name string
+}
+
+func (fi fsInfo) Name() string {
+	return fi.name
+}
+
+func (fi fsInfo) Size() int64 {
+	if fi.ent.IsDir() {
+		return 0
+	}
+	return fi.ent.Size
+}
+
+func (fi fsInfo) Mode() fs.FileMode {
+	return fi.ent.Mode
+}
+
+func (fi fsInfo) ModTime() time.Time {
+	return fi.ent.ModTime
+}
+
+func (fi fsInfo) IsDir() bool {
+	return fi.ent.IsDir()
+}
+
+func (fi fsInfo) Sys() interface{} {
+	return fi.ent
+}
+
+func (fi fsInfo) Type() fs.FileMode {
+	return fi.ent.Mode.Type()
+}
+
+func (fi fsInfo) Info() (fs.FileInfo, error) {
+	return fi, nil
+}
+
+/*
+An open regular file.  cr is nil for an empty file, which keeps its own
+offset.
+*/
+type fsFile struct {
+	ent *Entry
+	name string
+	cr *Reader
+	off int64
+}
+
+func (ff *fsFile) Stat() (fs.FileInfo, error) {
+	return fsInfo{ ent: ff.ent, name: path.Base(ff.name) }, nil
+}
+
+func (ff *fsFile) Read(p []byte) (nn int, err error) {
+	if ff.cr == nil {
+		return 0, io.EOF
+	}
+	return ff.cr.Read(p)
+}
+
+func (ff *fsFile) ReadAt(p []byte, off int64) (nn int, err error) {
+	if ff.cr == nil {
+		return 0, io.EOF
+	}
+	return ff.cr.ReadAt(p, off)
+}
+
+func (ff *fsFile) Seek(offset int64, whence int) (pos int64, err error) {
+	if ff.cr != nil {
+		return ff.cr.Seek(offset, whence)
+	}
+
+	// as Reader.Seek with a size of 0
+	switch whence {
+	case io.SeekStart, io.SeekEnd:
+		pos = offset
+	case io.SeekCurrent:
+		pos = ff.off + offset
+	default:
+		return ff.off, &fs.PathError{ Op: "seek", Path: ff.name, Err: fs.ErrInvalid }
+	}
+	if pos < 0 {
+		return ff.off, &fs.PathError{ Op: "seek", Path: ff.name, Err: fs.ErrInvalid }
+	}
+	ff.off = pos
+
+	return
+}
+
+func (ff *fsFile) Close() (err error) {
+	if ff.cr != nil {
+		err = ff.cr.Close()
+		ff.cr = nil
+	}
+	return
+}
+
+/*
+An open directory.  Entries are read on the first ReadDir.
+*/
+type fsDir struct {
+	fsys *FS
+	ent *Entry
+	name string
+	des []fs.DirEntry
+	read bool
+}
+
+func (fd *fsDir) Stat() (fs.FileInfo, error) {
+	return fsInfo{ ent: fd.ent, name: path.Base(fd.name) }, nil
+}
+
+func (fd *fsDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{ Op: "read", Path: fd.name, Err: errors.New("is a directory") }
+}
+
+func (fd *fsDir) Close() error {
+	return nil
+}
+
+/*
+Implement fs.ReadDirFile.
+*/
+func (fd *fsDir) ReadDir(count int) (des []fs.DirEntry, err error) {
+	var ents []*Entry
+
+	if !fd.read {
+		if ents, err = fd.fsys.server.ReadDir(fd.ent.Id); err != nil {
+			return nil, &fs.PathError{ Op: "readdir", Path: fd.name, Err: err }
+		}
+		fd.des = dirEntries(ents)
+		fd.read = true
+	}
+
+	if count <= 0 {
+		des, fd.des = fd.des, nil
+		return
+	}
+	if len(fd.des) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(fd.des) {
+		count = len(fd.des)
+	}
+	des, fd.des = fd.des[:count], fd.des[count:]
+
+	return
+}
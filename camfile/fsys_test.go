@@ -0,0 +1,172 @@
+package camfile
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFS(t *testing.T) {
+	t.Run("fstest", fsFstest)
+	t.Run("walk", fsWalk)
+	t.Run("http-range", fsHttpRange)
+	t.Run("lookup", fsLookup)
+	t.Run("seek", fsSeek)
+}
+
+func fsSetup(t *testing.T) (cs *Server, src, id string) {
+	var err error
+
+	src = treeSetup(t)
+	cs = memServer(t)
+	if id, err = cs.PutTree(src); err != nil {
+		t.Fatal("failed to put tree, ", err.Error())
+	}
+
+	return
+}
+
+func fsFstest(t *testing.T) {
+	cs, _, id := fsSetup(t)
+
+	if err := fstest.TestFS(cs.FS(id), "big.dat", "empty", "sub/one.txt", "sub/deeper/two.txt", "many/024"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/*
+fs.WalkDir over the store sees the same files as over the source.
+*/
+func fsWalk(t *testing.T) {
+	var (
+		want, got []string
+		err error
+	)
+
+	cs, src, id := fsSetup(t)
+
+	if err = fs.WalkDir(os.DirFS(src), ".", func(path string, de fs.DirEntry, err error) error {
+		want = append(want, path)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.WalkDir(cs.FS(id), ".", func(path string, de fs.DirEntry, err error) error {
+		got = append(got, path)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(want) {
+		t.Fatal("walks differ", len(got), len(want))
+	}
+	for ii := range want {
+		if got[ii] != want[ii] {
+			t.Fatal("walks differ at", ii, got[ii], want[ii])
+		}
+	}
+}
+
+func fsHttpRange(t *testing.T) {
+	var (
+		req *http.Request
+		rsp *http.Response
+		body, want []byte
+		err error
+	)
+
+	cs, src, id := fsSetup(t)
+
+	ts := httptest.NewServer(http.FileServer(cs.HTTPFileSystem(id)))
+	defer ts.Close()
+
+	req, _ = http.NewRequest("GET", ts.URL + "/big.dat", nil)
+	req.Header.Set("Range", "bytes=1000-2999")
+	if rsp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusPartialContent {
+		t.Fatal("unexpected status", rsp.Status)
+	}
+	body, _ = io.ReadAll(rsp.Body)
+	want, _ = os.ReadFile(filepath.Join(src, "big.dat"))
+	if string(body) != string(want[1000:3000]) {
+		t.Fatal("unexpected range content")
+	}
+}
+
+/*
+Finding a path reads a few entries of each directory, not all of them.
+*/
+func fsLookup(t *testing.T) {
+	var err error
+
+	cs, _, id := fsSetup(t)
+	metrics := NewMetrics()
+	cs.SetInstrument(metrics)
+
+	if _, err = cs.FS(id).Stat("many/024"); err != nil {
+		t.Fatal("failed to stat, ", err.Error())
+	}
+	if get := instrumentOp(metrics, "file", "get"); get.count > 16 {
+		t.Fatal("lookup read", get.count, "blocks")
+	}
+	if _, err = cs.FS(id).Stat("many/0245"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal("found a missing file", err)
+	}
+}
+
+/*
+Files seek as the source files do, the empty one included, and an empty
+file from an older tree, with no root, as well.
+*/
+func fsSeek(t *testing.T) {
+	cs, src, id := fsSetup(t)
+
+	seeks := []struct {
+		offset int64
+		whence int
+	}{
+		{ 5, io.SeekStart }, { 3, io.SeekCurrent }, { -2, io.SeekCurrent }, { -1, io.SeekStart },
+		{ 0, io.SeekEnd }, { 4, io.SeekEnd }, { -100, io.SeekEnd }, { -100, io.SeekCurrent },
+	}
+
+	for _, name := range []string{ "empty", "sub/one.txt", "" } {
+		var got io.Seeker
+
+		if name == "" {
+			name, got = "empty", &fsFile{ name: "empty" }
+		} else if ff, err := cs.FS(id).Open(name); err != nil {
+			t.Fatal(err)
+		} else {
+			defer ff.Close()
+			got = ff.(io.Seeker)
+		}
+		want, err := os.Open(filepath.Join(src, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer want.Close()
+
+		for _, sk := range seeks {
+			wpos, werr := want.Seek(sk.offset, sk.whence)
+			gpos, gerr := got.Seek(sk.offset, sk.whence)
+			if (werr == nil) != (gerr == nil) || (werr == nil && gpos != wpos) {
+				t.Error(name, "seek", sk.offset, sk.whence, "got", gpos, gerr, "want", wpos, werr)
+			}
+		}
+		// and failed seeks moved neither
+		wpos, _ := want.Seek(0, io.SeekCurrent)
+		if gpos, _ := got.Seek(0, io.SeekCurrent); gpos != wpos {
+			t.Error(name, "ended at", gpos, "want", wpos)
+		}
+	}
+}
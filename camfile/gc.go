@@ -0,0 +1,293 @@
+package camfile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Garbage collection.
+
+Blocks are kept while they are reachable from a pinned root, were written
+within the grace period, or are held by an open Writer.  Everything else
+is swept.
+
+The grace period covers the gap between a Writer closing, which releases
+its blocks, and the caller pinning the new root.  Writing a block that is
+already stored refreshes its time, so deduplicated blocks are covered too.
+Readers of unpinned roots get no protection.
+*/
+
+type GCOptions struct {
+	// report what would be removed, but remove nothing
+	DryRun bool
+	// keep blocks written less than this long before the collection started
+	Grace time.Duration
+}
+
+type GCReport struct {
+	Blocks int
+	Reachable int
+	Young int
+	Held int
+	Removed []string
+}
+
+/*
+Name a root so GC keeps it and everything below it.  Names are simple
+file names: letters, digits, '.', '_' and '-', not starting with '.'.
+An existing pin of the same name is replaced.  The key of an encrypted
+root is dropped; only the id is stored.
+*/
+func (cs *Server) Pin(name, id string) (err error) {
+	return cs.PinContext(context.Background(), name, id)
+}
+
+func (cs *Server) PinContext(ctx context.Context, name, id string) (err error) {
+	var ok bool
+
+	if cs.state != state_open {
+		return fmt.Errorf("not opened: server %s", stateString(cs.state))
+	}
+	id, _, _ = strings.Cut(id, ":")
+	if !isPinName(name) {
+		return fmt.Errorf("bad pin name: %q", name)
+	}
+	if !isBlockId(id) {
+		return fmt.Errorf("not a block id: %s", id)
+	}
+	if ok, err = cs.store.Has(ctx, id); err != nil {
+		return
+	} else if !ok {
+		return fmt.Errorf("no such block: %s", id)
+	}
+
+	return cs.store.PutPin(ctx, name, id)
+}
+
+func (cs *Server) Unpin(name string) (err error) {
+	return cs.UnpinContext(context.Background(), name)
+}
+
+func (cs *Server) UnpinContext(ctx context.Context, name string) (err error) {
+
+	if cs.state != state_open {
+		return fmt.Errorf("not opened: server %s", stateString(cs.state))
+	}
+	if !isPinName(name) {
+		return fmt.Errorf("bad pin name: %q", name)
+	}
+
+	return cs.store.RemovePin(ctx, name)
+}
+
+/*
+All pins, name to root id.
+*/
+func (cs *Server) Pins() (pins map[string]string, err error) {
+	return cs.PinsContext(context.Background())
+}
+
+func (cs *Server) PinsContext(ctx context.Context) (pins map[string]string, err error) {
+
+	if cs.state != state_open {
+		return nil, fmt.Errorf("not opened: server %s", stateString(cs.state))
+	}
+
+	pins = make(map[string]string)
+	err = cs.store.WalkPins(ctx, func(name, id string) error {
+		// a mirror gives a name its backends disagree on once per id
+		if _, ok := pins[name]; !ok {
+			pins[name] = id
+		}
+		return nil
+	})
+
+	return
+}
+
+/*
+Mark everything reachable from the pins, then sweep the rest.
+
+A reachable block that is missing is ignored, but one that cannot be read
+or parsed stops the collection, since its children are unknown; run Fsck.
+*/
+func (cs *Server) GC(opts GCOptions) (report *GCReport, err error) {
+	return cs.GCContext(context.Background(), opts)
+}
+
+/*
+As GC.  Once ctx is done the collection stops where it is; blocks already
+removed stay removed, and none of them was reachable.
+*/
+func (cs *Server) GCContext(ctx context.Context, opts GCOptions) (report *GCReport, err error) {
+	var (
+		marked map[string]bool
+		todo, ids, candidates []string
+		id string
+		block []byte
+		start time.Time
+	)
+
+	if cs.state != state_open {
+		err = fmt.Errorf("not opened: server %s", stateString(cs.state))
+		goto out
+	}
+
+	start = time.Now()
+	report = &GCReport{}
+	marked = make(map[string]bool)
+
+	if err = cs.store.WalkPins(ctx, func(name, id string) error {
+		todo = append(todo, id)
+		return nil
+	}); err != nil {
+		goto out
+	}
+
+	for len(todo) > 0 {
+		id, todo = todo[len(todo)-1], todo[:len(todo)-1]
+		if marked[id] {
+			continue
+		}
+		if block, err = cs.store.Get(ctx, id); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				err = nil
+				continue
+			}
+			goto out
+		}
+		if err = verifyBlock(id, block); err != nil {
+			goto out
+		}
+		if ids, err = blockChildren(block); err != nil {
+			err = fmt.Errorf("gc: %s: %s", id, err.Error())
+			goto out
+		}
+		marked[id] = true
+		todo = append(todo, ids...)
+	}
+	report.Reachable = len(marked)
+
+	if err = cs.store.Walk(ctx, func(id string, mtime time.Time) error {
+		report.Blocks++
+		if marked[id] {
+			return nil
+		}
+		if mtime.After(start.Add(-opts.Grace)) {
+			report.Young++
+			return nil
+		}
+		candidates = append(candidates, id)
+		return nil
+	}); err != nil {
+		goto out
+	}
+
+	for _, id = range candidates {
+		if err = cs.sweep(ctx, id, opts.DryRun); err == errHeld {
+			err = nil
+			report.Held++
+			continue
+		} else if err != nil {
+			goto out
+		}
+		report.Removed = append(report.Removed, id)
+	}
+	sort.Strings(report.Removed)
+
+	// stores that keep removed blocks' space until compacted, see pack.go
+	if cp, ok := cs.store.(interface{ Compact(context.Context) error }); ok && !opts.DryRun && len(report.Removed) > 0 {
+		err = cp.Compact(ctx)
+	}
+
+out:
+	return
+}
+
+var errHeld = errors.New("held by a writer")
+
+/*
+Remove one unmarked block unless an open Writer holds it.  The check and
+the removal happen under the lock that Writers take before each put.
+*/
+func (cs *Server) sweep(ctx context.Context, id string, dryrun bool) (err error) {
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.live[id] > 0 {
+		return errHeld
+	}
+	if dryrun {
+		return
+	}
+	if err = cs.store.Remove(ctx, id); errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+
+	return
+}
+
+func (cs *Server) hold(ids ...string) {
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.live == nil {
+		cs.live = make(map[string]int)
+	}
+	for _, id := range ids {
+		cs.live[id]++
+	}
+}
+
+/*
+As hold, appending id to held under the same lock, so a Writer's workers
+can share one list.
+*/
+func (cs *Server) holdInto(held *[]string, id string) {
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.live == nil {
+		cs.live = make(map[string]int)
+	}
+	cs.live[id]++
+	*held = append(*held, id)
+}
+
+func (cs *Server) release(ids []string) {
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for _, id := range ids {
+		if cs.live[id]--; cs.live[id] <= 0 {
+			delete(cs.live, id)
+		}
+	}
+}
+
+func isPinName(name string) (ok bool) {
+
+	if name == "" || name[0] == '.' || len(name) > 255 {
+		return false
+	}
+	for _, cc := range name {
+		switch {
+		case cc >= 'a' && cc <= 'z', cc >= 'A' && cc <= 'Z', cc >= '0' && cc <= '9':
+		case cc == '.', cc == '_', cc == '-':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,194 @@
+package camfile
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestGC(t *testing.T) {
+	t.Run("pins", gcPins)
+	t.Run("sweep", gcSweep)
+	t.Run("grace", gcGrace)
+	t.Run("active-writer", gcActiveWriter)
+}
+
+func gcWrite(t *testing.T, cs *Server, seed int64, size int) (id string) {
+	var (
+		cw *Writer
+		err error
+		content []byte
+	)
+
+	content = make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(content)
+
+	if cw, err = cs.Create(); err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+	defer cw.Close()
+
+	if id, _, err = cw.Copy(bytes.NewReader(content)); err != nil {
+		t.Fatal("failed to copy to cam, ", err.Error())
+	}
+
+	return
+}
+
+func gcPins(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		id string
+		pins map[string]string
+	)
+
+	cs = memServer(t)
+
+	id = gcWrite(t, cs, 1, 100)
+
+	if err = cs.Pin("../escape", id); err == nil {
+		t.Fatal("expected error for bad pin name")
+	}
+	if err = cs.Pin("missing", "0123456789abcdef0123456789abcdef"); err == nil {
+		t.Fatal("expected error pinning a missing block")
+	}
+	if err = cs.Pin("first", id); err != nil {
+		t.Fatal("failed to pin, ", err.Error())
+	}
+	if pins, err = cs.Pins(); err != nil || len(pins) != 1 || pins["first"] != id {
+		t.Fatal("unexpected pins", pins, err)
+	}
+	if err = cs.Unpin("first"); err != nil {
+		t.Fatal("failed to unpin, ", err.Error())
+	}
+	if pins, err = cs.Pins(); err != nil || len(pins) != 0 {
+		t.Fatal("unexpected pins", pins, err)
+	}
+}
+
+func gcSweep(t *testing.T) {
+	var (
+		cs *Server
+		cr *Reader
+		err error
+		keep, lose string
+		report *GCReport
+	)
+
+	cs = memServer(t)
+
+	keep = gcWrite(t, cs, 1, 5000)
+	lose = gcWrite(t, cs, 2, 3000)
+	if err = cs.Pin("keep", keep); err != nil {
+		t.Fatal("failed to pin, ", err.Error())
+	}
+
+	if report, err = cs.GC(GCOptions{ DryRun: true }); err != nil {
+		t.Fatal("gc failed, ", err.Error())
+	}
+	// 6 DATA + INDB kept, 4 DATA + INDB would go
+	if report.Blocks != 12 || report.Reachable != 7 || len(report.Removed) != 5 {
+		t.Fatal("unexpected dry run", report)
+	}
+	if ok, _ := cs.store.Has(context.Background(), lose); !ok {
+		t.Fatal("dry run removed a block")
+	}
+
+	if report, err = cs.GC(GCOptions{}); err != nil {
+		t.Fatal("gc failed, ", err.Error())
+	}
+	if len(report.Removed) != 5 {
+		t.Fatal("unexpected sweep", report)
+	}
+	if ok, _ := cs.store.Has(context.Background(), lose); ok {
+		t.Fatal("unpinned root survived")
+	}
+
+	if cr, err = cs.Open(keep); err != nil {
+		t.Fatal("failed to create reader, ", err.Error())
+	}
+	defer cr.Close()
+	if nn, err := cr.Copy(&bytes.Buffer{}); err != nil || nn != 5000 {
+		t.Fatal("pinned root damaged", nn, err)
+	}
+}
+
+func gcGrace(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		report *GCReport
+	)
+
+	cs = memServer(t)
+
+	gcWrite(t, cs, 1, 3000)
+
+	if report, err = cs.GC(GCOptions{ Grace: time.Hour }); err != nil {
+		t.Fatal("gc failed, ", err.Error())
+	}
+	if report.Young != 5 || len(report.Removed) != 0 {
+		t.Fatal("young blocks removed", report)
+	}
+}
+
+/*
+Blocks already put by an open Writer survive a collection, and the
+finished tree is complete.
+*/
+func gcActiveWriter(t *testing.T) {
+	var (
+		cs *Server
+		cw *Writer
+		cr *Reader
+		err error
+		content []byte
+		report *GCReport
+		nn int
+	)
+
+	cs = memServer(t)
+	// every block is stored by the time Write returns
+	cs.SetConcurrency(1)
+
+	content = make([]byte, 5000)
+	rand.New(rand.NewSource(5)).Read(content)
+
+	if cw, err = cs.Create(); err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+	if _, err = cw.Write(content[:3000]); err != nil {
+		t.Fatal("failed to write, ", err.Error())
+	}
+
+	if report, err = cs.GC(GCOptions{}); err != nil {
+		t.Fatal("gc failed, ", err.Error())
+	}
+	if report.Held != 3 || len(report.Removed) != 0 {
+		t.Fatal("writer blocks not held", report)
+	}
+
+	if _, err = cw.Write(content[3000:]); err != nil {
+		t.Fatal("failed to write, ", err.Error())
+	}
+	if err = cw.Close(); err != nil {
+		t.Fatal("failed to close writer, ", err.Error())
+	}
+	if err = cs.Pin("new", cw.Id()); err != nil {
+		t.Fatal("failed to pin, ", err.Error())
+	}
+	if len(cs.live) != 0 {
+		t.Fatal("writer did not release its blocks", cs.live)
+	}
+
+	if cr, err = cs.Open(cw.Id()); err != nil {
+		t.Fatal("failed to create reader, ", err.Error())
+	}
+	defer cr.Close()
+	if nn, err = cr.Copy(&bytes.Buffer{}); err != nil || nn != 5000 {
+		t.Fatal("tree damaged", nn, err)
+	}
+}
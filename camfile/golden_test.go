@@ -0,0 +1,52 @@
+package camfile_test
+
+import (
+	"testing"
+
+	"github.com/KimN100/random-examples/camfile"
+	"github.com/KimN100/random-examples/camfile/camtest"
+)
+
+/*
+Roots of known content, written every way camtest.Writes has.  A change
+here changes every id in every store, so it needs a new header version,
+see header.go, not a new vector.
+*/
+func TestGolden(t *testing.T) {
+	const payload = camtest.Payload
+
+	var vectors = []struct {
+		name string
+		size int
+		opts camtest.Options
+		want string
+	}{
+		{ "empty", 0, camtest.Options{}, camfile.EmptyId },
+		{ "one-byte", 1, camtest.Options{}, "6ae52c8925cc4ce94ef367b79ee79993" },
+		{ "one-block", payload, camtest.Options{}, "994c23f0fdc87b20eaa7079c44372748" },
+		{ "two-blocks", payload + 1, camtest.Options{}, "37e969695894e21b91fd08c1bba85338" },
+		{ "two-levels", 20*payload + 1, camtest.Options{}, "01c1fcfec5e8cecb9c6cb8321e7c3db6" },
+		{ "flate-empty", 0, camtest.Options{ Codec: camfile.CodecFlate }, camfile.EmptyId },
+		// too short to gain, so stored as it is
+		{ "flate-one-byte", 1, camtest.Options{ Codec: camfile.CodecFlate }, "6ae52c8925cc4ce94ef367b79ee79993" },
+		{ "flate-one-block", payload, camtest.Options{ Codec: camfile.CodecFlate }, "9dcf714581d35a78f06f0999b2d1b757" },
+		{ "flate-two-blocks", payload + 1, camtest.Options{ Codec: camfile.CodecFlate }, "c94e73910b6eabfc269920e643eeb572" },
+		{ "flate", 20*payload + 1, camtest.Options{ Codec: camfile.CodecFlate }, "ace4ab256e99275664430d8da8373789" },
+		{ "encrypted", payload + 1, camtest.Options{ Secret: []byte("golden secret") }, "b4b25811022d1464c299616946cb239b:c47b4e086cd8e9b9a7e17237b0cfe078" },
+		{ "encrypted-flate", 20*payload + 1, camtest.Options{ Secret: []byte("golden secret"), Codec: camfile.CodecFlate }, "c56be0de7108f972726ca1135b41c317:95c5c5e09309bb9620f211561abcb146" },
+	}
+
+	for _, be := range camtest.Backends {
+		t.Run(be.Name, func(t *testing.T) {
+			cs := be.Open(t)
+			for _, vv := range vectors {
+				for _, opts := range camtest.Writes {
+					opts.Codec, opts.Secret = vv.opts.Codec, vv.opts.Secret
+					if id := camtest.RoundTrip(t, cs, camtest.Pattern(vv.size), opts); id != vv.want {
+						t.Errorf("%s %+v: root %s, want %s", vv.name, opts, id, vv.want)
+					}
+				}
+			}
+		})
+	}
+}
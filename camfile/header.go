@@ -0,0 +1,206 @@
+package camfile
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+/*
+Block headers.
+
+Every block starts with a 32 byte header.  Blocks are written with the
+binary header, version 1, all integers big endian:
+
+	[0:4]    magic "\x89CAM"
+	[4]      version, 1
+	[5]      type: 1 DATA, 2 INDB, 3 FILE, 4 DIRB, 5 REFB
+	[6]      codec, see compress.go
+	[7]      flags: 0x01 sized indirect block, 0x02 encrypted payload
+	[8:12]   payload length, decoded
+	[12:20]  content bytes below a sized indirect block, else 0
+	[20:24]  salt
+	[24:32]  reserved, 0
+
+A header that is not exactly this is refused, so a later version must
+change the version byte to use any of the bits left.  The first byte of
+the magic is not a hex digit, which sets these apart from legacy blocks,
+version 0, whose header is the text the first writers used:
+
+	[0:4]    salt, 4 hex digits
+	[4:8]    type, DATA or INDB
+	[8:12]   payload length, 4 hex digits
+	[12:32]  '-'
+
+Legacy blocks are never sized, encrypted or compressed; their indirect
+blocks hold bare ids.  The header is part of what the id hashes, so a
+block written now never has the id of the legacy block with the same
+content.
+*/
+
+const (
+	cam_header_magic = "\x89CAM"
+	cam_header_version = 1
+
+	cam_flag_sized = 0x01
+	cam_flag_crypt = 0x02
+
+	cam_legacy_fill = "--------------------"
+)
+
+var cam_header_types = []string{ 1: "DATA", 2: "INDB", 3: "FILE", 4: "DIRB", 5: "REFB" }
+
+type header struct {
+	// 0 for legacy text headers
+	version int
+	tag string
+	codec Codec
+	sized, crypt bool
+	// payload length, decoded
+	cnt int
+	// content bytes below a sized indirect block
+	total int64
+	salt uint32
+}
+
+/*
+A header for a new block.
+*/
+func newHeader(tag string, cnt int) (hd header) {
+	return header{ version: cam_header_version, tag: tag, codec: CodecNone, cnt: cnt }
+}
+
+/*
+Decode the header at the front of data, of either version.
+*/
+func decodeHeader(data []byte) (hd header, err error) {
+
+	if len(data) < cam_header_size {
+		return hd, fmt.Errorf("bad header: block too short: %d bytes", len(data))
+	}
+	if string(data[:4]) == cam_header_magic {
+		hd, err = decodeBinary(data[:cam_header_size])
+	} else {
+		hd, err = decodeLegacy(data[:cam_header_size])
+	}
+	if err == nil && hd.cnt > cam_block_size - cam_header_size {
+		err = fmt.Errorf("bad header: payload too large: %d", hd.cnt)
+	}
+
+	return
+}
+
+func decodeBinary(data []byte) (hd header, err error) {
+	var ntype, flags byte
+
+	if hd.version = int(data[4]); hd.version != cam_header_version {
+		return hd, fmt.Errorf("bad header: unsupported version: %d", hd.version)
+	}
+	if ntype = data[5]; int(ntype) >= len(cam_header_types) || cam_header_types[ntype] == "" {
+		return hd, fmt.Errorf("bad header: unknown block type: %d", ntype)
+	}
+	hd.tag = cam_header_types[ntype]
+	switch hd.codec = Codec(data[6]); hd.codec {
+	case CodecNone, CodecFlate:
+	default:
+		return hd, fmt.Errorf("bad header: unknown codec: %d", data[6])
+	}
+	if flags = data[7]; flags &^ (cam_flag_sized|cam_flag_crypt) != 0 {
+		return hd, fmt.Errorf("bad header: unknown flags: %#02x", flags)
+	}
+	hd.sized, hd.crypt = flags&cam_flag_sized != 0, flags&cam_flag_crypt != 0
+	if hd.sized && hd.tag != "INDB" {
+		return hd, fmt.Errorf("bad header: sized %s block", hd.tag)
+	}
+	if nn := binary.BigEndian.Uint32(data[8:12]); nn > cam_block_size {
+		return hd, fmt.Errorf("bad header: payload too large: %d", nn)
+	} else {
+		hd.cnt = int(nn)
+	}
+	if hd.total = int64(binary.BigEndian.Uint64(data[12:20])); hd.total < 0 || (hd.total != 0 && !hd.sized) {
+		return hd, fmt.Errorf("bad header: content size %d", hd.total)
+	}
+	hd.salt = binary.BigEndian.Uint32(data[20:24])
+	for _, bb := range data[24:32] {
+		if bb != 0 {
+			return hd, fmt.Errorf("bad header: reserved bytes set")
+		}
+	}
+
+	return
+}
+
+/*
+The text header of blocks written before the binary one.
+*/
+func decodeLegacy(data []byte) (hd header, err error) {
+	var nn int64
+
+	if nn, err = strconv.ParseInt(string(data[0:4]), 16, 32); err != nil || nn < 0 {
+		return hd, fmt.Errorf("bad header: salt: %q", data[0:4])
+	}
+	hd.salt = uint32(nn)
+	if hd.tag = string(data[4:8]); hd.tag != "DATA" && hd.tag != "INDB" {
+		return hd, fmt.Errorf("bad header: unknown block type: %q", hd.tag)
+	}
+	if nn, err = strconv.ParseInt(string(data[8:12]), 16, 32); err != nil || nn < 0 {
+		return hd, fmt.Errorf("bad header: payload length: %q", data[8:12])
+	}
+	hd.cnt = int(nn)
+	if string(data[12:32]) != cam_legacy_fill {
+		return hd, fmt.Errorf("bad header: legacy fill: %q", data[12:32])
+	}
+	hd.codec = CodecNone
+
+	return
+}
+
+/*
+The header as stored, in its own version.
+*/
+func (hd *header) encode() (head []byte) {
+	var flags byte
+
+	if hd.version == 0 {
+		head = []byte(fmt.Sprintf("%04x----%04x%s", hd.salt&0xffff, hd.cnt&0xffff, cam_legacy_fill))
+		copy(head[4:8], hd.tag)
+		return
+	}
+
+	head = make([]byte, cam_header_size)
+	copy(head, cam_header_magic)
+	head[4] = byte(hd.version)
+	for ii, tag := range cam_header_types {
+		if tag != "" && tag == hd.tag {
+			head[5] = byte(ii)
+		}
+	}
+	head[6] = byte(hd.codec)
+	if hd.sized {
+		flags |= cam_flag_sized
+	}
+	if hd.crypt {
+		flags |= cam_flag_crypt
+	}
+	head[7] = flags
+	binary.BigEndian.PutUint32(head[8:12], uint32(hd.cnt))
+	binary.BigEndian.PutUint64(head[12:20], uint64(hd.total))
+	binary.BigEndian.PutUint32(head[20:24], hd.salt)
+
+	return
+}
+
+/*
+Change the header of block in place.
+*/
+func editHeader(block []byte, fn func(hd *header)) (err error) {
+	var hd header
+
+	if hd, err = decodeHeader(block); err != nil {
+		return
+	}
+	fn(&hd)
+	copy(block, hd.encode())
+
+	return
+}
@@ -0,0 +1,233 @@
+package camfile
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHeader(t *testing.T) {
+	t.Run("round-trip", headerRoundTrip)
+	t.Run("legacy", headerLegacy)
+	t.Run("empty", headerEmpty)
+	t.Run("refuse", headerRefuse)
+	t.Run("written", headerWritten)
+}
+
+func headerRoundTrip(t *testing.T) {
+	var (
+		hd, got header
+		err error
+	)
+
+	for _, tag := range []string{ "DATA", "INDB", "FILE", "DIRB", "REFB" } {
+		for _, codec := range []Codec{ CodecNone, CodecFlate } {
+			hd = newHeader(tag, 992)
+			hd.codec, hd.crypt, hd.salt = codec, true, 0xdeadbeef
+			if tag == "INDB" {
+				hd.sized, hd.total = true, 1 << 40
+			}
+			head := hd.encode()
+			if len(head) != cam_header_size {
+				t.Fatal("header is", len(head), "bytes")
+			}
+			if got, err = decodeHeader(head); err != nil {
+				t.Fatal("failed to decode, ", err.Error())
+			}
+			if got != hd {
+				t.Fatalf("decoded %+v, want %+v", got, hd)
+			}
+		}
+	}
+}
+
+func headerLegacy(t *testing.T) {
+	var (
+		hd header
+		err error
+	)
+
+	tests := []struct {
+		head string
+		want header
+	}{
+		{ "0000DATA03e0--------------------", header{ tag: "DATA", codec: CodecNone, cnt: 992 } },
+		{ "0000INDB03c0--------------------", header{ tag: "INDB", codec: CodecNone, cnt: 960 } },
+		{ "001fDATA0040--------------------", header{ tag: "DATA", codec: CodecNone, cnt: 64, salt: 0x1f } },
+		// never written outside the binary header
+		{ "0000INDB03c0S00000000000f2000---", header{} },
+		{ "001fFILE0040--------------------", header{} },
+		{ "0000DATA03e1--------------------", header{} },
+		{ "0000DATAzzzz--------------------", header{} },
+	}
+	for _, tt := range tests {
+		if hd, err = decodeHeader([]byte(tt.head)); tt.want.tag == "" {
+			if err == nil {
+				t.Fatal("decoded a bad legacy header", tt.head, hd)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal("failed to decode", tt.head, err.Error())
+		}
+		if hd != tt.want {
+			t.Fatalf("%s: decoded %+v, want %+v", tt.head, hd, tt.want)
+		}
+		if head := hd.encode(); string(head) != tt.head {
+			t.Fatalf("re-encoded %q as %q", tt.head, head)
+		}
+	}
+}
+
+func headerEmpty(t *testing.T) {
+	var (
+		tag string
+		cnt int
+		err error
+	)
+
+	if sum := fmt.Sprintf("%x", md5.Sum([]byte(cam_empty_head))); sum != EmptyId {
+		t.Fatal("empty block hashes to", sum, "not", EmptyId)
+	}
+	hd := newHeader("DATA", 0)
+	if !bytes.Equal(hd.encode(), []byte(cam_empty_head)) {
+		t.Fatalf("empty header %q, want %q", hd.encode(), cam_empty_head)
+	}
+	if tag, cnt, err = parseHeader([]byte(cam_empty_head)); err != nil || tag != "DATA" || cnt != 0 {
+		t.Fatal("empty header parsed as", tag, cnt, err)
+	}
+}
+
+func headerRefuse(t *testing.T) {
+	var err error
+
+	hd := newHeader("INDB", 960)
+	hd.sized, hd.total = true, 5000
+	good := hd.encode()
+
+	tests := map[string]func(head []byte){
+		"version": func(head []byte) { head[4] = 2 },
+		"type": func(head []byte) { head[5] = 9 },
+		"codec": func(head []byte) { head[6] = 'Z' },
+		"flags": func(head []byte) { head[7] |= 0x80 },
+		"length": func(head []byte) { head[10] = 0x04 },
+		"reserved": func(head []byte) { head[31] = 1 },
+		"total": func(head []byte) { head[7] = 0 },
+		"short": nil,
+	}
+	for name, fn := range tests {
+		head := append([]byte(nil), good...)
+		if fn == nil {
+			head = head[:cam_header_size-1]
+		} else {
+			fn(head)
+		}
+		if _, err = decodeHeader(head); err == nil {
+			t.Fatal("decoded a header with a bad", name)
+		}
+	}
+}
+
+/*
+Everything a Writer stores has the current header.
+*/
+func headerWritten(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		id string
+		cw *Writer
+	)
+
+	cs = memServer(t)
+
+	content := make([]byte, 40*992)
+	rand.New(rand.NewSource(46)).Read(content)
+	for _, secret := range [][]byte{ nil, []byte("secret") } {
+		if secret == nil {
+			cw, err = cs.Create()
+		} else {
+			cw, err = cs.CreateEncrypted(secret)
+		}
+		if err != nil {
+			t.Fatal("failed to create writer, ", err.Error())
+		}
+		cw.SetCodec(CodecFlate)
+		if id, _, err = cw.Copy(bytes.NewReader(content)); err != nil {
+			t.Fatal("failed to copy to cam, ", err.Error())
+		}
+		cw.Close()
+		tierRead(t, cs, id, content)
+	}
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "file"), content, 0644)
+	if _, err = cs.PutTree(dir); err != nil {
+		t.Fatal("failed to put tree, ", err.Error())
+	}
+
+	if err = cs.store.Walk(context.Background(), func(id string, mtime time.Time) error {
+		block, err := cs.store.Get(context.Background(), id)
+		if err != nil {
+			return err
+		}
+		if hd, err := decodeHeader(block); err != nil || hd.version != cam_header_version {
+			return fmt.Errorf("%s: version %d, %v", id, hd.version, err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+/*
+Any header decodes without a panic, within bounds, and encodes to one
+that decodes the same.
+*/
+func FuzzParseHeader(f *testing.F) {
+
+	for _, head := range []string{
+		cam_empty_head,
+		"0000DATA03e0--------------------",
+		"0000INDB03c0S00000000000f2000EF-",
+		"ffffFILE0040--------------------",
+	} {
+		f.Add([]byte(head))
+	}
+	hd := newHeader("INDB", 960)
+	hd.sized, hd.crypt, hd.codec, hd.total = true, true, CodecFlate, 1 << 33
+	f.Add(hd.encode())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		tag, cnt, err := parseHeader(data)
+		if err != nil {
+			return
+		}
+		if cnt < 0 || cnt > cam_block_size - cam_header_size {
+			t.Fatal("payload length out of bounds", cnt)
+		}
+		hd, err := decodeHeader(data)
+		if err != nil || hd.tag != tag || hd.cnt != cnt {
+			t.Fatal("parseHeader and decodeHeader differ", hd, err)
+		}
+		head := hd.encode()
+		if len(head) != cam_header_size {
+			t.Fatal("encoded", len(head), "bytes")
+		}
+		again, err := decodeHeader(head)
+		if err != nil {
+			t.Fatal("failed to decode encoded header, ", err.Error())
+		}
+		if again != hd {
+			t.Fatalf("decoded %+v, re-encoded as %+v", hd, again)
+		}
+		if hd.version == cam_header_version && !bytes.Equal(head, data[:cam_header_size]) {
+			t.Fatalf("binary header %x re-encoded as %x", data[:cam_header_size], head)
+		}
+	})
+}
@@ -0,0 +1,354 @@
+package camfile
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+A networked Cam block server.
+
+The protocol is plain HTTP under a base URL:
+
+	GET    /block/        one "id mtime" line per block, mtime in Unix nanoseconds
+	GET    /block/{id}    the block
+	HEAD   /block/{id}    200 if present, 404 if not
+	PUT    /block/{id}    store the block, which must hash to id
+	DELETE /block/{id}
+	GET    /pin/          one "name id" line per pin
+	GET    /pin/{name}    the id
+	PUT    /pin/{name}    set the pin to the id in the body
+	PUT    /pin/{name}?prev={id}
+	                      set it only if it is still prev, "" for unset, else 409
+	DELETE /pin/{name}
+	GET    /metrics       Prometheus text, if the server is instrumented
+
+Every request carries the caller's context, so its deadline and
+cancellation apply to the round trip.  Serve a store with Server.Handler.
+Batched requests are described in batch.go.
+*/
+type httpStore struct {
+	client *http.Client
+	base string
+	// bearer token for an authenticated server, see auth.go
+	token string
+}
+
+/*
+A store on the block server at url, authenticating with token if it is
+not empty.  NewServer makes one, without a token, for an http URL.
+*/
+func NewHTTPStore(url, token string) (store BlockStore) {
+	return &httpStore{ client: &http.Client{}, base: strings.TrimSuffix(url, "/"), token: token }
+}
+
+func (hs *httpStore) do(ctx context.Context, method, path string, body []byte) (data []byte, err error) {
+	var (
+		req *http.Request
+		resp *http.Response
+	)
+
+	if req, err = http.NewRequestWithContext(ctx, method, hs.base + path, bytes.NewReader(body)); err != nil {
+		return
+	}
+	if hs.token != "" {
+		req.Header.Set("Authorization", "Bearer " + hs.token)
+	}
+	if resp, err = hs.client.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if data, err = io.ReadAll(resp.Body); err != nil {
+		return
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		err = fmt.Errorf("%s %s: %w", method, path, os.ErrNotExist)
+	case resp.StatusCode == http.StatusConflict:
+		err = fmt.Errorf("%s %s: %w", method, path, ErrConflict)
+	case resp.StatusCode/100 != 2:
+		err = fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	return
+}
+
+func (hs *httpStore) Put(ctx context.Context, id string, block []byte) (err error) {
+	_, err = hs.do(ctx, http.MethodPut, "/block/" + id, block)
+	return
+}
+
+func (hs *httpStore) Get(ctx context.Context, id string) (block []byte, err error) {
+	return hs.do(ctx, http.MethodGet, "/block/" + id, nil)
+}
+
+func (hs *httpStore) Has(ctx context.Context, id string) (ok bool, err error) {
+
+	if _, err = hs.do(ctx, http.MethodHead, "/block/" + id, nil); err == nil {
+		ok = true
+	} else if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+
+	return
+}
+
+func (hs *httpStore) Remove(ctx context.Context, id string) (err error) {
+	_, err = hs.do(ctx, http.MethodDelete, "/block/" + id, nil)
+	return
+}
+
+func (hs *httpStore) Walk(ctx context.Context, fn func(id string, mtime time.Time) error) (err error) {
+	var (
+		data []byte
+		nanos int64
+	)
+
+	if data, err = hs.do(ctx, http.MethodGet, "/block/", nil); err != nil {
+		return
+	}
+
+	scan := bufio.NewScanner(bytes.NewReader(data))
+	for scan.Scan() {
+		id, mtime, _ := strings.Cut(scan.Text(), " ")
+		if nanos, err = strconv.ParseInt(mtime, 10, 64); err != nil || !isBlockId(id) {
+			return fmt.Errorf("bad block list line: %q", scan.Text())
+		}
+		if err = fn(id, time.Unix(0, nanos)); err != nil {
+			return
+		}
+	}
+
+	return scan.Err()
+}
+
+func (hs *httpStore) PutPin(ctx context.Context, name, id string) (err error) {
+	_, err = hs.do(ctx, http.MethodPut, "/pin/" + name, []byte(id))
+	return
+}
+
+/*
+Swapped by the server, so it is atomic for all its clients, see refs.go.
+*/
+func (hs *httpStore) SwapPin(ctx context.Context, name, old, id string) (err error) {
+	_, err = hs.do(ctx, http.MethodPut, "/pin/" + name + "?prev=" + old, []byte(id))
+	return
+}
+
+func (hs *httpStore) GetPin(ctx context.Context, name string) (id string, err error) {
+	var data []byte
+
+	if data, err = hs.do(ctx, http.MethodGet, "/pin/" + name, nil); err == nil {
+		id = strings.TrimSpace(string(data))
+	}
+
+	return
+}
+
+func (hs *httpStore) RemovePin(ctx context.Context, name string) (err error) {
+	_, err = hs.do(ctx, http.MethodDelete, "/pin/" + name, nil)
+	return
+}
+
+func (hs *httpStore) WalkPins(ctx context.Context, fn func(name, id string) error) (err error) {
+	var data []byte
+
+	if data, err = hs.do(ctx, http.MethodGet, "/pin/", nil); err != nil {
+		return
+	}
+
+	scan := bufio.NewScanner(bytes.NewReader(data))
+	for scan.Scan() {
+		name, id, ok := strings.Cut(scan.Text(), " ")
+		if !ok || !isPinName(name) || !isBlockId(id) {
+			return fmt.Errorf("bad pin list line: %q", scan.Text())
+		}
+		if err = fn(name, id); err != nil {
+			return
+		}
+	}
+
+	return scan.Err()
+}
+
+/*
+Serve the Server's store with the protocol above.  Blocks are checked
+against their ids on the way in.  Each request's context is passed to
+the store, so a client that goes away stops the work done for it.  An
+instrumented Server reports what it serves, and serves /metrics too if
+its Instrument is an http.Handler, as Metrics is.
+*/
+func (cs *Server) Handler() (hh http.Handler) {
+	var (
+		mux *http.ServeMux
+		store BlockStore
+	)
+
+	store = cs.metered().store(cs.store)
+	mux = http.NewServeMux()
+	mux.HandleFunc("/block/", func(w http.ResponseWriter, r *http.Request) { serveBlock(store, w, r) })
+	mux.HandleFunc("/pin/", func(w http.ResponseWriter, r *http.Request) { servePin(store, w, r) })
+	mux.HandleFunc("/batch/", func(w http.ResponseWriter, r *http.Request) { serveBatch(store, w, r) })
+	if mh := cs.metricsHandler(); mh != nil {
+		mux.Handle("/metrics", mh)
+	}
+
+	return mux
+}
+
+func serveBlocks(store BlockStore, w http.ResponseWriter, r *http.Request) {
+	var buff bytes.Buffer
+
+	if err := store.Walk(r.Context(), func(id string, mtime time.Time) error {
+		fmt.Fprintf(&buff, "%s %d\n", id, mtime.UnixNano())
+		return nil
+	}); err != nil {
+		httpError(w, err)
+		return
+	}
+
+	w.Write(buff.Bytes())
+}
+
+func serveBlock(store BlockStore, w http.ResponseWriter, r *http.Request) {
+	var (
+		id string
+		block []byte
+		ok bool
+		err error
+	)
+
+	if id = strings.TrimPrefix(r.URL.Path, "/block/"); id == "" && r.Method == http.MethodGet {
+		serveBlocks(store, w, r)
+		return
+	}
+	if !isBlockId(id) {
+		http.Error(w, "not a block id", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if block, err = store.Get(r.Context(), id); err == nil {
+			w.Write(block)
+		}
+	case http.MethodHead:
+		if ok, err = store.Has(r.Context(), id); err == nil && !ok {
+			err = os.ErrNotExist
+		}
+	case http.MethodPut:
+		if block, err = io.ReadAll(io.LimitReader(r.Body, cam_block_size+1)); err != nil {
+			break
+		}
+		if err = verifyBlock(id, block); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = store.Put(r.Context(), id, block); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case http.MethodDelete:
+		if err = store.Remove(r.Context(), id); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		httpError(w, err)
+	}
+}
+
+func servePins(store BlockStore, w http.ResponseWriter, r *http.Request) {
+	var buff bytes.Buffer
+
+	if err := store.WalkPins(r.Context(), func(name, id string) error {
+		fmt.Fprintf(&buff, "%s %s\n", name, id)
+		return nil
+	}); err != nil {
+		httpError(w, err)
+		return
+	}
+
+	w.Write(buff.Bytes())
+}
+
+func servePin(store BlockStore, w http.ResponseWriter, r *http.Request) {
+	var (
+		name, id string
+		data []byte
+		err error
+	)
+
+	if name = strings.TrimPrefix(r.URL.Path, "/pin/"); name == "" && r.Method == http.MethodGet {
+		servePins(store, w, r)
+		return
+	}
+	if !isPinName(name) {
+		http.Error(w, "bad pin name", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if id, err = store.GetPin(r.Context(), name); err == nil {
+			fmt.Fprintln(w, id)
+		}
+	case http.MethodPut:
+		if data, err = io.ReadAll(io.LimitReader(r.Body, 64)); err != nil {
+			break
+		}
+		if id = strings.TrimSpace(string(data)); !isBlockId(id) {
+			http.Error(w, "not a block id", http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Has("prev") {
+			err = swapPin(r.Context(), store, name, r.URL.Query().Get("prev"), id)
+		} else {
+			err = store.PutPin(r.Context(), name, id)
+		}
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case http.MethodDelete:
+		if err = store.RemovePin(r.Context(), name); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		httpError(w, err)
+	}
+}
+
+func httpError(w http.ResponseWriter, err error) {
+
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrQuota) {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if errors.Is(err, ErrConflict) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,221 @@
+package camfile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTP(t *testing.T) {
+	t.Run("round-trip", httpRoundTrip)
+	t.Run("tree", httpTree)
+	t.Run("corrupt-put", httpCorruptPut)
+	t.Run("deadline", httpDeadline)
+}
+
+/*
+A block server on a temporary directory, and a Server talking to it.
+*/
+func httpSetup(t *testing.T, wrap func(http.Handler) http.Handler) (remote, cs *Server) {
+	var (
+		err error
+		hh http.Handler
+	)
+
+	remote = memServer(t)
+	if hh = remote.Handler(); wrap != nil {
+		hh = wrap(hh)
+	}
+	ts := httptest.NewServer(hh)
+	t.Cleanup(ts.Close)
+
+	if cs, err = NewServer(ts.URL + "/"); err != nil {
+		t.Fatal("failed to create client, ", err.Error())
+	}
+
+	return
+}
+
+func httpRoundTrip(t *testing.T) {
+	var (
+		remote, cs *Server
+		cw *Writer
+		cr *Reader
+		err error
+		content []byte
+		buff bytes.Buffer
+		pins map[string]string
+		report *GCReport
+		fsck *FsckReport
+		id string
+	)
+
+	remote, cs = httpSetup(t, nil)
+	defer remote.Close()
+	defer cs.Close()
+
+	content = make([]byte, 30000)
+	rand.New(rand.NewSource(35)).Read(content)
+
+	if cw, err = cs.Create(); err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+	if id, _, err = cw.Copy(bytes.NewReader(content)); err != nil {
+		t.Fatal("failed to copy to cam, ", err.Error())
+	}
+	cw.Close()
+
+	if cr, err = remote.Open(id); err != nil {
+		t.Fatal("failed to create reader, ", err.Error())
+	}
+	if _, err = cr.Copy(&buff); err != nil || !bytes.Equal(buff.Bytes(), content) {
+		t.Fatal("content not stored on the remote", err)
+	}
+	cr.Close()
+
+	buff.Reset()
+	if cr, err = cs.Open(id); err != nil {
+		t.Fatal("failed to create reader, ", err.Error())
+	}
+	if _, err = cr.Copy(&buff); err != nil || !bytes.Equal(buff.Bytes(), content) {
+		t.Fatal("content mismatch over http", err)
+	}
+	cr.Close()
+
+	if err = cs.Pin("keep", id); err != nil {
+		t.Fatal("failed to pin, ", err.Error())
+	}
+	if pins, err = cs.Pins(); err != nil || pins["keep"] != id {
+		t.Fatal("pin not listed", pins, err)
+	}
+	if err = cs.Pin("missing", "0123456789abcdef0123456789abcdef"); err == nil {
+		t.Fatal("pinned a missing block")
+	}
+	if report, err = cs.GC(GCOptions{}); err != nil {
+		t.Fatal("gc failed, ", err.Error())
+	}
+	if report.Reachable != report.Blocks || len(report.Removed) != 0 {
+		t.Fatal("gc removed pinned blocks", report)
+	}
+	if fsck, err = cs.Fsck([]string{ id }, ""); err != nil || !fsck.Ok() {
+		t.Fatal("fsck over http", fsck, err)
+	}
+
+	if err = cs.Unpin("keep"); err != nil {
+		t.Fatal("failed to unpin, ", err.Error())
+	}
+	if report, err = cs.GC(GCOptions{}); err != nil {
+		t.Fatal("gc failed, ", err.Error())
+	}
+	if len(report.Removed) != report.Blocks {
+		t.Fatal("gc kept unpinned blocks", report)
+	}
+}
+
+func httpTree(t *testing.T) {
+	var (
+		remote, cs *Server
+		err error
+		src, dst, id string
+	)
+
+	remote, cs = httpSetup(t, nil)
+	defer remote.Close()
+	defer cs.Close()
+
+	src = treeSetup(t)
+	if id, err = cs.PutTree(src); err != nil {
+		t.Fatal("failed to put tree, ", err.Error())
+	}
+	dst = filepath.Join(t.TempDir(), "out")
+	if err = cs.GetTree(id, dst); err != nil {
+		t.Fatal("failed to get tree, ", err.Error())
+	}
+	treeCompare(t, src, dst)
+}
+
+/*
+The block server refuses a block that does not hash to its id.
+*/
+func httpCorruptPut(t *testing.T) {
+	var (
+		remote, cs *Server
+		err error
+		ok bool
+	)
+
+	remote, cs = httpSetup(t, nil)
+	defer remote.Close()
+	defer cs.Close()
+
+	id := "0123456789abcdef0123456789abcdef"
+	if err = cs.store.Put(context.Background(), id, make([]byte, 100)); err == nil {
+		t.Fatal("stored a block under the wrong id")
+	}
+	if ok, err = remote.store.Has(context.Background(), id); err != nil || ok {
+		t.Fatal("corrupt block reached the store", ok, err)
+	}
+	if _, err = cs.store.Get(context.Background(), id); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("expected not found", err)
+	}
+}
+
+/*
+A deadline on the caller's context ends a request the server never answers.
+*/
+func httpDeadline(t *testing.T) {
+	var (
+		remote, cs *Server
+		cw *Writer
+		cr *Reader
+		err error
+		id string
+		stall atomic.Bool
+		ctx context.Context
+		cancel context.CancelFunc
+	)
+
+	remote, cs = httpSetup(t, func(hh http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if stall.Load() {
+				<-r.Context().Done()
+				return
+			}
+			hh.ServeHTTP(w, r)
+		})
+	})
+	defer remote.Close()
+	defer cs.Close()
+
+	if cw, err = cs.Create(); err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+	if id, _, err = cw.Copy(bytes.NewReader(make([]byte, 3000))); err != nil {
+		t.Fatal("failed to copy to cam, ", err.Error())
+	}
+	cw.Close()
+	stall.Store(true)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if cr, err = cs.OpenContext(ctx, id); err != nil {
+		t.Fatal("failed to create reader, ", err.Error())
+	}
+	defer cr.Close()
+
+	start := time.Now()
+	if _, err = cr.ReadAt(make([]byte, 10), 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected the deadline", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("deadline not applied to the request")
+	}
+}
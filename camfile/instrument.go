@@ -0,0 +1,380 @@
+package camfile
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Instrumentation.
+
+A Server with an Instrument reports every block operation it makes for
+Readers, Writers and the block server: the backend, the operation, how
+many blocks and bytes, how long it took and how it failed.  Puts ask the
+store first whether it has the block, so deduplication can be counted;
+that costs a lookup per block, paid only when instrumented.  A Server
+without one, as every Server starts, does no timing and no lookups.
+
+Metrics is an Instrument that keeps counters and latency histograms and
+writes them in the Prometheus text format.  The block server serves it
+at /metrics, to admin tokens behind AuthHandler.
+
+	metrics := camfile.NewMetrics()
+	cs.SetInstrument(metrics)
+	http.ListenAndServe(addr, cs.Handler())
+*/
+type Instrument interface {
+	// an operation on the store: get, put, has, or in batches
+	// has-many and put-many
+	StoreOp(backend, op string, blocks int, bytes int64, dur time.Duration, err error)
+	// blocks put that the store already had
+	Deduped(backend string, blocks int, bytes int64)
+	// the depth of a tree a Writer finished, 1 for a single block
+	TreeDepth(depth int)
+}
+
+/*
+An Instrument and the name of the backend it reports for.  A nil meter
+does nothing and costs nothing.
+*/
+type meter struct {
+	inst Instrument
+	backend string
+}
+
+/*
+Report to in from now on, or with nil stop.  Set it before serving, as
+Handler and AuthHandler take it when they are made.
+*/
+func (cs *Server) SetInstrument(in Instrument) {
+
+	if in == nil {
+		cs.meter.Store(nil)
+		return
+	}
+	cs.meter.Store(&meter{ inst: in, backend: backendName(cs.store) })
+}
+
+func (cs *Server) metered() (mt *meter) {
+	return cs.meter.Load()
+}
+
+/*
+The handler for /metrics, if the Instrument is one.
+*/
+func (cs *Server) metricsHandler() (hh http.Handler) {
+	if mt := cs.metered(); mt != nil {
+		hh, _ = mt.inst.(http.Handler)
+	}
+	return
+}
+
+func backendName(store BlockStore) (name string) {
+
+	switch store.(type) {
+	case *fileStore:
+		return "file"
+	case *packStore:
+		return "pack"
+	case *httpStore:
+		return "http"
+	case *memStore:
+		return "mem"
+	case *cacheStore:
+		return "cache"
+	case *mirrorStore:
+		return "mirror"
+	case *fallbackStore:
+		return "fallback"
+	}
+
+	return fmt.Sprintf("%T", store)
+}
+
+/*
+The time an operation starts, or nothing for a nil meter.
+*/
+func (mt *meter) now() (start time.Time) {
+	if mt != nil {
+		start = time.Now()
+	}
+	return
+}
+
+func (mt *meter) op(op string, blocks int, bytes int64, start time.Time, err error) {
+	if mt != nil {
+		mt.inst.StoreOp(mt.backend, op, blocks, bytes, time.Since(start), err)
+	}
+}
+
+func (mt *meter) deduped(blocks int, bytes int64) {
+	if mt != nil && blocks > 0 {
+		mt.inst.Deduped(mt.backend, blocks, bytes)
+	}
+}
+
+func (mt *meter) depth(depth int) {
+	if mt != nil {
+		mt.inst.TreeDepth(depth)
+	}
+}
+
+func (mt *meter) get(ctx context.Context, store BlockStore, id string) (block []byte, err error) {
+
+	if mt == nil {
+		return store.Get(ctx, id)
+	}
+
+	start := time.Now()
+	block, err = store.Get(ctx, id)
+	mt.op("get", 1, int64(len(block)), start, err)
+
+	return
+}
+
+func (mt *meter) has(ctx context.Context, store BlockStore, id string) (ok bool, err error) {
+
+	if mt == nil {
+		return store.Has(ctx, id)
+	}
+
+	start := time.Now()
+	ok, err = store.Has(ctx, id)
+	mt.op("has", 1, 0, start, err)
+
+	return
+}
+
+func (mt *meter) put(ctx context.Context, store BlockStore, id string, block []byte) (err error) {
+	var ok bool
+
+	if mt == nil {
+		return store.Put(ctx, id, block)
+	}
+
+	// the check for dedup is part of the put, not a has of its own, and
+	// the put still goes ahead, to refresh the block for GC
+	start := time.Now()
+	if ok, err = store.Has(ctx, id); err != nil {
+		mt.op("put", 1, int64(len(block)), start, err)
+		return
+	} else if ok {
+		mt.deduped(1, int64(len(block)))
+	}
+	start = time.Now()
+	err = store.Put(ctx, id, block)
+	mt.op("put", 1, int64(len(block)), start, err)
+
+	return
+}
+
+/*
+The number of levels in a tree over cnt leaves.
+*/
+func treeDepth(cnt, fanout int) (depth int) {
+	for depth = 1; cnt > 1; depth++ {
+		cnt = (cnt + fanout - 1) / fanout
+	}
+	return
+}
+
+/*
+A store the block server hands requests to, reporting to mt as the
+Server's own operations do.
+*/
+type meteredStore struct {
+	BlockStore
+	mt *meter
+}
+
+func (mt *meter) store(store BlockStore) (ms BlockStore) {
+	if mt == nil {
+		return store
+	}
+	return &meteredStore{ BlockStore: store, mt: mt }
+}
+
+func (ms *meteredStore) Get(ctx context.Context, id string) (block []byte, err error) {
+	return ms.mt.get(ctx, ms.BlockStore, id)
+}
+
+func (ms *meteredStore) Has(ctx context.Context, id string) (ok bool, err error) {
+	return ms.mt.has(ctx, ms.BlockStore, id)
+}
+
+func (ms *meteredStore) Put(ctx context.Context, id string, block []byte) (err error) {
+	return ms.mt.put(ctx, ms.BlockStore, id, block)
+}
+
+func (ms *meteredStore) SwapPin(ctx context.Context, name, old, id string) (err error) {
+	return swapPin(ctx, ms.BlockStore, name, old, id)
+}
+
+func (ms *meteredStore) Touch(ctx context.Context, id string) (err error) {
+	return touchBlock(ctx, ms.BlockStore, id)
+}
+
+/*
+Upper bounds of the latency buckets, in seconds.
+*/
+var metricBuckets = []float64{ .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10 }
+
+const metric_depth_max = 8
+
+/*
+An Instrument counting everything it is told, for Prometheus.
+*/
+type Metrics struct {
+	mu sync.Mutex
+	ops map[metricKey]*metricOp
+	deduped map[string]*[2]int64
+	// trees by depth, the last for metric_depth_max and deeper
+	depths [metric_depth_max]int64
+	depthSum int64
+}
+
+type metricKey struct {
+	backend, op string
+}
+
+type metricOp struct {
+	count, errors, blocks, bytes int64
+	// per bucket, not cumulative; the last is above every bound
+	buckets []int64
+	seconds float64
+}
+
+func NewMetrics() (m *Metrics) {
+	return &Metrics{ ops: make(map[metricKey]*metricOp), deduped: make(map[string]*[2]int64) }
+}
+
+func (m *Metrics) StoreOp(backend, op string, blocks int, bytes int64, dur time.Duration, err error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mo := m.ops[metricKey{ backend, op }]
+	if mo == nil {
+		mo = &metricOp{ buckets: make([]int64, len(metricBuckets)+1) }
+		m.ops[metricKey{ backend, op }] = mo
+	}
+	mo.count++
+	if err != nil {
+		mo.errors++
+	} else {
+		mo.blocks += int64(blocks)
+		mo.bytes += bytes
+	}
+	mo.buckets[sort.SearchFloat64s(metricBuckets, dur.Seconds())]++
+	mo.seconds += dur.Seconds()
+}
+
+func (m *Metrics) Deduped(backend string, blocks int, bytes int64) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dd := m.deduped[backend]
+	if dd == nil {
+		dd = new([2]int64)
+		m.deduped[backend] = dd
+	}
+	dd[0] += int64(blocks)
+	dd[1] += bytes
+}
+
+func (m *Metrics) TreeDepth(depth int) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.depths[min(max(depth, 1), metric_depth_max)-1]++
+	m.depthSum += int64(depth)
+}
+
+/*
+Write every metric in the Prometheus text exposition format, sorted by
+backend and operation so scrapes compare line for line.
+*/
+func (m *Metrics) WritePrometheus(w io.Writer) (err error) {
+	var (
+		keys []metricKey
+		backends []string
+		cum int64
+	)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key := range m.ops {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(ii, jj int) bool {
+		if keys[ii].backend != keys[jj].backend {
+			return keys[ii].backend < keys[jj].backend
+		}
+		return keys[ii].op < keys[jj].op
+	})
+	for backend := range m.deduped {
+		backends = append(backends, backend)
+	}
+	sort.Strings(backends)
+
+	bw := bufio.NewWriter(w)
+	counter := func(name, help string, value func(mo *metricOp) int64) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, key := range keys {
+			fmt.Fprintf(bw, "%s{backend=%q,op=%q} %d\n", name, key.backend, key.op, value(m.ops[key]))
+		}
+	}
+	counter("camfile_store_ops_total", "Store operations.", func(mo *metricOp) int64 { return mo.count })
+	counter("camfile_store_errors_total", "Store operations that failed.", func(mo *metricOp) int64 { return mo.errors })
+	counter("camfile_blocks_total", "Blocks read, written or looked up.", func(mo *metricOp) int64 { return mo.blocks })
+	counter("camfile_bytes_total", "Bytes read or written.", func(mo *metricOp) int64 { return mo.bytes })
+
+	fmt.Fprintf(bw, "# HELP camfile_deduped_blocks_total Blocks put that were already stored.\n# TYPE camfile_deduped_blocks_total counter\n")
+	for _, backend := range backends {
+		fmt.Fprintf(bw, "camfile_deduped_blocks_total{backend=%q} %d\n", backend, m.deduped[backend][0])
+	}
+	fmt.Fprintf(bw, "# HELP camfile_deduped_bytes_total Bytes put that were already stored.\n# TYPE camfile_deduped_bytes_total counter\n")
+	for _, backend := range backends {
+		fmt.Fprintf(bw, "camfile_deduped_bytes_total{backend=%q} %d\n", backend, m.deduped[backend][1])
+	}
+
+	fmt.Fprintf(bw, "# HELP camfile_store_latency_seconds Store operation latency.\n# TYPE camfile_store_latency_seconds histogram\n")
+	for _, key := range keys {
+		mo := m.ops[key]
+		cum = 0
+		for ii, le := range metricBuckets {
+			cum += mo.buckets[ii]
+			fmt.Fprintf(bw, "camfile_store_latency_seconds_bucket{backend=%q,op=%q,le=\"%g\"} %d\n", key.backend, key.op, le, cum)
+		}
+		fmt.Fprintf(bw, "camfile_store_latency_seconds_bucket{backend=%q,op=%q,le=\"+Inf\"} %d\n", key.backend, key.op, mo.count)
+		fmt.Fprintf(bw, "camfile_store_latency_seconds_sum{backend=%q,op=%q} %g\n", key.backend, key.op, mo.seconds)
+		fmt.Fprintf(bw, "camfile_store_latency_seconds_count{backend=%q,op=%q} %d\n", key.backend, key.op, mo.count)
+	}
+
+	fmt.Fprintf(bw, "# HELP camfile_tree_depth Depth of the trees written.\n# TYPE camfile_tree_depth histogram\n")
+	cum = 0
+	for ii, cnt := range m.depths {
+		cum += cnt
+		if ii < metric_depth_max-1 {
+			fmt.Fprintf(bw, "camfile_tree_depth_bucket{le=\"%d\"} %d\n", ii+1, cum)
+		}
+	}
+	fmt.Fprintf(bw, "camfile_tree_depth_bucket{le=\"+Inf\"} %d\n", cum)
+	fmt.Fprintf(bw, "camfile_tree_depth_sum %d\ncamfile_tree_depth_count %d\n", m.depthSum, cum)
+
+	return bw.Flush()
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WritePrometheus(w)
+}
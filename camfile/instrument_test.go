@@ -0,0 +1,242 @@
+package camfile
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInstrument(t *testing.T) {
+	t.Run("counts", instrumentCounts)
+	t.Run("batch", instrumentBatch)
+	t.Run("errors", instrumentErrors)
+	t.Run("off", instrumentOff)
+	t.Run("prometheus", instrumentPrometheus)
+}
+
+func instrumentOp(m *Metrics, backend, op string) (mo metricOp) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if found := m.ops[metricKey{ backend, op }]; found != nil {
+		mo = *found
+	}
+
+	return
+}
+
+/*
+Writing the same content twice dedups every block the second time,
+without counting the checks as has ops, and reading it back counts the
+blocks read.
+*/
+func instrumentCounts(t *testing.T) {
+	var (
+		cs *Server
+		cr *Reader
+		err error
+		id string
+		buff bytes.Buffer
+	)
+
+	cs = memServer(t)
+	metrics := NewMetrics()
+	cs.SetInstrument(metrics)
+
+	// 21 data blocks under two indirect blocks and a root
+	size := 20*(cam_block_size-cam_header_size) + 1
+	id = gcWrite(t, cs, 50, size)
+	put := instrumentOp(metrics, "mem", "put")
+	if put.count != 24 || put.blocks != 24 || put.bytes < int64(size) {
+		t.Fatal("unexpected puts", put)
+	}
+	if metrics.deduped["mem"] != nil {
+		t.Fatal("fresh blocks counted as deduped", metrics.deduped["mem"])
+	}
+
+	gcWrite(t, cs, 50, size)
+	if dd := metrics.deduped["mem"]; dd == nil || dd[0] != 24 || dd[1] != put.bytes {
+		t.Fatal("unexpected dedup", dd)
+	}
+	// the checks for dedup are not has ops
+	if has := instrumentOp(metrics, "mem", "has"); has.count != 0 {
+		t.Fatal("dedup checks counted as has ops", has)
+	}
+	if metrics.depths[2] != 2 || metrics.depthSum != 6 {
+		t.Fatal("unexpected depths", metrics.depths, metrics.depthSum)
+	}
+
+	if cr, err = cs.Open(id); err != nil {
+		t.Fatal("failed to create reader, ", err.Error())
+	}
+	defer cr.Close()
+	if _, err = cr.Copy(&buff); err != nil {
+		t.Fatal("failed to read, ", err.Error())
+	}
+	if get := instrumentOp(metrics, "mem", "get"); get.blocks != 24 || get.bytes != put.bytes || get.errors != 0 {
+		t.Fatal("unexpected gets", get)
+	}
+}
+
+/*
+A client counts its batches, and the block server what it served.
+*/
+func instrumentBatch(t *testing.T) {
+	var (
+		remote, cs *Server
+		resp *http.Response
+		err error
+		body []byte
+	)
+
+	// instrumented before its handler is made
+	remote = memServer(t)
+	client, server := NewMetrics(), NewMetrics()
+	remote.SetInstrument(server)
+	ts := httptest.NewServer(remote.Handler())
+	defer ts.Close()
+
+	cs = NewServerStore(NewHTTPStore(ts.URL + "/", ""))
+	defer cs.Close()
+	cs.SetInstrument(client)
+
+	gcWrite(t, cs, 51, 5000)
+	gcWrite(t, cs, 51, 5000)
+
+	if has := instrumentOp(client, "http", "has-many"); has.count != 2 || has.blocks != 14 {
+		t.Fatal("unexpected batch lookups", has)
+	}
+	sent := instrumentOp(client, "http", "put-many")
+	if sent.count != 1 || sent.blocks != 7 || sent.bytes == 0 {
+		t.Fatal("unexpected batch puts", sent)
+	}
+	// the second write sends nothing, saving what the first sent
+	if dd := client.deduped["http"]; dd == nil || dd[0] != 7 || dd[1] != sent.bytes {
+		t.Fatal("unexpected dedup", dd)
+	}
+	if put := instrumentOp(server, "mem", "put"); put.blocks != 7 || put.bytes != sent.bytes {
+		t.Fatal("server counted puts", put)
+	}
+
+	if resp, err = http.Get(ts.URL + "/metrics"); err != nil {
+		t.Fatal("failed to get metrics, ", err.Error())
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `camfile_blocks_total{backend="mem",op="put"} 7`) {
+		t.Fatal("metrics missing server puts\n", string(body))
+	}
+}
+
+/*
+Failures are counted per backend and operation, and a block the store
+does not have is one.
+*/
+func instrumentErrors(t *testing.T) {
+	var err error
+
+	cs := memServer(t)
+	metrics := NewMetrics()
+	cs.SetInstrument(metrics)
+
+	if _, err = cs.Stat(strings.Repeat("0", 32)); err == nil {
+		t.Fatal("stat of a missing block")
+	}
+	if get := instrumentOp(metrics, "mem", "get"); get.count != 1 || get.errors != 1 || get.blocks != 0 {
+		t.Fatal("unexpected gets", get)
+	}
+}
+
+func instrumentOff(t *testing.T) {
+
+	cs := memServer(t)
+	metrics := NewMetrics()
+	cs.SetInstrument(metrics)
+	gcWrite(t, cs, 52, 100)
+	cs.SetInstrument(nil)
+	gcWrite(t, cs, 53, 100)
+
+	if put := instrumentOp(metrics, "mem", "put"); put.count != 1 {
+		t.Fatal("counted after it was turned off", put)
+	}
+	if cs.metricsHandler() != nil {
+		t.Fatal("metrics served when off")
+	}
+}
+
+/*
+Every sample parses, and histogram buckets only grow.
+*/
+func instrumentPrometheus(t *testing.T) {
+	var (
+		buff bytes.Buffer
+		err error
+		last = make(map[string]float64)
+	)
+
+	metrics := NewMetrics()
+	metrics.StoreOp("file", "get", 1, 1024, 3*time.Millisecond, nil)
+	metrics.StoreOp("file", "get", 1, 1024, time.Second, nil)
+	metrics.StoreOp("file", "get", 0, 0, time.Minute, io.EOF)
+	metrics.StoreOp("http", "put-many", 10, 10240, 20*time.Millisecond, nil)
+	metrics.Deduped("http", 4, 4096)
+	metrics.TreeDepth(1)
+	metrics.TreeDepth(12)
+	if err = metrics.WritePrometheus(&buff); err != nil {
+		t.Fatal("failed to write, ", err.Error())
+	}
+
+	text := buff.String()
+	sample := regexp.MustCompile(`^([a-z_]+)(\{[^}]*\})? ([0-9.e+-]+)$`)
+	bound := regexp.MustCompile(`,?le="[^"]*"`)
+	scan := bufio.NewScanner(&buff)
+	for scan.Scan() {
+		line := scan.Text()
+		if strings.HasPrefix(line, "# ") {
+			continue
+		}
+		mm := sample.FindStringSubmatch(line)
+		if mm == nil {
+			t.Fatal("bad sample", line)
+		}
+		value, _ := strconv.ParseFloat(mm[3], 64)
+		if !strings.HasSuffix(mm[1], "_bucket") {
+			continue
+		}
+		series := mm[1] + bound.ReplaceAllString(mm[2], "")
+		if value < last[series] {
+			t.Fatal("bucket shrinks", line)
+		}
+		last[series] = value
+	}
+
+	buff.Reset()
+	metrics.WritePrometheus(&buff)
+	for _, want := range []string{
+		`camfile_store_ops_total{backend="file",op="get"} 3`,
+		`camfile_store_errors_total{backend="file",op="get"} 1`,
+		`camfile_bytes_total{backend="file",op="get"} 2048`,
+		`camfile_deduped_blocks_total{backend="http"} 4`,
+		`camfile_store_latency_seconds_bucket{backend="file",op="get",le="0.005"} 1`,
+		`camfile_store_latency_seconds_bucket{backend="file",op="get",le="10"} 2`,
+		`camfile_store_latency_seconds_bucket{backend="file",op="get",le="+Inf"} 3`,
+		`camfile_tree_depth_bucket{le="1"} 1`,
+		`camfile_tree_depth_count 2`,
+		`camfile_tree_depth_sum 13`,
+	} {
+		if !strings.Contains(buff.String(), want + "\n") {
+			t.Error("missing", want)
+		}
+	}
+	if buff.String() != text {
+		t.Fatal("output differs between scrapes")
+	}
+}
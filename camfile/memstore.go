@@ -0,0 +1,220 @@
+package camfile
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Blocks and pins kept in memory, gone with the store, for tests and for
+scratch work that should leave nothing behind.  It behaves as the file
+store does, so a test on it holds for the others, and costs no disk.
+*/
+type memStore struct {
+	mu sync.Mutex
+	blocks map[string]*memBlock
+	pins map[string]string
+}
+
+type memBlock struct {
+	data []byte
+	mtime time.Time
+}
+
+func NewMemStore() (store BlockStore) {
+	return &memStore{ blocks: make(map[string]*memBlock), pins: make(map[string]string) }
+}
+
+func (ms *memStore) Put(ctx context.Context, id string, block []byte) (err error) {
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	// a block that differs was damaged, so keep the new one
+	if mb, ok := ms.blocks[id]; ok && bytes.Equal(mb.data, block) {
+		mb.mtime = time.Now()
+		return
+	}
+	ms.blocks[id] = &memBlock{ data: append([]byte(nil), block...), mtime: time.Now() }
+
+	return
+}
+
+func (ms *memStore) Touch(ctx context.Context, id string) (err error) {
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if mb, ok := ms.blocks[id]; ok {
+		mb.mtime = time.Now()
+		return
+	}
+
+	return fmt.Errorf("touch %s: %w", id, os.ErrNotExist)
+}
+
+func (ms *memStore) Get(ctx context.Context, id string) (block []byte, err error) {
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if mb, ok := ms.blocks[id]; ok {
+		return append([]byte(nil), mb.data...), nil
+	}
+
+	return nil, fmt.Errorf("get %s: %w", id, os.ErrNotExist)
+}
+
+func (ms *memStore) Has(ctx context.Context, id string) (ok bool, err error) {
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	_, ok = ms.blocks[id]
+
+	return
+}
+
+func (ms *memStore) Remove(ctx context.Context, id string) (err error) {
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.blocks[id]; !ok {
+		return fmt.Errorf("remove %s: %w", id, os.ErrNotExist)
+	}
+	delete(ms.blocks, id)
+
+	return
+}
+
+/*
+Walk and WalkPins call fn on a snapshot, in id or name order, so fn may
+change the store.
+*/
+func (ms *memStore) Walk(ctx context.Context, fn func(id string, mtime time.Time) error) (err error) {
+	var (
+		ids []string
+		mtimes map[string]time.Time
+	)
+
+	ms.mu.Lock()
+	mtimes = make(map[string]time.Time, len(ms.blocks))
+	for id, mb := range ms.blocks {
+		ids = append(ids, id)
+		mtimes[id] = mb.mtime
+	}
+	ms.mu.Unlock()
+
+	sort.Strings(ids)
+	for _, id := range ids {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if err = fn(id, mtimes[id]); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (ms *memStore) PutPin(ctx context.Context, name, id string) (err error) {
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.pins[name] = id
+
+	return
+}
+
+func (ms *memStore) GetPin(ctx context.Context, name string) (id string, err error) {
+	var ok bool
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if id, ok = ms.pins[name]; !ok {
+		err = fmt.Errorf("pin %s: %w", name, os.ErrNotExist)
+	}
+
+	return
+}
+
+func (ms *memStore) RemovePin(ctx context.Context, name string) (err error) {
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.pins[name]; !ok {
+		return fmt.Errorf("pin %s: %w", name, os.ErrNotExist)
+	}
+	delete(ms.pins, name)
+
+	return
+}
+
+func (ms *memStore) WalkPins(ctx context.Context, fn func(name, id string) error) (err error) {
+	var (
+		names []string
+		pins map[string]string
+	)
+
+	ms.mu.Lock()
+	pins = make(map[string]string, len(ms.pins))
+	for name, id := range ms.pins {
+		names = append(names, name)
+		pins[name] = id
+	}
+	ms.mu.Unlock()
+
+	sort.Strings(names)
+	for _, name := range names {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if err = fn(name, pins[name]); err != nil {
+			return
+		}
+	}
+
+	return
+}
@@ -0,0 +1,1279 @@
+package camfile
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// a pack is sealed and a new one started past this size
+	cam_pack_max = 64 << 20
+	// record header: id, kind, hex mtime in nanoseconds, hex block length
+	cam_pack_head = 32 + 1 + 16 + 4
+	// index entry: id, hex pack, hex offset, hex length, hex mtime, newline
+	cam_pack_entry = 32 + 8 + 12 + 4 + 16 + 1
+	// write an index run after this many records
+	cam_pack_index_every = 10000
+	// compact packs with less than this fraction still live
+	cam_pack_live_min = 0.5
+
+	pack_block = 'B'
+	pack_touch = 'T'
+	pack_delete = 'D'
+)
+
+/*
+Blocks kept in large append-only pack files rather than one file each.
+
+	dir/pack-%08x       records, appended to the newest pack only
+	dir/index-%08x      sorted runs of the index, newest highest
+	dir/pins/           pins, as in the directory store
+
+Each record is a cam_pack_head header followed by the block:
+
+	[0:32]   id
+	[32]     'B' block, 'T' refreshed time, 'D' removed
+	[33:49]  time, hex nanoseconds since the epoch
+	[49:53]  block length, hex, 0 for 'T' and 'D'
+
+The packs are the truth.  The index is a stack of runs, each a sorted
+file of fixed width entries searched in place, headed by how far into
+each pack the index covered when it was written:
+
+	camidx <npacks hex> <nentries hex>
+	<pack hex> <end hex>             once per pack
+	<id><pack><offset><length><mtime>  once per block, all hex
+
+A length of 0 marks a block removed since an older run.  Lookups search
+the runs newest first and take the first entry for the id.
+
+Records appended since the last run are kept in memory and written as a
+new run every cam_pack_index_every records and on Close.  A run is merged
+with the one below it once it is half its size, so there are about log n
+runs and each entry is rewritten about log n times, not once per run as a
+single index rewritten whole would be.  Compact merges them all into one.
+On open the tail of each pack past what the newest run covers is scanned
+back in, so after a crash nothing written is lost, and a torn last
+record is cut off.  Without a usable index every pack is scanned.  A
+damaged record met on the way is passed over, see scan, never cut off.
+
+Has and the duplicate check on Put first ask a bloom filter over every
+id, so looking for a block that is not there, the usual case when writing
+new content, rarely touches the index file.
+
+Remove appends a 'D' record.  Space comes back when Compact, which GC
+calls, copies the live blocks out of packs that are mostly dead and
+deletes them.
+*/
+type packStore struct {
+	dir string
+	pins *fileStore
+	// cam_pack_max and cam_pack_index_every, smaller in tests
+	max int64
+	every int
+
+	mu sync.Mutex
+	files map[int]*os.File
+	// bytes of records in each pack, and of the live ones among them
+	ends, live map[int]int64
+	cur int
+
+	// oldest first
+	runs []*packRun
+	// changes since the last run was written; size -1 marks a removal
+	recent map[string]packLoc
+	appended int
+
+	bloom *bloom
+}
+
+type packLoc struct {
+	pack int
+	off int64
+	size int
+	mtime int64
+}
+
+/*
+One run of the index, open for searching.
+*/
+type packRun struct {
+	num int
+	fh *os.File
+	base, cnt int64
+}
+
+/*
+Open or create a pack store in dir, which must exist.
+*/
+func OpenPackStore(dir string) (store BlockStore, err error) {
+	var ps *packStore
+
+	ps = &packStore{
+		dir: dir,
+		pins: &fileStore{ root: dir },
+		max: cam_pack_max,
+		every: cam_pack_index_every,
+		files: make(map[int]*os.File),
+		ends: make(map[int]int64),
+		live: make(map[int]int64),
+		recent: make(map[string]packLoc),
+	}
+	if err = ps.open(); err != nil {
+		ps.Close()
+		return nil, err
+	}
+
+	return ps, nil
+}
+
+func (ps *packStore) packPath(nn int) (fn string) {
+	return filepath.Join(ps.dir, fmt.Sprintf("pack-%08x", nn))
+}
+
+func (ps *packStore) open() (err error) {
+	var (
+		names []string
+		nums []int
+		nn int64
+		fh *os.File
+		fi os.FileInfo
+		scanned bool
+		covered map[int]int64
+	)
+
+	if names, err = filepath.Glob(filepath.Join(ps.dir, "pack-????????")); err != nil {
+		return
+	}
+	for _, name := range names {
+		if nn, err = strconv.ParseInt(strings.TrimPrefix(filepath.Base(name), "pack-"), 16, 32); err != nil {
+			return fmt.Errorf("bad pack name: %s", name)
+		}
+		nums = append(nums, int(nn))
+	}
+	sort.Ints(nums)
+	for _, num := range nums {
+		if fh, err = os.OpenFile(ps.packPath(num), os.O_RDWR, 0); err != nil {
+			return
+		}
+		ps.files[num] = fh
+	}
+
+	// an index that cannot be read is only a cache; rebuild it
+	if covered, err = ps.loadRuns(); err != nil {
+		covered = nil
+		ps.dropIndex()
+		err = nil
+	}
+	for _, num := range nums {
+		if fi, err = ps.files[num].Stat(); err != nil {
+			return
+		}
+		if covered[num] > fi.Size() {
+			// a pack lost data the index knew of; trust only the packs
+			covered = nil
+			ps.dropIndex()
+			break
+		}
+	}
+	for pack := range covered {
+		if ps.files[pack] == nil {
+			// removed by Compact after the index was written
+			scanned = true
+		}
+	}
+
+	for _, num := range nums {
+		if err = ps.scan(num, covered[num]); err != nil {
+			return
+		}
+		if ps.ends[num] != covered[num] {
+			scanned = true
+		}
+	}
+
+	if len(nums) == 0 {
+		if err = ps.roll(); err != nil {
+			return
+		}
+	} else {
+		ps.cur = nums[len(nums)-1]
+	}
+
+	if scanned || len(ps.runs) == 0 {
+		return ps.rewriteIndex()
+	}
+
+	return ps.fillBloom()
+}
+
+/*
+Open every run of the index for searching.  Returns how far into each
+pack the newest covers.
+*/
+func (ps *packStore) loadRuns() (covered map[int]int64, err error) {
+	var (
+		names []string
+		nn int64
+		run *packRun
+	)
+
+	if names, err = filepath.Glob(filepath.Join(ps.dir, "index-????????")); err != nil {
+		return
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if nn, err = strconv.ParseInt(strings.TrimPrefix(filepath.Base(name), "index-"), 16, 32); err != nil {
+			return nil, fmt.Errorf("bad pack index name: %s", name)
+		}
+		if run, covered, err = openRun(name, int(nn)); err != nil {
+			return nil, err
+		}
+		ps.runs = append(ps.runs, run)
+	}
+
+	for pack, end := range covered {
+		if ps.files[pack] != nil {
+			ps.ends[pack] = end
+		}
+	}
+
+	// live bytes per pack, for Compact
+	err = ps.walkIndex(func(id string, loc packLoc) error {
+		ps.live[loc.pack] += int64(cam_pack_head + loc.size)
+		return nil
+	})
+
+	return
+}
+
+/*
+Open one run, checking its header against its size.  Returns how far
+into each pack it covers.
+*/
+func openRun(name string, num int) (run *packRun, covered map[int]int64, err error) {
+	var (
+		head []byte
+		npacks, cnt, pack, end int64
+		fi os.FileInfo
+	)
+
+	run = &packRun{ num: num }
+	if run.fh, err = os.Open(name); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			run.fh.Close()
+			run = nil
+		}
+	}()
+
+	head = make([]byte, 25)
+	if _, err = run.fh.ReadAt(head, 0); err != nil || string(head[:7]) != "camidx " {
+		return nil, nil, fmt.Errorf("bad pack index header: %s", name)
+	}
+	if npacks, err = strconv.ParseInt(string(head[7:15]), 16, 64); err != nil {
+		return
+	}
+	if cnt, err = strconv.ParseInt(string(head[16:24]), 16, 64); err != nil {
+		return
+	}
+
+	covered = make(map[int]int64)
+	line := make([]byte, 22)
+	for ii := int64(0); ii < npacks; ii++ {
+		if _, err = run.fh.ReadAt(line, 25+ii*22); err != nil {
+			return
+		}
+		if pack, err = strconv.ParseInt(string(line[:8]), 16, 64); err != nil {
+			return
+		}
+		if end, err = strconv.ParseInt(string(line[9:21]), 16, 64); err != nil {
+			return
+		}
+		covered[int(pack)] = end
+	}
+
+	run.base, run.cnt = 25+npacks*22, cnt
+	if fi, err = run.fh.Stat(); err != nil {
+		return
+	}
+	if fi.Size() != run.base+cnt*cam_pack_entry {
+		return nil, nil, fmt.Errorf("bad pack index size: %s, %d", name, fi.Size())
+	}
+
+	return
+}
+
+func (ps *packStore) runPath(num int) (fn string) {
+	return filepath.Join(ps.dir, fmt.Sprintf("index-%08x", num))
+}
+
+/*
+Forget the index and delete its runs, to be rebuilt from the packs.
+*/
+func (ps *packStore) dropIndex() {
+	var names []string
+
+	for _, run := range ps.runs {
+		run.fh.Close()
+	}
+	ps.runs = nil
+	names, _ = filepath.Glob(filepath.Join(ps.dir, "index-????????"))
+	for _, name := range names {
+		os.Remove(name)
+	}
+	ps.live = make(map[int]int64)
+	for pack := range ps.ends {
+		ps.ends[pack] = 0
+	}
+}
+
+/*
+Read records from pack num starting at off and apply them.
+
+Only a short record at the end of the pack, torn by a crash, is cut off.
+A whole block record that does not match its id is indexed only if
+there is no other copy of the block, so that Fsck reports it and can
+quarantine it; a header that cannot be parsed is skipped up to the next
+record that can.  Nothing after either is lost.  Any other read error
+is returned.
+*/
+func (ps *packStore) scan(num int, off int64) (err error) {
+	var (
+		fh *os.File
+		fi os.FileInfo
+		head [cam_pack_head]byte
+		block []byte
+		loc packLoc
+		id string
+		kind byte
+		next int64
+		perr error
+	)
+
+	fh = ps.files[num]
+	if fi, err = fh.Stat(); err != nil {
+		return
+	}
+
+	for off < fi.Size() {
+		if _, err = fh.ReadAt(head[:], off); err == io.EOF {
+			break
+		} else if err != nil {
+			return
+		}
+		if id, kind, loc, perr = parseRecord(head[:]); perr != nil {
+			if next, err = resyncPack(fh, off+1, fi.Size()); err != nil {
+				return
+			}
+			if next == fi.Size() {
+				// nothing whole follows, so this is the torn tail
+				break
+			}
+			off = next
+			continue
+		}
+		loc.pack, loc.off = num, off
+		if kind == pack_block {
+			block = make([]byte, loc.size)
+			if _, err = fh.ReadAt(block, off+cam_pack_head); err == io.EOF {
+				break
+			} else if err != nil {
+				return
+			}
+			if fmt.Sprintf("%x", md5.Sum(block)) != id && ps.known(id) {
+				off += int64(cam_pack_head + loc.size)
+				continue
+			}
+		}
+		ps.apply(id, kind, loc)
+		off += int64(cam_pack_head + loc.size)
+	}
+	err = nil
+
+	if off < fi.Size() {
+		// a torn tail, most likely from a crash
+		if err = fh.Truncate(off); err != nil {
+			return
+		}
+	}
+	ps.ends[num] = off
+
+	return
+}
+
+/*
+The offset of the first record at or after off, up to size, that parses
+and, for a block, matches its id; size if there is none.
+*/
+func resyncPack(fh *os.File, off, size int64) (next int64, err error) {
+	const window = 1 << 20
+
+	var (
+		buff []byte
+		nn int
+		id string
+		kind byte
+		loc packLoc
+		perr error
+	)
+
+	buff = make([]byte, window+cam_pack_head+cam_block_size)
+	for ; off < size; off += window {
+		if nn, err = fh.ReadAt(buff, off); err != nil && err != io.EOF {
+			return
+		}
+		for ii := 0; ii < min(window, nn); ii++ {
+			if ii+cam_pack_head > nn {
+				break
+			}
+			if id, kind, loc, perr = parseRecord(buff[ii:ii+cam_pack_head]); perr != nil {
+				continue
+			}
+			if kind == pack_block {
+				end := ii + cam_pack_head + loc.size
+				if end > nn || fmt.Sprintf("%x", md5.Sum(buff[ii+cam_pack_head:end])) != id {
+					continue
+				}
+			}
+			return off + int64(ii), nil
+		}
+	}
+
+	return size, nil
+}
+
+func parseRecord(head []byte) (id string, kind byte, loc packLoc, err error) {
+	var nn int64
+
+	id, kind = string(head[:32]), head[32]
+	if !isBlockId(id) {
+		return "", 0, loc, fmt.Errorf("bad pack record id: %q", head[:32])
+	}
+	if loc.mtime, err = strconv.ParseInt(string(head[33:49]), 16, 64); err != nil {
+		return
+	}
+	if nn, err = strconv.ParseInt(string(head[49:53]), 16, 32); err != nil {
+		return
+	}
+	loc.size = int(nn)
+
+	switch {
+	case kind == pack_block && loc.size > 0 && loc.size <= cam_block_size:
+	case (kind == pack_touch || kind == pack_delete) && loc.size == 0:
+	default:
+		err = fmt.Errorf("bad pack record: %q", head)
+	}
+
+	return
+}
+
+/*
+Record the effect of one record, newer than everything seen before.
+*/
+/*
+True if the index has a copy of id.
+*/
+func (ps *packStore) known(id string) (ok bool) {
+
+	if ps.bloom == nil || ps.bloom.maybe(id) {
+		_, ok = ps.locate(id)
+	}
+
+	return
+}
+
+func (ps *packStore) apply(id string, kind byte, loc packLoc) {
+	var (
+		old packLoc
+		ok bool
+	)
+
+	if ps.bloom == nil || ps.bloom.maybe(id) {
+		old, ok = ps.locate(id)
+	}
+	switch kind {
+	case pack_block:
+		if ok {
+			ps.live[old.pack] -= int64(cam_pack_head + old.size)
+		}
+		ps.live[loc.pack] += int64(cam_pack_head + loc.size)
+		ps.recent[id] = loc
+		if ps.bloom != nil {
+			ps.bloom.add(id)
+		}
+	case pack_touch:
+		if ok {
+			old.mtime = loc.mtime
+			ps.recent[id] = old
+		}
+	case pack_delete:
+		if ok {
+			ps.live[old.pack] -= int64(cam_pack_head + old.size)
+		}
+		ps.recent[id] = packLoc{ size: -1 }
+	}
+}
+
+/*
+Where the live block id is, checking recent changes, then the runs.
+*/
+func (ps *packStore) locate(id string) (loc packLoc, ok bool) {
+
+	if loc, ok = ps.recent[id]; ok {
+		return loc, loc.size >= 0
+	}
+	for ii := len(ps.runs) - 1; ii >= 0; ii-- {
+		if loc, ok = ps.runs[ii].find(id); ok {
+			return loc, loc.size >= 0 && ps.files[loc.pack] != nil
+		}
+	}
+
+	return loc, false
+}
+
+/*
+The run's entry for id, a removal included.
+*/
+func (run *packRun) find(id string) (loc packLoc, ok bool) {
+
+	entry := make([]byte, cam_pack_entry)
+	ii := sort.Search(int(run.cnt), func(ii int) bool {
+		if _, err := run.fh.ReadAt(entry[:32], run.base+int64(ii)*cam_pack_entry); err != nil {
+			return true
+		}
+		return string(entry[:32]) >= id
+	})
+	if ii == int(run.cnt) {
+		return loc, false
+	}
+	if _, err := run.fh.ReadAt(entry, run.base+int64(ii)*cam_pack_entry); err != nil || string(entry[:32]) != id {
+		return loc, false
+	}
+	if _, loc, err := parsePackEntry(entry); err == nil {
+		return loc, true
+	}
+
+	return loc, false
+}
+
+func parsePackEntry(entry []byte) (id string, loc packLoc, err error) {
+	var pack, size int64
+
+	id = string(entry[:32])
+	if pack, err = strconv.ParseInt(string(entry[32:40]), 16, 64); err != nil {
+		return
+	}
+	if loc.off, err = strconv.ParseInt(string(entry[40:52]), 16, 64); err != nil {
+		return
+	}
+	if size, err = strconv.ParseInt(string(entry[52:56]), 16, 64); err != nil {
+		return
+	}
+	if loc.mtime, err = strconv.ParseInt(string(entry[56:72]), 16, 64); err != nil {
+		return
+	}
+	loc.pack, loc.size = int(pack), int(size)
+	if size == 0 {
+		loc.size = -1
+	}
+
+	return
+}
+
+/*
+Call fn for every live entry in the index, in id order, merging the
+runs.
+*/
+func (ps *packStore) walkIndex(fn func(id string, loc packLoc) error) (err error) {
+	return walkRuns(ps.runs, func(id string, loc packLoc) error {
+		if loc.size < 0 {
+			return nil
+		}
+		return fn(id, loc)
+	})
+}
+
+/*
+Call fn for every id in runs, oldest first, in id order, with the entry
+of the newest run that has it, removals included.
+*/
+func walkRuns(runs []*packRun, fn func(id string, loc packLoc) error) (err error) {
+	var (
+		rds []io.Reader
+		heads []string
+		locs []packLoc
+		left []int64
+		entry []byte
+	)
+
+	rds, heads, locs, left = make([]io.Reader, len(runs)), make([]string, len(runs)), make([]packLoc, len(runs)), make([]int64, len(runs))
+	entry = make([]byte, cam_pack_entry)
+	next := func(ii int) (err error) {
+		if heads[ii] = ""; left[ii] == 0 {
+			return
+		}
+		if _, err = io.ReadFull(rds[ii], entry); err != nil {
+			return
+		}
+		heads[ii], locs[ii], err = parsePackEntry(entry)
+		left[ii]--
+		return
+	}
+	for ii, run := range runs {
+		rds[ii], left[ii] = io.NewSectionReader(run.fh, run.base, run.cnt*cam_pack_entry), run.cnt
+		if err = next(ii); err != nil {
+			return
+		}
+	}
+
+	for {
+		low := -1
+		for ii := range runs {
+			// the later run wins a tie
+			if heads[ii] != "" && (low < 0 || heads[ii] <= heads[low]) {
+				low = ii
+			}
+		}
+		if low < 0 {
+			return
+		}
+		id, loc := heads[low], locs[low]
+		for ii := range runs {
+			if heads[ii] == id {
+				if err = next(ii); err != nil {
+					return
+				}
+			}
+		}
+		if err = fn(id, loc); err != nil {
+			return
+		}
+	}
+}
+
+/*
+Write the recent changes as a new run, then merge runs while the newest
+is at least half the size of the one below it.
+*/
+func (ps *packStore) writeIndex() (err error) {
+
+	if err = ps.writeRun(); err != nil {
+		return
+	}
+	for nn := len(ps.runs); nn >= 2 && 2*ps.runs[nn-1].cnt >= ps.runs[nn-2].cnt; nn = len(ps.runs) {
+		if err = ps.mergeRuns(nn - 2); err != nil {
+			return
+		}
+	}
+
+	// refill the bloom filter as it fills, so it stays accurate
+	if ps.bloom == nil || ps.bloom.size < ps.indexed() {
+		return ps.fillBloom()
+	}
+
+	return
+}
+
+/*
+Write the recent changes and merge every run into one, dropping removed
+blocks and packs that no longer exist, and rebuild the bloom filter.
+*/
+func (ps *packStore) rewriteIndex() (err error) {
+
+	if err = ps.writeRun(); err != nil {
+		return
+	}
+	if err = ps.mergeRuns(0); err != nil {
+		return
+	}
+
+	return ps.fillBloom()
+}
+
+/*
+Entries in every run, an upper bound on the live blocks they index.
+*/
+func (ps *packStore) indexed() (cnt int) {
+	for _, run := range ps.runs {
+		cnt += int(run.cnt)
+	}
+	return
+}
+
+/*
+Write the recent changes, removals included, as a run on top of the
+others.
+*/
+func (ps *packStore) writeRun() (err error) {
+	var (
+		ids []string
+		body bytes.Buffer
+		cnt int64
+		num int
+		run *packRun
+	)
+
+	for id := range ps.recent {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if loc := ps.recent[id]; loc.size >= 0 && ps.files[loc.pack] != nil {
+			fmt.Fprintf(&body, "%s%08x%012x%04x%016x\n", id, loc.pack, loc.off, loc.size, loc.mtime)
+			cnt++
+		} else if len(ps.runs) > 0 {
+			// nothing below to hide otherwise
+			fmt.Fprintf(&body, "%s%08x%012x%04x%016x\n", id, 0, 0, 0, loc.mtime)
+			cnt++
+		}
+	}
+
+	if len(ps.runs) > 0 {
+		num = ps.runs[len(ps.runs)-1].num + 1
+	}
+	if run, err = ps.createRun(num, cnt, body.Bytes()); err != nil {
+		return
+	}
+	ps.runs = append(ps.runs, run)
+	ps.recent = make(map[string]packLoc)
+	ps.appended = 0
+
+	return
+}
+
+/*
+Merge ps.runs[from:] into one new run on top.  Merging from 0 drops
+removals, with nothing older left to hide, and recounts the live bytes
+per pack.  The recent changes must already be in a run.
+
+The merged runs are deleted once the new one is in place.  After a crash
+in between they are still there, below it, and give the same answers
+they did, so a removal dropped from the new run still hides the block.
+*/
+func (ps *packStore) mergeRuns(from int) (err error) {
+	var (
+		body bytes.Buffer
+		cnt int64
+		live map[int]int64
+		run *packRun
+		merged []*packRun
+	)
+
+	merged = ps.runs[from:]
+	live = make(map[int]int64)
+	if err = walkRuns(merged, func(id string, loc packLoc) error {
+		if loc.size < 0 || ps.files[loc.pack] == nil {
+			if from == 0 {
+				return nil
+			}
+			loc = packLoc{ mtime: loc.mtime }
+		} else {
+			live[loc.pack] += int64(cam_pack_head + loc.size)
+		}
+		fmt.Fprintf(&body, "%s%08x%012x%04x%016x\n", id, loc.pack, loc.off, max(loc.size, 0), loc.mtime)
+		cnt++
+		return nil
+	}); err != nil {
+		return
+	}
+
+	if run, err = ps.createRun(merged[len(merged)-1].num+1, cnt, body.Bytes()); err != nil {
+		return
+	}
+	for _, old := range merged {
+		old.fh.Close()
+		os.Remove(ps.runPath(old.num))
+	}
+	ps.runs = append(ps.runs[:from], run)
+	if from == 0 {
+		ps.live = live
+	}
+
+	return
+}
+
+/*
+Write a run of cnt entries, headed by how far the packs are covered, and
+open it.  The packs are synced first, so an index never covers what is
+not on disk.
+*/
+func (ps *packStore) createRun(num int, cnt int64, body []byte) (run *packRun, err error) {
+	var (
+		fh *os.File
+		tmp string
+		head bytes.Buffer
+		packs []int
+	)
+
+	for pack, fh := range ps.files {
+		if err = fh.Sync(); err != nil {
+			return
+		}
+		packs = append(packs, pack)
+	}
+	sort.Ints(packs)
+
+	fmt.Fprintf(&head, "camidx %08x %08x\n", len(packs), cnt)
+	for _, pack := range packs {
+		fmt.Fprintf(&head, "%08x %012x\n", pack, ps.ends[pack])
+	}
+
+	tmp = filepath.Join(ps.dir, ".index.tmp")
+	if fh, err = os.Create(tmp); err != nil {
+		return
+	}
+	if _, err = fh.Write(head.Bytes()); err == nil {
+		_, err = fh.Write(body)
+	}
+	if err == nil {
+		err = fh.Sync()
+	}
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+	if err = os.Rename(tmp, ps.runPath(num)); err != nil {
+		return
+	}
+
+	run = &packRun{ num: num, base: int64(head.Len()), cnt: cnt }
+	if run.fh, err = os.Open(ps.runPath(num)); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+/*
+A new bloom filter over every live id, sized for growth.
+*/
+func (ps *packStore) fillBloom() (err error) {
+
+	ps.bloom = newBloom(2*ps.indexed() + len(ps.recent) + ps.every)
+	if err = ps.walkIndex(func(id string, loc packLoc) error {
+		ps.bloom.add(id)
+		return nil
+	}); err != nil {
+		return
+	}
+	for id, loc := range ps.recent {
+		if loc.size >= 0 {
+			ps.bloom.add(id)
+		}
+	}
+
+	return
+}
+
+/*
+Seal the current pack and start the next.
+*/
+func (ps *packStore) roll() (err error) {
+	var (
+		fh *os.File
+		num int
+	)
+
+	if fh = ps.files[ps.cur]; fh != nil {
+		if err = fh.Sync(); err != nil {
+			return
+		}
+		num = ps.cur
+	}
+	for ps.files[num] != nil || num == 0 {
+		num++
+	}
+	if fh, err = os.OpenFile(ps.packPath(num), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644); err != nil {
+		return
+	}
+	ps.files[num], ps.ends[num], ps.cur = fh, 0, num
+
+	return
+}
+
+/*
+Append one record to the current pack.  A failed write is cut off so the
+pack never holds a partial record.
+*/
+func (ps *packStore) append(id string, kind byte, mtime int64, block []byte) (loc packLoc, err error) {
+	var rec []byte
+
+	if ps.ends[ps.cur] >= ps.max {
+		if err = ps.roll(); err != nil {
+			return
+		}
+	}
+
+	rec = make([]byte, 0, cam_pack_head+len(block))
+	rec = fmt.Appendf(rec, "%s%c%016x%04x", id, kind, mtime, len(block))
+	rec = append(rec, block...)
+
+	fh := ps.files[ps.cur]
+	loc = packLoc{ pack: ps.cur, off: ps.ends[ps.cur], size: len(block), mtime: mtime }
+	if _, err = fh.WriteAt(rec, loc.off); err != nil {
+		fh.Truncate(loc.off)
+		return
+	}
+	ps.ends[ps.cur] += int64(len(rec))
+
+	ps.apply(id, kind, loc)
+	if ps.appended++; ps.appended >= ps.every {
+		err = ps.writeIndex()
+	}
+
+	return
+}
+
+func (ps *packStore) Put(ctx context.Context, id string, block []byte) (err error) {
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if len(block) == 0 || len(block) > cam_block_size {
+		return fmt.Errorf("bad block size: %d", len(block))
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.bloom.maybe(id) {
+		if _, ok := ps.locate(id); ok {
+			_, err = ps.append(id, pack_touch, time.Now().UnixNano(), nil)
+			return
+		}
+	}
+	_, err = ps.append(id, pack_block, time.Now().UnixNano(), block)
+
+	return
+}
+
+func (ps *packStore) Get(ctx context.Context, id string) (block []byte, err error) {
+	var (
+		loc packLoc
+		ok bool
+	)
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if !ps.bloom.maybe(id) {
+		return nil, fmt.Errorf("%s: %w", id, os.ErrNotExist)
+	}
+	if loc, ok = ps.locate(id); !ok || ps.files[loc.pack] == nil {
+		return nil, fmt.Errorf("%s: %w", id, os.ErrNotExist)
+	}
+	block = make([]byte, loc.size)
+	if _, err = ps.files[loc.pack].ReadAt(block, loc.off+cam_pack_head); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+func (ps *packStore) Has(ctx context.Context, id string) (ok bool, err error) {
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if !ps.bloom.maybe(id) {
+		return false, nil
+	}
+	_, ok = ps.locate(id)
+
+	return
+}
+
+func (ps *packStore) Remove(ctx context.Context, id string) (err error) {
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if _, ok := ps.locate(id); !ok {
+		return fmt.Errorf("%s: %w", id, os.ErrNotExist)
+	}
+	_, err = ps.append(id, pack_delete, time.Now().UnixNano(), nil)
+
+	return
+}
+
+func (ps *packStore) Walk(ctx context.Context, fn func(id string, mtime time.Time) error) (err error) {
+	var (
+		ids []string
+		times []int64
+	)
+
+	// collect first, so fn may call back into the store
+	ps.mu.Lock()
+	err = ps.walkIndex(func(id string, loc packLoc) error {
+		if _, ok := ps.recent[id]; !ok {
+			ids, times = append(ids, id), append(times, loc.mtime)
+		}
+		return nil
+	})
+	for id, loc := range ps.recent {
+		if loc.size >= 0 {
+			ids, times = append(ids, id), append(times, loc.mtime)
+		}
+	}
+	ps.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	for ii, id := range ids {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if err = fn(id, time.Unix(0, times[ii])); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+/*
+Copy the live blocks out of every sealed pack that is less than
+cam_pack_live_min live, then delete it, and merge the index into one
+run.  Removal records are carried
+along while an older pack might still hold the block they remove.
+*/
+func (ps *packStore) Compact(ctx context.Context) (err error) {
+	var (
+		victims []int
+		changed bool
+	)
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for pack, end := range ps.ends {
+		if pack != ps.cur && float64(ps.live[pack]) < float64(end)*cam_pack_live_min {
+			victims = append(victims, pack)
+		}
+	}
+	sort.Ints(victims)
+
+	for _, pack := range victims {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		if err = ps.compactPack(pack); err != nil {
+			break
+		}
+		changed = true
+	}
+
+	// and the index runs merge into one
+	if changed || len(ps.runs) > 1 || len(ps.recent) > 0 {
+		if werr := ps.rewriteIndex(); err == nil {
+			err = werr
+		}
+	}
+
+	return
+}
+
+func (ps *packStore) compactPack(pack int) (err error) {
+	var (
+		fh *os.File
+		head [cam_pack_head]byte
+		block []byte
+		loc, at packLoc
+		id string
+		kind byte
+		ok, oldest bool
+	)
+
+	fh = ps.files[pack]
+	oldest = true
+	for other := range ps.files {
+		if other < pack {
+			oldest = false
+		}
+	}
+
+	for off := int64(0); off < ps.ends[pack]; off += int64(cam_pack_head + loc.size) {
+		if _, err = fh.ReadAt(head[:], off); err != nil {
+			return
+		}
+		if id, kind, loc, err = parseRecord(head[:]); err != nil {
+			return
+		}
+		switch kind {
+		case pack_block:
+			if at, ok = ps.locate(id); !ok || at.pack != pack || at.off != off {
+				continue
+			}
+			block = make([]byte, loc.size)
+			if _, err = fh.ReadAt(block, off+cam_pack_head); err != nil {
+				return
+			}
+			if _, err = ps.append(id, pack_block, at.mtime, block); err != nil {
+				return
+			}
+		case pack_delete:
+			if _, ok = ps.locate(id); !ok && !oldest {
+				if _, err = ps.append(id, pack_delete, loc.mtime, nil); err != nil {
+					return
+				}
+			}
+		}
+	}
+
+	// the copies must be on disk before the originals go
+	if err = ps.files[ps.cur].Sync(); err != nil {
+		return
+	}
+	fh.Close()
+	delete(ps.files, pack)
+	delete(ps.ends, pack)
+	delete(ps.live, pack)
+
+	return os.Remove(ps.packPath(pack))
+}
+
+/*
+Write the index and close every file.  Implements io.Closer; Server.Close
+calls it.
+*/
+func (ps *packStore) Close() (err error) {
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.bloom != nil && len(ps.files) > 0 && (len(ps.recent) > 0 || len(ps.runs) == 0) {
+		err = ps.writeIndex()
+	}
+	for pack, fh := range ps.files {
+		if cerr := fh.Close(); err == nil {
+			err = cerr
+		}
+		delete(ps.files, pack)
+	}
+	for _, run := range ps.runs {
+		run.fh.Close()
+	}
+	ps.runs = nil
+
+	return
+}
+
+/*
+Pins are small files, as in the directory store.
+*/
+func (ps *packStore) PutPin(ctx context.Context, name, id string) (err error) {
+
+	// a pin must never reach the disk ahead of the blocks it names
+	ps.mu.Lock()
+	if fh := ps.files[ps.cur]; fh != nil {
+		err = fh.Sync()
+	}
+	ps.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	return ps.pins.PutPin(ctx, name, id)
+}
+
+func (ps *packStore) GetPin(ctx context.Context, name string) (id string, err error) {
+	return ps.pins.GetPin(ctx, name)
+}
+
+func (ps *packStore) RemovePin(ctx context.Context, name string) (err error) {
+	return ps.pins.RemovePin(ctx, name)
+}
+
+func (ps *packStore) WalkPins(ctx context.Context, fn func(name, id string) error) (err error) {
+	return ps.pins.WalkPins(ctx, fn)
+}
+
+/*
+A bloom filter over block ids.  Ids are md5 sums and already uniformly
+distributed, so two halves of one serve as the two base hashes.
+*/
+type bloom struct {
+	bits []uint64
+	k int
+	// the ids it was sized for
+	size int
+}
+
+func newBloom(nn int) (bf *bloom) {
+	var mm int
+
+	// about 10 bits an id gives under 1% false positives with 7 probes
+	if mm = nn * 10; mm < 1<<16 {
+		mm = 1 << 16
+	}
+
+	return &bloom{ bits: make([]uint64, (mm+63)/64), k: 7, size: nn }
+}
+
+func (bf *bloom) hashes(id string) (h1, h2 uint64) {
+	var sum []byte
+
+	if sum, _ = hex.DecodeString(id); len(sum) < 16 {
+		hh := fnv.New128a()
+		hh.Write([]byte(id))
+		sum = hh.Sum(nil)
+	}
+	for ii := 0; ii < 8; ii++ {
+		h1 = h1<<8 | uint64(sum[ii])
+		h2 = h2<<8 | uint64(sum[8+ii])
+	}
+
+	return h1, h2 | 1
+}
+
+func (bf *bloom) add(id string) {
+	h1, h2 := bf.hashes(id)
+	mm := uint64(len(bf.bits) * 64)
+	for ii := 0; ii < bf.k; ii++ {
+		bit := (h1 + uint64(ii)*h2) % mm
+		bf.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (bf *bloom) maybe(id string) (ok bool) {
+	h1, h2 := bf.hashes(id)
+	mm := uint64(len(bf.bits) * 64)
+	for ii := 0; ii < bf.k; ii++ {
+		bit := (h1 + uint64(ii)*h2) % mm
+		if bf.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
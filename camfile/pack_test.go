@@ -0,0 +1,312 @@
+package camfile
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestPack(t *testing.T) {
+	t.Run("round-trip", packRoundTrip)
+	t.Run("recover", packRecover)
+	t.Run("damaged", packDamaged)
+	t.Run("gc-compact", packCompact)
+	t.Run("index-runs", packRuns)
+	t.Run("bloom", packBloom)
+}
+
+func packRoundTrip(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		dir, src, tree string
+	)
+
+	dir = t.TempDir()
+	cs = connServer(t, "pack:" + dir)
+	id, content := tierWrite(t, cs, 12, 50000)
+	again, _ := tierWrite(t, cs, 12, 50000)
+	if again != id {
+		t.Fatal("same content, different root", id, again)
+	}
+	src = treeSetup(t)
+	if tree, err = cs.PutTree(src); err != nil {
+		t.Fatal("failed to put tree, ", err.Error())
+	}
+	if err = cs.Close(); err != nil {
+		t.Fatal("failed to close, ", err.Error())
+	}
+
+	if names, _ := filepath.Glob(filepath.Join(dir, "pack-*")); len(names) != 1 {
+		t.Fatal("expected a single pack", names)
+	}
+
+	cs = connServer(t, "pack:" + dir)
+	tierRead(t, cs, id, content)
+	out := filepath.Join(t.TempDir(), "out")
+	if err = cs.GetTree(tree, out); err != nil {
+		t.Fatal("failed to get tree, ", err.Error())
+	}
+	treeCompare(t, src, out)
+
+	if report, err := cs.Fsck([]string{ id, tree }, ""); err != nil || !report.Ok() || len(report.Unreachable) != 0 {
+		t.Fatal("fsck of pack store", report, err)
+	}
+}
+
+/*
+Blocks written after the index and a torn last record, as a crash leaves
+them, and a lost index.
+*/
+func packRecover(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		dir string
+		fh *os.File
+		store BlockStore
+	)
+
+	dir = t.TempDir()
+	cs = connServer(t, "pack:" + dir)
+	first, one := tierWrite(t, cs, 13, 20000)
+	cs.Close()
+
+	// never closed, so the index does not cover the second file
+	if store, err = OpenPackStore(dir); err != nil {
+		t.Fatal("failed to open pack store, ", err.Error())
+	}
+	cs = NewServerStore(store)
+	second, two := tierWrite(t, cs, 14, 20000)
+
+	if fh, err = os.OpenFile(filepath.Join(dir, "pack-00000001"), os.O_WRONLY|os.O_APPEND, 0); err != nil {
+		t.Fatal(err)
+	}
+	fh.Write([]byte("0123456789abcdef0123456789abcdefB"))
+	fh.Close()
+
+	cs = connServer(t, "pack:" + dir)
+	tierRead(t, cs, first, one)
+	tierRead(t, cs, second, two)
+	cs.Close()
+
+	packDropIndex(t, dir)
+	cs = connServer(t, "pack:" + dir)
+	tierRead(t, cs, first, one)
+	tierRead(t, cs, second, two)
+}
+
+/*
+A damaged record in the middle of a pack, in its block or its header,
+loses nothing after it when the pack is scanned again, and the damaged
+block is left for Fsck.
+*/
+func packDamaged(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		dir string
+		data []byte
+		fi os.FileInfo
+		report *FsckReport
+	)
+
+	dir = t.TempDir()
+	cs = connServer(t, "pack:" + dir)
+	first, _ := tierWrite(t, cs, 15, 20000)
+	second, two := tierWrite(t, cs, 16, 20000)
+	third, three := tierWrite(t, cs, 17, 20000)
+	cs.Close()
+
+	name := filepath.Join(dir, "pack-00000001")
+	if data, err = os.ReadFile(name); err != nil {
+		t.Fatal(err)
+	}
+	// a bit of the first block, and the length of the record after it
+	data[cam_pack_head+100] ^= 1
+	size, _ := strconv.ParseInt(string(data[49:53]), 16, 32)
+	data[2*cam_pack_head+int(size)-4] = 'z'
+	if err = os.WriteFile(name, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	packDropIndex(t, dir)
+
+	cs = connServer(t, "pack:" + dir)
+	if fi, err = os.Stat(name); err != nil || fi.Size() != int64(len(data)) {
+		t.Fatal("cut the pack short", fi.Size(), len(data), err)
+	}
+	tierRead(t, cs, second, two)
+	tierRead(t, cs, third, three)
+	if report, err = cs.Fsck([]string{ first, second, third }, ""); err != nil {
+		t.Fatal("fsck failed, ", err.Error())
+	}
+	if len(report.Corrupt) != 1 || len(report.Dangling) != 1 {
+		t.Fatalf("fsck did not find the damage: %+v", report)
+	}
+}
+
+func packDropIndex(t *testing.T, dir string) {
+
+	names, _ := filepath.Glob(filepath.Join(dir, "index-*"))
+	if len(names) == 0 {
+		t.Fatal("no index to drop")
+	}
+	for _, name := range names {
+		if err := os.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func packCompact(t *testing.T) {
+	var (
+		store BlockStore
+		cs *Server
+		err error
+		dir string
+		report *GCReport
+		ok bool
+	)
+
+	dir = t.TempDir()
+	if store, err = OpenPackStore(dir); err != nil {
+		t.Fatal("failed to open pack store, ", err.Error())
+	}
+	store.(*packStore).max = 16 * cam_block_size
+	cs = NewServerStore(store)
+
+	keep, content := tierWrite(t, cs, 15, 30000)
+	lose, _ := tierWrite(t, cs, 16, 60000)
+	before, _ := filepath.Glob(filepath.Join(dir, "pack-*"))
+
+	if err = cs.Pin("keep", keep); err != nil {
+		t.Fatal("failed to pin, ", err.Error())
+	}
+	if report, err = cs.GC(GCOptions{}); err != nil {
+		t.Fatal("gc failed, ", err.Error())
+	}
+	if len(report.Removed) == 0 {
+		t.Fatal("nothing collected", report)
+	}
+	after, _ := filepath.Glob(filepath.Join(dir, "pack-*"))
+	if len(after) >= len(before) {
+		t.Fatal("packs not compacted", len(before), len(after))
+	}
+	tierRead(t, cs, keep, content)
+	cs.Close()
+
+	cs = connServer(t, "pack:" + dir)
+	tierRead(t, cs, keep, content)
+	if ok, err = cs.store.Has(context.Background(), lose); err != nil || ok {
+		t.Fatal("collected block is back", ok, err)
+	}
+	packDropIndex(t, dir)
+	cs.Close()
+
+	// rebuilt from the packs alone, removals still hold
+	cs = connServer(t, "pack:" + dir)
+	tierRead(t, cs, keep, content)
+	if ok, err = cs.store.Has(context.Background(), lose); err != nil || ok {
+		t.Fatal("collected block is back after rebuild", ok, err)
+	}
+	cs.Close()
+}
+
+/*
+The index stays a few runs as it grows, removals in a newer run hide
+blocks in an older one, and a rebuild from the packs agrees.
+*/
+func packRuns(t *testing.T) {
+	var (
+		store BlockStore
+		err error
+		ids []string
+		ok bool
+	)
+
+	dir := t.TempDir()
+	open := func() *packStore {
+		if store, err = OpenPackStore(dir); err != nil {
+			t.Fatal("failed to open pack store, ", err.Error())
+		}
+		store.(*packStore).every = 16
+		return store.(*packStore)
+	}
+	check := func(ps *packStore) {
+		for ii, id := range ids {
+			if ok, err = ps.Has(context.Background(), id); err != nil || ok != (ii%3 != 0) {
+				t.Fatal("block", ii, "has", ok, err)
+			}
+		}
+	}
+
+	ctx := context.Background()
+	ps := open()
+	most := 0
+	for ii := 0; ii < 2000; ii++ {
+		block := []byte(fmt.Sprintf("block %d", ii))
+		ids = append(ids, fmt.Sprintf("%x", md5.Sum(block)))
+		if err = ps.Put(ctx, ids[ii], block); err != nil {
+			t.Fatal("failed to put, ", err.Error())
+		}
+		most = max(most, len(ps.runs))
+	}
+	for ii := 0; ii < len(ids); ii += 3 {
+		if err = ps.Remove(ctx, ids[ii]); err != nil {
+			t.Fatal("failed to remove, ", err.Error())
+		}
+	}
+	// 125 flushes, merged down to about log2 of that
+	if most > 9 {
+		t.Fatal("index kept", most, "runs")
+	}
+	check(ps)
+	ps.Close()
+
+	ps = open()
+	check(ps)
+	if err = ps.Compact(ctx); err != nil || len(ps.runs) != 1 {
+		t.Fatal("compact left", len(ps.runs), "runs", err)
+	}
+	ps.Close()
+
+	packDropIndex(t, dir)
+	ps = open()
+	defer ps.Close()
+	check(ps)
+}
+
+func packBloom(t *testing.T) {
+	var (
+		bf *bloom
+		ids []string
+		false_pos int
+	)
+
+	rnd := rand.New(rand.NewSource(17))
+	id := func() string { return fmt.Sprintf("%016x%016x", rnd.Uint64(), rnd.Uint64()) }
+
+	bf = newBloom(1000)
+	for ii := 0; ii < 1000; ii++ {
+		ids = append(ids, id())
+		bf.add(ids[ii])
+	}
+	for _, id := range ids {
+		if !bf.maybe(id) {
+			t.Fatal("bloom filter lost an id", id)
+		}
+	}
+	for ii := 0; ii < 10000; ii++ {
+		if bf.maybe(id()) {
+			false_pos++
+		}
+	}
+	if false_pos > 100 {
+		t.Fatal("too many false positives", false_pos)
+	}
+}
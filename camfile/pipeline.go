@@ -0,0 +1,194 @@
+package camfile
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+const (
+	// blocks in flight per Writer, indirect level or Reader by default
+	cam_default_workers = 8
+)
+
+var (
+	// what run returns once the pipe has been waited for
+	errPipeClosed = errors.New("pipe closed")
+)
+
+/*
+Pipelined transfers.
+
+A Writer hands each DATA block to a bounded pool of workers that encode,
+hash and put it while the caller goes on writing; each result lands in its
+own slot of the Writer's refs, so the tree is the same whatever order the
+puts finish in.  The indirect blocks of each level are put the same way.
+
+Reader.Copy keeps up to the same number of blocks fetched ahead of the one
+being written out, in the order a one-at-a-time walk would visit them, so
+the output order is unchanged.
+
+The first error cancels the context every in-flight request was given, and
+is what the transfer returns.
+*/
+
+/*
+Set how many block requests a Writer or Reader keeps in flight at once.
+With n of 1 or less a Writer puts each block before Write returns, as it
+did before pipelining.  Affects transfers started afterwards.
+*/
+func (cs *Server) SetConcurrency(n int) {
+
+	if n < 1 {
+		n = 1
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.workers = n
+}
+
+func (cs *Server) concurrency() (n int) {
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.workers == 0 {
+		return cam_default_workers
+	}
+
+	return cs.workers
+}
+
+/*
+A bounded pool of jobs sharing one context, cancelled by the first error.
+*/
+type pipe struct {
+	ctx context.Context
+	cancel context.CancelFunc
+	sem chan struct{}
+	wg sync.WaitGroup
+	once sync.Once
+	err error
+}
+
+func newPipe(ctx context.Context, workers int) (pp *pipe) {
+
+	pp = &pipe{ sem: make(chan struct{}, workers) }
+	pp.ctx, pp.cancel = context.WithCancel(ctx)
+
+	return
+}
+
+/*
+Start fn once a worker is free, or with a single worker run it here.
+Returns the first error of the pipe, if there is one yet, so the caller
+stops feeding it.
+*/
+func (pp *pipe) run(fn func(ctx context.Context) error) (err error) {
+
+	if err = pp.ctx.Err(); err != nil {
+		return pp.fail(err)
+	}
+	if cap(pp.sem) == 1 {
+		if err = fn(pp.ctx); err != nil {
+			return pp.fail(err)
+		}
+		return
+	}
+	select {
+	case pp.sem <- struct{}{}:
+	case <-pp.ctx.Done():
+		return pp.fail(pp.ctx.Err())
+	}
+	if err = pp.ctx.Err(); err != nil {
+		// a worker came free because the pipe failed
+		<-pp.sem
+		return pp.fail(err)
+	}
+
+	pp.wg.Add(1)
+	go func() {
+		defer func() {
+			<-pp.sem
+			pp.wg.Done()
+		}()
+		if err := fn(pp.ctx); err != nil {
+			pp.fail(err)
+		}
+	}()
+
+	return
+}
+
+/*
+Record err if it is the first, cancel the rest, and return the first.
+*/
+func (pp *pipe) fail(err error) (first error) {
+
+	pp.once.Do(func() {
+		pp.err = err
+		pp.cancel()
+	})
+
+	return pp.err
+}
+
+/*
+Wait for every job started, then release the context.  Returns the first
+error.  The pipe is closed afterwards, and run refuses any further job,
+whose ref would otherwise never be filled in.
+*/
+func (pp *pipe) wait() (err error) {
+
+	pp.wg.Wait()
+	if err = pp.fail(errPipeClosed); err == errPipeClosed {
+		err = nil
+	}
+	pp.cancel()
+
+	return
+}
+
+/*
+Run fn(ctx, ii) for ii in [0, cnt) on a pipe and wait for them all.
+*/
+func (cs *Server) parallel(ctx context.Context, cnt int, fn func(ctx context.Context, ii int) error) (err error) {
+	var pp *pipe
+
+	pp = newPipe(ctx, cs.concurrency())
+	for ii := 0; ii < cnt; ii++ {
+		ii := ii
+		if err = pp.run(func(ctx context.Context) error { return fn(ctx, ii) }); err != nil {
+			break
+		}
+	}
+
+	if werr := pp.wait(); err == nil {
+		err = werr
+	}
+
+	return
+}
+
+/*
+One block being fetched ahead of the reader.
+*/
+type fetch struct {
+	ref camref
+	block [cam_block_size]byte
+	err error
+	done chan struct{}
+}
+
+func (cs *Server) prefetch(ctx context.Context, ref camref) (ff *fetch) {
+
+	ff = &fetch{ ref: ref, done: make(chan struct{}) }
+	go func() {
+		ff.err = cs.readBlock(ctx, ref, ff.block[:])
+		close(ff.done)
+	}()
+
+	return
+}
@@ -0,0 +1,241 @@
+package camfile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPipeline(t *testing.T) {
+	t.Run("same-tree", pipelineSameTree)
+	t.Run("prefetch", pipelinePrefetch)
+	t.Run("cancel", pipelineCancel)
+	t.Run("finish-failed", pipelineFinishFailed)
+}
+
+/*
+A store that counts requests in flight and can fail or stall puts.
+*/
+type slowStore struct {
+	BlockStore
+	delay time.Duration
+	// fail the put with this index, counting from 1
+	failAt int32
+	// fail the first put of a block with this tag
+	failTag string
+	mu sync.Mutex
+
+	puts, inflight, peak, cancelled int32
+}
+
+func (ss *slowStore) enter() {
+	nn := atomic.AddInt32(&ss.inflight, 1)
+	for {
+		peak := atomic.LoadInt32(&ss.peak)
+		if nn <= peak || atomic.CompareAndSwapInt32(&ss.peak, peak, nn) {
+			break
+		}
+	}
+}
+
+func (ss *slowStore) Put(ctx context.Context, id string, block []byte) (err error) {
+	ss.enter()
+	defer atomic.AddInt32(&ss.inflight, -1)
+
+	if atomic.AddInt32(&ss.puts, 1) == ss.failAt {
+		return errors.New("put failed")
+	}
+	if ss.failed(block) {
+		return errors.New("put failed")
+	}
+	select {
+	case <-time.After(ss.delay):
+	case <-ctx.Done():
+		atomic.AddInt32(&ss.cancelled, 1)
+		return ctx.Err()
+	}
+
+	return ss.BlockStore.Put(ctx, id, block)
+}
+
+func (ss *slowStore) failed(block []byte) (failed bool) {
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if hd, err := decodeHeader(block[:cam_header_size]); err == nil && hd.tag == ss.failTag {
+		ss.failTag, failed = "", true
+	}
+
+	return
+}
+
+func (ss *slowStore) Get(ctx context.Context, id string) (block []byte, err error) {
+	ss.enter()
+	defer atomic.AddInt32(&ss.inflight, -1)
+
+	select {
+	case <-time.After(ss.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return ss.BlockStore.Get(ctx, id)
+}
+
+func pipelineServer(t *testing.T, delay time.Duration) (cs *Server, ss *slowStore) {
+	cs = memServer(t)
+	ss = &slowStore{ BlockStore: cs.store, delay: delay }
+	cs.store = ss
+
+	return
+}
+
+func pipelineWrite(t *testing.T, cs *Server, content []byte) (id string) {
+	var (
+		cw *Writer
+		err error
+	)
+
+	if cw, err = cs.Create(); err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+	defer cw.Close()
+
+	if id, _, err = cw.Copy(bytes.NewReader(content)); err != nil {
+		t.Fatal("failed to copy to cam, ", err.Error())
+	}
+
+	return
+}
+
+/*
+The root does not depend on how many puts were in flight.
+*/
+func pipelineSameTree(t *testing.T) {
+	var (
+		cs *Server
+		content []byte
+		id, want string
+	)
+
+	content = make([]byte, 500*1000)
+	rand.New(rand.NewSource(34)).Read(content)
+
+	for _, workers := range []int{ 1, 3, 16, 64 } {
+		cs, _ = pipelineServer(t, 0)
+		cs.SetConcurrency(workers)
+		id = pipelineWrite(t, cs, content)
+		if want == "" {
+			want = id
+		} else if id != want {
+			t.Fatal("root depends on concurrency", workers, id, want)
+		}
+		cs.Close()
+	}
+}
+
+func pipelinePrefetch(t *testing.T) {
+	var (
+		cs *Server
+		ss *slowStore
+		cr *Reader
+		err error
+		content []byte
+		buff bytes.Buffer
+		id string
+	)
+
+	cs, ss = pipelineServer(t, time.Millisecond)
+	cs.SetConcurrency(8)
+
+	content = make([]byte, 100*1000)
+	rand.New(rand.NewSource(35)).Read(content)
+	id = pipelineWrite(t, cs, content)
+	if ss.peak < 2 {
+		t.Fatal("puts were not pipelined", ss.peak)
+	}
+
+	ss.peak = 0
+	if cr, err = cs.Open(id); err != nil {
+		t.Fatal("failed to create reader, ", err.Error())
+	}
+	defer cr.Close()
+
+	if _, err = cr.Copy(&buff); err != nil {
+		t.Fatal("failed to copy from cam, ", err.Error())
+	}
+	if !bytes.Equal(buff.Bytes(), content) {
+		t.Fatal("content mismatch")
+	}
+	if ss.peak < 2 || ss.peak > 8 {
+		t.Fatal("gets not prefetched within the limit", ss.peak)
+	}
+}
+
+/*
+One failed put stops the Writer and cancels the puts still in flight.
+*/
+func pipelineCancel(t *testing.T) {
+	var (
+		cs *Server
+		ss *slowStore
+		cw *Writer
+		err error
+		content []byte
+	)
+
+	cs, ss = pipelineServer(t, time.Hour)
+	cs.SetConcurrency(4)
+	ss.failAt = 4
+
+	content = make([]byte, 100*1000)
+	rand.New(rand.NewSource(36)).Read(content)
+
+	if cw, err = cs.Create(); err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+
+	if _, _, err = cw.Copy(bytes.NewReader(content)); err == nil || err.Error() != "put failed" {
+		t.Fatal("expected the failed put", err)
+	}
+	cw.Close()
+	if ss.cancelled != 3 || ss.inflight != 0 {
+		t.Fatal("in-flight puts not cancelled", ss.cancelled, ss.inflight)
+	}
+	if len(cs.live) != 0 {
+		t.Fatal("writer did not release its blocks", cs.live)
+	}
+}
+
+/*
+Once finishing the tree has failed, nothing written afterwards can make
+the Writer publish a root over the DATA blocks it never put.
+*/
+func pipelineFinishFailed(t *testing.T) {
+	var (
+		cs *Server
+		ss *slowStore
+		cw *Writer
+		err error
+	)
+
+	cs, ss = pipelineServer(t, 0)
+	ss.failTag = "INDB"
+
+	if cw, err = cs.Create(); err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+	if _, _, err = cw.Copy(bytes.NewReader(make([]byte, 5000))); err == nil {
+		t.Fatal("copy put no INDB")
+	}
+	cw.Write([]byte("more after the failure"))
+	if err = cw.Close(); err == nil || cw.Id() != "" {
+		t.Fatal("published a root after a failed finish", cw.Id(), err)
+	}
+}
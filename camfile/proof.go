@@ -0,0 +1,280 @@
+package camfile
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+)
+
+/*
+Inclusion proofs for byte ranges.
+
+A Proof holds the blocks, as stored, on the paths from a root down to the
+DATA blocks covering a range: each INDB block on the way and the DATA
+leaves themselves.  Every block is checked against its id, and each id is
+named by its parent, so anyone holding the proof and trusting the root id
+can confirm the range belongs to that root without access to a store.
+
+Legacy indirect blocks carry no subtree sizes, so for those the blocks
+needed to size the subtrees before the range are included too.  Proofs of
+encrypted trees hold ciphertext; verifying one needs the capability.
+*/
+type Proof struct {
+	// root id, without any key
+	Root string
+	// the range proved, clipped to the end of the file
+	Off, Len int64
+	// blocks in the order a verifier visits them
+	Blocks [][]byte
+}
+
+const (
+	cam_proof_magic = "camproof"
+)
+
+/*
+The proof that bytes [off, off+length) of the file under root are what
+the tree holds.  root is an id, or a capability for an encrypted file.
+*/
+func (cs *Server) Prove(root string, off, length int64) (proof *Proof, err error) {
+	return cs.ProveContext(context.Background(), root, off, length)
+}
+
+func (cs *Server) ProveContext(ctx context.Context, root string, off, length int64) (proof *Proof, err error) {
+	var (
+		ref camref
+		data []byte
+		seen map[string]bool
+	)
+
+	if off < 0 || length < 0 {
+		return nil, fmt.Errorf("bad range: %d, %d", off, length)
+	}
+	if ref, err = parseCap(root); err != nil {
+		return
+	}
+
+	proof = &Proof{ Root: ref.id, Off: off }
+	seen = make(map[string]bool)
+	get := func(at camref) (block []byte, err error) {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if block, err = cs.getBlock(ctx, at.id); err != nil {
+			return
+		}
+		if !seen[at.id] {
+			seen[at.id] = true
+			proof.Blocks = append(proof.Blocks, block)
+		}
+		return decodeBlock(at, block)
+	}
+
+	if data, err = proveRange(get, ref, off, off+length); err != nil {
+		return nil, err
+	}
+	proof.Len = int64(len(data))
+
+	return
+}
+
+/*
+Check the proof against root, an id or capability the caller trusts, and
+return the bytes it proves.  Nothing in the proof is trusted but what
+hashes to an id reached from root.
+*/
+func (proof *Proof) Verify(root string) (data []byte, err error) {
+	var (
+		ref camref
+		blocks map[string][]byte
+	)
+
+	if ref, err = parseCap(root); err != nil {
+		return
+	}
+	if ref.id != proof.Root {
+		return nil, fmt.Errorf("proof is for %s, not %s", proof.Root, ref.id)
+	}
+	if proof.Off < 0 || proof.Len < 0 {
+		return nil, fmt.Errorf("bad range: %d, %d", proof.Off, proof.Len)
+	}
+
+	blocks = make(map[string][]byte)
+	for _, block := range proof.Blocks {
+		blocks[fmt.Sprintf("%x", md5.Sum(block))] = block
+	}
+	get := func(at camref) (block []byte, err error) {
+		var ok bool
+
+		if block, ok = blocks[at.id]; !ok {
+			return nil, fmt.Errorf("proof is missing block %s", at.id)
+		}
+		if err = verifyBlock(at.id, block); err != nil {
+			return
+		}
+		return decodeBlock(at, block)
+	}
+
+	if data, err = proveRange(get, ref, proof.Off, proof.Off+proof.Len); err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != proof.Len {
+		return nil, fmt.Errorf("proof covers %d bytes, claims %d", len(data), proof.Len)
+	}
+
+	return
+}
+
+/*
+The bytes [off, end) below at, fetching blocks with get.  Prover and
+verifier both use this, so the prover records exactly the blocks the
+verifier will ask for.
+*/
+func proveRange(get func(at camref) ([]byte, error), at camref, off, end int64) (data []byte, err error) {
+	var (
+		tag string
+		cnt int
+		block, sub []byte
+		refs []camref
+	)
+
+	if block, err = get(at); err != nil {
+		return
+	}
+	if tag, cnt, err = parseHeader(block); err != nil {
+		return
+	}
+
+	switch tag {
+	case "DATA":
+		if off < int64(cnt) && end > off {
+			data = block[cam_header_size+off : cam_header_size+min(end, int64(cnt))]
+		}
+	case "INDB":
+		if refs, err = parseIndirect(block, cnt); err != nil {
+			return
+		}
+		for _, ref := range refs {
+			if end <= 0 {
+				break
+			}
+			if ref.size < 0 {
+				if ref.size, err = proveSize(get, ref); err != nil {
+					return
+				}
+			}
+			if off < ref.size {
+				if sub, err = proveRange(get, ref, max(off, 0), min(end, ref.size)); err != nil {
+					return
+				}
+				data = append(data, sub...)
+			}
+			off, end = off-ref.size, end-ref.size
+		}
+	default:
+		err = fmt.Errorf("unimplemented block type: %s", tag)
+	}
+
+	return
+}
+
+/*
+Content bytes below a legacy ref, by walking it.
+*/
+func proveSize(get func(at camref) ([]byte, error), at camref) (size int64, err error) {
+	var (
+		tag string
+		cnt int
+		block []byte
+		refs []camref
+		sub int64
+	)
+
+	if block, err = get(at); err != nil {
+		return
+	}
+	if tag, cnt, err = parseHeader(block); err != nil {
+		return
+	}
+	switch tag {
+	case "DATA":
+		size = int64(cnt)
+	case "INDB":
+		if refs, err = parseIndirect(block, cnt); err != nil {
+			return
+		}
+		for _, ref := range refs {
+			if sub = ref.size; sub < 0 {
+				if sub, err = proveSize(get, ref); err != nil {
+					return
+				}
+			}
+			size += sub
+		}
+	default:
+		err = fmt.Errorf("unimplemented block type: %s", tag)
+	}
+
+	return
+}
+
+/*
+Encode the proof for sending: a "camproof root off len count" line, then
+each block as a 4 hex digit length and the bytes.
+*/
+func (proof *Proof) MarshalBinary() (data []byte, err error) {
+	var buff bytes.Buffer
+
+	fmt.Fprintf(&buff, "%s %s %d %d %d\n", cam_proof_magic, proof.Root, proof.Off, proof.Len, len(proof.Blocks))
+	for _, block := range proof.Blocks {
+		if len(block) > cam_block_size {
+			return nil, fmt.Errorf("block too large for a proof: %d bytes", len(block))
+		}
+		fmt.Fprintf(&buff, "%04x", len(block))
+		buff.Write(block)
+	}
+
+	return buff.Bytes(), nil
+}
+
+func (proof *Proof) UnmarshalBinary(data []byte) (err error) {
+	var (
+		magic, line string
+		cnt, nn int
+		size [4]byte
+		rd *bufio.Reader
+	)
+
+	rd = bufio.NewReader(bytes.NewReader(data))
+	if line, err = rd.ReadString('\n'); err != nil {
+		return fmt.Errorf("bad proof: %w", err)
+	}
+	if _, err = fmt.Sscanf(line, "%s %s %d %d %d\n", &magic, &proof.Root, &proof.Off, &proof.Len, &cnt); err != nil || magic != cam_proof_magic {
+		return fmt.Errorf("bad proof header: %q", line)
+	}
+	if !isBlockId(proof.Root) || cnt < 0 || cnt > len(data)/cam_header_size {
+		return fmt.Errorf("bad proof header: %q", line)
+	}
+
+	proof.Blocks = make([][]byte, cnt)
+	for ii := range proof.Blocks {
+		if _, err = io.ReadFull(rd, size[:]); err != nil {
+			return fmt.Errorf("bad proof: block %d: %w", ii, err)
+		}
+		if _, err = fmt.Sscanf(string(size[:]), "%04x", &nn); err != nil || nn > cam_block_size {
+			return fmt.Errorf("bad proof: block %d length %q", ii, size)
+		}
+		proof.Blocks[ii] = make([]byte, nn)
+		if _, err = io.ReadFull(rd, proof.Blocks[ii]); err != nil {
+			return fmt.Errorf("bad proof: block %d: %w", ii, err)
+		}
+	}
+	if rd.Buffered() > 0 {
+		return fmt.Errorf("bad proof: trailing data")
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package camfile
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestProof(t *testing.T) {
+	t.Run("ranges", proofRanges)
+	t.Run("tamper", proofTamper)
+	t.Run("encode", proofEncode)
+	t.Run("encrypted", proofEncrypted)
+}
+
+func proofCheck(t *testing.T, cs *Server, root string, content []byte, off, length int64) (proof *Proof) {
+	var (
+		err error
+		data []byte
+	)
+
+	if proof, err = cs.Prove(root, off, length); err != nil {
+		t.Fatal("failed to prove, ", err.Error())
+	}
+	if data, err = proof.Verify(root); err != nil {
+		t.Fatal("proof did not verify, ", off, length, err.Error())
+	}
+	end := min(off+length, int64(len(content)))
+	if off > end {
+		end = off
+	}
+	if off < int64(len(content)) && !bytes.Equal(data, content[off:end]) {
+		t.Fatal("proof gave the wrong bytes", off, length)
+	}
+
+	return
+}
+
+func proofRanges(t *testing.T) {
+	var (
+		cs *Server
+		proof *Proof
+	)
+
+	cs = memServer(t)
+	id, content := tierWrite(t, cs, 39, 100000)
+	all := tierCount(t, cs.store)
+
+	// one byte is a path from the root to one leaf
+	proof = proofCheck(t, cs, id, content, 50000, 1)
+	if len(proof.Blocks) > 4 {
+		t.Fatal("proof of one byte is not minimal", len(proof.Blocks))
+	}
+	proofCheck(t, cs, id, content, 0, 2000)
+	proofCheck(t, cs, id, content, 99000, 5000)
+	proofCheck(t, cs, id, content, 200000, 10)
+	proofCheck(t, cs, id, content, 30000, 0)
+	if proof = proofCheck(t, cs, id, content, 0, 100000); len(proof.Blocks) != all {
+		t.Fatal("proof of the whole file should hold every block", len(proof.Blocks), all)
+	}
+}
+
+func proofTamper(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		proof *Proof
+	)
+
+	cs = memServer(t)
+	id, content := tierWrite(t, cs, 40, 30000)
+	other, _ := tierWrite(t, cs, 41, 30000)
+
+	proof = proofCheck(t, cs, id, content, 10000, 3000)
+	if _, err = proof.Verify(other); err == nil {
+		t.Fatal("proof verified against another root")
+	}
+
+	leaf := proof.Blocks[len(proof.Blocks)-1]
+	leaf[cam_header_size] ^= 1
+	if _, err = proof.Verify(id); err == nil {
+		t.Fatal("verified a changed leaf")
+	}
+	leaf[cam_header_size] ^= 1
+
+	proof.Blocks = proof.Blocks[:len(proof.Blocks)-1]
+	if _, err = proof.Verify(id); err == nil {
+		t.Fatal("verified a proof missing a leaf")
+	}
+
+	proof = proofCheck(t, cs, id, content, 10000, 3000)
+	proof.Len += 5000
+	if _, err = proof.Verify(id); err == nil {
+		t.Fatal("verified a longer range than proved")
+	}
+}
+
+func proofEncode(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		proof, back *Proof
+		data []byte
+	)
+
+	cs = memServer(t)
+	id, content := tierWrite(t, cs, 42, 30000)
+
+	proof = proofCheck(t, cs, id, content, 1000, 5000)
+	if data, err = proof.MarshalBinary(); err != nil {
+		t.Fatal("failed to encode, ", err.Error())
+	}
+	back = &Proof{}
+	if err = back.UnmarshalBinary(data); err != nil {
+		t.Fatal("failed to decode, ", err.Error())
+	}
+	if data, err = back.Verify(id); err != nil || !bytes.Equal(data, content[1000:6000]) {
+		t.Fatal("decoded proof did not verify", err)
+	}
+	if err = back.UnmarshalBinary(data[:len(data)/2]); err == nil {
+		t.Fatal("decoded a truncated proof")
+	}
+}
+
+func proofEncrypted(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		proof *Proof
+	)
+
+	cs = memServer(t)
+	content := cryptContent()
+	capa := cryptWrite(t, cs, cryptSecret, content)
+
+	proof = proofCheck(t, cs, capa, content, 70000, 500)
+	if proof.Root+":" != capa[:33] {
+		t.Fatal("key leaked into the proof root", proof.Root)
+	}
+	if _, err = proof.Verify(proof.Root); err == nil {
+		t.Fatal("verified encrypted content without the key")
+	}
+}
@@ -0,0 +1,291 @@
+package camfile
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+const (
+	// cap on the number of indirect blocks a Reader keeps in memory
+	cam_reader_inner_max = 256
+)
+
+/*
+Random access to the file behind a Reader.
+
+Rather than streaming the whole tree, ReadAt descends from the root to the
+DATA block holding the requested offset, using the subtree byte counts
+kept in indirect blocks.  Trees written before those counts existed are
+still readable; the size of each legacy subtree is computed once by
+walking it and remembered for the life of the Reader.
+
+The Read/Seek position is independent of Copy, which always streams the
+whole file.
+*/
+
+/*
+Implement io.ReaderAt.  Safe for concurrent use.
+*/
+func (cr *Reader) ReadAt(p []byte, off int64) (nn int, err error) {
+	return cr.ReadAtContext(cr.ctx, p, off)
+}
+
+func (cr *Reader) ReadAtContext(ctx context.Context, p []byte, off int64) (nn int, err error) {
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	return cr.readFull(ctx, p, off)
+}
+
+/*
+As ReadAtContext, with cr.mu held.
+*/
+func (cr *Reader) readFull(ctx context.Context, p []byte, off int64) (nn int, err error) {
+	var cnt int
+
+	if cr.server == nil || cr.server.state != state_open || cr.state != state_open {
+		err = fmt.Errorf("not opened: reader %s", stateString(cr.state))
+		return
+	}
+	if off < 0 {
+		err = fmt.Errorf("negative offset: %d", off)
+		return
+	}
+
+	for nn < len(p) {
+		if cnt, err = cr.readAt(ctx, p[nn:], off+int64(nn)); err != nil {
+			break
+		}
+		if cnt == 0 {
+			err = io.EOF
+			break
+		}
+		nn += cnt
+	}
+
+	return
+}
+
+/*
+Implement io.Reader, reading from the current Seek position.  Safe for
+concurrent use, though concurrent Reads share the one position.
+*/
+func (cr *Reader) Read(p []byte) (nn int, err error) {
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	nn, err = cr.readFull(cr.ctx, p, cr.off)
+	cr.off += int64(nn)
+	if err == io.EOF && nn > 0 {
+		err = nil
+	}
+
+	return
+}
+
+/*
+Implement io.Seeker.  Seeking past the end is allowed; reads there
+return io.EOF.  Safe for concurrent use.
+*/
+func (cr *Reader) Seek(offset int64, whence int) (pos int64, err error) {
+	var size int64
+
+	// Size takes cr.mu itself
+	if whence == io.SeekEnd {
+		if size, err = cr.Size(); err != nil {
+			return
+		}
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = cr.off + offset
+	case io.SeekEnd:
+		pos = size + offset
+	default:
+		err = fmt.Errorf("bad whence: %d", whence)
+		return
+	}
+
+	if pos < 0 {
+		err = fmt.Errorf("negative position: %d", pos)
+		pos = cr.off
+		return
+	}
+	cr.off = pos
+
+	return
+}
+
+/*
+Number of content bytes in the file.
+*/
+func (cr *Reader) Size() (size int64, err error) {
+	return cr.SizeContext(cr.ctx)
+}
+
+func (cr *Reader) SizeContext(ctx context.Context) (size int64, err error) {
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if cr.server == nil || cr.server.state != state_open || cr.state != state_open {
+		err = fmt.Errorf("not opened: reader %s", stateString(cr.state))
+		return
+	}
+
+	return cr.subtreeSize(ctx, cr.root)
+}
+
+/*
+Copy into p from the DATA block holding off.  Returns 0 at or past the end.
+*/
+func (cr *Reader) readAt(ctx context.Context, p []byte, off int64) (nn int, err error) {
+	var (
+		tag string
+		cnt int
+		block []byte
+		refs []camref
+		at, ref camref
+	)
+
+	at = cr.root
+
+loop:
+	for {
+		if block, err = cr.block(ctx, at); err != nil {
+			break loop
+		}
+		if tag, cnt, err = parseHeader(block); err != nil {
+			break loop
+		}
+		switch tag {
+		case "DATA":
+			if off < int64(cnt) {
+				nn = copy(p, block[cam_header_size+off:cam_header_size+cnt])
+			}
+			break loop
+		case "INDB":
+			if refs, err = parseIndirect(block, cnt); err != nil {
+				break loop
+			}
+			at = camref{}
+			for _, ref = range refs {
+				if ref.size < 0 {
+					if ref.size, err = cr.subtreeSize(ctx, ref); err != nil {
+						break loop
+					}
+				}
+				if off < ref.size {
+					at = ref
+					break
+				}
+				off -= ref.size
+			}
+			if at.id == "" {
+				break loop
+			}
+		default:
+			err = fmt.Errorf("unimplemented block type: %s", tag)
+			break loop
+		}
+	}
+
+	return
+}
+
+/*
+Content bytes below id.  Sized indirect blocks answer directly; legacy
+ones are walked and the answer cached.
+*/
+func (cr *Reader) subtreeSize(ctx context.Context, at camref) (size int64, err error) {
+	var (
+		ok bool
+		tag string
+		cnt int
+		block []byte
+		refs []camref
+		sub int64
+	)
+
+	if size, ok = cr.sizes[at.id]; ok {
+		return
+	}
+
+	if block, err = cr.block(ctx, at); err != nil {
+		return
+	}
+	if tag, cnt, err = parseHeader(block); err != nil {
+		return
+	}
+	switch tag {
+	case "DATA":
+		size = int64(cnt)
+	case "INDB":
+		if refs, err = parseIndirect(block, cnt); err != nil {
+			return
+		}
+		for _, ref := range refs {
+			if sub = ref.size; sub < 0 {
+				if sub, err = cr.subtreeSize(ctx, ref); err != nil {
+					return
+				}
+			}
+			size += sub
+		}
+	default:
+		err = fmt.Errorf("unimplemented block type: %s", tag)
+		return
+	}
+
+	if cr.sizes == nil {
+		cr.sizes = make(map[string]int64)
+	}
+	cr.sizes[at.id] = size
+
+	return
+}
+
+/*
+Fetch a block, keeping indirect blocks and the most recent DATA block in
+memory so sequential small reads do not refetch the path from the root.
+*/
+func (cr *Reader) block(ctx context.Context, at camref) (block []byte, err error) {
+	var (
+		ok bool
+		id string
+	)
+
+	id = at.id
+	if id == cr.leafid {
+		return cr.leaf, nil
+	}
+	if block, ok = cr.inner[id]; ok {
+		return
+	}
+
+	block = make([]byte, cam_block_size)
+	if err = cr.server.readBlock(ctx, at, block); err != nil {
+		block = nil
+		return
+	}
+
+	if tag, _, _ := parseHeader(block); tag == "DATA" {
+		cr.leafid, cr.leaf = id, block
+	} else {
+		if cr.inner == nil || len(cr.inner) >= cam_reader_inner_max {
+			cr.inner = make(map[string][]byte)
+		}
+		cr.inner[id] = block
+	}
+
+	return
+}
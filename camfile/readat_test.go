@@ -0,0 +1,217 @@
+package camfile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReadAt(t *testing.T) {
+	t.Run("sized", readAtSized)
+	t.Run("legacy", readAtLegacy)
+	t.Run("seek", readAtSeek)
+}
+
+/*
+Write content to a fresh store and return the server and root id.
+*/
+func readAtSetup(t *testing.T, content []byte) (cs *Server, id string) {
+	var (
+		cw *Writer
+		err error
+	)
+
+	cs = memServer(t)
+	if cw, err = cs.Create(); err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+	defer cw.Close()
+
+	if id, _, err = cw.Copy(bytes.NewReader(content)); err != nil {
+		t.Fatal("failed to copy to cam, ", err.Error())
+	}
+
+	return
+}
+
+func readAtCheck(t *testing.T, cr *Reader, content []byte) {
+	var (
+		err error
+		off int64
+		nn, ii int
+		buff [3000]byte
+		size int64
+	)
+
+	if size, err = cr.Size(); err != nil {
+		t.Fatal("failed to size, ", err.Error())
+	}
+	if size != int64(len(content)) {
+		t.Fatal("unexpected size", size)
+	}
+
+	rr := rand.New(rand.NewSource(1))
+	for ii = 0; ii < 100; ii++ {
+		off = rr.Int63n(int64(len(content)))
+		nn, err = cr.ReadAt(buff[:rr.Intn(len(buff))+1], off)
+		if err != nil && err != io.EOF {
+			t.Fatal("failed to read, ", err.Error())
+		}
+		if !bytes.Equal(buff[:nn], content[off:off+int64(nn)]) {
+			t.Fatal("mismatch at", off, nn)
+		}
+		if err == io.EOF && off+int64(nn) != int64(len(content)) {
+			t.Fatal("early EOF at", off, nn)
+		}
+	}
+
+	if nn, err = cr.ReadAt(buff[:], int64(len(content))); nn != 0 || err != io.EOF {
+		t.Fatal("expected EOF at end", nn, err)
+	}
+}
+
+func readAtSized(t *testing.T) {
+	var (
+		cs *Server
+		cr *Reader
+		err error
+		id string
+		content []byte
+	)
+
+	// enough leaves for two levels of indirect blocks
+	content = make([]byte, (cam_block_size-cam_header_size)*cam_sized_indirect_cnt*2+17)
+	rand.New(rand.NewSource(0)).Read(content)
+
+	cs, id = readAtSetup(t, content)
+
+	if cr, err = cs.Open(id); err != nil {
+		t.Fatal("failed to create reader, ", err.Error())
+	}
+	defer cr.Close()
+
+	readAtCheck(t, cr, content)
+}
+
+/*
+Hand build a tree in the legacy layout, indirect blocks without sizes
+and short DATA blocks, and make sure offsets are still found.
+*/
+func readAtLegacy(t *testing.T) {
+	var (
+		cs *Server
+		cr *Reader
+		err error
+		id, leaf string
+		ids []string
+		content []byte
+		chunk string
+		ii int
+	)
+
+	cs = memServer(t)
+
+	for ii = 0; ii < 5; ii++ {
+		chunk = strings.Repeat(fmt.Sprintf("%d", ii), 100*(ii+1))
+		head := []byte(fmt.Sprintf("%04xDATA%04x--------------------", 0, len(chunk)))
+		data := []byte(chunk + strings.Repeat("-", cam_block_size-cam_header_size-len(chunk)))
+		if leaf, err = cs.putBlock(head, data); err != nil {
+			t.Fatal("failed to put block, ", err.Error())
+		}
+		ids = append(ids, leaf)
+		content = append(content, chunk...)
+	}
+
+	head := []byte(fmt.Sprintf("%04xINDB%04x--------------------", 0, len(ids)*32))
+	data := []byte(strings.Join(ids, "") + strings.Repeat("-", cam_block_size-cam_header_size-len(ids)*32))
+	if id, err = cs.putBlock(head, data); err != nil {
+		t.Fatal("failed to put block, ", err.Error())
+	}
+
+	if cr, err = cs.Open(id); err != nil {
+		t.Fatal("failed to create reader, ", err.Error())
+	}
+	defer cr.Close()
+
+	readAtCheck(t, cr, content)
+}
+
+func readAtSeek(t *testing.T) {
+	var (
+		cs *Server
+		cr *Reader
+		err error
+		id string
+		content, got []byte
+		pos int64
+	)
+
+	content = []byte(strings.Repeat("0123456789", 500))
+	cs, id = readAtSetup(t, content)
+
+	if cr, err = cs.Open(id); err != nil {
+		t.Fatal("failed to create reader, ", err.Error())
+	}
+	defer cr.Close()
+
+	if pos, err = cr.Seek(-15, io.SeekEnd); err != nil || pos != int64(len(content)-15) {
+		t.Fatal("failed to seek from end", pos, err)
+	}
+	if got, err = io.ReadAll(cr); err != nil {
+		t.Fatal("failed to read, ", err.Error())
+	}
+	if string(got) != string(content[len(content)-15:]) {
+		t.Fatal("unexpected tail", string(got))
+	}
+
+	if pos, err = cr.Seek(990, io.SeekStart); err != nil || pos != 990 {
+		t.Fatal("failed to seek from start", pos, err)
+	}
+	if pos, err = cr.Seek(5, io.SeekCurrent); err != nil || pos != 995 {
+		t.Fatal("failed to seek from current", pos, err)
+	}
+	got = make([]byte, 10)
+	if _, err = io.ReadFull(cr, got); err != nil {
+		t.Fatal("failed to read across block boundary, ", err.Error())
+	}
+	if string(got) != string(content[995:1005]) {
+		t.Fatal("unexpected data", string(got))
+	}
+
+	if _, err = cr.Seek(-1, io.SeekStart); err == nil {
+		t.Fatal("expected error for negative position")
+	}
+
+	// concurrent Reads share the position, each reading a part once
+	var (
+		wg sync.WaitGroup
+		total atomic.Int64
+	)
+	cr.Seek(0, io.SeekStart)
+	for ii := 0; ii < 4; ii++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buff := make([]byte, 100)
+			for {
+				nn, err := cr.Read(buff)
+				if nn > 0 && !bytes.Equal(buff[:nn], content[:nn]) {
+					t.Error("unaligned read", string(buff[:nn]))
+				}
+				total.Add(int64(nn))
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if total.Load() != int64(len(content)) {
+		t.Fatal("concurrent reads read", total.Load(), "bytes of", len(content))
+	}
+}
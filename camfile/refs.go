@@ -0,0 +1,463 @@
+package camfile
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Named, versioned references to roots.
+
+A ref gives a root a name and metadata.  Each version is a REFB block
+holding the name, the root, the id of the version before it, the
+metadata and an HMAC-SHA256 signature over all of that with a key the
+clients share, as text:
+
+	camref 1
+	name report.pdf
+	root 0123456789abcdef0123456789abcdef
+	prev -
+	type application/pdf
+	size 48213
+	by alice
+	time 1700000000000000000
+	sig 9f86d081884c7d659a2feaa0c55ad015...
+
+Like any block it never changes, so the history of a ref is the chain of
+prev ids, newest first.  The current version is held by the pin
+"ref.name", which also keeps every version and its root from GC.  A
+version is only accepted if its signature checks and it names the ref
+it was found under, so a store that cannot sign cannot move a ref.
+
+Updates are compare and swap: SetRef takes the id of the version it
+replaces, "" for a new ref, and fails with ErrConflict if another
+update came first.  As with Pin, only the id of an encrypted root is
+stored, not its key.
+*/
+type Ref struct {
+	// this version
+	Id string
+	Name string
+	Root string
+	// the version before, "" for the first
+	Prev string
+	Meta RefMeta
+	Time time.Time
+}
+
+type RefMeta struct {
+	ContentType string
+	Size int64
+	CreatedBy string
+}
+
+const (
+	cam_ref_pin = "ref."
+	cam_ref_meta_max = 128
+)
+
+var (
+	// returned, wrapped, when a ref or pin was changed by someone else
+	ErrConflict = errors.New("changed since read")
+
+	// swaps on stores that cannot swap themselves, see swapPin
+	pinSwapMu sync.Mutex
+)
+
+/*
+Sign refs with key, and check them with it when read.  Refs cannot be
+set or read without one.
+*/
+func (cs *Server) SetRefKey(key []byte) {
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.refKey = append([]byte(nil), key...)
+}
+
+func (cs *Server) refKeyOf() (key []byte, err error) {
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if len(cs.refKey) == 0 {
+		return nil, fmt.Errorf("no ref key set")
+	}
+
+	return cs.refKey, nil
+}
+
+/*
+Point name at root, replacing the version prev, "" if the ref should not
+exist yet.
+*/
+func (cs *Server) SetRef(name, root string, meta RefMeta, prev string) (ref *Ref, err error) {
+	return cs.SetRefContext(context.Background(), name, root, meta, prev)
+}
+
+func (cs *Server) SetRefContext(ctx context.Context, name, root string, meta RefMeta, prev string) (ref *Ref, err error) {
+	var (
+		key, data []byte
+		ok bool
+		held []string
+		hd header
+	)
+
+	if cs.state != state_open {
+		return nil, fmt.Errorf("not opened: server %s", stateString(cs.state))
+	}
+	if key, err = cs.refKeyOf(); err != nil {
+		return
+	}
+	root, _, _ = strings.Cut(root, ":")
+	if !isPinName(cam_ref_pin + name) {
+		return nil, fmt.Errorf("bad ref name: %q", name)
+	}
+	if !isBlockId(root) {
+		return nil, fmt.Errorf("not a block id: %s", root)
+	}
+	if prev != "" && !isBlockId(prev) {
+		return nil, fmt.Errorf("not a block id: %s", prev)
+	}
+	if ok, err = cs.store.Has(ctx, root); err != nil {
+		return
+	} else if !ok {
+		return nil, fmt.Errorf("no such block: %s", root)
+	}
+
+	ref = &Ref{ Name: name, Root: root, Prev: prev, Meta: meta, Time: time.Now() }
+	if data, err = ref.marshal(key); err != nil {
+		return nil, err
+	}
+
+	defer func() { cs.release(held) }()
+	hd = newHeader("REFB", len(data))
+	if ref.Id, err = cs.putHeld(ctx, hd.encode(), data, &held); err != nil {
+		return nil, err
+	}
+	if err = swapPin(ctx, cs.store, cam_ref_pin + name, prev, ref.Id); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+/*
+The current version of name.
+*/
+func (cs *Server) GetRef(name string) (ref *Ref, err error) {
+	return cs.GetRefContext(context.Background(), name)
+}
+
+func (cs *Server) GetRefContext(ctx context.Context, name string) (ref *Ref, err error) {
+	var id string
+
+	if cs.state != state_open {
+		return nil, fmt.Errorf("not opened: server %s", stateString(cs.state))
+	}
+	if !isPinName(cam_ref_pin + name) {
+		return nil, fmt.Errorf("bad ref name: %q", name)
+	}
+	if id, err = cs.store.GetPin(ctx, cam_ref_pin + name); err != nil {
+		return
+	}
+	if ref, err = cs.ReadRefContext(ctx, id); err != nil {
+		return nil, err
+	}
+	if ref.Name != name {
+		return nil, fmt.Errorf("%w: ref %s holds %s", ErrCorrupt, name, ref.Name)
+	}
+
+	return
+}
+
+/*
+One version of a ref, by its id.
+*/
+func (cs *Server) ReadRef(id string) (ref *Ref, err error) {
+	return cs.ReadRefContext(context.Background(), id)
+}
+
+func (cs *Server) ReadRefContext(ctx context.Context, id string) (ref *Ref, err error) {
+	var (
+		key, block []byte
+		tag string
+		cnt int
+	)
+
+	if key, err = cs.refKeyOf(); err != nil {
+		return
+	}
+	if block, err = cs.getBlock(ctx, id); err != nil {
+		return
+	}
+	if tag, cnt, err = parseHeader(block); err != nil {
+		return
+	}
+	if tag != "REFB" || cam_header_size+cnt > len(block) {
+		return nil, fmt.Errorf("not a ref: %s is %s", id, tag)
+	}
+	if ref, err = parseRef(block[cam_header_size:cam_header_size+cnt], key); err != nil {
+		return nil, fmt.Errorf("%s: %w", id, err)
+	}
+	ref.Id = id
+
+	return
+}
+
+/*
+Call fn for every version of name, newest first.
+*/
+func (cs *Server) RefHistory(name string, fn func(ref *Ref) error) (err error) {
+	return cs.RefHistoryContext(context.Background(), name, fn)
+}
+
+func (cs *Server) RefHistoryContext(ctx context.Context, name string, fn func(ref *Ref) error) (err error) {
+	var ref *Ref
+
+	if ref, err = cs.GetRefContext(ctx, name); err != nil {
+		return
+	}
+	for {
+		if err = fn(ref); err != nil || ref.Prev == "" {
+			return
+		}
+		if ref, err = cs.ReadRefContext(ctx, ref.Prev); err != nil {
+			return
+		}
+		if ref.Name != name {
+			return fmt.Errorf("%w: history of %s holds %s", ErrCorrupt, name, ref.Name)
+		}
+	}
+}
+
+/*
+The names of all refs, sorted.
+*/
+func (cs *Server) Refs() (names []string, err error) {
+	return cs.RefsContext(context.Background())
+}
+
+func (cs *Server) RefsContext(ctx context.Context) (names []string, err error) {
+	var pins map[string]string
+
+	if pins, err = cs.PinsContext(ctx); err != nil {
+		return
+	}
+	for pin := range pins {
+		if name, ok := strings.CutPrefix(pin, cam_ref_pin); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return
+}
+
+/*
+Drop name and with it, once GC runs, its history.
+*/
+func (cs *Server) RemoveRef(name string) (err error) {
+	return cs.UnpinContext(context.Background(), cam_ref_pin + name)
+}
+
+/*
+Write the content of rd and point name at it, with its size recorded.
+*/
+func (cs *Server) PutObject(name string, rd io.Reader, meta RefMeta, prev string) (ref *Ref, err error) {
+	return cs.PutObjectContext(context.Background(), name, rd, meta, prev)
+}
+
+func (cs *Server) PutObjectContext(ctx context.Context, name string, rd io.Reader, meta RefMeta, prev string) (ref *Ref, err error) {
+	var (
+		cw *Writer
+		id string
+		nn int
+	)
+
+	if cw, err = cs.CreateContext(ctx); err != nil {
+		return
+	}
+	defer cw.Close()
+	if id, nn, err = cw.Copy(rd); err != nil {
+		return
+	}
+	meta.Size = int64(nn)
+
+	return cs.SetRefContext(ctx, name, id, meta, prev)
+}
+
+/*
+The current version of name and a Reader on its content.
+*/
+func (cs *Server) OpenObject(name string) (ref *Ref, cr *Reader, err error) {
+	return cs.OpenObjectContext(context.Background(), name)
+}
+
+func (cs *Server) OpenObjectContext(ctx context.Context, name string) (ref *Ref, cr *Reader, err error) {
+
+	if ref, err = cs.GetRefContext(ctx, name); err != nil {
+		return
+	}
+	if cr, err = cs.OpenContext(ctx, ref.Root); err != nil {
+		return nil, nil, err
+	}
+
+	return
+}
+
+func (ref *Ref) marshal(key []byte) (data []byte, err error) {
+	var (
+		buff strings.Builder
+		prev string
+	)
+
+	for _, val := range []string{ ref.Meta.ContentType, ref.Meta.CreatedBy } {
+		if len(val) > cam_ref_meta_max || !isRefText(val) {
+			return nil, fmt.Errorf("bad ref metadata: %q", val)
+		}
+	}
+	if prev = ref.Prev; prev == "" {
+		prev = "-"
+	}
+
+	fmt.Fprintf(&buff, "camref 1\nname %s\nroot %s\nprev %s\n", ref.Name, ref.Root, prev)
+	fmt.Fprintf(&buff, "type %s\nsize %d\nby %s\ntime %d\n", ref.Meta.ContentType, ref.Meta.Size, ref.Meta.CreatedBy, ref.Time.UnixNano())
+	fmt.Fprintf(&buff, "sig %s\n", refSign(key, buff.String()))
+	if buff.Len() > cam_block_size - cam_header_size {
+		return nil, fmt.Errorf("ref too large: %d bytes", buff.Len())
+	}
+
+	return []byte(buff.String()), nil
+}
+
+func parseRef(data, key []byte) (ref *Ref, err error) {
+	var (
+		lines []string
+		vals [9]string
+		nanos int64
+		ok bool
+	)
+
+	names := []string{ "camref", "name", "root", "prev", "type", "size", "by", "time", "sig" }
+	if lines = strings.Split(string(data), "\n"); len(lines) != len(names)+1 || lines[len(names)] != "" {
+		return nil, fmt.Errorf("%w: bad ref", ErrCorrupt)
+	}
+	for ii, name := range names {
+		if vals[ii], ok = strings.CutPrefix(lines[ii], name + " "); !ok {
+			return nil, fmt.Errorf("%w: bad ref line: %q", ErrCorrupt, lines[ii])
+		}
+	}
+	if vals[0] != "1" {
+		return nil, fmt.Errorf("unsupported ref version: %s", vals[0])
+	}
+
+	signed := string(data[:len(data)-len(lines[8])-1])
+	if !hmac.Equal([]byte(vals[8]), []byte(refSign(key, signed))) {
+		return nil, fmt.Errorf("%w: bad ref signature", ErrCorrupt)
+	}
+
+	ref = &Ref{ Name: vals[1], Root: vals[2], Prev: vals[3] }
+	ref.Meta = RefMeta{ ContentType: vals[4], CreatedBy: vals[6] }
+	if ref.Prev == "-" {
+		ref.Prev = ""
+	}
+	if !isBlockId(ref.Root) || (ref.Prev != "" && !isBlockId(ref.Prev)) {
+		return nil, fmt.Errorf("%w: bad ref ids", ErrCorrupt)
+	}
+	if ref.Meta.Size, err = strconv.ParseInt(vals[5], 10, 64); err != nil {
+		return nil, fmt.Errorf("%w: bad ref size: %q", ErrCorrupt, vals[5])
+	}
+	if nanos, err = strconv.ParseInt(vals[7], 10, 64); err != nil {
+		return nil, fmt.Errorf("%w: bad ref time: %q", ErrCorrupt, vals[7])
+	}
+	ref.Time = time.Unix(0, nanos)
+
+	return
+}
+
+/*
+The ids a ref block keeps alive, without checking its signature; GC and
+Sync have no key.
+*/
+func refChildren(data []byte) (ids []string, err error) {
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if id, ok := strings.CutPrefix(line, "root "); ok {
+			ids = append(ids, id)
+		} else if id, ok = strings.CutPrefix(line, "prev "); ok && id != "-" {
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range ids {
+		if !isBlockId(id) {
+			return nil, fmt.Errorf("bad ref: not a block id: %q", id)
+		}
+	}
+
+	return
+}
+
+func refSign(key []byte, text string) (sig string) {
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(text))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+Metadata is one line of printable text.
+*/
+func isRefText(val string) (ok bool) {
+
+	for _, cc := range val {
+		if cc < ' ' || cc == 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
+
+/*
+Set pin name to id if it is still old, "" for unset, or fail with
+ErrConflict.  A store that can swap atomically, as the HTTP store asks its
+server to, does, and the stores wrapping others pass the swap on to the
+one holding their pins; otherwise swaps are made under a lock, which
+only orders them against other swaps in this process.
+*/
+func swapPin(ctx context.Context, store BlockStore, name, old, id string) (err error) {
+	var cur string
+
+	if sp, ok := store.(interface{ SwapPin(context.Context, string, string, string) error }); ok {
+		return sp.SwapPin(ctx, name, old, id)
+	}
+
+	pinSwapMu.Lock()
+	defer pinSwapMu.Unlock()
+
+	if cur, err = store.GetPin(ctx, name); errors.Is(err, os.ErrNotExist) {
+		cur, err = "", nil
+	}
+	if err != nil {
+		return
+	}
+	if cur != old {
+		return fmt.Errorf("%w: pin %s is %q, not %q", ErrConflict, name, cur, old)
+	}
+
+	return store.PutPin(ctx, name, id)
+}
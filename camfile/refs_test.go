@@ -0,0 +1,338 @@
+package camfile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRefs(t *testing.T) {
+	t.Run("history", refsHistory)
+	t.Run("swap", refsSwap)
+	t.Run("signed", refsSigned)
+	t.Run("gc", refsGC)
+	t.Run("http", refsHTTP)
+	t.Run("wrapped", refsWrapped)
+	t.Run("objects", refsObjects)
+}
+
+const refsKey = "ref signing key"
+
+func refsHistory(t *testing.T) {
+	var (
+		ref, prev *Ref
+		err error
+		names []string
+		seen []*Ref
+	)
+
+	cs := memServer(t)
+	cs.SetRefKey([]byte(refsKey))
+	roots := []string{ gcWrite(t, cs, 1, 100), gcWrite(t, cs, 2, 5000), gcWrite(t, cs, 3, 0) }
+
+	for ii, root := range roots {
+		meta := RefMeta{ ContentType: "text/plain", Size: int64(ii), CreatedBy: "tester" }
+		var id string
+		if prev != nil {
+			id = prev.Id
+		}
+		if ref, err = cs.SetRef("notes.txt", root, meta, id); err != nil {
+			t.Fatal("failed to set ref, ", err.Error())
+		}
+		prev = ref
+	}
+
+	if ref, err = cs.GetRef("notes.txt"); err != nil {
+		t.Fatal("failed to get ref, ", err.Error())
+	}
+	if ref.Id != prev.Id || ref.Root != roots[2] || ref.Meta != prev.Meta || !ref.Time.Equal(prev.Time) {
+		t.Fatalf("got %+v, want %+v", ref, prev)
+	}
+
+	if err = cs.RefHistory("notes.txt", func(ref *Ref) error {
+		seen = append(seen, ref)
+		return nil
+	}); err != nil {
+		t.Fatal("failed to walk history, ", err.Error())
+	}
+	if len(seen) != len(roots) {
+		t.Fatal("history has", len(seen), "versions")
+	}
+	for ii, ref := range seen {
+		if ref.Root != roots[len(roots)-1-ii] || ref.Meta.Size != int64(len(roots)-1-ii) {
+			t.Fatal("version", ii, "is", ref)
+		}
+	}
+	if seen[len(seen)-1].Prev != "" {
+		t.Fatal("first version has a prev", seen[len(seen)-1].Prev)
+	}
+
+	if names, err = cs.Refs(); err != nil || !equalStrings(names, []string{ "notes.txt" }) {
+		t.Fatal("refs are", names, err)
+	}
+	if _, err = cs.GetRef("absent"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("expected not found", err)
+	}
+	if _, err = cs.SetRef("bad/name", roots[0], RefMeta{}, ""); err == nil {
+		t.Fatal("set a ref with a bad name")
+	}
+	if _, err = cs.SetRef("meta", roots[0], RefMeta{ ContentType: "text/plain\nsig x" }, ""); err == nil {
+		t.Fatal("set a ref with a newline in its metadata")
+	}
+	if _, err = cs.SetRef("meta", roots[0], RefMeta{ CreatedBy: strings.Repeat("x", 200) }, ""); err == nil {
+		t.Fatal("set a ref with long metadata")
+	}
+}
+
+/*
+Of many updates from the same version, exactly one wins.
+*/
+func refsSwap(t *testing.T) {
+	var (
+		first *Ref
+		err error
+		wg sync.WaitGroup
+		mu sync.Mutex
+		wins, conflicts int
+	)
+
+	cs := memServer(t)
+	cs.SetRefKey([]byte(refsKey))
+	root := gcWrite(t, cs, 4, 100)
+
+	if first, err = cs.SetRef("doc", root, RefMeta{}, ""); err != nil {
+		t.Fatal("failed to set ref, ", err.Error())
+	}
+	if _, err = cs.SetRef("doc", root, RefMeta{}, ""); !errors.Is(err, ErrConflict) {
+		t.Fatal("created a ref twice", err)
+	}
+
+	for ii := 0; ii < 8; ii++ {
+		wg.Add(1)
+		go func(ii int) {
+			defer wg.Done()
+			_, err := cs.SetRef("doc", root, RefMeta{ Size: int64(ii) }, first.Id)
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				wins++
+			} else if errors.Is(err, ErrConflict) {
+				conflicts++
+			} else {
+				t.Error("set ref failed, ", err.Error())
+			}
+		}(ii)
+	}
+	wg.Wait()
+	if wins != 1 || conflicts != 7 {
+		t.Fatal(wins, "wins and", conflicts, "conflicts")
+	}
+}
+
+/*
+A ref signed with another key, or named for another ref, is refused.
+*/
+func refsSigned(t *testing.T) {
+	var (
+		ref, other *Ref
+		err error
+	)
+
+	cs := memServer(t)
+	cs.SetRefKey([]byte(refsKey))
+	root := gcWrite(t, cs, 5, 100)
+	if ref, err = cs.SetRef("mine", root, RefMeta{}, ""); err != nil {
+		t.Fatal("failed to set ref, ", err.Error())
+	}
+	if other, err = cs.SetRef("theirs", root, RefMeta{}, ""); err != nil {
+		t.Fatal("failed to set ref, ", err.Error())
+	}
+
+	cs.SetRefKey([]byte("some other key"))
+	if _, err = cs.GetRef("mine"); !errors.Is(err, ErrCorrupt) {
+		t.Fatal("read a ref with the wrong key", err)
+	}
+	cs.SetRefKey([]byte(refsKey))
+
+	// a store that moves one ref onto another's version
+	cs.store.PutPin(context.Background(), cam_ref_pin + "mine", other.Id)
+	if _, err = cs.GetRef("mine"); !errors.Is(err, ErrCorrupt) {
+		t.Fatal("read a ref holding another's version", err)
+	}
+	cs.store.PutPin(context.Background(), cam_ref_pin + "mine", ref.Id)
+	if _, err = cs.GetRef("mine"); err != nil {
+		t.Fatal("failed to get ref, ", err.Error())
+	}
+
+	cs.SetRefKey(nil)
+	if _, err = cs.SetRef("mine", root, RefMeta{}, ref.Id); err == nil {
+		t.Fatal("set a ref without a key")
+	}
+}
+
+/*
+GC keeps every version of a ref and its root until the ref goes.
+*/
+func refsGC(t *testing.T) {
+	var (
+		ref *Ref
+		err error
+		report *GCReport
+	)
+
+	cs := memServer(t)
+	cs.SetRefKey([]byte(refsKey))
+	old, cur := gcWrite(t, cs, 6, 3000), gcWrite(t, cs, 7, 3000)
+	if ref, err = cs.SetRef("doc", old, RefMeta{}, ""); err != nil {
+		t.Fatal("failed to set ref, ", err.Error())
+	}
+	if _, err = cs.SetRef("doc", cur, RefMeta{}, ref.Id); err != nil {
+		t.Fatal("failed to set ref, ", err.Error())
+	}
+
+	if report, err = cs.GC(GCOptions{}); err != nil {
+		t.Fatal("gc failed, ", err.Error())
+	}
+	if len(report.Removed) != 0 {
+		t.Fatal("gc removed blocks of a ref's history", report.Removed)
+	}
+	if _, err = cs.ReadRef(ref.Id); err != nil {
+		t.Fatal("lost the first version, ", err.Error())
+	}
+	if _, err = cs.Open(old); err != nil {
+		t.Fatal("lost the first root, ", err.Error())
+	}
+
+	if err = cs.RemoveRef("doc"); err != nil {
+		t.Fatal("failed to remove ref, ", err.Error())
+	}
+	if report, err = cs.GC(GCOptions{}); err != nil {
+		t.Fatal("gc failed, ", err.Error())
+	}
+	if len(report.Removed) == 0 {
+		t.Fatal("gc kept a removed ref's blocks")
+	}
+}
+
+/*
+Swaps go to the block server, so clients of it see each other's.
+*/
+func refsHTTP(t *testing.T) {
+	var (
+		ref *Ref
+		err error
+	)
+
+	remote, one := httpSetup(t, nil)
+	defer remote.Close()
+	defer one.Close()
+	two := NewServerStore(one.store)
+	one.SetRefKey([]byte(refsKey))
+	two.SetRefKey([]byte(refsKey))
+
+	root := gcWrite(t, one, 8, 2000)
+	if ref, err = one.SetRef("shared", root, RefMeta{ ContentType: "a/b" }, ""); err != nil {
+		t.Fatal("failed to set ref, ", err.Error())
+	}
+	if _, err = two.SetRef("shared", root, RefMeta{}, ""); !errors.Is(err, ErrConflict) {
+		t.Fatal("created a ref twice", err)
+	}
+	if _, err = two.SetRef("shared", root, RefMeta{ ContentType: "c/d" }, ref.Id); err != nil {
+		t.Fatal("failed to update ref, ", err.Error())
+	}
+	if _, err = one.SetRef("shared", root, RefMeta{}, ref.Id); !errors.Is(err, ErrConflict) {
+		t.Fatal("updated a stale ref", err)
+	}
+
+	remote.SetRefKey([]byte(refsKey))
+	if ref, err = remote.GetRef("shared"); err != nil || ref.Meta.ContentType != "c/d" {
+		t.Fatal("server sees", ref, err)
+	}
+}
+
+/*
+A store that counts the swaps it is asked for.
+*/
+type swapStore struct {
+	BlockStore
+	swaps *atomic.Int32
+}
+
+func (ss swapStore) SwapPin(ctx context.Context, name, old, id string) (err error) {
+	ss.swaps.Add(1)
+	return swapPin(ctx, ss.BlockStore, name, old, id)
+}
+
+/*
+Stores wrapping one that swaps atomically pass the swap on, rather than
+falling back to a lock in this process.
+*/
+func refsWrapped(t *testing.T) {
+	var err error
+
+	wraps := []struct {
+		name string
+		wrap func(inner BlockStore) BlockStore
+	}{
+		{ "cache", func(inner BlockStore) BlockStore {
+			cst, err := NewCacheStore(context.Background(), NewMemStore(), inner, 1 << 20)
+			if err != nil {
+				t.Fatal("failed to create cache, ", err.Error())
+			}
+			return cst
+		} },
+		{ "mirror", func(inner BlockStore) BlockStore { return NewMirrorStore(2, inner, swapStore{ NewMemStore(), inner.(swapStore).swaps }) } },
+		{ "fallback", func(inner BlockStore) BlockStore { return NewFallbackStore(inner, NewMemStore()) } },
+		{ "metered", func(inner BlockStore) BlockStore { return (&meter{ inst: NewMetrics(), backend: "mem" }).store(inner) } },
+	}
+
+	for _, ww := range wraps {
+		inner := swapStore{ NewMemStore(), &atomic.Int32{} }
+		cs := NewServerStore(ww.wrap(inner))
+		cs.SetRefKey([]byte(refsKey))
+		root := gcWrite(t, cs, 9, 2000)
+		if _, err = cs.SetRef("wrapped", root, RefMeta{}, ""); err != nil {
+			t.Fatal(ww.name, "failed to set ref, ", err.Error())
+		}
+		if inner.swaps.Load() == 0 {
+			t.Error(ww.name, "swapped under a local lock")
+		}
+		cs.Close()
+	}
+}
+
+func refsObjects(t *testing.T) {
+	var (
+		ref *Ref
+		cr *Reader
+		err error
+		buff bytes.Buffer
+	)
+
+	cs := memServer(t)
+	cs.SetRefKey([]byte(refsKey))
+	content := []byte(strings.Repeat("versioned object ", 500))
+	if _, err = cs.PutObject("obj", bytes.NewReader(content), RefMeta{ ContentType: "text/plain", Size: 1 }, ""); err != nil {
+		t.Fatal("failed to put object, ", err.Error())
+	}
+	if ref, cr, err = cs.OpenObject("obj"); err != nil {
+		t.Fatal("failed to open object, ", err.Error())
+	}
+	defer cr.Close()
+	if _, err = io.Copy(&buff, cr); err != nil {
+		t.Fatal("failed to read object, ", err.Error())
+	}
+	if !bytes.Equal(buff.Bytes(), content) || ref.Meta.Size != int64(len(content)) {
+		t.Fatal("object read back wrong", buff.Len(), ref.Meta.Size)
+	}
+	if ref.Time.After(time.Now()) {
+		t.Fatal("ref from the future", ref.Time)
+	}
+}
@@ -0,0 +1,104 @@
+package camfile_test
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/KimN100/random-examples/camfile"
+	"github.com/KimN100/random-examples/camfile/camtest"
+)
+
+// replay a failing run with go test -run RoundTrip -roundtrip.seed N
+var roundTripSeed = flag.Int64("roundtrip.seed", 1, "seed for the random round trips")
+
+/*
+One random round trip: content of some size written two ways, to two
+backends.
+*/
+type roundTripCase struct {
+	seed int64
+	size int
+	codec camfile.Codec
+	secret []byte
+	one, two camtest.Options
+	back [2]camtest.Backend
+}
+
+/*
+Sizes fall mostly on either side of a block or fan-out boundary, where
+the mistakes are, and otherwise anywhere up to two levels of indirection.
+Each side writes with block parameters from camtest.Writes or picked at
+random, and any codec.
+*/
+func (roundTripCase) Generate(rr *rand.Rand, _ int) reflect.Value {
+	const payload = camtest.Payload
+
+	var (
+		rc roundTripCase
+		edges = []int{ 0, payload, 20 * payload, 20 * 20 * payload }
+	)
+
+	rc.seed = rr.Int63()
+	if rr.Intn(4) == 0 {
+		rc.size = rr.Intn(20*20*payload + 2)
+	} else {
+		rc.size = max(0, edges[rr.Intn(len(edges))] + rr.Intn(5) - 2)
+	}
+	rc.codec = []camfile.Codec{ 0, camfile.CodecNone, camfile.CodecFlate }[rr.Intn(3)]
+	if rr.Intn(3) == 0 {
+		rc.secret = []byte(fmt.Sprint("secret ", rr.Intn(4)))
+	}
+	for _, opts := range []*camtest.Options{ &rc.one, &rc.two } {
+		if rr.Intn(2) == 0 {
+			*opts = camtest.Writes[rr.Intn(len(camtest.Writes))]
+		} else {
+			*opts = camtest.Options{ Workers: 1 + rr.Intn(32) }
+			if rr.Intn(2) == 0 {
+				opts.Chunk = 1 + rr.Intn(3*payload)
+			}
+		}
+		opts.Codec, opts.Secret = rc.codec, rc.secret
+	}
+	for ii := range rc.back {
+		rc.back[ii] = camtest.Backends[rr.Intn(len(camtest.Backends))]
+	}
+
+	return reflect.ValueOf(rc)
+}
+
+func (rc roundTripCase) String() string {
+	return fmt.Sprintf("seed %d size %d codec %v secret %q %s %+v %s %+v", rc.seed, rc.size, rc.codec, rc.secret,
+		rc.back[0].Name, rc.one, rc.back[1].Name, rc.two)
+}
+
+/*
+Whatever the backend, chunking and concurrency, content reads back as
+written and under the same root for the same codec and secret.
+*/
+func TestRoundTrip(t *testing.T) {
+	var count = 40
+
+	if testing.Short() {
+		count = 8
+	}
+
+	check := func(rc roundTripCase) bool {
+		content := camtest.Content(rc.seed, rc.size)
+		one := camtest.RoundTrip(t, rc.back[0].Open(t), content, rc.one)
+		two := camtest.RoundTrip(t, rc.back[1].Open(t), content, rc.two)
+		if one != two {
+			t.Log(rc, "roots", one, two)
+		}
+		return one == two
+	}
+
+	t.Log("seed", *roundTripSeed)
+	config := &quick.Config{ MaxCount: count, Rand: rand.New(rand.NewSource(*roundTripSeed)) }
+	if err := quick.Check(check, config); err != nil {
+		t.Fatal(err)
+	}
+}
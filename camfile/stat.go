@@ -0,0 +1,135 @@
+package camfile
+
+import (
+	"context"
+	"fmt"
+)
+
+/*
+One block of a file's tree, as visited by WalkBlocks.
+*/
+type BlockInfo struct {
+	Id string
+	// DATA or INDB
+	Type string
+	// 0 for the root
+	Depth int
+	// content bytes below the block
+	Size int64
+	// bytes as stored, after compression and encryption
+	Stored int
+	Children int
+}
+
+type FileStat struct {
+	Size int64
+	// levels in the tree, 1 for a file in a single DATA block
+	Depth int
+	// blocks in the tree, and their bytes as stored
+	Blocks int
+	Stored int64
+}
+
+/*
+Visit the blocks of the file under root, an id or capability, parents
+before children and children in file order.
+*/
+func (cs *Server) WalkBlocks(root string, fn func(info BlockInfo) error) (err error) {
+	return cs.WalkBlocksContext(context.Background(), root, fn)
+}
+
+func (cs *Server) WalkBlocksContext(ctx context.Context, root string, fn func(info BlockInfo) error) (err error) {
+	var ref camref
+
+	if ref, err = parseCap(root); err != nil {
+		return
+	}
+
+	return cs.walkBlocks(ctx, ref, 0, fn)
+}
+
+func (cs *Server) walkBlocks(ctx context.Context, at camref, depth int, fn func(info BlockInfo) error) (err error) {
+	var (
+		raw, block []byte
+		cnt int
+		refs []camref
+		info BlockInfo
+	)
+
+	get := func(at camref) (block []byte, err error) {
+		if block, err = cs.getBlock(ctx, at.id); err != nil {
+			return
+		}
+		return decodeBlock(at, block)
+	}
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if raw, err = cs.getBlock(ctx, at.id); err != nil {
+		return
+	}
+	if block, err = decodeBlock(at, raw); err != nil {
+		return
+	}
+
+	info = BlockInfo{ Id: at.id, Depth: depth, Stored: len(raw) }
+	if info.Type, cnt, err = parseHeader(block); err != nil {
+		return
+	}
+	switch info.Type {
+	case "DATA":
+		info.Size = int64(cnt)
+	case "INDB":
+		if refs, err = parseIndirect(block, cnt); err != nil {
+			return
+		}
+		for ii := range refs {
+			if refs[ii].size < 0 {
+				if refs[ii].size, err = proveSize(get, refs[ii]); err != nil {
+					return
+				}
+			}
+			info.Size += refs[ii].size
+		}
+		info.Children = len(refs)
+	default:
+		return fmt.Errorf("not a file tree: %s is %s", at.id, info.Type)
+	}
+
+	if err = fn(info); err != nil {
+		return
+	}
+	for _, ref := range refs {
+		if err = cs.walkBlocks(ctx, ref, depth+1, fn); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+/*
+Size, depth and block count of the file under root.
+*/
+func (cs *Server) Stat(root string) (stat *FileStat, err error) {
+	return cs.StatContext(context.Background(), root)
+}
+
+func (cs *Server) StatContext(ctx context.Context, root string) (stat *FileStat, err error) {
+
+	stat = &FileStat{}
+	if err = cs.WalkBlocksContext(ctx, root, func(info BlockInfo) error {
+		if info.Depth == 0 {
+			stat.Size = info.Size
+		}
+		stat.Depth = max(stat.Depth, info.Depth+1)
+		stat.Blocks++
+		stat.Stored += int64(info.Stored)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return
+}
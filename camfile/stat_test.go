@@ -0,0 +1,69 @@
+package camfile
+
+import (
+	"testing"
+)
+
+func TestStat(t *testing.T) {
+	t.Run("plain", statPlain)
+	t.Run("encrypted", statEncrypted)
+}
+
+func statPlain(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		stat *FileStat
+		leaves int
+		order []int64
+	)
+
+	cs = memServer(t)
+	id, _ := tierWrite(t, cs, 41, 50000)
+
+	if stat, err = cs.Stat(id); err != nil {
+		t.Fatal("stat failed, ", err.Error())
+	}
+	if stat.Size != 50000 || stat.Depth != 3 || stat.Blocks != tierCount(t, cs.store) {
+		t.Fatal("wrong stat", stat)
+	}
+
+	if err = cs.WalkBlocks(id, func(info BlockInfo) error {
+		if info.Type == "DATA" {
+			leaves++
+			order = append(order, info.Size)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal("walk failed, ", err.Error())
+	}
+	if leaves != (50000+cam_block_size-cam_header_size-1)/(cam_block_size-cam_header_size) {
+		t.Fatal("wrong leaf count", leaves)
+	}
+	if order[len(order)-1] != 50000%(cam_block_size-cam_header_size) {
+		t.Fatal("leaves out of order", order)
+	}
+
+	if _, err = cs.Stat("0123456789abcdef0123456789abcdef"); err == nil {
+		t.Fatal("stat of a missing root")
+	}
+}
+
+func statEncrypted(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		stat *FileStat
+	)
+
+	cs = memServer(t)
+	content := cryptContent()
+	capa := cryptWrite(t, cs, cryptSecret, content)
+
+	if stat, err = cs.Stat(capa); err != nil || stat.Size != int64(len(content)) {
+		t.Fatal("stat of an encrypted file", stat, err)
+	}
+	if _, err = cs.Stat(capa[:32]); err == nil {
+		t.Fatal("stat of an encrypted file without the key")
+	}
+}
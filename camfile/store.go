@@ -0,0 +1,410 @@
+package camfile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+A BlockStore keeps whole blocks, header and payload, by id, along with
+a small set of named pins that record the roots worth keeping.
+
+Stores do not hash or parse what they keep; the Server computes ids on the
+way in and verifies them on the way out.  Put of an id that is already
+present may skip the write but must refresh its modification time, which
+GC uses as a grace period.  Get of a missing id, and GetPin of a missing
+name, return an error satisfying errors.Is(err, os.ErrNotExist).
+
+Every method takes a context and should give up with its error once it is
+done; the Server keeps several requests in flight and cancels the rest
+when one fails.
+*/
+type BlockStore interface {
+	Put(ctx context.Context, id string, block []byte) (err error)
+	Get(ctx context.Context, id string) (block []byte, err error)
+	Has(ctx context.Context, id string) (ok bool, err error)
+	Remove(ctx context.Context, id string) (err error)
+	// Call fn for every block in the store, in no particular order.
+	Walk(ctx context.Context, fn func(id string, mtime time.Time) error) (err error)
+
+	PutPin(ctx context.Context, name, id string) (err error)
+	GetPin(ctx context.Context, name string) (id string, err error)
+	RemovePin(ctx context.Context, name string) (err error)
+	WalkPins(ctx context.Context, fn func(name, id string) error) (err error)
+}
+
+/*
+Blocks kept as one file per block in a directory on the local file system.
+Pins are small files holding an id in the pins subdirectory.
+
+With a fan-out of n, blocks sit n levels of two hex characters below the
+root, ab/cd/abcd..., so no one directory grows too large.  The fan-out is
+chosen when the store is made and recorded in its layout file.
+
+Every file is written to a temporary name beside its final one, synced,
+and renamed into place, so a crash or a full disk never leaves a partial
+block under a valid id.
+*/
+type fileStore struct {
+	root string
+	fanout int
+}
+
+const (
+	cam_fanout_max = 4
+	// temporary files older than this are left over from a crash
+	cam_tmp_grace = time.Hour
+)
+
+/*
+Open the directory store at root, in the layout recorded there, or flat
+if none is.
+*/
+func OpenFileStore(root string) (store BlockStore, err error) {
+	var (
+		fi os.FileInfo
+		data []byte
+		fst *fileStore
+	)
+
+	if fi, err = os.Stat(root); err != nil {
+		return nil, fmt.Errorf("bad root: %s, %s", root, err.Error())
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("bad root: %s, not a directory", root)
+	}
+
+	fst = &fileStore{ root: root }
+	if data, err = os.ReadFile(fst.layoutPath()); errors.Is(err, os.ErrNotExist) {
+		return fst, nil
+	} else if err != nil {
+		return
+	}
+	if _, err = fmt.Sscanf(string(data), "fanout %d\n", &fst.fanout); err != nil || fst.fanout < 0 || fst.fanout > cam_fanout_max {
+		return nil, fmt.Errorf("bad layout in %s: %q", root, strings.TrimSpace(string(data)))
+	}
+
+	return fst, nil
+}
+
+/*
+Make a directory store at root with the given fan-out, creating root if
+need be.  An existing store is accepted only if it has the same layout.
+*/
+func NewFileStore(root string, fanout int) (store BlockStore, err error) {
+	var fst *fileStore
+
+	if fanout < 0 || fanout > cam_fanout_max {
+		return nil, fmt.Errorf("fan-out %d out of range", fanout)
+	}
+	if err = os.MkdirAll(root, 0755); err != nil {
+		return
+	}
+	if store, err = OpenFileStore(root); err != nil {
+		return
+	}
+	if fst = store.(*fileStore); fst.fanout == fanout {
+		return
+	}
+	if _, err = os.Stat(fst.layoutPath()); err == nil || fst.populated() {
+		return nil, fmt.Errorf("%s already holds a store with fan-out %d", root, fst.fanout)
+	}
+	fst.fanout = fanout
+	if err = fst.writeFile(fst.layoutPath(), []byte(fmt.Sprintf("fanout %d\n", fanout))); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+func (fst *fileStore) layoutPath() (fn string) {
+	return fst.root + "/layout"
+}
+
+/*
+Whether there is anything but pins in the root.
+*/
+func (fst *fileStore) populated() (ok bool) {
+
+	ents, _ := os.ReadDir(fst.root)
+	for _, ent := range ents {
+		if ent.Name() != "pins" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (fst *fileStore) path(id string) (fn string) {
+	var buff strings.Builder
+
+	buff.WriteString(fst.root)
+	for ii := 0; ii < fst.fanout; ii++ {
+		buff.WriteString("/" + id[2*ii:2*ii+2])
+	}
+	buff.WriteString("/" + id)
+
+	return buff.String()
+}
+
+/*
+Write data to fn by way of a synced temporary file in the same directory,
+then sync the directory so the rename is durable too.
+*/
+func (fst *fileStore) writeFile(fn string, data []byte) (err error) {
+	var (
+		fh *os.File
+		dir string
+	)
+
+	dir = filepath.Dir(fn)
+	if fh, err = os.CreateTemp(dir, ".tmp-*"); errors.Is(err, os.ErrNotExist) {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return
+		}
+		fh, err = os.CreateTemp(dir, ".tmp-*")
+	}
+	if err != nil {
+		return
+	}
+
+	if _, err = fh.Write(data); err == nil {
+		if err = fh.Chmod(0644); err == nil {
+			err = fh.Sync()
+		}
+	}
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(fh.Name(), fn)
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+		return
+	}
+
+	return syncDir(dir)
+}
+
+func syncDir(dir string) (err error) {
+	var fh *os.File
+
+	if fh, err = os.Open(dir); err != nil {
+		return
+	}
+	err = fh.Sync()
+	fh.Close()
+
+	return
+}
+
+func (fst *fileStore) Put(ctx context.Context, id string, block []byte) (err error) {
+	var (
+		old []byte
+		now time.Time
+	)
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	// a file that differs is a partial write from before writes were
+	// atomic, or damaged since, so write it again
+	if old, err = os.ReadFile(fst.path(id)); err == nil && bytes.Equal(old, block) {
+		now = time.Now()
+		err = os.Chtimes(fst.path(id), now, now)
+		return
+	}
+
+	return fst.writeFile(fst.path(id), block)
+}
+
+/*
+Refresh a block's modification time, see batch.go.
+*/
+func (fst *fileStore) Touch(ctx context.Context, id string) (err error) {
+	var now time.Time
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	now = time.Now()
+
+	return os.Chtimes(fst.path(id), now, now)
+}
+
+func (fst *fileStore) Get(ctx context.Context, id string) (block []byte, err error) {
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	return os.ReadFile(fst.path(id))
+}
+
+func (fst *fileStore) Has(ctx context.Context, id string) (ok bool, err error) {
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if _, err = os.Stat(fst.path(id)); err == nil {
+		ok = true
+	} else if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+
+	return
+}
+
+func (fst *fileStore) Remove(ctx context.Context, id string) (err error) {
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	return os.Remove(fst.path(id))
+}
+
+/*
+Walk also removes temporary files a crash left behind.
+*/
+func (fst *fileStore) Walk(ctx context.Context, fn func(id string, mtime time.Time) error) (err error) {
+	return fst.walkDir(ctx, fst.root, fst.fanout, fn)
+}
+
+func (fst *fileStore) walkDir(ctx context.Context, dir string, depth int, fn func(id string, mtime time.Time) error) (err error) {
+	var (
+		ents []os.DirEntry
+		fi os.FileInfo
+	)
+
+	if ents, err = os.ReadDir(dir); err != nil {
+		if errors.Is(err, os.ErrNotExist) && dir != fst.root {
+			err = nil
+		}
+		return
+	}
+	for _, ent := range ents {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if depth > 0 {
+			if ent.IsDir() && len(ent.Name()) == 2 && strings.Trim(ent.Name(), "0123456789abcdef") == "" {
+				if err = fst.walkDir(ctx, dir + "/" + ent.Name(), depth-1, fn); err != nil {
+					return
+				}
+			}
+			continue
+		}
+		if ent.IsDir() {
+			continue
+		}
+		if fi, err = ent.Info(); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				err = nil
+				continue
+			}
+			return
+		}
+		if strings.HasPrefix(ent.Name(), ".tmp-") {
+			if time.Since(fi.ModTime()) > cam_tmp_grace {
+				os.Remove(dir + "/" + ent.Name())
+			}
+			continue
+		}
+		if !isBlockId(ent.Name()) {
+			continue
+		}
+		if err = fn(ent.Name(), fi.ModTime()); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (fst *fileStore) pinPath(name string) (fn string) {
+	return fst.root + "/pins/" + name
+}
+
+func (fst *fileStore) PutPin(ctx context.Context, name, id string) (err error) {
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	return fst.writeFile(fst.pinPath(name), []byte(id + "\n"))
+}
+
+func (fst *fileStore) GetPin(ctx context.Context, name string) (id string, err error) {
+	var data []byte
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if data, err = os.ReadFile(fst.pinPath(name)); err != nil {
+		return
+	}
+	id = strings.TrimSpace(string(data))
+
+	return
+}
+
+func (fst *fileStore) RemovePin(ctx context.Context, name string) (err error) {
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	return os.Remove(fst.pinPath(name))
+}
+
+func (fst *fileStore) WalkPins(ctx context.Context, fn func(name, id string) error) (err error) {
+	var (
+		ents []os.DirEntry
+		id string
+	)
+
+	if ents, err = os.ReadDir(fst.root + "/pins"); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		return
+	}
+	for _, ent := range ents {
+		if ent.IsDir() || strings.HasPrefix(ent.Name(), ".") {
+			continue
+		}
+		if id, err = fst.GetPin(ctx, ent.Name()); err != nil {
+			return
+		}
+		if err = fn(ent.Name(), id); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+/*
+Block ids are 32 lower case hex characters.
+*/
+func isBlockId(id string) (ok bool) {
+
+	if len(id) != 32 {
+		return false
+	}
+	for _, cc := range id {
+		if (cc < '0' || cc > '9') && (cc < 'a' || cc > 'f') {
+			return false
+		}
+	}
+
+	return true
+}
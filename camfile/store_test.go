@@ -0,0 +1,158 @@
+package camfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	t.Run("fanout", fileFanout)
+	t.Run("partial", filePartial)
+	t.Run("stale-tmp", fileStaleTmp)
+	t.Run("layout", fileLayout)
+}
+
+func TestMemStore(t *testing.T) {
+	t.Run("damaged", memDamaged)
+}
+
+/*
+A damaged block of the right length is replaced when written again, as
+the file store does.
+*/
+func memDamaged(t *testing.T) {
+	var (
+		store BlockStore
+		cs *Server
+	)
+
+	store = NewMemStore()
+	cs = NewServerStore(store)
+	defer cs.Close()
+	id, content := tierWrite(t, cs, 39, 100)
+
+	ms := store.(*memStore)
+	ms.blocks[id].data = make([]byte, len(ms.blocks[id].data))
+	tierWrite(t, cs, 39, 100)
+	tierRead(t, cs, id, content)
+}
+
+func fileFanout(t *testing.T) {
+	var (
+		store BlockStore
+		cs *Server
+		err error
+		dir string
+		report *GCReport
+	)
+
+	dir = t.TempDir()
+	if store, err = NewFileStore(dir, 2); err != nil {
+		t.Fatal("failed to create store, ", err.Error())
+	}
+	cs = NewServerStore(store)
+	id, content := tierWrite(t, cs, 38, 20000)
+	cs.Close()
+
+	if _, err = os.Stat(filepath.Join(dir, id[0:2], id[2:4], id)); err != nil {
+		t.Fatal("root block not fanned out, ", err.Error())
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "*", "*", "*")); len(names) != tierCount(t, store) {
+		t.Fatal("walk and the directory disagree", len(names))
+	}
+
+	// NewServer picks the layout up from the directory
+	cs = connServer(t, dir)
+	tierRead(t, cs, id, content)
+	if err = cs.Pin("keep", id); err != nil {
+		t.Fatal("failed to pin, ", err.Error())
+	}
+	if report, err = cs.GC(GCOptions{}); err != nil || len(report.Removed) != 0 || report.Blocks != report.Reachable {
+		t.Fatal("gc over a fanned out store", report, err)
+	}
+}
+
+/*
+A truncated file left by an old non-atomic write is replaced, not kept,
+and so is one damaged in place.
+*/
+func filePartial(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		dir string
+	)
+
+	dir = t.TempDir()
+	cs = connServer(t, dir)
+	id, content := tierWrite(t, cs, 39, 100)
+
+	if err = os.Truncate(filepath.Join(dir, id), 20); err != nil {
+		t.Fatal(err)
+	}
+	tierWrite(t, cs, 39, 100)
+	tierRead(t, cs, id, content)
+
+	damaged := make([]byte, cam_header_size+100)
+	if err = os.WriteFile(filepath.Join(dir, id), damaged, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tierWrite(t, cs, 39, 100)
+	tierRead(t, cs, id, content)
+}
+
+func fileStaleTmp(t *testing.T) {
+	var (
+		store BlockStore
+		err error
+		dir string
+	)
+
+	dir = t.TempDir()
+	if store, err = OpenFileStore(dir); err != nil {
+		t.Fatal("failed to open store, ", err.Error())
+	}
+	stale, fresh := filepath.Join(dir, ".tmp-1"), filepath.Join(dir, ".tmp-2")
+	os.WriteFile(stale, []byte("partial"), 0644)
+	os.WriteFile(fresh, []byte("partial"), 0644)
+	old := time.Now().Add(-2 * cam_tmp_grace)
+	os.Chtimes(stale, old, old)
+
+	if nn := tierCount(t, store); nn != 0 {
+		t.Fatal("temporary file walked as a block", nn)
+	}
+	if _, err = os.Stat(stale); err == nil {
+		t.Fatal("stale temporary file kept")
+	}
+	if _, err = os.Stat(fresh); err != nil {
+		t.Fatal("temporary file of a write in progress removed")
+	}
+}
+
+func fileLayout(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		dir string
+	)
+
+	dir = t.TempDir()
+	cs = connServer(t, dir)
+	tierWrite(t, cs, 40, 100)
+	cs.Close()
+
+	if _, err = NewFileStore(dir, 1); err == nil {
+		t.Fatal("changed the layout of a populated store")
+	}
+	if _, err = NewFileStore(dir, 0); err != nil {
+		t.Fatal("same layout refused, ", err.Error())
+	}
+	if err = os.WriteFile(filepath.Join(dir, "layout"), []byte("fanout 9\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenStore(dir); err == nil {
+		t.Fatal("opened a store with a bad layout")
+	}
+}
@@ -0,0 +1,88 @@
+package camfile
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+type SyncReport struct {
+	// blocks copied, and their bytes as stored
+	Copied int
+	Bytes int64
+	// subtrees found already in the destination and skipped
+	Present int
+}
+
+/*
+Copy every block reachable from roots from src to dst.
+
+Children are copied before their parents, as a Writer stores them, so a
+block present in dst is taken to have its whole subtree there and is not
+descended into.  That makes a sync that was cancelled or failed safe to
+run again; it picks up where it stopped.  Blocks are verified against
+their ids on the way across.
+
+Sync blocks until done.  For a background copy run it in a goroutine and
+cancel ctx to stop it.  Roots may be capabilities; only the ids are used.
+*/
+func Sync(ctx context.Context, dst, src BlockStore, roots ...string) (report *SyncReport, err error) {
+	var seen map[string]bool
+
+	report = &SyncReport{}
+	seen = make(map[string]bool)
+	for _, root := range roots {
+		root, _, _ = strings.Cut(root, ":")
+		if !isBlockId(root) {
+			return report, fmt.Errorf("not a block id: %s", root)
+		}
+		if err = syncBlock(ctx, dst, src, root, seen, report); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func syncBlock(ctx context.Context, dst, src BlockStore, id string, seen map[string]bool, report *SyncReport) (err error) {
+	var (
+		ok bool
+		block []byte
+		ids []string
+	)
+
+	if seen[id] {
+		return
+	}
+	seen[id] = true
+
+	if ok, err = dst.Has(ctx, id); err != nil {
+		return
+	} else if ok {
+		report.Present++
+		return
+	}
+
+	if block, err = src.Get(ctx, id); err != nil {
+		return fmt.Errorf("sync: %s: %w", id, err)
+	}
+	if err = verifyBlock(id, block); err != nil {
+		return fmt.Errorf("sync: %w", err)
+	}
+	if ids, err = blockChildren(block); err != nil {
+		return fmt.Errorf("sync: %s: %s", id, err.Error())
+	}
+	for _, child := range ids {
+		if err = syncBlock(ctx, dst, src, child, seen, report); err != nil {
+			return
+		}
+	}
+
+	if err = dst.Put(ctx, id, block); err != nil {
+		return
+	}
+	report.Copied++
+	report.Bytes += int64(len(block))
+
+	return
+}
@@ -0,0 +1,105 @@
+package camfile
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestSync(t *testing.T) {
+	t.Run("tree", syncTree)
+	t.Run("resume", syncResume)
+}
+
+func syncTree(t *testing.T) {
+	var (
+		src, dst *Server
+		err error
+		dir, id string
+		report *SyncReport
+	)
+
+	src, dst = NewServerStore(tierStore(t)), NewServerStore(tierStore(t))
+	defer src.Close()
+	defer dst.Close()
+
+	dir = treeSetup(t)
+	if id, err = src.PutTree(dir); err != nil {
+		t.Fatal("failed to put tree, ", err.Error())
+	}
+	capa, content := tierWrite(t, src, 10, 20000)
+
+	if report, err = Sync(context.Background(), dst.store, src.store, id, capa); err != nil {
+		t.Fatal("sync failed, ", err.Error())
+	}
+	if report.Copied != tierCount(t, src.store) {
+		t.Fatal("not every block copied", report)
+	}
+
+	out := filepath.Join(t.TempDir(), "out")
+	if err = dst.GetTree(id, out); err != nil {
+		t.Fatal("failed to get tree, ", err.Error())
+	}
+	treeCompare(t, dir, out)
+	tierRead(t, dst, capa, content)
+
+	if report, err = Sync(context.Background(), dst.store, src.store, id); err != nil {
+		t.Fatal("sync failed, ", err.Error())
+	}
+	if report.Copied != 0 || report.Present != 1 {
+		t.Fatal("second sync copied again", report)
+	}
+}
+
+/*
+A sync that stops part way is finished by running it again.
+*/
+func syncResume(t *testing.T) {
+	var (
+		src, dst *Server
+		err error
+		report *SyncReport
+		ctx context.Context
+		cancel context.CancelFunc
+	)
+
+	src, dst = NewServerStore(tierStore(t)), NewServerStore(tierStore(t))
+	defer src.Close()
+	defer dst.Close()
+
+	id, content := tierWrite(t, src, 11, 100000)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	stop := &countStore{ BlockStore: dst.store, after: 30, cancel: cancel }
+	if _, err = Sync(ctx, stop, src.store, id); !errors.Is(err, context.Canceled) {
+		t.Fatal("expected cancellation", err)
+	}
+	if nn := tierCount(t, dst.store); nn == 0 || nn >= tierCount(t, src.store) {
+		t.Fatal("expected a partial copy", nn)
+	}
+
+	if report, err = Sync(context.Background(), dst.store, src.store, id); err != nil {
+		t.Fatal("sync failed, ", err.Error())
+	}
+	if report.Present == 0 {
+		t.Fatal("resumed sync started over", report)
+	}
+	tierRead(t, dst, id, content)
+}
+
+/*
+Cancels after a number of puts.
+*/
+type countStore struct {
+	BlockStore
+	after int
+	cancel context.CancelFunc
+}
+
+func (cst *countStore) Put(ctx context.Context, id string, block []byte) (err error) {
+	if cst.after--; cst.after < 0 {
+		cst.cancel()
+	}
+	return cst.BlockStore.Put(ctx, id, block)
+}
@@ -0,0 +1,535 @@
+package camfile
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Composite block stores.
+
+Each is a BlockStore built from others, so they nest; for example a
+cache on local disk in front of a mirror of two remote block servers:
+
+	local, _ := camfile.OpenStore("/var/cache/cam")
+	a, _ := camfile.OpenStore("http://cam1:8080")
+	b, _ := camfile.OpenStore("http://cam2:8080")
+	mirror := camfile.NewMirrorStore(2, a, b)
+	cache, _ := camfile.NewCacheStore(ctx, local, mirror, 1<<30)
+	cs := camfile.NewServerStore(cache)
+
+Blocks never change once written, so none of these has to worry about
+stale copies; a block is either present or not.
+*/
+
+/*
+A write-through cache: every write goes to the backing store, and a copy
+is kept in the local store, which is trimmed to a size limit by removing
+the least recently used blocks.  Reads are served locally when possible
+and fill the cache on a miss.  Listing, pins and removal go to the
+backing store, which is the authority.
+*/
+type cacheStore struct {
+	local, remote BlockStore
+	max int64
+
+	mu sync.Mutex
+	size int64
+	lru *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	id string
+	size int64
+}
+
+/*
+Cache remote in local, keeping at most max bytes there.  Blocks already in
+local are counted at full block size, oldest first, until read again.
+*/
+func NewCacheStore(ctx context.Context, local, remote BlockStore, max int64) (store BlockStore, err error) {
+	var (
+		cst *cacheStore
+		old []cacheWalked
+	)
+
+	if max < cam_block_size {
+		return nil, fmt.Errorf("cache too small: %d", max)
+	}
+
+	cst = &cacheStore{ local: local, remote: remote, max: max, lru: list.New(), entries: make(map[string]*list.Element) }
+	if err = local.Walk(ctx, func(id string, mtime time.Time) error {
+		old = append(old, cacheWalked{ id, mtime })
+		return nil
+	}); err != nil {
+		return
+	}
+	sort.Slice(old, func(ii, jj int) bool { return old[ii].mtime.Before(old[jj].mtime) })
+	for _, ow := range old {
+		cst.touch(ow.id, cam_block_size)
+	}
+	cst.trim(ctx)
+
+	return cst, nil
+}
+
+type cacheWalked struct {
+	id string
+	mtime time.Time
+}
+
+/*
+Mark id most recently used, recording its size if known.
+*/
+func (cst *cacheStore) touch(id string, size int64) {
+	var ent *cacheEntry
+
+	cst.mu.Lock()
+	defer cst.mu.Unlock()
+
+	if el, ok := cst.entries[id]; ok {
+		ent = el.Value.(*cacheEntry)
+		cst.lru.MoveToFront(el)
+		if size > 0 {
+			cst.size += size - ent.size
+			ent.size = size
+		}
+		return
+	}
+	if size <= 0 {
+		size = cam_block_size
+	}
+	cst.entries[id] = cst.lru.PushFront(&cacheEntry{ id: id, size: size })
+	cst.size += size
+}
+
+func (cst *cacheStore) forget(id string) {
+
+	cst.mu.Lock()
+	defer cst.mu.Unlock()
+
+	if el, ok := cst.entries[id]; ok {
+		cst.size -= el.Value.(*cacheEntry).size
+		cst.lru.Remove(el)
+		delete(cst.entries, id)
+	}
+}
+
+/*
+Remove least recently used blocks from local until it fits.
+*/
+func (cst *cacheStore) trim(ctx context.Context) {
+	var victims []string
+
+	cst.mu.Lock()
+	for cst.size > cst.max && cst.lru.Len() > 0 {
+		ent := cst.lru.Remove(cst.lru.Back()).(*cacheEntry)
+		delete(cst.entries, ent.id)
+		cst.size -= ent.size
+		victims = append(victims, ent.id)
+	}
+	cst.mu.Unlock()
+
+	for _, id := range victims {
+		// a failed removal only wastes space; remote has the block
+		cst.local.Remove(ctx, id)
+	}
+}
+
+func (cst *cacheStore) Put(ctx context.Context, id string, block []byte) (err error) {
+
+	if err = cst.remote.Put(ctx, id, block); err != nil {
+		return
+	}
+	if cst.local.Put(ctx, id, block) == nil {
+		cst.touch(id, int64(len(block)))
+		cst.trim(ctx)
+	}
+
+	return
+}
+
+func (cst *cacheStore) Get(ctx context.Context, id string) (block []byte, err error) {
+
+	if block, err = cst.local.Get(ctx, id); err == nil && verifyBlock(id, block) == nil {
+		cst.touch(id, int64(len(block)))
+		return
+	}
+	if block, err = cst.remote.Get(ctx, id); err != nil {
+		return
+	}
+	// never cache what the Server would reject
+	if verifyBlock(id, block) == nil && cst.local.Put(ctx, id, block) == nil {
+		cst.touch(id, int64(len(block)))
+		cst.trim(ctx)
+	}
+
+	return
+}
+
+func (cst *cacheStore) Has(ctx context.Context, id string) (ok bool, err error) {
+
+	if ok, err = cst.local.Has(ctx, id); err == nil && ok {
+		return
+	}
+
+	return cst.remote.Has(ctx, id)
+}
+
+func (cst *cacheStore) Remove(ctx context.Context, id string) (err error) {
+
+	cst.forget(id)
+	cst.local.Remove(ctx, id)
+
+	return cst.remote.Remove(ctx, id)
+}
+
+func (cst *cacheStore) Walk(ctx context.Context, fn func(id string, mtime time.Time) error) (err error) {
+	return cst.remote.Walk(ctx, fn)
+}
+
+func (cst *cacheStore) PutPin(ctx context.Context, name, id string) (err error) {
+	return cst.remote.PutPin(ctx, name, id)
+}
+
+func (cst *cacheStore) SwapPin(ctx context.Context, name, old, id string) (err error) {
+	return swapPin(ctx, cst.remote, name, old, id)
+}
+
+func (cst *cacheStore) GetPin(ctx context.Context, name string) (id string, err error) {
+	return cst.remote.GetPin(ctx, name)
+}
+
+func (cst *cacheStore) RemovePin(ctx context.Context, name string) (err error) {
+	return cst.remote.RemovePin(ctx, name)
+}
+
+func (cst *cacheStore) WalkPins(ctx context.Context, fn func(name, id string) error) (err error) {
+	return cst.remote.WalkPins(ctx, fn)
+}
+
+/*
+Writes go to every backend at once and succeed when at least quorum of
+them do.  Reads take the first backend, in order, that has the block.
+Listings are the union of every backend, and fail if any backend does: a
+listing missing one backend's pins would let GC sweep the trees only it
+pins.  A block's time is the newest of its copies, so GC's grace period
+holds on every backend.  Removals go to every backend too.
+*/
+type mirrorStore struct {
+	stores []BlockStore
+	quorum int
+	// calls still running on slow backends, see each
+	pending sync.WaitGroup
+}
+
+/*
+Mirror stores, requiring quorum successful writes.  A quorum outside
+1..len(stores) means all of them.
+*/
+func NewMirrorStore(quorum int, stores ...BlockStore) (store BlockStore) {
+
+	if quorum < 1 || quorum > len(stores) {
+		quorum = len(stores)
+	}
+
+	return &mirrorStore{ stores: stores, quorum: quorum }
+}
+
+/*
+Run fn on every backend in parallel.  Returns as soon as need of them
+succeed, or too many have failed for that, leaving the rest to finish on
+their own, for Close to wait for; a slow backend holds up nothing once
+the quorum is in.
+Returns an error unless need succeed, wrapping os.ErrNotExist if every
+failure was that.
+*/
+func (mst *mirrorStore) each(need int, fn func(ii int, store BlockStore) error) (err error) {
+	var (
+		done chan error
+		errs []error
+		ok, missing int
+	)
+
+	// buffered, so backends finishing after the return do not block
+	done = make(chan error, len(mst.stores))
+	mst.pending.Add(len(mst.stores))
+	for ii, store := range mst.stores {
+		go func(ii int, store BlockStore) {
+			defer mst.pending.Done()
+			done <- fn(ii, store)
+		}(ii, store)
+	}
+
+	for left := len(mst.stores); left > 0 && ok < need && ok+left >= need; left-- {
+		if err = <-done; err == nil {
+			ok++
+		} else {
+			if errors.Is(err, os.ErrNotExist) {
+				missing++
+			}
+			errs = append(errs, err)
+		}
+	}
+	if ok >= need {
+		return nil
+	}
+	if missing == len(errs) {
+		return fmt.Errorf("mirror: %d of %d: %w", ok, need, os.ErrNotExist)
+	}
+
+	return fmt.Errorf("mirror: %d of %d: %w", ok, need, errors.Join(errs...))
+}
+
+/*
+Wait for the calls still running on slow backends.  The backends are
+the caller's to close.
+*/
+func (mst *mirrorStore) Close() (err error) {
+
+	mst.pending.Wait()
+
+	return
+}
+
+func (mst *mirrorStore) Put(ctx context.Context, id string, block []byte) (err error) {
+	return mst.each(mst.quorum, func(ii int, store BlockStore) error { return store.Put(ctx, id, block) })
+}
+
+func (mst *mirrorStore) Get(ctx context.Context, id string) (block []byte, err error) {
+
+	for _, store := range mst.stores {
+		// a bad copy on one backend should not hide a good one
+		if block, err = store.Get(ctx, id); err == nil && verifyBlock(id, block) == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	if err == nil {
+		err = verifyBlock(id, block)
+	}
+
+	return
+}
+
+func (mst *mirrorStore) Has(ctx context.Context, id string) (ok bool, err error) {
+
+	for _, store := range mst.stores {
+		if ok, err = store.Has(ctx, id); err == nil && ok {
+			return
+		}
+	}
+
+	return
+}
+
+/*
+Run fn on every backend, as each, where a backend without the block or
+pin has nothing to remove.  Wraps os.ErrNotExist if none had it.
+*/
+func (mst *mirrorStore) removeAll(fn func(store BlockStore) error) (err error) {
+	var missing atomic.Int32
+
+	if err = mst.each(len(mst.stores), func(ii int, store BlockStore) error {
+		err := fn(store)
+		if errors.Is(err, os.ErrNotExist) {
+			missing.Add(1)
+			return nil
+		}
+		return err
+	}); err != nil {
+		return
+	}
+	if int(missing.Load()) == len(mst.stores) {
+		return fmt.Errorf("mirror: %w", os.ErrNotExist)
+	}
+
+	return
+}
+
+func (mst *mirrorStore) Remove(ctx context.Context, id string) (err error) {
+	return mst.removeAll(func(store BlockStore) error { return store.Remove(ctx, id) })
+}
+
+func (mst *mirrorStore) Walk(ctx context.Context, fn func(id string, mtime time.Time) error) (err error) {
+	var (
+		mu sync.Mutex
+		times map[string]time.Time
+	)
+
+	times = make(map[string]time.Time)
+	if err = mst.each(len(mst.stores), func(ii int, store BlockStore) error {
+		return store.Walk(ctx, func(id string, mtime time.Time) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if mtime.After(times[id]) {
+				times[id] = mtime
+			}
+			return nil
+		})
+	}); err != nil {
+		return
+	}
+
+	for id, mtime := range times {
+		if err = fn(id, mtime); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (mst *mirrorStore) PutPin(ctx context.Context, name, id string) (err error) {
+	return mst.each(mst.quorum, func(ii int, store BlockStore) error { return store.PutPin(ctx, name, id) })
+}
+
+/*
+Swap the pin on every backend, succeeding as PutPin does when quorum of
+them swap.  Only a quorum over half the backends keeps two clients from
+both winning a race; a backend left behind by one refuses later swaps
+from the old id until the pin is set again.
+*/
+func (mst *mirrorStore) SwapPin(ctx context.Context, name, old, id string) (err error) {
+	return mst.each(mst.quorum, func(ii int, store BlockStore) error { return swapPin(ctx, store, name, old, id) })
+}
+
+func (mst *mirrorStore) GetPin(ctx context.Context, name string) (id string, err error) {
+
+	for _, store := range mst.stores {
+		if id, err = store.GetPin(ctx, name); err == nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (mst *mirrorStore) RemovePin(ctx context.Context, name string) (err error) {
+	return mst.removeAll(func(store BlockStore) error { return store.RemovePin(ctx, name) })
+}
+
+/*
+The pins of every backend.  Where backends disagree a name comes once
+for each id it has, the earliest backend's first, so GC keeps every tree
+any of them pins.
+*/
+func (mst *mirrorStore) WalkPins(ctx context.Context, fn func(name, id string) error) (err error) {
+	var (
+		all []map[string]string
+		seen map[[2]string]bool
+	)
+
+	all = make([]map[string]string, len(mst.stores))
+	if err = mst.each(len(mst.stores), func(ii int, store BlockStore) error {
+		found := make(map[string]string)
+		if err := store.WalkPins(ctx, func(name, id string) error {
+			found[name] = id
+			return nil
+		}); err != nil {
+			return err
+		}
+		all[ii] = found
+		return nil
+	}); err != nil {
+		return
+	}
+
+	seen = make(map[[2]string]bool)
+	for _, found := range all {
+		for name, id := range found {
+			if seen[[2]string{ name, id }] {
+				continue
+			}
+			seen[[2]string{ name, id }] = true
+			if err = fn(name, id); err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+/*
+Reads try each store in order until one has the block; everything else,
+writes included, goes to the first.  For example a local store in front
+of an archive that is only read from.
+*/
+type fallbackStore struct {
+	stores []BlockStore
+}
+
+func NewFallbackStore(stores ...BlockStore) (store BlockStore) {
+	return &fallbackStore{ stores: stores }
+}
+
+func (fbs *fallbackStore) Put(ctx context.Context, id string, block []byte) (err error) {
+	return fbs.stores[0].Put(ctx, id, block)
+}
+
+func (fbs *fallbackStore) Get(ctx context.Context, id string) (block []byte, err error) {
+
+	for _, store := range fbs.stores {
+		if block, err = store.Get(ctx, id); err == nil && verifyBlock(id, block) == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	if err == nil {
+		err = verifyBlock(id, block)
+	}
+
+	return
+}
+
+func (fbs *fallbackStore) Has(ctx context.Context, id string) (ok bool, err error) {
+
+	for _, store := range fbs.stores {
+		if ok, err = store.Has(ctx, id); err == nil && ok {
+			return
+		}
+	}
+
+	return
+}
+
+func (fbs *fallbackStore) Remove(ctx context.Context, id string) (err error) {
+	return fbs.stores[0].Remove(ctx, id)
+}
+
+func (fbs *fallbackStore) Walk(ctx context.Context, fn func(id string, mtime time.Time) error) (err error) {
+	return fbs.stores[0].Walk(ctx, fn)
+}
+
+func (fbs *fallbackStore) PutPin(ctx context.Context, name, id string) (err error) {
+	return fbs.stores[0].PutPin(ctx, name, id)
+}
+
+func (fbs *fallbackStore) SwapPin(ctx context.Context, name, old, id string) (err error) {
+	return swapPin(ctx, fbs.stores[0], name, old, id)
+}
+
+func (fbs *fallbackStore) GetPin(ctx context.Context, name string) (id string, err error) {
+	return fbs.stores[0].GetPin(ctx, name)
+}
+
+func (fbs *fallbackStore) RemovePin(ctx context.Context, name string) (err error) {
+	return fbs.stores[0].RemovePin(ctx, name)
+}
+
+func (fbs *fallbackStore) WalkPins(ctx context.Context, fn func(name, id string) error) (err error) {
+	return fbs.stores[0].WalkPins(ctx, fn)
+}
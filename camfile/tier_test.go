@@ -0,0 +1,309 @@
+package camfile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestTier(t *testing.T) {
+	t.Run("cache", tierCache)
+	t.Run("mirror", tierMirror)
+	t.Run("mirror-hung", tierMirrorHung)
+	t.Run("fallback", tierFallback)
+}
+
+func tierStore(t *testing.T) (store BlockStore) {
+	var err error
+
+	if store, err = OpenStore(t.TempDir()); err != nil {
+		t.Fatal("failed to open store, ", err.Error())
+	}
+
+	return
+}
+
+/*
+A backend that is down for writes and reads.
+*/
+type downStore struct {
+	BlockStore
+}
+
+func (ds downStore) Put(ctx context.Context, id string, block []byte) (err error) {
+	return errors.New("down")
+}
+
+func (ds downStore) Get(ctx context.Context, id string) (block []byte, err error) {
+	return nil, errors.New("down")
+}
+
+/*
+A backend that cannot list its blocks or pins.
+*/
+type unlistedStore struct {
+	BlockStore
+}
+
+func (us unlistedStore) Walk(ctx context.Context, fn func(id string, mtime time.Time) error) (err error) {
+	return errors.New("down")
+}
+
+func (us unlistedStore) WalkPins(ctx context.Context, fn func(name, id string) error) (err error) {
+	return errors.New("down")
+}
+
+/*
+A backend whose writes hang until release is closed.
+*/
+type hungStore struct {
+	BlockStore
+	release chan struct{}
+}
+
+func (hs hungStore) Put(ctx context.Context, id string, block []byte) (err error) {
+	<-hs.release
+	return hs.BlockStore.Put(ctx, id, block)
+}
+
+func (hs hungStore) PutPin(ctx context.Context, name, id string) (err error) {
+	<-hs.release
+	return hs.BlockStore.PutPin(ctx, name, id)
+}
+
+func tierWrite(t *testing.T, cs *Server, seed int64, size int) (id string, content []byte) {
+	var (
+		cw *Writer
+		err error
+	)
+
+	content = make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(content)
+
+	if cw, err = cs.Create(); err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+	defer cw.Close()
+	if id, _, err = cw.Copy(bytes.NewReader(content)); err != nil {
+		t.Fatal("failed to copy to cam, ", err.Error())
+	}
+
+	return
+}
+
+func tierRead(t *testing.T, cs *Server, id string, content []byte) {
+	var (
+		cr *Reader
+		err error
+		buff bytes.Buffer
+	)
+
+	if cr, err = cs.Open(id); err != nil {
+		t.Fatal("failed to create reader, ", err.Error())
+	}
+	defer cr.Close()
+	if _, err = cr.Copy(&buff); err != nil {
+		t.Fatal("failed to copy from cam, ", err.Error())
+	}
+	if !bytes.Equal(buff.Bytes(), content) {
+		t.Fatal("content mismatch")
+	}
+}
+
+func tierCount(t *testing.T, store BlockStore) (nn int) {
+
+	if err := store.Walk(context.Background(), func(id string, mtime time.Time) error {
+		nn++
+		return nil
+	}); err != nil {
+		t.Fatal("walk failed, ", err.Error())
+	}
+
+	return
+}
+
+func tierBytes(t *testing.T, store BlockStore) (nn int) {
+
+	if err := store.Walk(context.Background(), func(id string, mtime time.Time) error {
+		block, err := store.Get(context.Background(), id)
+		nn += len(block)
+		return err
+	}); err != nil {
+		t.Fatal("walk failed, ", err.Error())
+	}
+
+	return
+}
+
+func tierCache(t *testing.T) {
+	var (
+		local, remote, cache BlockStore
+		cs *Server
+		err error
+		ids []string
+		contents [][]byte
+	)
+
+	local, remote = tierStore(t), tierStore(t)
+	if cache, err = NewCacheStore(context.Background(), local, remote, 10*cam_block_size); err != nil {
+		t.Fatal("failed to create cache, ", err.Error())
+	}
+	cs = NewServerStore(cache)
+	defer cs.Close()
+
+	for ii := 0; ii < 4; ii++ {
+		id, content := tierWrite(t, cs, int64(ii), 5000)
+		ids, contents = append(ids, id), append(contents, content)
+	}
+	if nn := tierCount(t, remote); nn != 4*7 {
+		t.Fatal("writes did not reach the remote", nn)
+	}
+	if nn := tierBytes(t, local); nn > 10*cam_block_size || nn == 0 {
+		t.Fatal("cache not kept within its limit", nn)
+	}
+
+	// the oldest file was evicted and is read back through the cache
+	tierRead(t, cs, ids[0], contents[0])
+	if ok, _ := local.Has(context.Background(), ids[0]); !ok {
+		t.Fatal("read did not fill the cache")
+	}
+	if nn := tierBytes(t, local); nn > 10*cam_block_size {
+		t.Fatal("cache not kept within its limit", nn)
+	}
+
+	// a reopened cache picks up what is on disk
+	if cache, err = NewCacheStore(context.Background(), local, remote, 2*cam_block_size); err != nil {
+		t.Fatal("failed to create cache, ", err.Error())
+	}
+	if nn := tierCount(t, local); nn > 2 {
+		t.Fatal("reopened cache not trimmed", nn)
+	}
+}
+
+func tierMirror(t *testing.T) {
+	var (
+		aa, bb, cc BlockStore
+		cs *Server
+		cw *Writer
+		err error
+		report *GCReport
+	)
+
+	aa, bb, cc = tierStore(t), tierStore(t), tierStore(t)
+
+	cs = NewServerStore(NewMirrorStore(2, aa, downStore{ bb }, cc))
+	defer cs.Close()
+	id, content := tierWrite(t, cs, 7, 5000)
+	if tierCount(t, aa) != 7 || tierCount(t, bb) != 0 || tierCount(t, cc) != 7 {
+		t.Fatal("writes not mirrored")
+	}
+
+	// reads go past a backend that lost its copy
+	if err = aa.Remove(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+	tierRead(t, cs, id, content)
+	if err = cs.Pin("keep", id); err != nil {
+		t.Fatal("failed to pin, ", err.Error())
+	}
+	if report, err = cs.GC(GCOptions{}); err != nil || len(report.Removed) != 0 {
+		t.Fatal("gc removed mirrored blocks", report, err)
+	}
+
+	// a tree only one backend pins survives GC through the mirror, even
+	// under a name another backend pins elsewhere
+	other, _ := tierWrite(t, cs, 17, 5000)
+	if err = cc.PutPin(context.Background(), "keep", other); err != nil {
+		t.Fatal("failed to pin, ", err.Error())
+	}
+	if report, err = cs.GC(GCOptions{}); err != nil || len(report.Removed) != 0 {
+		t.Fatal("gc removed a tree one backend pins", report, err)
+	}
+	if pins, _ := cs.Pins(); pins["keep"] != id {
+		t.Fatal("pins not the first backend's", pins)
+	}
+
+	// and GC does not run on a listing missing a backend
+	cs = NewServerStore(NewMirrorStore(1, aa, unlistedStore{ cc }))
+	defer cs.Close()
+	if report, err = cs.GC(GCOptions{}); err == nil {
+		t.Fatal("gc ran without a backend's pins", report)
+	}
+
+	// below quorum
+	cs = NewServerStore(NewMirrorStore(2, aa, downStore{ bb }, downStore{ cc }))
+	defer cs.Close()
+	if cw, err = cs.Create(); err != nil {
+		t.Fatal("failed to create writer, ", err.Error())
+	}
+	if _, _, err = cw.Copy(bytes.NewReader([]byte("not enough backends"))); err == nil {
+		t.Fatal("write succeeded without a quorum")
+	}
+	cw.Close()
+}
+
+func tierFallback(t *testing.T) {
+	var (
+		front, archive BlockStore
+		cs *Server
+	)
+
+	front, archive = tierStore(t), tierStore(t)
+
+	cs = NewServerStore(archive)
+	id, content := tierWrite(t, cs, 8, 5000)
+	cs.Close()
+
+	cs = NewServerStore(NewFallbackStore(front, archive))
+	defer cs.Close()
+	tierRead(t, cs, id, content)
+
+	other, _ := tierWrite(t, cs, 9, 100)
+	if ok, _ := front.Has(context.Background(), other); !ok {
+		t.Fatal("write did not go to the first store")
+	}
+	if ok, _ := archive.Has(context.Background(), other); ok {
+		t.Fatal("write reached the archive")
+	}
+}
+
+/*
+A mirror backend that hangs holds up no write once the quorum is in.
+*/
+func tierMirrorHung(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		done chan error
+	)
+
+	// in memory, so nothing is left writing to a removed directory
+	hung := hungStore{ NewMemStore(), make(chan struct{}) }
+	defer close(hung.release)
+	cs = NewServerStore(NewMirrorStore(2, NewMemStore(), NewMemStore(), hung))
+
+	done = make(chan error, 1)
+	go func() {
+		var id string
+		cw, err := cs.Create()
+		if err == nil {
+			id, _, err = cw.Copy(bytes.NewReader(make([]byte, 50000)))
+			cw.Close()
+		}
+		if err == nil {
+			err = cs.Pin("keep", id)
+		}
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal("mirrored write failed, ", err.Error())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("a hung backend held up the quorum")
+	}
+}
@@ -0,0 +1,468 @@
+package camfile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Directory trees.
+
+A FILE block describes one file: its name, mode, modification time, size
+and the root of its content, an ordinary DATA/INDB tree.  A DIRB block
+describes a directory the same way, except that its root is a tree of
+indirect blocks whose leaves are the FILE and DIRB blocks of its entries,
+sorted by name, and its size is the number of entries.  Sizes in those
+indirect blocks count entries rather than bytes.
+
+Both share one payload layout after the usual header:
+
+	[0:32]   root id, or dashes when size is 0
+	[32:48]  size, hex
+	[48:56]  mode, hex fs.FileMode
+	[56:72]  modification time, hex nanoseconds since the epoch
+	[72:]    name
+
+So a whole directory hashes to a single root, and identical files or
+subdirectories anywhere in any snapshot are stored once.
+*/
+
+const (
+	cam_entry_fixed = 72
+	cam_entry_name_max = cam_block_size - cam_header_size - cam_entry_fixed
+)
+
+var (
+	// returned, wrapped, by Lookup for a block that is not a FILE or
+	// DIRB, such as the root of a file's content
+	ErrNotEntry = errors.New("not a file or directory")
+)
+
+type Entry struct {
+	// the FILE or DIRB block
+	Id string
+	Name string
+	Mode fs.FileMode
+	ModTime time.Time
+	// content bytes for a file, entries for a directory
+	Size int64
+	// content or entries root; EmptyId for an empty file, but empty for
+	// an empty directory and for empty files in older trees
+	Root string
+}
+
+func (ent *Entry) IsDir() (ok bool) {
+	return ent.Mode.IsDir()
+}
+
+/*
+Store the file or directory at path and everything below it.
+Returns the id of the top FILE or DIRB block.
+Only regular files and directories are supported.
+*/
+func (cs *Server) PutTree(path string) (id string, err error) {
+	return cs.PutTreeContext(context.Background(), path)
+}
+
+/*
+As PutTree.  If ctx is done first no id is returned, whatever was stored.
+*/
+func (cs *Server) PutTreeContext(ctx context.Context, path string) (id string, err error) {
+	var (
+		held []string
+		ref camref
+	)
+
+	if cs.state != state_open {
+		return "", fmt.Errorf("not opened: server %s", stateString(cs.state))
+	}
+
+	// hold everything until the root exists, as a Writer does
+	defer func() { cs.release(held) }()
+
+	if ref, err = cs.putTree(ctx, path, filepath.Base(path), &held); err == nil {
+		id = ref.id
+	}
+
+	return
+}
+
+func (cs *Server) putTree(ctx context.Context, path, name string, held *[]string) (ref camref, err error) {
+	var (
+		fi os.FileInfo
+		ents []os.DirEntry
+		refs []camref
+		root string
+		size int64
+		sub camref
+	)
+
+	if err = ctx.Err(); err != nil {
+		goto out
+	}
+	if fi, err = os.Lstat(path); err != nil {
+		goto out
+	}
+
+	switch {
+	case fi.IsDir():
+		if ents, err = os.ReadDir(path); err != nil {
+			goto out
+		}
+		// ReadDir sorts by name
+		for _, de := range ents {
+			if sub, err = cs.putTree(ctx, filepath.Join(path, de.Name()), de.Name(), held); err != nil {
+				goto out
+			}
+			refs = append(refs, camref{ id: sub.id, size: 1 })
+		}
+		if len(refs) > 0 {
+			if sub, err = cs.putIndirect(ctx, refs, nil, CodecNone, held); err != nil {
+				goto out
+			}
+			root = sub.id
+		}
+		size = int64(len(refs))
+		ref.id, err = cs.putEntry(ctx, "DIRB", root, size, fi.Mode(), fi.ModTime(), name, held)
+	case fi.Mode().IsRegular():
+		if root, size, err = cs.putContent(ctx, path, held); err != nil {
+			goto out
+		}
+		ref.id, err = cs.putEntry(ctx, "FILE", root, size, fi.Mode(), fi.ModTime(), name, held)
+	default:
+		err = fmt.Errorf("unsupported file type: %s, %s", path, fi.Mode().Type())
+	}
+
+out:
+	return
+}
+
+/*
+Copy a file's content through a Writer, keeping its blocks held.
+*/
+func (cs *Server) putContent(ctx context.Context, path string, held *[]string) (root string, size int64, err error) {
+	var fh *os.File
+
+	if fh, err = os.Open(path); err != nil {
+		return
+	}
+	defer fh.Close()
+
+	return cs.putReader(ctx, fh, held)
+}
+
+func (cs *Server) putReader(ctx context.Context, src io.Reader, held *[]string) (root string, size int64, err error) {
+	var cw *Writer
+
+	if cw, err = cs.CreateContext(ctx); err != nil {
+		return
+	}
+	if size, err = io.Copy(cw, src); err == nil {
+		root, err = cw.finish()
+	}
+	if cw.pipe != nil {
+		// held is complete once no put is in flight
+		cw.pipe.wait()
+	}
+	cs.hold(cw.held...)
+	*held = append(*held, cw.held...)
+	cw.Close()
+
+	return
+}
+
+func (cs *Server) putEntry(ctx context.Context, tag, root string, size int64, mode fs.FileMode, mtime time.Time, name string, held *[]string) (id string, err error) {
+	var (
+		data []byte
+		hd header
+	)
+
+	if len(name) > cam_entry_name_max {
+		return "", fmt.Errorf("name too long: %s", name)
+	}
+	if root == "" {
+		root = strings.Repeat("-", 32)
+	}
+
+	data = []byte(fmt.Sprintf("%s%016x%08x%016x%s", root, size, uint32(mode), mtime.UnixNano(), name))
+	hd = newHeader(tag, len(data))
+
+	return cs.putHeld(ctx, hd.encode(), data, held)
+}
+
+/*
+Decode a FILE or DIRB block.
+*/
+func parseEntry(id string, block []byte) (ent *Entry, err error) {
+	var (
+		tag string
+		cnt int
+		payload []byte
+		size, mtime int64
+		mode uint64
+	)
+
+	if tag, cnt, err = parseHeader(block); err != nil {
+		return
+	}
+	if tag != "FILE" && tag != "DIRB" {
+		return nil, fmt.Errorf("%w: %s, %s", ErrNotEntry, id, tag)
+	}
+	if cnt < cam_entry_fixed || cam_header_size+cnt > len(block) {
+		return nil, fmt.Errorf("bad %s block: %s", tag, id)
+	}
+	payload = block[cam_header_size:cam_header_size+cnt]
+
+	if size, err = strconv.ParseInt(string(payload[32:48]), 16, 64); err != nil {
+		return nil, fmt.Errorf("bad %s size: %s, %s", tag, id, err.Error())
+	}
+	if mode, err = strconv.ParseUint(string(payload[48:56]), 16, 32); err != nil {
+		return nil, fmt.Errorf("bad %s mode: %s, %s", tag, id, err.Error())
+	}
+	if mtime, err = strconv.ParseInt(string(payload[56:72]), 16, 64); err != nil {
+		return nil, fmt.Errorf("bad %s time: %s, %s", tag, id, err.Error())
+	}
+
+	ent = &Entry{
+		Id: id,
+		Name: string(payload[cam_entry_fixed:]),
+		Mode: fs.FileMode(mode),
+		ModTime: time.Unix(0, mtime),
+		Size: size,
+	}
+	// older trees name no root for empty files
+	if root := string(payload[:32]); isBlockId(root) {
+		ent.Root = root
+	}
+	if ent.IsDir() != (tag == "DIRB") {
+		return nil, fmt.Errorf("bad %s mode: %s, %s", tag, id, ent.Mode)
+	}
+
+	return
+}
+
+/*
+Read the FILE or DIRB block id.
+*/
+func (cs *Server) Lookup(id string) (ent *Entry, err error) {
+	return cs.LookupContext(context.Background(), id)
+}
+
+func (cs *Server) LookupContext(ctx context.Context, id string) (ent *Entry, err error) {
+	var block [cam_block_size]byte
+
+	if cs.state != state_open {
+		return nil, fmt.Errorf("not opened: server %s", stateString(cs.state))
+	}
+	if err = cs.readBlock(ctx, camref{ id: id }, block[:]); err != nil {
+		return
+	}
+
+	return parseEntry(id, block[:])
+}
+
+/*
+The entries of the directory id, sorted by name.
+*/
+func (cs *Server) ReadDir(id string) (ents []*Entry, err error) {
+	return cs.ReadDirContext(context.Background(), id)
+}
+
+func (cs *Server) ReadDirContext(ctx context.Context, id string) (ents []*Entry, err error) {
+	var (
+		dir, ent *Entry
+		ids []string
+	)
+
+	if dir, err = cs.LookupContext(ctx, id); err != nil {
+		return
+	}
+	if !dir.IsDir() {
+		return nil, fmt.Errorf("not a directory: %s", id)
+	}
+	if dir.Root == "" {
+		return
+	}
+	if ids, err = cs.entryIds(ctx, dir.Root); err != nil {
+		return
+	}
+
+	for _, eid := range ids {
+		if ent, err = cs.LookupContext(ctx, eid); err != nil {
+			return nil, err
+		}
+		ents = append(ents, ent)
+	}
+
+	return
+}
+
+/*
+The entry called name in the directory dir.  Entries are sorted by name,
+so a binary search reads about log n of them rather than all.  Wraps
+fs.ErrNotExist if there is none.
+*/
+func (cs *Server) lookupChild(ctx context.Context, dir *Entry, name string) (ent *Entry, err error) {
+	var (
+		ids []string
+		read map[int]*Entry
+	)
+
+	if dir.Root != "" {
+		if ids, err = cs.entryIds(ctx, dir.Root); err != nil {
+			return
+		}
+	}
+
+	read = make(map[int]*Entry)
+	at := func(ii int) *Entry {
+		if read[ii] == nil && err == nil {
+			read[ii], err = cs.LookupContext(ctx, ids[ii])
+		}
+		return read[ii]
+	}
+	ii := sort.Search(len(ids), func(ii int) bool {
+		if ent := at(ii); ent != nil {
+			return ent.Name >= name
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ii == len(ids) || at(ii).Name != name {
+		return nil, fmt.Errorf("%s in %s: %w", name, dir.Id, fs.ErrNotExist)
+	}
+
+	return at(ii), err
+}
+
+/*
+The leaves of an entries tree, in order.  The tree is balanced, as
+putIndirect builds it, so once the first branch reaches a leaf every id
+on that level is one, and no other leaf is read.
+*/
+func (cs *Server) entryIds(ctx context.Context, root string) (ids []string, err error) {
+	var (
+		block [cam_block_size]byte
+		tag string
+		cnt int
+		refs []camref
+		next []string
+	)
+
+	ids = []string{ root }
+	for {
+		next = nil
+		for ii, id := range ids {
+			if err = cs.readBlock(ctx, camref{ id: id }, block[:]); err != nil {
+				return
+			}
+			if tag, cnt, err = parseHeader(block[:]); err != nil {
+				return
+			}
+			if tag != "INDB" && ii == 0 {
+				return ids, nil
+			}
+			if tag != "INDB" {
+				return nil, fmt.Errorf("unbalanced entries tree: %s", root)
+			}
+			if refs, err = parseIndirect(block[:], cnt); err != nil {
+				return
+			}
+			for _, ref := range refs {
+				next = append(next, ref.id)
+			}
+		}
+		ids = next
+	}
+}
+
+/*
+Restore the tree id to path.  A directory is created if needed and its
+entries written into it; a file is created or truncated.  Modes and
+modification times are restored.
+*/
+func (cs *Server) GetTree(id, path string) (err error) {
+	return cs.GetTreeContext(context.Background(), id, path)
+}
+
+/*
+As GetTree.  If ctx is done first the restore stops, leaving what was
+already written.
+*/
+func (cs *Server) GetTreeContext(ctx context.Context, id, path string) (err error) {
+	var ent *Entry
+
+	if ent, err = cs.LookupContext(ctx, id); err != nil {
+		return
+	}
+
+	return cs.getTree(ctx, ent, path)
+}
+
+func (cs *Server) getTree(ctx context.Context, ent *Entry, path string) (err error) {
+	var (
+		ents []*Entry
+		fh *os.File
+		cr *Reader
+	)
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if ent.IsDir() {
+		if err = os.Mkdir(path, 0700); err != nil && !os.IsExist(err) {
+			return
+		}
+		if ents, err = cs.ReadDirContext(ctx, ent.Id); err != nil {
+			return
+		}
+		for _, sub := range ents {
+			if !isEntryName(sub.Name) {
+				return fmt.Errorf("bad name in %s: %q", ent.Id, sub.Name)
+			}
+			if err = cs.getTree(ctx, sub, filepath.Join(path, sub.Name)); err != nil {
+				return
+			}
+		}
+	} else {
+		if fh, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+			return
+		}
+		if ent.Root != "" {
+			if cr, err = cs.OpenContext(ctx, ent.Root); err == nil {
+				_, err = cr.Copy(fh)
+				cr.Close()
+			}
+		}
+		if cerr := fh.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	if err = os.Chmod(path, ent.Mode.Perm()); err != nil {
+		return
+	}
+
+	return os.Chtimes(path, ent.ModTime, ent.ModTime)
+}
+
+/*
+A name that stays inside the directory it is restored to.
+*/
+func isEntryName(name string) (ok bool) {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
@@ -0,0 +1,197 @@
+package camfile
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTree(t *testing.T) {
+	t.Run("round-trip", treeRoundTrip)
+	t.Run("dedup", treeDedup)
+	t.Run("gc", treeGC)
+}
+
+/*
+Build a small directory: nested directories, an empty file, a multi
+block file, and a directory with more entries than fit in one indirect
+block.
+*/
+func treeSetup(t *testing.T) (dir string) {
+	var (
+		err error
+		content []byte
+		ii int
+	)
+
+	dir = t.TempDir()
+	mtime := time.Date(2019, 10, 23, 12, 0, 0, 0, time.UTC)
+
+	content = make([]byte, 5000)
+	rand.New(rand.NewSource(6)).Read(content)
+
+	files := map[string][]byte{
+		"empty": nil,
+		"big.dat": content,
+		"sub/one.txt": []byte("one\n"),
+		"sub/deeper/two.txt": []byte("two\n"),
+	}
+	for ii = 0; ii < cam_sized_indirect_cnt+5; ii++ {
+		files[fmt.Sprintf("many/%03d", ii)] = []byte(fmt.Sprintf("file %d\n", ii))
+	}
+
+	for name, data := range files {
+		fn := filepath.Join(dir, name)
+		if err = os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(fn, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Chtimes(fn, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.Chmod(filepath.Join(dir, "sub/one.txt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+/*
+Compare two trees on disk: names, modes, file times and content.
+*/
+func treeCompare(t *testing.T, want, got string) {
+
+	err := filepath.Walk(want, func(path string, wi os.FileInfo, err error) error {
+		var (
+			rel string
+			gi os.FileInfo
+			wd, gd []byte
+		)
+
+		if err != nil {
+			return err
+		}
+		rel, _ = filepath.Rel(want, path)
+		if gi, err = os.Stat(filepath.Join(got, rel)); err != nil {
+			return err
+		}
+		if gi.Mode() != wi.Mode() {
+			return fmt.Errorf("%s: mode %s, want %s", rel, gi.Mode(), wi.Mode())
+		}
+		if !gi.ModTime().Equal(wi.ModTime()) {
+			return fmt.Errorf("%s: mtime %s, want %s", rel, gi.ModTime(), wi.ModTime())
+		}
+		if wi.IsDir() {
+			return nil
+		}
+		wd, _ = os.ReadFile(path)
+		gd, _ = os.ReadFile(filepath.Join(got, rel))
+		if !bytes.Equal(wd, gd) {
+			return fmt.Errorf("%s: content differs", rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("trees differ, ", err.Error())
+	}
+}
+
+func treeRoundTrip(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		src, dst, id string
+		ents []*Entry
+	)
+
+	src = treeSetup(t)
+	cs = memServer(t)
+
+	if id, err = cs.PutTree(src); err != nil {
+		t.Fatal("failed to put tree, ", err.Error())
+	}
+
+	if ents, err = cs.ReadDir(id); err != nil {
+		t.Fatal("failed to read dir, ", err.Error())
+	}
+	if len(ents) != 4 || ents[0].Name != "big.dat" || ents[0].Size != 5000 || !ents[2].IsDir() {
+		t.Fatal("unexpected entries", ents)
+	}
+	if ents, err = cs.ReadDir(ents[2].Id); err != nil || len(ents) != cam_sized_indirect_cnt+5 {
+		t.Fatal("unexpected entries in many", len(ents), err)
+	}
+	if ents[7].Name != "007" {
+		t.Fatal("entries out of order", ents[7].Name)
+	}
+
+	dst = filepath.Join(t.TempDir(), "restored")
+	if err = cs.GetTree(id, dst); err != nil {
+		t.Fatal("failed to get tree, ", err.Error())
+	}
+	treeCompare(t, src, dst)
+}
+
+/*
+Snapshots of the same content share everything.
+*/
+func treeDedup(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		src, one, two string
+	)
+
+	src = treeSetup(t)
+	cs = memServer(t)
+
+	if one, err = cs.PutTree(src); err != nil {
+		t.Fatal("failed to put tree, ", err.Error())
+	}
+	if two, err = cs.PutTree(src); err != nil {
+		t.Fatal("failed to put tree, ", err.Error())
+	}
+	if one != two {
+		t.Fatal("same tree, different roots", one, two)
+	}
+}
+
+/*
+A pinned snapshot keeps every block below it.
+*/
+func treeGC(t *testing.T) {
+	var (
+		cs *Server
+		err error
+		id string
+		report *GCReport
+		fr *FsckReport
+	)
+
+	cs = memServer(t)
+
+	if id, err = cs.PutTree(treeSetup(t)); err != nil {
+		t.Fatal("failed to put tree, ", err.Error())
+	}
+	if len(cs.live) != 0 {
+		t.Fatal("tree blocks still held", len(cs.live))
+	}
+	if err = cs.Pin("snap", id); err != nil {
+		t.Fatal("failed to pin, ", err.Error())
+	}
+	if report, err = cs.GC(GCOptions{}); err != nil {
+		t.Fatal("gc failed, ", err.Error())
+	}
+	if len(report.Removed) != 0 || report.Reachable != report.Blocks {
+		t.Fatal("snapshot blocks swept", report)
+	}
+	if fr, err = cs.Fsck([]string{ id }, ""); err != nil || !fr.Ok() {
+		t.Fatal("fsck failed", fr, err)
+	}
+}